@@ -0,0 +1,120 @@
+package chasqui
+
+import (
+	. "github.com/universe-10th/chasqui/types"
+	"net"
+	"time"
+)
+
+
+// The time the farewell message of a connection rejected by
+// the accept policy is given to be written.
+const rejectWriteTimeout = time.Second
+
+
+// The kind of an accept decision.
+type acceptVerdict int
+
+
+const (
+	acceptVerdictAccept acceptVerdict = iota
+	acceptVerdictSilent
+	acceptVerdictNotify
+)
+
+
+// The decision of an accept policy about a new connection:
+// either accept it, reject it silently, or reject it after
+// sending a single message. Use the Accept, RejectSilently
+// and RejectWith functions to build them.
+type AcceptDecision struct {
+	verdict acceptVerdict
+	command string
+	args    Args
+	kwargs  KWArgs
+}
+
+
+// Accept policies tell, from the remote address of each new
+// connection, whether the server starts an attendant for it.
+// They run in the accept loop, so they should be fast (e.g.
+// lookups in a ban list).
+type AcceptPolicy func(remote net.Addr) AcceptDecision
+
+
+// Returns the decision of accepting the connection, starting
+// an attendant for it.
+func Accept() AcceptDecision {
+	return AcceptDecision{verdict: acceptVerdictAccept}
+}
+
+
+// Returns the decision of rejecting the connection, closing
+// it right away.
+func RejectSilently() AcceptDecision {
+	return AcceptDecision{verdict: acceptVerdictSilent}
+}
+
+
+// Returns the decision of rejecting the connection, sending it
+// a single message (e.g. the reason to be rejected) and then
+// closing it. The connection is never read.
+func RejectWith(command string, args Args, kwargs KWArgs) AcceptDecision {
+	if args == nil {
+		args = Args{}
+	}
+	if kwargs == nil {
+		kwargs = KWArgs{}
+	}
+	return AcceptDecision{acceptVerdictNotify, command, args, kwargs}
+}
+
+
+// Tells whether the decision accepts the connection.
+func (decision AcceptDecision) Accepted() bool {
+	return decision.verdict == acceptVerdictAccept
+}
+
+
+// Runs the accept policy (if any) against a new connection.
+// Returns whether it was accepted. Rejected connections never
+// get an attendant: they are closed, in the background if a
+// message must be sent to them first.
+func (server *Server) screen(conn net.Conn) bool {
+	if server.acceptPolicy == nil {
+		return true
+	}
+	decision := server.acceptPolicy(conn.RemoteAddr())
+	switch decision.verdict {
+	case acceptVerdictSilent:
+		server.logger.Debugf("server rejected a connection by policy (%s)", conn.RemoteAddr())
+		// noinspection GoUnhandledErrorResult
+		conn.Close()
+		return false
+	case acceptVerdictNotify:
+		server.logger.Debugf(
+			"server rejected a connection by policy with %s (%s)", decision.command, conn.RemoteAddr(),
+		)
+		server.sendAndClose(conn, decision.command, decision.args, decision.kwargs)
+		return false
+	default:
+		return true
+	}
+}
+
+
+// Sends a single message to a rejected connection (bounded by
+// a short write deadline), in the background, and then closes
+// it. The connection is never read.
+func (server *Server) sendAndClose(conn net.Conn, command string, args Args, kwargs KWArgs) {
+	server.resources.addConnections(1)
+	server.resources.spawn(func() {
+		defer server.resources.addConnections(-1)
+		// noinspection GoUnhandledErrorResult
+		defer conn.Close()
+		// noinspection GoUnhandledErrorResult
+		conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+		// noinspection GoUnhandledErrorResult
+		server.factory.Create(conn).Send(command, args, kwargs)
+	})
+}
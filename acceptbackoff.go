@@ -0,0 +1,93 @@
+package chasqui
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+
+// The bounds of the delay the accept loop waits after each
+// temporary failure (e.g. running out of file descriptors):
+// it starts at the minimum, and doubles on each consecutive
+// failure, up to the maximum.
+const (
+	MinAcceptBackoff = 5 * time.Millisecond
+	MaxAcceptBackoff = time.Second
+)
+
+
+// Error reported to the accept error callback when accepting
+// a connection failed temporarily. It tells the delay the
+// accept loop waits before trying again, and unwraps to the
+// original error.
+type TemporaryAcceptError struct {
+	Err   error
+	Delay time.Duration
+}
+
+
+// The error message.
+func (err TemporaryAcceptError) Error() string {
+	return fmt.Sprintf("%v (retrying in %s)", err.Err, err.Delay)
+}
+
+
+// Returns the original error.
+func (err TemporaryAcceptError) Unwrap() error {
+	return err.Err
+}
+
+
+// The delay of the accept loop after temporary failures. A
+// zero delay means the last attempt succeeded.
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+
+// Doubles the delay (or starts it), and returns it.
+func (backoff *acceptBackoff) next() time.Duration {
+	if backoff.delay == 0 {
+		backoff.delay = MinAcceptBackoff
+	} else if backoff.delay *= 2; backoff.delay > MaxAcceptBackoff {
+		backoff.delay = MaxAcceptBackoff
+	}
+	return backoff.delay
+}
+
+
+// Starts over, after a successful attempt.
+func (backoff *acceptBackoff) reset() {
+	backoff.delay = 0
+}
+
+
+// Tells whether an accept error is temporary: either the error
+// says so, or the process (or the system) ran out of file
+// descriptors.
+func isTemporaryAcceptError(err error) bool {
+	if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+		return true
+	}
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+
+// Waits the current delay (accounting the timer in the given
+// resources), unless told to quit meanwhile. Returns whether
+// it waited the whole delay.
+func (backoff *acceptBackoff) wait(resources *resourceCounter, quit <-chan uint8) bool {
+	resources.addTimers(1)
+	defer resources.addTimers(-1)
+	timer := time.NewTimer(backoff.delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-quit:
+		return false
+	}
+}
@@ -0,0 +1,135 @@
+package chasqui
+
+import (
+	"net"
+	"time"
+)
+
+
+// The default time a single Accept may block, so the accept
+// loop honors a pause even while no connection arrives.
+const DefaultAcceptPollInterval = 250 * time.Millisecond
+
+
+// Sets how long a single Accept may block (by default,
+// DefaultAcceptPollInterval) before the accept loop wakes up
+// to check whether it is paused. It relies on the accept
+// deadline of the listener (listeners not supporting one
+// block until a connection arrives). The wake-ups are not
+// reported as accept errors. Zero means blocking until a
+// connection arrives. Negative ones will be negated, to
+// positive.
+func WithAcceptPollInterval(interval time.Duration) DispatcherOption {
+	return func(dispatcher *Dispatcher) {
+		if interval < 0 {
+			interval = -interval
+		}
+		dispatcher.pollInterval = interval
+	}
+}
+
+
+// A TLS listener keeping the accept deadline of the listener
+// it wraps.
+type tlsListener struct {
+	net.Listener
+	deadline deadlineListener
+}
+
+
+// Sets the accept deadline of the wrapped listener.
+func (listener tlsListener) SetDeadline(deadline time.Time) error {
+	return listener.deadline.SetDeadline(deadline)
+}
+
+
+// Pauses the accepting: the accept loop stops taking new
+// connections (within the poll interval, at most) until
+// ResumeAccepting is called, so they wait in the backlog of
+// the listener. It keeps listening, and the running
+// connections are not affected. The pause holds across runs.
+// Pausing a paused dispatcher does nothing.
+func (dispatcher *Dispatcher) PauseAccepting() {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	if dispatcher.resumed == nil {
+		dispatcher.resumed = make(chan struct{})
+	}
+}
+
+
+// Resumes the accepting. Resuming a dispatcher not paused
+// does nothing.
+func (dispatcher *Dispatcher) ResumeAccepting() {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	if dispatcher.resumed != nil {
+		close(dispatcher.resumed)
+		dispatcher.resumed = nil
+	}
+}
+
+
+// Tells whether the accepting is paused.
+func (dispatcher *Dispatcher) AcceptingPaused() bool {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	return dispatcher.resumed != nil
+}
+
+
+// Waits until the accepting is resumed (if paused), unless
+// told to quit meanwhile. Returns whether it was resumed.
+func (dispatcher *Dispatcher) waitAcceptResumed(quit <-chan uint8) bool {
+	dispatcher.mutex.Lock()
+	resumed := dispatcher.resumed
+	dispatcher.mutex.Unlock()
+	if resumed == nil {
+		return true
+	}
+	select {
+	case <-resumed:
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+
+// Sets the accept deadline of the listener one poll interval
+// ahead, if polling and supported. Tells whether it did.
+func (dispatcher *Dispatcher) armAcceptPoll(listener net.Listener) bool {
+	if dispatcher.pollInterval == 0 {
+		return false
+	}
+	deadline, ok := listener.(deadlineListener)
+	if !ok {
+		return false
+	}
+	// noinspection GoUnhandledErrorResult
+	deadline.SetDeadline(time.Now().Add(dispatcher.pollInterval))
+	return true
+}
+
+
+// Pauses the accepting of all the dispatchers of the server
+// (see Dispatcher.PauseAccepting).
+func (server *Server) PauseAccepting() {
+	for _, dispatcher := range server.allDispatchers() {
+		dispatcher.PauseAccepting()
+	}
+}
+
+
+// Resumes the accepting of all the dispatchers of the server.
+func (server *Server) ResumeAccepting() {
+	for _, dispatcher := range server.allDispatchers() {
+		dispatcher.ResumeAccepting()
+	}
+}
+
+
+// Tells whether the accepting of the server is paused.
+func (server *Server) AcceptingPaused() bool {
+	return server.dispatcher.AcceptingPaused()
+}
@@ -0,0 +1,238 @@
+package chasqui
+
+import (
+	"container/list"
+	. "github.com/universe-10th/chasqui/types"
+	"net"
+	"sync"
+	"time"
+)
+
+
+// The default maximum of remote IPs tracked by the accept rate
+// limit.
+const DefaultAcceptRateMaxTracked = 10000
+
+
+// The default minimum lapse between two rate limited events of
+// the same remote IP.
+const DefaultAcceptRateEventInterval = time.Second
+
+
+// The accept rate limit of a server: each remote IP gets a
+// token bucket holding up to Burst tokens (zero means one),
+// which refills at Rate tokens (connections) per second. New
+// connections from an IP whose bucket is empty are closed
+// right away (after sending a BusyCommand message, if given).
+// Up to MaxTracked IPs (zero means DefaultAcceptRateMaxTracked)
+// are tracked: the least recently seen ones are forgotten
+// beyond that, and so are the ones whose bucket refilled
+// completely. A rate limited event is triggered at most once
+// per EventInterval (zero means DefaultAcceptRateEventInterval)
+// for each IP.
+type AcceptRateLimit struct {
+	Rate          float64
+	Burst         uint
+	MaxTracked    uint
+	EventInterval time.Duration
+	BusyCommand   string
+}
+
+
+// Fills the defaults of an accept rate limit.
+func (limit AcceptRateLimit) normalized() AcceptRateLimit {
+	if limit.Rate < 0 {
+		limit.Rate = -limit.Rate
+	}
+	if limit.Burst == 0 {
+		limit.Burst = 1
+	}
+	if limit.MaxTracked == 0 {
+		limit.MaxTracked = DefaultAcceptRateMaxTracked
+	}
+	if limit.EventInterval < 0 {
+		limit.EventInterval = -limit.EventInterval
+	} else if limit.EventInterval == 0 {
+		limit.EventInterval = DefaultAcceptRateEventInterval
+	}
+	return limit
+}
+
+
+// Event reporting the server closed connections from a remote
+// IP exceeding the accept rate limit (see WithAcceptRateLimit).
+// The count tells how many were closed since the previous
+// event for that IP.
+type ConnectionRateLimitedEvent struct {
+	IP    net.IP
+	Count uint64
+}
+
+
+// The token bucket of a remote IP, the connections limited
+// since the last event, and the instant of that event.
+type acceptRateEntry struct {
+	ip         string
+	tokens     float64
+	seenAt     time.Time
+	limited    uint64
+	reportedAt time.Time
+	element    *list.Element
+}
+
+
+// The token buckets of the remote IPs, and their order (the
+// most recently seen first).
+type acceptRateLimiter struct {
+	mutex   sync.Mutex
+	config  AcceptRateLimit
+	entries map[string]*acceptRateEntry
+	recent  *list.List
+}
+
+
+// Creates the limiter of an accept rate limit.
+func newAcceptRateLimiter(limit AcceptRateLimit) *acceptRateLimiter {
+	return &acceptRateLimiter{
+		config:  limit.normalized(),
+		entries: make(map[string]*acceptRateEntry),
+		recent:  list.New(),
+	}
+}
+
+
+// Tells how long an unseen IP is tracked: until its bucket
+// refilled completely, and its last event is old enough.
+// Zero means until evicted by newer ones.
+func (limiter *acceptRateLimiter) staleAfter() time.Duration {
+	if limiter.config.Rate == 0 {
+		return 0
+	}
+	refill := time.Duration(float64(limiter.config.Burst) / limiter.config.Rate * float64(time.Second))
+	if refill < limiter.config.EventInterval {
+		return limiter.config.EventInterval
+	}
+	return refill
+}
+
+
+// Forgets the IPs not seen for too long, and the least
+// recently seen ones beyond the maximum.
+func (limiter *acceptRateLimiter) evict(now time.Time) {
+	staleAfter := limiter.staleAfter()
+	for element := limiter.recent.Back(); element != nil; element = limiter.recent.Back() {
+		entry := element.Value.(*acceptRateEntry)
+		if uint(limiter.recent.Len()) <= limiter.config.MaxTracked &&
+			(staleAfter == 0 || now.Sub(entry.seenAt) < staleAfter) {
+			return
+		}
+		limiter.recent.Remove(element)
+		delete(limiter.entries, entry.ip)
+	}
+}
+
+
+// Takes a token for a new connection from the given IP. Tells
+// whether the connection is admitted and, when it is not and
+// an event is due, how many connections to report (zero
+// otherwise).
+func (limiter *acceptRateLimiter) take(ip net.IP, now time.Time) (bool, uint64) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	key := ip.String()
+	entry, ok := limiter.entries[key]
+	if !ok {
+		entry = &acceptRateEntry{ip: key, tokens: float64(limiter.config.Burst), seenAt: now}
+		entry.element = limiter.recent.PushFront(entry)
+		limiter.entries[key] = entry
+	} else {
+		if elapsed := now.Sub(entry.seenAt); elapsed > 0 {
+			entry.tokens += elapsed.Seconds() * limiter.config.Rate
+			if burst := float64(limiter.config.Burst); entry.tokens > burst {
+				entry.tokens = burst
+			}
+		}
+		entry.seenAt = now
+		limiter.recent.MoveToFront(entry.element)
+	}
+	// The entry is the most recently seen one, so it is never
+	// evicted here.
+	limiter.evict(now)
+	if entry.tokens >= 1 {
+		entry.tokens--
+		return true, 0
+	}
+	entry.limited++
+	if now.Sub(entry.reportedAt) < limiter.config.EventInterval {
+		return false, 0
+	}
+	count := entry.limited
+	entry.limited = 0
+	entry.reportedAt = now
+	return false, count
+}
+
+
+// Tells the number of remote IPs currently tracked.
+func (limiter *acceptRateLimiter) tracked() int {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return len(limiter.entries)
+}
+
+
+// Tells the IP of a remote address (nil if it has none).
+func remoteIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+
+// Applies the accept rate limit to a new connection. Limited
+// connections are closed (after the busy message, if any), and
+// reported once in a while. Returns whether it was admitted.
+func (server *Server) admitRate(conn net.Conn) bool {
+	ip := remoteIP(conn.RemoteAddr())
+	if ip == nil {
+		return true
+	}
+	admitted, count := server.acceptRate.take(ip, time.Now())
+	if admitted {
+		return true
+	}
+	server.logger.Debugf("server rate limited a connection (%s)", conn.RemoteAddr())
+	if command := server.acceptRate.config.BusyCommand; command != "" {
+		server.sendAndClose(conn, command, Args{}, KWArgs{})
+	} else {
+		// noinspection GoUnhandledErrorResult
+		conn.Close()
+	}
+	if count > 0 {
+		// Floods of limited connections must not stall the
+		// accept loop.
+		select {
+		case server.rateLimitedEvent <- ConnectionRateLimitedEvent{ip, count}:
+		default:
+		}
+	}
+	return false
+}
+
+
+// Returns the number of remote IPs the accept rate limit
+// currently tracks (zero if there is no limit).
+func (server *Server) AcceptRateTracked() int {
+	if server.acceptRate == nil {
+		return 0
+	}
+	return server.acceptRate.tracked()
+}
@@ -0,0 +1,102 @@
+package chasqui
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+
+// The first descriptor passed by the systemd socket activation.
+const listenFdsStart = 3
+
+
+// Error raised when the listeners passed by the systemd socket
+// activation cannot be taken (e.g. the process was not started
+// that way). It also matches ErrSocketActivation.
+type SocketActivationError struct {
+	Reason string
+	Err    error
+}
+
+
+// The error message.
+func (err SocketActivationError) Error() string {
+	if err.Err != nil {
+		return "socket activation failed: " + err.Reason + ": " + err.Err.Error()
+	}
+	return "socket activation failed: " + err.Reason
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err SocketActivationError) Is(target error) bool {
+	return target == ErrSocketActivation
+}
+
+
+// Returns the underlying error, if any.
+func (err SocketActivationError) Unwrap() error {
+	return err.Err
+}
+
+
+// Takes the listeners passed by the systemd socket activation
+// (the LISTEN_PID / LISTEN_FDS protocol, e.g. by a socket
+// unit), in order, so they may be given to RunWithListeners
+// (or, if there is only one, RunWithListener). The variables
+// are unset afterwards, so child processes do not take them
+// as theirs, and the passed descriptors are closed (the
+// listeners keep duplicates of them). Fails with a
+// SocketActivationError when the process was not started by
+// the socket activation, or any descriptor is not a listening
+// socket.
+func ListenersFromEnv() ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pid == "" || fds == "" {
+		return nil, SocketActivationError{"LISTEN_PID and LISTEN_FDS are not set", nil}
+	}
+	if parsed, err := strconv.Atoi(pid); err != nil || parsed != os.Getpid() {
+		return nil, SocketActivationError{"LISTEN_PID does not tell this process", nil}
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 1 {
+		return nil, SocketActivationError{"LISTEN_FDS is not a positive number", nil}
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// noinspection GoUnhandledErrorResult
+	os.Unsetenv("LISTEN_PID")
+	// noinspection GoUnhandledErrorResult
+	os.Unsetenv("LISTEN_FDS")
+	// noinspection GoUnhandledErrorResult
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, count)
+	var failure error
+	for index := 0; index < count; index++ {
+		fd := listenFdsStart + index
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if index < len(names) && names[index] != "" {
+			name = names[index]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		if failure == nil {
+			if listener, err := net.FileListener(file); err != nil {
+				failure = SocketActivationError{"descriptor " + strconv.Itoa(fd) + " (" + name + ")", err}
+			} else {
+				listeners = append(listeners, listener)
+			}
+		}
+		// noinspection GoUnhandledErrorResult
+		file.Close()
+	}
+	if failure != nil {
+		for _, listener := range listeners {
+			// noinspection GoUnhandledErrorResult
+			listener.Close()
+		}
+		return nil, failure
+	}
+	return listeners, nil
+}
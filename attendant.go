@@ -1,8 +1,14 @@
 package chasqui
 
 import (
+	"context"
+	"errors"
 	. "github.com/universe-10th/chasqui/types"
+	"io"
 	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -36,14 +42,42 @@ func (AttendantIsAlreadyStopped) Error() string {
 }
 
 
+// Tells whether the error matches the given sentinel: it
+// also matches ErrAttendantStopped.
+func (err AttendantIsAlreadyStopped) Is(target error) bool {
+	return target == ErrAttendantStopped
+}
+
+
+// Error that tells when a message could not be sent in time
+// (see Attendant.SendWithTimeout).
+type SendTimeoutError struct {
+	Timeout time.Duration
+}
+
+
+// The error message.
+func (err SendTimeoutError) Error() string {
+	return "attendant could not send the message within " + err.Timeout.String()
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err SendTimeoutError) Is(target error) bool {
+	return target == ErrSendTimeout
+}
+
+
 // The status of an Attendant. It will have 3 sequential
 // internal states:
 // - New: The attendant was just created, but not yet started.
 // - Running: The attendant is running.
 // - Closed: The attendant is closed, or was just told to close.
-type AttendantStatus int
+// Transitions only go forward, and they are atomic: see the
+// Status method.
+type AttendantStatus int32
 const (
-	AttendantNew = iota
+	AttendantNew AttendantStatus = iota
 	AttendantRunning
 	AttendantStopped
 )
@@ -55,22 +89,51 @@ const (
 	AttendantLocalStop = iota
 	AttendantRemoteStop
 	AttendantAbnormalStop
+	AttendantIdleStop
+	AttendantHandshakeTimeout
+	AttendantAuthRejected
+	AttendantExpiredStop
 )
 
 
-// Start events come in a dummy structure with the attendant as
-// the only value.
+// Returns a readable name of the stop type (e.g. for logs).
+func (stopType AttendantStopType) String() string {
+	switch stopType {
+	case AttendantLocalStop:
+		return "local"
+	case AttendantRemoteStop:
+		return "remote"
+	case AttendantAbnormalStop:
+		return "abnormal"
+	case AttendantIdleStop:
+		return "idle"
+	case AttendantHandshakeTimeout:
+		return "handshake timeout"
+	case AttendantAuthRejected:
+		return "auth rejected"
+	case AttendantExpiredStop:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+
+// Start events come in a dummy structure with the attendant (and
+// its ID) as the only value.
 type AttendantStartedEvent struct {
-	Attendant *Attendant
+	Attendant   *Attendant
+	AttendantID uint64
 }
 
 
 // Messages being conveyed come in another kind of structure: The
 // structure will hold both the conveyed message and the attendant
-// that received and conveyed it.
+// (and its ID) that received and conveyed it.
 type MessageEvent struct {
-	Attendant *Attendant
-	Message   Message
+	Attendant   *Attendant
+	AttendantID uint64
+	Message     Message
 }
 
 
@@ -80,27 +143,54 @@ type MessageEvent struct {
 // useless as they are already closed, and so the handling of this
 // event should not attempt any further interaction with any of the
 // socket features of the attendant.
+//
+// Failures in the teardown callbacks (which do not prevent the
+// attendant from stopping) are reported in TeardownErrors, and
+// the final traffic of the attendant is reported in Stats. The
+// final context is only reported in Context (otherwise nil) if
+// the attendant was created with WithStoppedContext. If the
+// peer told why it closed (see StopWithReason), the reason is
+// reported in Reason (otherwise nil). The final identity of the
+// peer (see Attendant.Identity) is reported in Identity.
 type AttendantStoppedEvent struct {
-	Attendant *Attendant
-	StopType  AttendantStopType
-	Error     error
+	Attendant      *Attendant
+	AttendantID    uint64
+	StopType       AttendantStopType
+	Error          error
+	TeardownErrors []error
+	Stats          AttendantStats
+	Context        map[string]interface{}
+	Reason         *CloseReason
+	Identity       Identity
 }
 
 
 // ThrottledEvent events come in another kind of structure: The structure
 // will hold the attendant receiving the throttled message, the
-// instant of the throttle, and the message itself.
+// instant of the throttle, and the message itself. The rule is
+// the command whose throttle fired, or empty if the general
+// throttle fired. Tokens tells the remaining allowance (for
+// policies like the token bucket), and RetryAfter tells the
+// time to wait before a new message would be accepted (if it
+// can be told), so servers can inform their clients. Bytes
+// tells the size of the message, if the marshaler tells it
+// (see FrameSizer).
 type ThrottledEvent struct {
-	Attendant *Attendant
-	Message   Message
-	Instant   time.Time
-	Lapse     time.Duration
+	Attendant   *Attendant
+	AttendantID uint64
+	Message     Message
+	Instant     time.Time
+	Lapse       time.Duration
+	Rule        string
+	Tokens      float64
+	RetryAfter  time.Duration
+	Bytes       int
 }
 
 
 // Attendants are spawned objects and routines for a single
 // incoming connection. They are created using certain protocol
-// factory (an instance of MessageMarshaler), are connected to
+// factory (an instance of MarshalerFactory), are connected to
 // a central message channel (one for all the bunch of messages)
 // to read the incoming messages via an individual goroutine that
 // works as a "read loop", and have methods to Write and Close
@@ -144,23 +234,58 @@ type ThrottledEvent struct {
 // cases, they become particularly useful when there are many
 // clients connecting to many different servers).
 type Attendant struct {
-	// The connection and the wrapper are the main elements
-	// involved in the process. Although the wrapper will be
-	// the object being used the most to send/receive data,
-	// the connection is still needed to close it on need.
-	connection     *net.TCPConn
-	wrapper        MessageMarshaler
+	// The unique ID of the attendant, for logging and for
+	// referencing it from tools.
+	id             uint64
+	// The connection and the wrapper halves are the main
+	// elements involved in the process. Although the receiver
+	// and the sender will be the objects being used the most
+	// to receive/send data, the connection is still needed to
+	// close it on need. The sender is nil for receive-only
+	// attendants.
+	connection     net.Conn
+	receiver       MessageReceiver
+	sender         MessageSender
+	// Sends may come from several goroutines, but each frame
+	// must be written atomically: the send slot is taken by a
+	// single writer at a time (it is a channel, so waiting
+	// for it can time out). Sequenced sends are also
+	// kept in per-key queues, ahead of the sender.
+	sendSlot       chan struct{}
+	sequences      map[string]*sendSequence
+	sequencesMutex sync.Mutex
+	// The writes may be coalesced (see SetCoalescing).
+	coalescer      coalescer
+	// An optional outgoing queue, drained by a writer
+	// goroutine, makes Send return without waiting for
+	// the write. Nil means Send writes directly.
+	sendQueue      *sendQueue
 	// An internal status will also be needed, to track what
 	// happens in the read loop and to trigger the proper
-	// close event.
-	status         AttendantStatus
+	// close event. It is only changed atomically, through
+	// the transition method. The stop of a running attendant
+	// is claimed only once: either by Stop (a local stop), or
+	// by any other cause (see claimStop).
+	status         int32
+	stopping       int32
 	// Now, all the involved events.
 	messageEvent   chan MessageEvent
 	startedEvent   chan AttendantStartedEvent
 	stoppedEvent   chan AttendantStoppedEvent
+	// The message and throttled channels may be replaced
+	// (see Rebind).
+	binding        eventBinding
 	// Arbitrary context which will be user-specific or
-	// library-specific.
-	context        map[string]interface{}
+	// library-specific. It may be used from any goroutine,
+	// and it may be reported when the attendant stops.
+	// Some elements may expire: their deadlines, the callback
+	// run when they expire, and who sweeps them.
+	context          map[string]interface{}
+	contextMutex     sync.RWMutex
+	contextDeadlines map[string]time.Time
+	contextExpired   ContextExpiredFunc
+	sweeper          *contextSweeper
+	stoppedContext   bool
 	// Throttling involves a mean to have dead time in which
 	// the read loop does not process any message. Those dead
 	// times occur after the last processed message, and they
@@ -169,18 +294,200 @@ type Attendant struct {
 	// different throttling times, a "general" throttling time
 	// should seldom be > 1s). If using a throttle interval of
 	// 0, no throttle will occur at all. The throttle interval
-	// may be changed later.
-	throttle       time.Duration
+	// may be changed later, from any goroutine: it is kept in
+	// nanoseconds and only accessed atomically. The instant of
+	// the last accepted message is only accessed with the
+	// throttle mutex locked.
+	throttle       int64
 	throttleFrom   time.Time
 	throttledEvent chan ThrottledEvent
+	// Commands may have their own throttle, overriding the
+	// general one. They are tracked separately. An optional
+	// throttle policy replaces the lapse-based general one,
+	// and an optional byte throttle limits the rate of the
+	// received bytes (before any other throttle).
+	commandThrottles map[string]*commandThrottle
+	throttlePolicy   ThrottlePolicy
+	byteThrottle     *byteThrottle
+	escalation       *throttleEscalation
+	throttleMutex    sync.Mutex
+	// An optional queue delays the throttled messages instead
+	// of discarding them.
+	delayQueue       *delayQueue
+	// A write timeout (in nanoseconds) prevents a peer that
+	// stops reading from blocking Send forever. Zero means
+	// no deadline at all.
+	writeTimeout   int64
+	stallTimeout   int64
+	// An idle timeout (in nanoseconds) stops the attendant
+	// when nothing is received for that long. Zero means
+	// no timeout at all.
+	idleTimeout    int64
+	// A first message timeout (in nanoseconds) stops the
+	// attendant when its first message does not arrive in
+	// time since it started. Zero means no timeout at all.
+	firstTimeout   int64
+	// The optional keepalive (ping/pong) state. Nil means
+	// keepalive messages are neither sent nor understood.
+	keepalive      *keepaliveState
+	// The fraction of their period the periodic activities
+	// are offset by (see WithJitter).
+	jitter         float64
+	// The identity of the peer set by the application (see
+	// SetIdentity).
+	identity       identityState
+	// When the attendant is forcefully stopped from outside
+	// the read loop (e.g. a write timeout), the cause is kept
+	// here so the read loop reports an abnormal stop instead
+	// of a local one.
+	abortError     error
+	abortMutex     sync.Mutex
+	// The reading may be paused (see PauseReading), and
+	// the received messages discarded (see Drain).
+	pause          pauseState
+	draining       int32
+	// The received messages may be echoed instead of
+	// conveyed (see SetEchoMode).
+	echo           echoState
+	// The optional tuning of TCP connections.
+	tcpTuning      tcpTuningState
+	// The optional authentication phase.
+	auth           authState
+	// The reason the peer gave when closing, if any.
+	closeReason    closeReasonState
+	// The writing side may be closed before the reading one
+	// (see CloseWrite).
+	halfClose      halfCloseState
+	// The tags, and the index of the server they are kept in.
+	tags           tagState
+	// The sends waiting for (or in the middle of) a direct
+	// write, and the optional slow consumer detection.
+	inflightSends  int64
+	slowConsumer   *slowConsumerState
+	// Optional events, only triggered by optional features.
+	// Nil channels mean nobody listens to those events.
+	bandwidthExceededEvent chan BandwidthExceededEvent
+	eventOverflowEvent     chan EventOverflowEvent
+	authenticatedEvent     chan AttendantAuthenticatedEvent
+	slowConsumerEvent      chan SlowConsumerEvent
+	sendFailedEvent        chan SendFailedEvent
+	halfClosedEvent        chan AttendantHalfClosedEvent
+	unresponsiveEvent      chan AttendantUnresponsiveEvent
+	messageRejectedEvent   chan MessageRejectedEvent
+	// The unified channel, taking all of the events above
+	// instead of their own channels (see WithUnifiedEvents).
+	events                 chan AttendantEvent
+	// What to do when the message and throttled channels
+	// are full, the count of the dropped events, and the
+	// instant (in unix nanoseconds) of the last overflow
+	// event.
+	eventDelivery  EventDeliveryPolicy
+	droppedEvents  uint64
+	lastOverflow   int64
+	// The teardown pipeline, and the final stop type and
+	// error (set right before it runs).
+	teardown       teardownPipeline
+	stopType       AttendantStopType
+	stopError      error
+	// The hooks run when it stops (see OnStop).
+	stopHooks      stopHooks
+	// The optional maximum lifetime (see SetMaxLifetime).
+	lifetime       lifetimeState
+	// The goroutines, timers and connections it owns, and
+	// the signal telling it is fully stopped.
+	resources      resourceCounter
+	done           chan struct{}
+	// The traffic counters, and the recent receive rate.
+	stats          attendantStats
+	receiveRate    receiveRate
+	// Where the key points of its life are logged.
+	logger         Logger
+	// The size of the buffer the connection is read through
+	// (zero means none).
+	readBufferSize int
+}
+
+
+// The last ID given to an attendant. IDs are never reused
+// within the process lifetime.
+var lastAttendantID uint64
+
+
+// Returns the unique ID of the attendant, given when it was
+// created. IDs are increasing, and never reused.
+func (attendant *Attendant) ID() uint64 {
+	return attendant.id
+}
+
+
+// Returns the address of the peer: the one of the connection,
+// or the one told by its PROXY protocol header (see
+// WithProxyProtocol).
+func (attendant *Attendant) RemoteAddr() net.Addr {
+	return attendant.connection.RemoteAddr()
+}
+
+
+// Returns the current status of the attendant. It is safe to
+// call it from any goroutine.
+func (attendant *Attendant) Status() AttendantStatus {
+	return AttendantStatus(atomic.LoadInt32(&attendant.status))
+}
+
+
+// The claims of the stop of a running attendant.
+const (
+	stopUnclaimed = iota
+	stopClaimedLocal
+	stopClaimedOther
+)
+
+
+// Tells whether the attendant was told to stop while running.
+// It is set right before the connection is closed.
+func (attendant *Attendant) closing() bool {
+	return atomic.LoadInt32(&attendant.stopping) == stopClaimedLocal
+}
+
+
+// Claims the stop of the attendant for a cause other than a
+// local stop (e.g. the peer closing, or an abort). Returns
+// false if a local stop was claimed first: it wins.
+func (attendant *Attendant) claimStop() bool {
+	return atomic.CompareAndSwapInt32(&attendant.stopping, stopUnclaimed, stopClaimedOther) ||
+		atomic.LoadInt32(&attendant.stopping) == stopClaimedOther
+}
+
+
+// Changes the status of the attendant, only if it is in the
+// expected one. Returns whether the transition occurred, so
+// only one of several concurrent transitions wins.
+func (attendant *Attendant) transition(from, to AttendantStatus) bool {
+	return atomic.CompareAndSwapInt32(&attendant.status, int32(from), int32(to))
 }
 
 
 // Starts the attendant (starts its read loop), after preparing
 // the status and also triggering the onStart event appropriately.
 func (attendant *Attendant) Start() error {
-	if attendant.status == AttendantNew {
-		go attendant.readLoop()
+	if attendant.transition(AttendantNew, AttendantRunning) {
+		atomic.StoreInt64(&attendant.stats.startedAt, time.Now().UnixNano())
+		attendant.startLifetime()
+		attendant.applyTCPTuning()
+		attendant.resources.spawn(attendant.readLoop)
+		if attendant.sendQueue != nil {
+			attendant.resources.spawn(attendant.writeLoop)
+		}
+		if attendant.keepalive != nil && attendant.keepalive.config.Interval > 0 {
+			attendant.resources.spawn(attendant.pingLoop)
+		}
+		if attendant.delayQueue != nil {
+			attendant.resources.spawn(attendant.releaseLoop)
+		}
+		if attendant.slowConsumer != nil {
+			attendant.resources.spawn(attendant.slowConsumerLoop)
+		}
+		attendant.logger.Debugf("attendant %d started (%s)", attendant.id, attendant.connection.RemoteAddr())
 		return nil
 	} else {
 		return AttendantIsNotNew(true)
@@ -189,11 +496,35 @@ func (attendant *Attendant) Start() error {
 
 
 // Closes the attendant (it will also end its read loop), also
-// sets the end state and triggers the close event.
+// sets the end state and triggers the close event. Stopping
+// an attendant never started just closes its connection, and
+// no events are triggered. Only the first call succeeds, and
+// it returns the error of closing the connection, if any:
+// the attendant is stopped anyway. Further calls return an
+// AttendantIsAlreadyStopped error (which also matches
+// ErrAttendantStopped).
+//
+// The stopped event is triggered exactly once, telling the
+// cause that won: when Stop races another cause (e.g. the
+// peer closing the connection), a local stop is reported
+// unless the read loop already took the other cause, in
+// which case Stop fails as if the attendant was stopped.
 func (attendant *Attendant) Stop() error {
-	if attendant.status != AttendantStopped {
+	if attendant.transition(AttendantNew, AttendantStopped) {
+		err := attendant.connection.Close()
 		// noinspection GoUnhandledErrorResult
-		attendant.connection.Close()
+		attendant.runStopHooks(AttendantLocalStop, nil)
+		attendant.sweeper.untrack(attendant)
+		attendant.resources.addConnections(-1)
+		close(attendant.done)
+		return err
+	} else if attendant.Status() == AttendantRunning &&
+		atomic.CompareAndSwapInt32(&attendant.stopping, stopUnclaimed, stopClaimedLocal) {
+		err := attendant.connection.Close()
+		attendant.interruptPause()
+		if err != nil && !isClosedSocketError(err) {
+			return err
+		}
 		return nil
 	} else {
 		return AttendantIsAlreadyStopped(true)
@@ -201,9 +532,105 @@ func (attendant *Attendant) Stop() error {
 }
 
 
-// Returns a read-only channel with all the received messages.
+// Connections able to close only their writing side (e.g.
+// TCP and TLS connections).
+type writeCloser interface {
+	CloseWrite() error
+}
+
+
+// Blocks until the attendant is fully stopped: its read loop
+// finished and its teardown ran (regardless of anyone taking
+// the stopped event). Attendants stopped before starting are
+// also released. Beware: it blocks forever if the attendant
+// is never started nor stopped.
+func (attendant *Attendant) Wait() {
+	<-attendant.done
+}
+
+
+// Blocks until the attendant is fully stopped (as Wait does),
+// or the context is done. In the latter case, the error of
+// the context is returned.
+func (attendant *Attendant) WaitContext(ctx context.Context) error {
+	select {
+	case <-attendant.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+
+// The maximum time StopWith waits for the final message to
+// be written, when the attendant has no write timeout.
+const DefaultFarewellTimeout = 5 * time.Second
+
+
+// Sends a final message, waits until it is written, and then
+// stops the attendant as Stop does (producing a local stop).
+// The wait is bounded by the write timeout of the attendant
+// (or DefaultFarewellTimeout, if it has none): the attendant
+// is stopped anyway once it elapses. The message is written
+// after the ones already pending in the outgoing queue, if
+// any. Returns the error of the final send, if it failed.
+func (attendant *Attendant) StopWith(command string, args Args, kwargs KWArgs) error {
+	if attendant.Status() == AttendantStopped {
+		return AttendantIsAlreadyStopped(true)
+	}
+	timeout := attendant.WriteTimeout()
+	if timeout == 0 {
+		timeout = DefaultFarewellTimeout
+	}
+	err := attendant.sendFlushed(timeout, command, args, kwargs)
+	if closer, ok := attendant.connection.(writeCloser); ok && err == nil {
+		// The peer gets the final message before the close.
+		// noinspection GoUnhandledErrorResult
+		closer.CloseWrite()
+	}
+	if stopErr := attendant.Stop(); stopErr != nil {
+		return stopErr
+	}
+	return err
+}
+
+
+// Writes a message and waits until it is written (and flushed,
+// if the writes are coalesced), bounded by the given time.
+func (attendant *Attendant) sendFlushed(timeout time.Duration, command string, args Args, kwargs KWArgs) error {
+	if attendant.sendQueue == nil {
+		if sent, err := attendant.writeWithin(timeout, command, args, kwargs); !sent && err == nil || isTimeoutError(err) {
+			return SendTimeoutError{timeout}
+		} else if err != nil {
+			return err
+		}
+		return attendant.Flush()
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	result := make(chan error, 1)
+	if sent, err := attendant.sendQueue.offer(queuedSend{command, args, kwargs, result}, timeout); err != nil {
+		return err
+	} else if !sent {
+		return SendTimeoutError{timeout}
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			return err
+		}
+		return attendant.Flush()
+	case <-timer.C:
+		return SendTimeoutError{timeout}
+	}
+}
+
+
+// Returns a read-only channel with all the received messages
+// (the current one, if the attendant was rebound).
 func (attendant *Attendant) MessageEvent() <-chan MessageEvent {
-	return attendant.messageEvent
+	channel, _ := attendant.messageBinding()
+	return channel
 }
 
 
@@ -213,9 +640,11 @@ func (attendant *Attendant) StartedEvent() <-chan AttendantStartedEvent {
 }
 
 
-// Returns a read-only channel with all the "throttled" events.
+// Returns a read-only channel with all the "throttled" events
+// (the current one, if the attendant was rebound).
 func (attendant *Attendant) ThrottledEvent() <-chan ThrottledEvent {
-	return attendant.throttledEvent
+	channel, _ := attendant.throttledBinding()
+	return channel
 }
 
 
@@ -225,20 +654,336 @@ func (attendant *Attendant) StoppedEvent() <-chan AttendantStoppedEvent {
 }
 
 
+// Returns a read-only channel with all the "bandwidth exceeded" events.
+// It will be nil unless a channel was given on construction.
+func (attendant *Attendant) BandwidthExceededEvent() <-chan BandwidthExceededEvent {
+	return attendant.bandwidthExceededEvent
+}
+
+
+// Triggers a "bandwidth exceeded" event, if anyone listens.
+func (attendant *Attendant) emitBandwidthExceeded(event BandwidthExceededEvent) {
+	if attendant.unified() {
+		attendant.emitUnified(event, nil)
+	} else if attendant.bandwidthExceededEvent != nil {
+		attendant.bandwidthExceededEvent <- event
+	}
+}
+
+
+// Returns the bandwidth marshaler of this attendant, if it was
+// created with one, to inspect or change its limits at runtime.
+func (attendant *Attendant) Bandwidth() (*BandwidthMarshaler, bool) {
+	marshaler, ok := attendant.receiver.(*BandwidthMarshaler)
+	return marshaler, ok
+}
+
+
 // Writes a message via the connection, if it is not closed.
+// Concurrent sends are atomic per frame, but their relative
+// order is not guaranteed (see SendSequenced for that). If
+// a write timeout is set and the write does not complete in
+// time, the attendant is stopped abnormally.
+//
+// If the attendant has an outgoing queue, the message is
+// just enqueued (according to the queue policy) and this
+// call returns immediately: write errors will not be told
+// here (use SendSync for that).
 func (attendant *Attendant) Send(command string, args Args, kwargs KWArgs) error {
-	if attendant.status != AttendantStopped {
-		return attendant.wrapper.Send(command, args, kwargs)
+	if attendant.WriteClosed() {
+		return WriteClosedError(true)
+	} else if attendant.sendQueue == nil {
+		return attendant.write(command, args, kwargs)
+	} else if attendant.Status() != AttendantStopped {
+		return attendant.sendQueue.push(attendant, queuedSend{command, args, kwargs, nil})
+	} else {
+		return AttendantIsStopped(true)
+	}
+}
+
+
+// Writes a message via the connection, if it is not closed,
+// and waits until it is written (or failed to). If the
+// attendant has an outgoing queue, the message is written
+// after the ones already pending there.
+func (attendant *Attendant) SendSync(command string, args Args, kwargs KWArgs) error {
+	if attendant.WriteClosed() {
+		return WriteClosedError(true)
+	} else if attendant.sendQueue == nil {
+		return attendant.write(command, args, kwargs)
+	} else if attendant.Status() != AttendantStopped {
+		result := make(chan error, 1)
+		if err := attendant.sendQueue.push(attendant, queuedSend{command, args, kwargs, result}); err != nil {
+			return err
+		}
+		return <-result
 	} else {
 		return AttendantIsStopped(true)
 	}
 }
 
 
+// Queues a message to be written via the connection, if it
+// is not closed, only if that can be done without waiting:
+// returns false if the outgoing queue is full (regardless of
+// its policy). It requires an outgoing queue (see
+// WithSendQueue), since a direct write may block the caller
+// while the peer is slow: without one, it fails with a
+// SendQueueRequiredError.
+func (attendant *Attendant) TrySend(command string, args Args, kwargs KWArgs) (bool, error) {
+	if attendant.WriteClosed() {
+		return false, WriteClosedError(true)
+	} else if attendant.sendQueue == nil {
+		return false, SendQueueRequiredError(true)
+	} else if attendant.Status() != AttendantStopped {
+		return attendant.sendQueue.offer(queuedSend{command, args, kwargs, nil}, 0)
+	} else {
+		return false, AttendantIsStopped(true)
+	}
+}
+
+
+// Writes a message via the connection, if it is not closed,
+// giving up with a SendTimeoutError if that cannot be done
+// within the given time. If the attendant has an outgoing
+// queue, the time bounds the wait for room in the queue and
+// the message is written later. Otherwise, it bounds both
+// the wait for other writes and the write itself. Either a
+// whole message is written, or nothing: if the time elapses
+// in the middle of a write, the attendant is stopped (as it
+// happens with the write timeout). Non-positive times make
+// this call behave like TrySend (so they also require an
+// outgoing queue).
+func (attendant *Attendant) SendWithTimeout(timeout time.Duration, command string, args Args, kwargs KWArgs) error {
+	if timeout < 0 {
+		timeout = 0
+	}
+	var sent bool
+	var err error
+	if attendant.WriteClosed() {
+		return WriteClosedError(true)
+	} else if attendant.sendQueue == nil && timeout == 0 {
+		return SendQueueRequiredError(true)
+	} else if attendant.sendQueue == nil {
+		sent, err = attendant.writeWithin(timeout, command, args, kwargs)
+	} else if attendant.Status() != AttendantStopped {
+		sent, err = attendant.sendQueue.offer(queuedSend{command, args, kwargs, nil}, timeout)
+	} else {
+		return AttendantIsStopped(true)
+	}
+	if !sent && err == nil || isTimeoutError(err) {
+		return SendTimeoutError{timeout}
+	}
+	return err
+}
+
+
+// Returns the number of messages waiting in the outgoing
+// queue (always 0 if the attendant has no queue).
+func (attendant *Attendant) QueuedSends() int {
+	if attendant.sendQueue == nil {
+		return 0
+	}
+	return attendant.sendQueue.length()
+}
+
+
+// Writes a message via the connection, right now.
+func (attendant *Attendant) write(command string, args Args, kwargs KWArgs) error {
+	_, err := attendant.writeWithin(-1, command, args, kwargs)
+	return err
+}
+
+
+// Writes a message via the connection, right now, if the
+// send slot can be taken within the given time (zero means
+// not waiting at all, and negative means waiting forever).
+// Positive times also bound the write. Returns false (and
+// no error) if the slot could not be taken in time.
+func (attendant *Attendant) writeWithin(wait time.Duration, command string, args Args, kwargs KWArgs) (bool, error) {
+	if attendant.writeShut() {
+		return false, WriteClosedError(true)
+	} else if attendant.sender == nil {
+		return false, SendUnsupportedError(true)
+	} else if attendant.Status() != AttendantStopped && !attendant.closing() {
+		atomic.AddInt64(&attendant.inflightSends, 1)
+		defer atomic.AddInt64(&attendant.inflightSends, -1)
+		start := time.Now()
+		if !attendant.acquireSendSlot(wait) {
+			return false, nil
+		}
+		defer attendant.releaseSendSlot()
+		deadline := time.Time{}
+		if timeout := attendant.WriteTimeout(); timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		if wait > 0 && (deadline.IsZero() || start.Add(wait).Before(deadline)) {
+			deadline = start.Add(wait)
+		}
+		// noinspection GoUnhandledErrorResult
+		attendant.connection.SetWriteDeadline(deadline)
+		unwatch := attendant.watchStall()
+		err := attendant.sender.Send(command, args, kwargs)
+		unwatch()
+		if err == nil {
+			atomic.AddUint64(&attendant.stats.messagesOut, 1)
+			atomic.StoreInt64(&attendant.stats.lastSentAt, time.Now().UnixNano())
+		} else if isTimeoutError(err) {
+			attendant.abort(err)
+		}
+		return true, err
+	} else {
+		return false, AttendantIsStopped(true)
+	}
+}
+
+
+// Takes the send slot, waiting at most the given time (zero
+// means not waiting at all, and negative means waiting
+// forever). Returns whether it was taken.
+func (attendant *Attendant) acquireSendSlot(wait time.Duration) bool {
+	if wait < 0 {
+		attendant.sendSlot <- struct{}{}
+		return true
+	} else if wait == 0 {
+		select {
+		case attendant.sendSlot <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	} else {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case attendant.sendSlot <- struct{}{}:
+			return true
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+
+// Releases the send slot.
+func (attendant *Attendant) releaseSendSlot() {
+	<-attendant.sendSlot
+}
+
+
+// Returns the number of goroutines currently run by this
+// attendant (read loop, writer, sequences, and so on).
+func (attendant *Attendant) GoroutineCount() int {
+	return attendant.resources.counts().Goroutines
+}
+
+
+// Returns the resources currently owned by this attendant.
+// They should all be zero once it is fully stopped.
+func (attendant *Attendant) ResourceCounts() ResourceCounts {
+	return attendant.resources.counts()
+}
+
+
+// Gets the write timeout for the current attendant.
+func (attendant *Attendant) WriteTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&attendant.writeTimeout))
+}
+
+
+// Sets the write timeout for the current attendant. Each
+// Send will fail if it does not complete within this time,
+// and the attendant will be stopped abnormally. Zero means
+// no timeout (Send may block forever). Negative timeouts
+// will be negated, to positive.
+func (attendant *Attendant) SetWriteTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = -timeout
+	}
+	atomic.StoreInt64(&attendant.writeTimeout, int64(timeout))
+}
+
+
+// Gets the idle timeout for the current attendant.
+func (attendant *Attendant) IdleTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&attendant.idleTimeout))
+}
+
+
+// Sets the idle timeout for the current attendant. If no
+// message arrives within this time, the attendant will be
+// stopped (with AttendantIdleStop as stop type). Zero means
+// no timeout. Negative timeouts will be negated, to positive.
+// The new timeout applies from the next received message, and
+// it is extended by the jitter offset of the attendant (see
+// WithJitter).
+func (attendant *Attendant) SetIdleTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = -timeout
+	}
+	atomic.StoreInt64(&attendant.idleTimeout, int64(timeout))
+}
+
+
+// Gets the first message timeout for the current attendant.
+func (attendant *Attendant) FirstMessageTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&attendant.firstTimeout))
+}
+
+
+// Sets the first message timeout for the current attendant.
+// If its first message (not counting keepalive messages) does
+// not arrive within this time since the attendant started, it
+// will be stopped (with AttendantHandshakeTimeout as stop
+// type). After the first message, only the idle timeout (if
+// any) applies. Zero means no timeout. Negative timeouts will
+// be negated, to positive. It must be set before starting.
+func (attendant *Attendant) SetFirstMessageTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = -timeout
+	}
+	atomic.StoreInt64(&attendant.firstTimeout, int64(timeout))
+}
+
+
+// Forcefully stops the attendant due to an abnormal cause
+// detected outside the read loop. The read loop will then
+// report an abnormal stop with the given error. Only the
+// first cause is kept, and none if the attendant was already
+// told to stop (which then remains a local stop).
+func (attendant *Attendant) abort(err error) {
+	attendant.abortMutex.Lock()
+	if attendant.abortError == nil && attendant.claimStop() {
+		attendant.abortError = err
+	}
+	attendant.abortMutex.Unlock()
+	// noinspection GoUnhandledErrorResult
+	attendant.connection.Close()
+	attendant.interruptPause()
+}
+
+
+// Gets the abort cause, if any.
+func (attendant *Attendant) abortCause() error {
+	attendant.abortMutex.Lock()
+	defer attendant.abortMutex.Unlock()
+	return attendant.abortError
+}
+
+
 // Gets a context element by its key. Purely user-specific or
-// library-specific.
+// library-specific. Expired elements are absent (and removed
+// right away).
 func (attendant *Attendant) Context(key string) (interface{}, bool) {
+	now := time.Now()
+	attendant.contextMutex.RLock()
 	result, ok := attendant.context[key]
+	expired := attendant.contextExpiredAt(key, now)
+	attendant.contextMutex.RUnlock()
+	if expired {
+		attendant.expireContext(now)
+		return nil, false
+	}
 	return result, ok
 }
 
@@ -246,42 +991,80 @@ func (attendant *Attendant) Context(key string) (interface{}, bool) {
 // Sets a context element by its key. Purely user-specific or
 // library-specific.
 func (attendant *Attendant) SetContext(key string, value interface{}) {
+	attendant.contextMutex.Lock()
+	defer attendant.contextMutex.Unlock()
 	attendant.context[key] = value
+	delete(attendant.contextDeadlines, key)
 }
 
 
 // Removes a context element by its key. Purely user-specific or
 // library-specific.
 func (attendant *Attendant) RemoveContext(key string) {
+	attendant.contextMutex.Lock()
+	defer attendant.contextMutex.Unlock()
 	delete(attendant.context, key)
+	delete(attendant.contextDeadlines, key)
+}
+
+
+// Returns a shallow copy of the whole context. It is safe
+// to iterate it while the context keeps changing. Expired
+// elements are removed beforehand.
+func (attendant *Attendant) ContextSnapshot() map[string]interface{} {
+	attendant.expireContext(time.Now())
+	attendant.contextMutex.RLock()
+	defer attendant.contextMutex.RUnlock()
+	snapshot := make(map[string]interface{}, len(attendant.context))
+	for key, value := range attendant.context {
+		snapshot[key] = value
+	}
+	return snapshot
+}
+
+
+// Returns the keys of the context, sorted. Expired elements
+// are removed beforehand.
+func (attendant *Attendant) ContextKeys() []string {
+	attendant.expireContext(time.Now())
+	attendant.contextMutex.RLock()
+	keys := make([]string, 0, len(attendant.context))
+	for key := range attendant.context {
+		keys = append(keys, key)
+	}
+	attendant.contextMutex.RUnlock()
+	sort.Strings(keys)
+	return keys
 }
 
 
 // Gets the throttle time for the current attendant.
 func (attendant *Attendant) Throttle() time.Duration {
-	return attendant.throttle
+	return time.Duration(atomic.LoadInt64(&attendant.throttle))
 }
 
 
 // Sets the throttle time for the current attendant.
 // Negative throttle times will be negated, to positive.
+// It may be called from any goroutine (e.g. a funnel),
+// and the next received message is checked against it.
 func (attendant *Attendant) SetThrottle(throttle time.Duration) {
 	if throttle < 0 {
 		throttle = -throttle
 	}
-	attendant.throttle = throttle
+	atomic.StoreInt64(&attendant.throttle, int64(throttle))
+}
+
+
+func isTimeoutError(err error) bool {
+	var netError net.Error
+	return errors.As(err, &netError) && netError.Timeout()
 }
 
 
 func isClosedSocketError(err error) bool {
-	if opError, ok := err.(*net.OpError); !ok {
-		return false
-	} else {
-		// Notes: this error is literally the polls.ErrNetClosing error,
-		// but it is illegal to import internals/poll.
-		err = opError.Err
-		return err == ErrNetClosing()
-	}
+	// In-memory pipes report their own error.
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
 }
 
 
@@ -290,24 +1073,73 @@ func isClosedSocketError(err error) bool {
 // was told to close beforehand. Received messages will be conveyed
 // via some kind of central message channel.
 func (attendant *Attendant) readLoop() {
-	if attendant.status != AttendantNew {
-		return
+	// The first message must arrive before this deadline
+	// (if any), which is armed right on start.
+	var firstDeadline time.Time
+	if firstTimeout := attendant.FirstMessageTimeout(); firstTimeout > 0 {
+		firstDeadline = time.Now().Add(firstTimeout)
 	}
 
-	// First, the start event
-	attendant.status = AttendantRunning
-	attendant.startedEvent <- AttendantStartedEvent{attendant}
+	// First, the start event (the status is already
+	// Running, since Start made that transition). Nobody
+	// may consume it, so a stop gives up waiting for it.
+	if attendant.unified() {
+		attendant.emitUnified(AttendantStartedEvent{attendant, attendant.id}, attendant.pause.interrupted)
+	} else {
+		select {
+		case attendant.startedEvent <- AttendantStartedEvent{attendant, attendant.id}:
+		case <-attendant.pause.interrupted:
+		}
+	}
 
 	// The stop type for the last event.
 	var stopType AttendantStopType
 	var stopError error
 
 	Loop: for {
-		if message, err, graceful := attendant.wrapper.Receive(); err != nil {
-			if isClosedSocketError(err) {
-				// The socket is closed. That happened
-				// on our side.
-				stopType = AttendantLocalStop
+		// While paused, nothing is received (not even
+		// counted as idle).
+		attendant.waitResumed()
+		idleTimeout := attendant.IdleTimeout()
+		deadline := time.Time{}
+		if idleTimeout > 0 {
+			deadline = time.Now().Add(idleTimeout + attendant.jitterOffset(idleTimeout))
+		}
+		awaitingFirst := !firstDeadline.IsZero() && (deadline.IsZero() || firstDeadline.Before(deadline))
+		if awaitingFirst {
+			deadline = firstDeadline
+		}
+		// noinspection GoUnhandledErrorResult
+		attendant.connection.SetReadDeadline(deadline)
+		if message, err, graceful := attendant.receiver.Receive(); err != nil && isMessageRejection(err) {
+			// Only this message is discarded.
+			attendant.emitMessageRejected(err)
+		} else if err != nil {
+			if graceful {
+				// A half-close of the peer may be told apart,
+				// waiting until our writing side is closed.
+				attendant.awaitHalfClose()
+			}
+			// The flags are set before the socket is closed
+			// on our side, so the reading error is not needed
+			// to tell these cases apart. The stop is claimed
+			// first: if told to stop meanwhile, it wins.
+			if !attendant.claimStop() {
+				// Told to stop.
+				stopType = attendant.localStopType()
+				break Loop
+			} else if abortError := attendant.abortCause(); abortError != nil {
+				// Aborted due to an abnormal cause.
+				stopType = AttendantAbnormalStop
+				stopError = abortError
+				break Loop
+			} else if awaitingFirst && isTimeoutError(err) {
+				// The first message did not arrive in time.
+				stopType = AttendantHandshakeTimeout
+				break Loop
+			} else if idleTimeout > 0 && isTimeoutError(err) {
+				// Nothing arrived in time.
+				stopType = AttendantIdleStop
 				break Loop
 			} else if graceful {
 				// This error is a graceful close.
@@ -322,80 +1154,211 @@ func (attendant *Attendant) readLoop() {
 				break Loop
 			}
 		} else {
-			// The message arrived successfully, but the throttle must be
-			// checked now to tell whether the messageEvent must pass the new
-			// message, or not.
-			if attendant.throttle == 0 {
-				// No throttle is being used right now. It counts as "ok".
-				// Moves the message to the messageEvent channel.
-				attendant.messageEvent <- MessageEvent{attendant, message}
-			} else if attendant.throttleFrom == (time.Time{}) {
-				// Throttle is being used, but this is the first message
-				// being received (no throttle can occur for it). It counts
-				// as "ok" but the current time will be stored for the next
-				// throttle.
-				attendant.throttleFrom = time.Now()
-				attendant.messageEvent <- MessageEvent{attendant, message}
-			} else {
-				// Now a throttle check starts. This means that if the lapse
-				// between the current time and the previous message time is
-				// greater than or equal to the throttle time, it counts as
-				// "ok" but the current time will be stored for the next
-				// throttle check. Otherwise, the message is throttled and
-				// not processed.
-				now := time.Now()
-				lapse := now.Sub(attendant.throttleFrom)
-				if lapse >= attendant.throttle {
-					attendant.throttleFrom = now
-					attendant.messageEvent <- MessageEvent{attendant, message}
+			now := time.Now()
+			atomic.AddUint64(&attendant.stats.messagesIn, 1)
+			atomic.StoreInt64(&attendant.stats.lastReceivedAt, now.UnixNano())
+			attendant.receiveRate.count(now)
+			if attendant.handleKeepalive(message) {
+				// Keepalive messages are not conveyed, and they
+				// are not subject to throttling.
+				continue
+			} else if attendant.handleCloseNotice(message) {
+				// Neither are close notices: their reason is
+				// reported when the peer closes.
+				continue
+			}
+			firstDeadline = time.Time{}
+			if attendant.Draining() {
+				// While draining, messages are discarded.
+				continue
+			}
+			// Until authenticated, messages are only taken
+			// by the authentication handler.
+			if taken, rejection := attendant.authenticate(message); rejection != nil {
+				if attendant.claimStop() {
+					stopType = AttendantAuthRejected
+					stopError = rejection
 				} else {
-					attendant.throttledEvent <- ThrottledEvent{attendant, message, now, lapse}
+					stopType = attendant.localStopType()
 				}
+				break Loop
+			} else if taken {
+				continue
 			}
+			// The message arrived successfully, but the throttle must be
+			// checked now to tell whether the messageEvent must pass the new
+			// message, or not.
+			attendant.convey(message)
 		}
 	}
 
-	attendant.status = AttendantStopped
-	if stopType != AttendantLocalStop {
-		// noinspection GoUnhandledErrorResult
-		attendant.connection.Close()
+	attendant.stopType = stopType
+	attendant.stopError = stopError
+	teardownErrors := attendant.teardown.run()
+	atomic.StoreInt64(&attendant.stats.stoppedAt, time.Now().UnixNano())
+	if stopError != nil {
+		attendant.logger.Warnf("attendant %d stopped (%s): %v", attendant.id, stopType, stopError)
+	} else {
+		attendant.logger.Debugf("attendant %d stopped (%s)", attendant.id, stopType)
+	}
+	for _, err := range teardownErrors {
+		attendant.logger.Errorf("attendant %d teardown failed: %v", attendant.id, err)
+	}
+	var reason *CloseReason
+	if closeReason, ok := attendant.CloseReason(); ok {
+		reason = &closeReason
+	}
+	var stoppedContext map[string]interface{}
+	if attendant.stoppedContext {
+		stoppedContext = attendant.ContextSnapshot()
 	}
-	attendant.stoppedEvent <- AttendantStoppedEvent{attendant, stopType, stopError}
+	identity, _ := attendant.Identity()
+	// Waiters are released even if nobody consumes the
+	// stopped event.
+	close(attendant.done)
+	event := AttendantStoppedEvent{
+		Attendant:      attendant,
+		AttendantID:    attendant.id,
+		StopType:       stopType,
+		Error:          stopError,
+		TeardownErrors: teardownErrors,
+		Stats:          attendant.Stats(),
+		Context:        stoppedContext,
+		Reason:         reason,
+		Identity:       identity,
+	}
+	if attendant.unified() {
+		attendant.emitUnified(event, nil)
+	} else {
+		attendant.stoppedEvent <- event
+	}
+}
+
+
+// Registers a callback to run when the attendant stops, in the
+// given teardown phase. The built-in teardown marks the attendant
+// as stopped (QuiesceReads), runs the stop hooks (PersistHooks,
+// see OnStop), stops sweeping its context and closes the
+// connection if needed (ReleaseResources), and triggers the
+// stopped event at the end of the last phase (EmitStopped).
+// Callbacks must be registered before the attendant stops:
+// otherwise they will never run.
+func (attendant *Attendant) OnTeardown(phase TeardownPhase, callback TeardownFunc) {
+	attendant.teardown.register(phase, callback)
+}
+
+
+// Registers the built-in teardown callbacks of an attendant.
+func (attendant *Attendant) registerTeardown() {
+	attendant.teardown.register(TeardownQuiesceReads, func() error {
+		attendant.transition(AttendantRunning, AttendantStopped)
+		return nil
+	})
+	attendant.teardown.register(TeardownPersistHooks, func() error {
+		return attendant.runStopHooks(attendant.stopType, attendant.stopError)
+	})
+	attendant.teardown.register(TeardownReleaseResources, func() error {
+		attendant.sweeper.untrack(attendant)
+		attendant.coalescer.discard()
+		return nil
+	})
+	attendant.registerLifetimeTeardown()
+	attendant.teardown.register(TeardownReleaseResources, func() error {
+		if attendant.stopType != AttendantLocalStop {
+			// The connection may already be closed, if aborted.
+			if err := attendant.connection.Close(); err != nil && !isClosedSocketError(err) {
+				attendant.resources.addConnections(-1)
+				return err
+			}
+		}
+		attendant.resources.addConnections(-1)
+		return nil
+	})
 }
 
 
-// Creates a new attendant, ready to be used.
-func NewAttendant(connection *net.TCPConn, factory MessageMarshaler, throttle time.Duration,
+// Creates a new attendant, ready to be used. Optional features
+// and events are configured by means of the trailing options.
+func NewAttendant(connection net.Conn, factory MarshalerFactory, throttle time.Duration,
 	              startedEvent chan AttendantStartedEvent, stoppedEvent chan AttendantStoppedEvent,
-	              messageEvent chan MessageEvent, throttledEvent chan ThrottledEvent) *Attendant {
+	              messageEvent chan MessageEvent, throttledEvent chan ThrottledEvent,
+	              options ...AttendantOption) *Attendant {
 	if connection == nil {
 		panic(ArgumentError{"NewAttendant:connection"})
 	}
 	if factory == nil {
 		panic(ArgumentError{"NewAttendant:factory"})
 	}
+	return newAttendant(connection, func(buffer io.ReadWriter) (MessageReceiver, MessageSender) {
+		wrapper := factory.Create(buffer)
+		return wrapper, wrapper
+	}, throttle, startedEvent, stoppedEvent, messageEvent, throttledEvent, options...)
+}
+
+
+// Creates a new attendant, wrapping its (counted, coalesced and
+// buffered) connection with the given function, which returns
+// the receiving and the (optional) sending halves.
+func newAttendant(connection net.Conn, wrap func(io.ReadWriter) (MessageReceiver, MessageSender),
+	              throttle time.Duration, startedEvent chan AttendantStartedEvent,
+	              stoppedEvent chan AttendantStoppedEvent, messageEvent chan MessageEvent,
+	              throttledEvent chan ThrottledEvent, options ...AttendantOption) *Attendant {
 	if throttle < 0 {
 		throttle = -throttle
 	}
-	return &Attendant{
-		connection:     connection,
-		wrapper:        factory.Create(connection),
-		status:         AttendantNew,
-		messageEvent:   messageEvent,
-		startedEvent:   startedEvent,
-		stoppedEvent:   stoppedEvent,
-		context:        make(map[string]interface{}),
-		throttle:       throttle,
-		throttledEvent: throttledEvent,
+	attendant := &Attendant{
+		id:               atomic.AddUint64(&lastAttendantID, 1),
+		connection:       connection,
+		status:           int32(AttendantNew),
+		messageEvent:     messageEvent,
+		startedEvent:     startedEvent,
+		stoppedEvent:     stoppedEvent,
+		sendSlot:         make(chan struct{}, 1),
+		sequences:        make(map[string]*sendSequence),
+		context:          make(map[string]interface{}),
+		throttle:         int64(throttle),
+		throttledEvent:   throttledEvent,
+		commandThrottles: make(map[string]*commandThrottle),
+		pause:            pauseState{interrupted: make(chan struct{})},
+		binding:          eventBinding{rebound: make(chan struct{})},
+		halfClose:        halfCloseState{done: make(chan struct{})},
+		lifetime:         lifetimeState{code: DefaultExpiryCode, text: DefaultExpiryText},
+		sweeper:          defaultContextSweeper,
+		jitter:           DefaultJitterFraction,
+		done:             make(chan struct{}),
+		logger:           nopLogger{},
+	}
+	attendant.registerTeardown()
+	for _, option := range options {
+		option(attendant)
 	}
+	attendant.resources.addConnections(1)
+	counted := countedConnection{connection, &attendant.stats}
+	attendant.coalescer.attendant = attendant
+	attendant.coalescer.target = counted
+	attendant.receiver, attendant.sender = wrap(bufferConnection(
+		coalescedConnection{counted, &attendant.coalescer}, attendant.readBufferSize,
+	))
+	if bandwidth, ok := attendant.receiver.(*BandwidthMarshaler); ok {
+		bandwidth.attendant = attendant
+	}
+	return attendant
 }
 
 
 // Creates an autonomous client (in a context where only one is needed).
-func NewClient(connection *net.TCPConn, factory MessageMarshaler, throttle time.Duration, bufferSize uint) *Attendant {
+// All the optional events are also created, with the same buffer size.
+func NewClient(connection net.Conn, factory MarshalerFactory, throttle time.Duration, bufferSize uint) *Attendant {
 	return NewAttendant(
 		connection, factory, throttle, make(chan AttendantStartedEvent), make(chan AttendantStoppedEvent),
 		make(chan MessageEvent, bufferSize), make(chan ThrottledEvent, bufferSize),
+		WithBandwidthExceededEvent(make(chan BandwidthExceededEvent, bufferSize)),
+		WithEventOverflowEvent(make(chan EventOverflowEvent, bufferSize)),
+		WithAuthenticatedEvent(make(chan AttendantAuthenticatedEvent, bufferSize)),
+		WithSlowConsumerEvent(make(chan SlowConsumerEvent, bufferSize)),
+		WithSendFailedEvent(make(chan SendFailedEvent, bufferSize)),
+		WithUnresponsiveEvent(make(chan AttendantUnresponsiveEvent, bufferSize)),
+		WithMessageRejectedEvent(make(chan MessageRejectedEvent, bufferSize)),
 	)
 }
 
@@ -411,6 +1374,63 @@ type ClientFunnel interface {
 }
 
 
+// Optional interface for client funnels also processing the
+// "bandwidth exceeded" events. Funnels not implementing it
+// will silently discard those events.
+type ClientBandwidthFunnel interface {
+	BandwidthExceeded(*Attendant, Direction, uint64, uint64, time.Duration)
+}
+
+
+// Optional interface for client funnels also processing the
+// "event overflow" events. Funnels not implementing it will
+// silently discard those events.
+type ClientEventOverflowFunnel interface {
+	EventsOverflowed(*Attendant, uint64)
+}
+
+
+// Optional interface for client funnels also processing the
+// "authenticated" events. Funnels not implementing it will
+// silently discard those events.
+type ClientAuthFunnel interface {
+	Authenticated(*Attendant)
+}
+
+
+// Optional interface for client funnels also processing the
+// "slow consumer" events. Funnels not implementing it will
+// silently discard those events.
+type ClientSlowConsumerFunnel interface {
+	SlowConsumer(*Attendant, bool, int, int)
+}
+
+
+// Optional interface for client funnels also processing the
+// "send failed" events. Funnels not implementing it will
+// silently discard those events. The failures are always
+// processed before the stop they may have caused.
+type ClientSendFailedFunnel interface {
+	SendFailed(*Attendant, string, error)
+}
+
+
+// Optional interface for client funnels also processing the
+// "unresponsive" events. Funnels not implementing it will
+// silently discard those events.
+type ClientUnresponsiveFunnel interface {
+	Unresponsive(*Attendant, bool, time.Duration)
+}
+
+
+// Optional interface for client funnels also processing the
+// "message rejected" events. Funnels not implementing it will
+// silently discard those events.
+type ClientMessageRejectedFunnel interface {
+	MessageRejected(*Attendant, error)
+}
+
+
 // Creates a funnel: runs a goroutine dispatching all the events from a client
 // to a given funnel object processing all the events. A funnel may be used by
 // several clients, but care should be taken, for race conditions will not be
@@ -425,7 +1445,7 @@ func FunnelClientWith(client *Attendant, funnel ClientFunnel) {
 		panic(ArgumentError{"Funnel:funnel"})
 	}
 
-	go func(client *Attendant) {
+	client.resources.spawn(func() {
 		Loop: for {
 			select {
 			case event := <-client.StartedEvent():
@@ -434,10 +1454,49 @@ func FunnelClientWith(client *Attendant, funnel ClientFunnel) {
 				funnel.MessageArrived(event.Attendant, event.Message)
 			case event := <-client.ThrottledEvent():
 				funnel.MessageThrottled(event.Attendant, event.Message, event.Instant, event.Lapse)
+			case event := <-client.BandwidthExceededEvent():
+				if bandwidthFunnel, ok := funnel.(ClientBandwidthFunnel); ok {
+					bandwidthFunnel.BandwidthExceeded(event.Attendant, event.Direction, event.Bytes, event.Limit, event.Window)
+				}
+			case event := <-client.EventOverflowEvent():
+				if overflowFunnel, ok := funnel.(ClientEventOverflowFunnel); ok {
+					overflowFunnel.EventsOverflowed(event.Attendant, event.Dropped)
+				}
+			case event := <-client.AuthenticatedEvent():
+				if authFunnel, ok := funnel.(ClientAuthFunnel); ok {
+					authFunnel.Authenticated(event.Attendant)
+				}
+			case event := <-client.SlowConsumerEvent():
+				if slowFunnel, ok := funnel.(ClientSlowConsumerFunnel); ok {
+					slowFunnel.SlowConsumer(event.Attendant, event.Slow, event.PendingSends, event.PendingBytes)
+				}
+			case event := <-client.SendFailedEvent():
+				if sendFailedFunnel, ok := funnel.(ClientSendFailedFunnel); ok {
+					sendFailedFunnel.SendFailed(event.Attendant, event.Command, event.Error)
+				}
+			case event := <-client.UnresponsiveEvent():
+				if unresponsiveFunnel, ok := funnel.(ClientUnresponsiveFunnel); ok {
+					unresponsiveFunnel.Unresponsive(event.Attendant, event.Unresponsive, event.SilentFor)
+				}
+			case event := <-client.MessageRejectedEvent():
+				if rejectedFunnel, ok := funnel.(ClientMessageRejectedFunnel); ok {
+					rejectedFunnel.MessageRejected(event.Attendant, event.Error)
+				}
 			case event := <-client.StoppedEvent():
+				// The pending failures come first.
+				for pending := true; pending; {
+					select {
+					case failed := <-client.SendFailedEvent():
+						if sendFailedFunnel, ok := funnel.(ClientSendFailedFunnel); ok {
+							sendFailedFunnel.SendFailed(failed.Attendant, failed.Command, failed.Error)
+						}
+					default:
+						pending = false
+					}
+				}
 				funnel.Stopped(event.Attendant, event.StopType, event.Error)
 				break Loop
 			}
 		}
-	}(client)
+	})
 }
\ No newline at end of file
@@ -0,0 +1,374 @@
+package chasqui
+
+import (
+	json2 "encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// Creates an attendant over one end of a pipe, with buffered
+// events, and returns the other end (drained in background
+// until closed).
+func newPipeAttendant() (*Attendant, net.Conn, chan AttendantStartedEvent, chan AttendantStoppedEvent) {
+	local, remote := net.Pipe()
+	go func() {
+		// noinspection GoUnhandledErrorResult
+		io.Copy(io.Discard, remote)
+	}()
+	started := make(chan AttendantStartedEvent, 4)
+	stopped := make(chan AttendantStoppedEvent, 4)
+	attendant := NewAttendant(
+		local, &json.JSONMessageMarshaler{}, 0, started, stopped,
+		make(chan MessageEvent, 16), make(chan ThrottledEvent, 16),
+	)
+	return attendant, remote, started, stopped
+}
+
+
+func TestAttendantConcurrentStartSendStop(t *testing.T) {
+	for round := 0; round < 200; round++ {
+		attendant, remote, _, stopped := newPipeAttendant()
+		var starts, localStops int32
+		var group sync.WaitGroup
+		run := func(call func()) {
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				call()
+			}()
+		}
+		for index := 0; index < 2; index++ {
+			run(func() {
+				if attendant.Start() == nil {
+					atomic.AddInt32(&starts, 1)
+				}
+			})
+			run(func() {
+				for sends := 0; sends < 5; sends++ {
+					// noinspection GoUnhandledErrorResult
+					attendant.Send("PING", nil, nil)
+				}
+			})
+			run(func() {
+				if err := attendant.Stop(); err == nil {
+					atomic.AddInt32(&localStops, 1)
+				} else if !errors.Is(err, ErrAttendantStopped) {
+					t.Errorf("round %d: stop: %v", round, err)
+				}
+			})
+		}
+		group.Wait()
+		within(t, 2*time.Second, "Wait", attendant.Wait)
+		// noinspection GoUnhandledErrorResult
+		remote.Close()
+		if starts > 1 {
+			t.Fatalf("round %d: %d starts succeeded", round, starts)
+		}
+		if localStops != 1 {
+			t.Fatalf("round %d: %d stops succeeded", round, localStops)
+		}
+		switch {
+		case starts == 0 && len(stopped) != 0:
+			t.Fatalf("round %d: stopped event for an attendant never started", round)
+		case starts == 1 && len(stopped) != 1:
+			t.Fatalf("round %d: %d stopped events", round, len(stopped))
+		case starts == 1:
+			if event := <-stopped; event.StopType != AttendantLocalStop {
+				t.Fatalf("round %d: stopped as %s, not local", round, event.StopType)
+			}
+		}
+	}
+}
+
+
+func TestAttendantStopRacesPeerClose(t *testing.T) {
+	for round := 0; round < 300; round++ {
+		attendant, remote, started, stopped := newPipeAttendant()
+		if err := attendant.Start(); err != nil {
+			t.Fatal(err)
+		}
+		<-started
+		var stopErr error
+		var group sync.WaitGroup
+		group.Add(2)
+		go func() {
+			defer group.Done()
+			stopErr = attendant.Stop()
+		}()
+		go func() {
+			defer group.Done()
+			// noinspection GoUnhandledErrorResult
+			remote.Close()
+		}()
+		group.Wait()
+		within(t, 2*time.Second, "Wait", attendant.Wait)
+		if len(stopped) != 1 {
+			t.Fatalf("round %d: %d stopped events", round, len(stopped))
+		}
+		event := <-stopped
+		// Local wins the tie: a successful Stop is always
+		// reported as a local stop.
+		if stopErr == nil && event.StopType != AttendantLocalStop {
+			t.Fatalf("round %d: Stop succeeded, but stopped as %s", round, event.StopType)
+		}
+		if stopErr != nil && (!errors.Is(stopErr, ErrAttendantStopped) || event.StopType == AttendantLocalStop) {
+			t.Fatalf("round %d: Stop failed with %v, stopped as %s", round, stopErr, event.StopType)
+		}
+		if err := attendant.Stop(); !errors.Is(err, ErrAttendantStopped) {
+			t.Fatalf("round %d: second Stop returned %v", round, err)
+		}
+	}
+}
+
+
+// Creates a started attendant over one end of a pipe whose
+// other end never reads, so every write blocks.
+func newStalledAttendant(t *testing.T, options ...AttendantOption) (*Attendant, net.Conn) {
+	local, remote := net.Pipe()
+	started := make(chan AttendantStartedEvent, 1)
+	attendant := NewAttendant(
+		local, &json.JSONMessageMarshaler{}, 0, started, make(chan AttendantStoppedEvent, 1),
+		make(chan MessageEvent, 1), make(chan ThrottledEvent, 1), options...,
+	)
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	return attendant, remote
+}
+
+
+func TestTrySendWithoutQueue(t *testing.T) {
+	attendant, remote := newStalledAttendant(t)
+	defer remote.Close()
+	within(t, time.Second, "TrySend", func() {
+		if sent, err := attendant.TrySend("PING", nil, nil); sent || !errors.Is(err, ErrSendQueueRequired) {
+			t.Errorf("TrySend returned %v, %v", sent, err)
+		}
+		if err := attendant.SendWithTimeout(0, "PING", nil, nil); !errors.Is(err, ErrSendQueueRequired) {
+			t.Errorf("SendWithTimeout(0) returned %v", err)
+		}
+	})
+	within(t, time.Second, "SendWithTimeout", func() {
+		if err := attendant.SendWithTimeout(50*time.Millisecond, "PING", nil, nil); !errors.Is(err, ErrSendTimeout) {
+			t.Errorf("SendWithTimeout returned %v", err)
+		}
+	})
+	// noinspection GoUnhandledErrorResult
+	attendant.Stop()
+	within(t, time.Second, "Wait", attendant.Wait)
+}
+
+
+func TestTrySendToStalledPeer(t *testing.T) {
+	attendant, remote := newStalledAttendant(t, WithSendQueue(2, SendQueueBlock))
+	defer remote.Close()
+	sent := 0
+	within(t, time.Second, "TrySend", func() {
+		for index := 0; index < 10; index++ {
+			if ok, err := attendant.TrySend("PING", nil, nil); err != nil {
+				t.Errorf("TrySend %d: %v", index, err)
+			} else if ok {
+				sent++
+			}
+		}
+	})
+	// The queue holds two messages, and the writer may hold
+	// another one, blocked in the write.
+	if sent < 2 || sent > 3 {
+		t.Fatalf("%d messages were queued", sent)
+	}
+	// noinspection GoUnhandledErrorResult
+	attendant.Stop()
+	within(t, time.Second, "Wait", attendant.Wait)
+}
+
+
+func TestSendToUnreadPeerTimesOut(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer listener.Close()
+	// The peer connects, and never reads.
+	peer, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer peer.Close()
+	// noinspection GoUnhandledErrorResult
+	peer.(*net.TCPConn).SetReadBuffer(4096)
+	local, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	local.(*net.TCPConn).SetWriteBuffer(4096)
+	stopped := make(chan AttendantStoppedEvent, 1)
+	attendant := NewAttendant(
+		local, &json.JSONMessageMarshaler{}, 0, make(chan AttendantStartedEvent, 1), stopped,
+		make(chan MessageEvent, 1), make(chan ThrottledEvent, 1),
+	)
+	attendant.SetWriteTimeout(100 * time.Millisecond)
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	payload := strings.Repeat("x", 16 * 1024)
+	within(t, 5*time.Second, "Send", func() {
+		for {
+			start := time.Now()
+			err := attendant.Send("FILL", Args{payload}, nil)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("a send took %v, beyond the write timeout", elapsed)
+				return
+			}
+			if err != nil {
+				if !isTimeoutError(err) {
+					t.Errorf("expected a timeout error, got: %v", err)
+				}
+				return
+			}
+		}
+	})
+	select {
+	case event := <-stopped:
+		if event.StopType != AttendantAbnormalStop || !isTimeoutError(event.Error) {
+			t.Errorf("unexpected stop: %v, %v", event.StopType, event.Error)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the attendant did not stop after the write timeout")
+	}
+	if err := attendant.Send("PING", nil, nil); err == nil {
+		t.Errorf("sends must fail once the attendant stopped")
+	}
+}
+
+
+func TestIdleTimeoutReapsSilentClients(t *testing.T) {
+	server := newTestServer(16, WithIdleTimeout(200 * time.Millisecond))
+	watch := watchServer(server, 4)
+	defer watch.stop()
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer server.Stop()
+	silent, _ := dialTest(t, server.TCPAddr())
+	// noinspection GoUnhandledErrorResult
+	defer silent.Close()
+	active, _ := dialTest(t, server.TCPAddr())
+	// noinspection GoUnhandledErrorResult
+	defer active.Close()
+	for index := 0; index < 2; index++ {
+		<-watch.started
+	}
+	dialed := time.Now()
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			select {
+			case <-quit:
+				return
+			case <-time.After(50 * time.Millisecond):
+				// noinspection GoUnhandledErrorResult
+				active.Write([]byte("{\"C\":\"MOVE\",\"A\":[],\"KWA\":{}}\n"))
+			}
+		}
+	}()
+
+	select {
+	case event := <-watch.stopped:
+		if event.StopType != AttendantIdleStop || event.Attendant.RemoteAddr().String() != silent.LocalAddr().String() {
+			t.Fatalf("unexpected stop: %v of %v", event.StopType, event.Attendant.RemoteAddr())
+		}
+		if elapsed := time.Since(dialed); elapsed < 150 * time.Millisecond {
+			t.Fatalf("the silent client was reaped too early (%v)", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the silent client was not reaped")
+	}
+	// noinspection GoUnhandledErrorResult
+	silent.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the silent connection must be closed, got: %v", err)
+	}
+	select {
+	case event := <-watch.stopped:
+		t.Fatalf("the active client was stopped: %v", event.StopType)
+	case <-time.After(600 * time.Millisecond):
+	}
+}
+
+
+func TestStopWithDeliversTheGoodbyeBeforeEOF(t *testing.T) {
+	for _, variant := range []struct {
+		name      string
+		options   []ServerOption
+		coalesced bool
+	}{
+		{"direct", nil, false},
+		{"queued", []ServerOption{WithAttendantSendQueue(256, SendQueueBlock)}, false},
+		{"coalesced", nil, true},
+	} {
+		t.Run(variant.name, func(t *testing.T) {
+			server := newTestServer(16, variant.options...)
+			watch := watchServer(server, 4)
+			defer watch.stop()
+			if err := server.Run("127.0.0.1:0"); err != nil {
+				t.Fatal(err)
+			}
+			// noinspection GoUnhandledErrorResult
+			defer server.Stop()
+			conn, reader := dialTest(t, server.TCPAddr())
+			// noinspection GoUnhandledErrorResult
+			defer conn.Close()
+			attendant := <-watch.started
+			if variant.coalesced {
+				attendant.SetCoalescing(time.Hour, 1 << 20)
+			}
+			// Pending messages come first, then the goodbye.
+			for index := 0; index < 100; index++ {
+				if err := attendant.Send("UPDATE", Args{index}, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := attendant.StopWith("BYE", Args{"kicked"}, nil); err != nil {
+				t.Fatalf("StopWith: %v", err)
+			}
+			// noinspection GoUnhandledErrorResult
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for index := 0; index <= 100; index++ {
+				line, err := reader.ReadBytes('\n')
+				if err != nil {
+					t.Fatalf("line %d: %v", index, err)
+				}
+				expected := "UPDATE"
+				if index == 100 {
+					expected = "BYE"
+				}
+				if frame := (wireFrame{}); json2.Unmarshal(line, &frame) != nil || frame.C != expected {
+					t.Fatalf("line %d: expected %s, got %s", index, expected, line)
+				}
+			}
+			if _, err := reader.ReadByte(); err != io.EOF {
+				t.Fatalf("expected EOF after the goodbye, got: %v", err)
+			}
+			if event := <-watch.stopped; event.StopType != AttendantLocalStop {
+				t.Fatalf("expected a local stop, got: %v, %v", event.StopType, event.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package chasqui
+
+import (
+	"fmt"
+	. "github.com/universe-10th/chasqui/types"
+	"sync/atomic"
+)
+
+
+// The command of the notice sent to the attendants whose
+// authentication was rejected (if enabled). Its "reason"
+// kwarg tells why.
+const AuthRejectedCommand = "__AUTH_REJECTED"
+
+
+// Authentication handlers take each message received by an
+// attendant until it is authenticated, and tell whether it
+// is accepted (authenticating the attendant) or rejected
+// (stopping it, with the given reason). They run in the
+// read loop of the attendant, so nothing else is received
+// meanwhile.
+type AuthHandler func(*Attendant, Message) (bool, string)
+
+
+// Error reported when an attendant is stopped because its
+// authentication was rejected.
+type AuthRejectedError struct {
+	Reason string
+}
+
+
+// The error message.
+func (err AuthRejectedError) Error() string {
+	return fmt.Sprintf("authentication rejected: %s", err.Reason)
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err AuthRejectedError) Is(target error) bool {
+	return target == ErrAuthRejected
+}
+
+
+// Event reporting an attendant was just authenticated. The
+// messages flow normally from now on.
+type AttendantAuthenticatedEvent struct {
+	Attendant   *Attendant
+	AttendantID uint64
+}
+
+
+// The authentication state of an attendant: the handler (nil
+// means no authentication phase), whether a notice is sent
+// on rejection, and whether it is authenticated already.
+type authState struct {
+	handler       AuthHandler
+	notify        bool
+	authenticated int32
+}
+
+
+// Tells whether the attendant is authenticated. Attendants
+// without an authentication phase are always authenticated.
+func (attendant *Attendant) Authenticated() bool {
+	return attendant.auth.handler == nil || atomic.LoadInt32(&attendant.auth.authenticated) == 1
+}
+
+
+// Returns a read-only channel with all the "authenticated"
+// events. It will be nil unless a channel was given on
+// construction.
+func (attendant *Attendant) AuthenticatedEvent() <-chan AttendantAuthenticatedEvent {
+	return attendant.authenticatedEvent
+}
+
+
+// Routes a message to the authentication handler, if the
+// attendant is not authenticated yet. Returns whether the
+// message was taken by the handler, and the rejection error
+// (which must stop the attendant), if any.
+func (attendant *Attendant) authenticate(message Message) (bool, error) {
+	if attendant.Authenticated() {
+		return false, nil
+	}
+	if accepted, reason := attendant.auth.handler(attendant, message); !accepted {
+		if attendant.auth.notify {
+			timeout := attendant.WriteTimeout()
+			if timeout == 0 {
+				timeout = DefaultFarewellTimeout
+			}
+			// noinspection GoUnhandledErrorResult
+			attendant.sendFlushed(timeout, AuthRejectedCommand, Args{}, KWArgs{"reason": reason})
+		}
+		return true, AuthRejectedError{reason}
+	}
+	atomic.StoreInt32(&attendant.auth.authenticated, 1)
+	if attendant.unified() {
+		attendant.emitUnified(AttendantAuthenticatedEvent{attendant, attendant.id}, attendant.pause.interrupted)
+	} else if attendant.authenticatedEvent != nil {
+		select {
+		case attendant.authenticatedEvent <- AttendantAuthenticatedEvent{attendant, attendant.id}:
+		case <-attendant.pause.interrupted:
+		}
+	}
+	return true, nil
+}
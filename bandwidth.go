@@ -0,0 +1,326 @@
+package chasqui
+
+import (
+	"fmt"
+	. "github.com/universe-10th/chasqui/types"
+	"io"
+	"sync"
+	"time"
+)
+
+
+// Error raised when the bandwidth of an attendant exceeds
+// the configured limit and the bandwidth marshaler was told
+// to close the connection in that case.
+type BandwidthExceededError struct {
+	Direction Direction
+	Bytes     uint64
+	Limit     uint64
+	Window    time.Duration
+}
+
+
+// The error message.
+func (err BandwidthExceededError) Error() string {
+	return fmt.Sprintf("%s bandwidth exceeded: %d bytes in %s (limit: %d)", err.Direction, err.Bytes, err.Window, err.Limit)
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err BandwidthExceededError) Is(target error) bool {
+	return target == ErrBandwidthExceeded
+}
+
+
+// BandwidthExceededEvent events come in another kind of structure:
+// The structure will hold the attendant exceeding the bandwidth,
+// the traffic direction, the amount of bytes in the window, and
+// the limit and window being configured.
+type BandwidthExceededEvent struct {
+	Attendant *Attendant
+	Direction Direction
+	Bytes     uint64
+	Limit     uint64
+	Window    time.Duration
+}
+
+
+// A timestamped amount of transferred bytes.
+type bandwidthSample struct {
+	instant time.Time
+	bytes   uint64
+}
+
+
+// A sliding window of transferred bytes. It also remembers
+// whether the limit was already reported, so an event is
+// only triggered when the limit is crossed.
+type bandwidthWindow struct {
+	samples  []bandwidthSample
+	total    uint64
+	exceeded bool
+}
+
+
+// Adds bytes to the window.
+func (window *bandwidthWindow) add(now time.Time, bytes uint64) {
+	window.samples = append(window.samples, bandwidthSample{now, bytes})
+	window.total += bytes
+}
+
+
+// Forgets the samples older than the window.
+func (window *bandwidthWindow) prune(now time.Time, duration time.Duration) {
+	threshold := now.Add(-duration)
+	index := 0
+	for index < len(window.samples) && window.samples[index].instant.Before(threshold) {
+		window.total -= window.samples[index].bytes
+		index++
+	}
+	if index > 0 {
+		window.samples = append(window.samples[:0], window.samples[index:]...)
+	}
+}
+
+
+// Counts the bytes going through a read-writer.
+type countingReadWriter struct {
+	buffer  io.ReadWriter
+	onRead  func(int)
+	onWrite func(int)
+}
+
+
+// Reads and counts the read bytes.
+func (counter *countingReadWriter) Read(data []byte) (int, error) {
+	n, err := counter.buffer.Read(data)
+	if n > 0 {
+		counter.onRead(n)
+	}
+	return n, err
+}
+
+
+// Writes and counts the written bytes.
+func (counter *countingReadWriter) Write(data []byte) (int, error) {
+	n, err := counter.buffer.Write(data)
+	if n > 0 {
+		counter.onWrite(n)
+	}
+	return n, err
+}
+
+
+// Wraps another marshaler factory, measuring the bytes per
+// second in both directions over a sliding window. When the
+// bytes in the window exceed the inbound or outbound limit
+// (zero means no limit), a BandwidthExceededEvent is emitted
+// through the attendant, and the connection is optionally
+// closed with an abnormal stop.
+//
+// This marshaler must be the outermost one given to the
+// attendant (or server), so the attendant can find it. Its
+// window and limits can be changed at runtime, per attendant,
+// by means of Attendant.Bandwidth().
+type BandwidthMarshaler struct {
+	factory       MarshalerFactory
+	inner         MessageMarshaler
+	attendant     *Attendant
+	mutex         sync.Mutex
+	window        time.Duration
+	inboundLimit  uint64
+	outboundLimit uint64
+	closeOnExceed bool
+	inbound       bandwidthWindow
+	outbound      bandwidthWindow
+}
+
+
+// Receives a message from the wrapped marshaler, and then
+// checks the inbound bandwidth.
+func (marshaler *BandwidthMarshaler) Receive() (Message, error, bool) {
+	message, err, graceful := marshaler.inner.Receive()
+	if err != nil {
+		return message, err, graceful
+	}
+	if err := marshaler.check(Inbound); err != nil {
+		return nil, err, false
+	}
+	return message, nil, false
+}
+
+
+// The size of the last message received by the wrapped
+// marshaler, if it can tell it (0 otherwise).
+func (marshaler *BandwidthMarshaler) LastFrameSize() int {
+	if sizer, ok := marshaler.inner.(FrameSizer); ok {
+		return sizer.LastFrameSize()
+	}
+	return 0
+}
+
+
+// Sends a message via the wrapped marshaler, and then checks
+// the outbound bandwidth.
+func (marshaler *BandwidthMarshaler) Send(command string, args Args, kwargs KWArgs) error {
+	if err := marshaler.inner.Send(command, args, kwargs); err != nil {
+		return err
+	}
+	if err := marshaler.check(Outbound); err != nil {
+		if marshaler.attendant != nil {
+			marshaler.attendant.abort(err)
+		}
+		return err
+	}
+	return nil
+}
+
+
+// Accounts transferred bytes in a direction.
+func (marshaler *BandwidthMarshaler) count(direction Direction, bytes int) {
+	marshaler.mutex.Lock()
+	defer marshaler.mutex.Unlock()
+	if direction == Inbound {
+		marshaler.inbound.add(time.Now(), uint64(bytes))
+	} else {
+		marshaler.outbound.add(time.Now(), uint64(bytes))
+	}
+}
+
+
+// Checks the bandwidth in a direction, triggering the event
+// when the limit is crossed. Returns an error only when the
+// limit is exceeded and the connection must be closed.
+func (marshaler *BandwidthMarshaler) check(direction Direction) error {
+	marshaler.mutex.Lock()
+	window, limit := &marshaler.inbound, marshaler.inboundLimit
+	if direction == Outbound {
+		window, limit = &marshaler.outbound, marshaler.outboundLimit
+	}
+	window.prune(time.Now(), marshaler.window)
+	if limit == 0 || window.total <= limit {
+		window.exceeded = false
+		marshaler.mutex.Unlock()
+		return nil
+	}
+	report := !window.exceeded
+	window.exceeded = true
+	bytes, duration, closeOnExceed := window.total, marshaler.window, marshaler.closeOnExceed
+	marshaler.mutex.Unlock()
+
+	if report && marshaler.attendant != nil {
+		marshaler.attendant.emitBandwidthExceeded(BandwidthExceededEvent{marshaler.attendant, direction, bytes, limit, duration})
+	}
+	if closeOnExceed {
+		return BandwidthExceededError{direction, bytes, limit, duration}
+	}
+	return nil
+}
+
+
+// Gets the sliding window duration.
+func (marshaler *BandwidthMarshaler) Window() time.Duration {
+	marshaler.mutex.Lock()
+	defer marshaler.mutex.Unlock()
+	return marshaler.window
+}
+
+
+// Sets the sliding window duration. Non-positive durations
+// are ignored.
+func (marshaler *BandwidthMarshaler) SetWindow(window time.Duration) {
+	if window > 0 {
+		marshaler.mutex.Lock()
+		defer marshaler.mutex.Unlock()
+		marshaler.window = window
+	}
+}
+
+
+// Gets the inbound and outbound limits, in bytes per window.
+func (marshaler *BandwidthMarshaler) Limits() (uint64, uint64) {
+	marshaler.mutex.Lock()
+	defer marshaler.mutex.Unlock()
+	return marshaler.inboundLimit, marshaler.outboundLimit
+}
+
+
+// Sets the inbound and outbound limits, in bytes per window.
+// Zero means no limit.
+func (marshaler *BandwidthMarshaler) SetLimits(inbound, outbound uint64) {
+	marshaler.mutex.Lock()
+	defer marshaler.mutex.Unlock()
+	marshaler.inboundLimit = inbound
+	marshaler.outboundLimit = outbound
+}
+
+
+// Tells whether the connection is closed when a limit is
+// exceeded.
+func (marshaler *BandwidthMarshaler) CloseOnExceed() bool {
+	marshaler.mutex.Lock()
+	defer marshaler.mutex.Unlock()
+	return marshaler.closeOnExceed
+}
+
+
+// Sets whether the connection is closed when a limit is
+// exceeded.
+func (marshaler *BandwidthMarshaler) SetCloseOnExceed(closeOnExceed bool) {
+	marshaler.mutex.Lock()
+	defer marshaler.mutex.Unlock()
+	marshaler.closeOnExceed = closeOnExceed
+}
+
+
+// Gets the bytes currently in the inbound and outbound
+// windows.
+func (marshaler *BandwidthMarshaler) Usage() (uint64, uint64) {
+	marshaler.mutex.Lock()
+	defer marshaler.mutex.Unlock()
+	now := time.Now()
+	marshaler.inbound.prune(now, marshaler.window)
+	marshaler.outbound.prune(now, marshaler.window)
+	return marshaler.inbound.total, marshaler.outbound.total
+}
+
+
+// Creates a new bandwidth marshaler around a buffer (socket,
+// most likely), wrapping a new instance of the inner one and
+// keeping the settings of this instance.
+func (marshaler *BandwidthMarshaler) Create(buffer io.ReadWriter) MessageMarshaler {
+	created := &BandwidthMarshaler{
+		factory:       marshaler.factory,
+		window:        marshaler.Window(),
+		closeOnExceed: marshaler.CloseOnExceed(),
+	}
+	created.inboundLimit, created.outboundLimit = marshaler.Limits()
+	created.inner = marshaler.factory.Create(&countingReadWriter{
+		buffer:  buffer,
+		onRead:  func(n int) { created.count(Inbound, n) },
+		onWrite: func(n int) { created.count(Outbound, n) },
+	})
+	return created
+}
+
+
+// Creates a new bandwidth marshaler factory, wrapping another
+// factory, with a sliding window, inbound and outbound limits
+// (in bytes per window, zero meaning no limit), and whether
+// the connection is closed when a limit is exceeded.
+func NewBandwidthMarshaler(factory MarshalerFactory, window time.Duration, inboundLimit, outboundLimit uint64,
+	                       closeOnExceed bool) *BandwidthMarshaler {
+	if factory == nil {
+		panic(ArgumentError{"NewBandwidthMarshaler:factory"})
+	}
+	if window <= 0 {
+		panic(ArgumentError{"NewBandwidthMarshaler:window"})
+	}
+	return &BandwidthMarshaler{
+		factory:       factory,
+		window:        window,
+		inboundLimit:  inboundLimit,
+		outboundLimit: outboundLimit,
+		closeOnExceed: closeOnExceed,
+	}
+}
@@ -0,0 +1,180 @@
+package chasqui
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// An attendant over a pipe, measuring its bandwidth, and the
+// other end of the pipe.
+type bandwidthHarness struct {
+	attendant *Attendant
+	remote    net.Conn
+	messages  chan MessageEvent
+	exceeded  chan BandwidthExceededEvent
+	stopped   chan AttendantStoppedEvent
+}
+
+
+func newBandwidthHarness(t *testing.T, inboundLimit, outboundLimit uint64, closeOnExceed bool) *bandwidthHarness {
+	local, remote := net.Pipe()
+	harness := &bandwidthHarness{
+		remote:   remote,
+		messages: make(chan MessageEvent, 16),
+		exceeded: make(chan BandwidthExceededEvent, 16),
+		stopped:  make(chan AttendantStoppedEvent, 1),
+	}
+	harness.attendant = NewAttendant(
+		local, NewBandwidthMarshaler(&json.JSONMessageMarshaler{}, time.Minute, inboundLimit, outboundLimit, closeOnExceed),
+		0, make(chan AttendantStartedEvent, 1), harness.stopped, harness.messages,
+		make(chan ThrottledEvent, 16), WithBandwidthExceededEvent(harness.exceeded),
+	)
+	if err := harness.attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// noinspection GoUnhandledErrorResult
+		remote.Close()
+		// noinspection GoUnhandledErrorResult
+		harness.attendant.Stop()
+	})
+	return harness
+}
+
+
+// Writes a message from the peer, waiting until the attendant
+// receives it. Returns the size of the written frame.
+func (harness *bandwidthHarness) push(t *testing.T, command string, args Args) uint64 {
+	frame := jsonFrame(t, command, args)
+	if _, err := harness.remote.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-harness.messages:
+	case <-time.After(time.Second):
+		t.Fatalf("the attendant did not receive %s", command)
+	}
+	return uint64(len(frame))
+}
+
+
+// Encodes a message as the JSON marshaler does.
+func jsonFrame(t *testing.T, command string, args Args) []byte {
+	encoded := &encodingConnection{}
+	if err := (&json.JSONMessageMarshaler{}).Create(encoded).Send(command, args, nil); err != nil {
+		t.Fatal(err)
+	}
+	return encoded.Bytes()
+}
+
+
+func TestBandwidthInboundBurst(t *testing.T) {
+	harness := newBandwidthHarness(t, 1000, 0, false)
+	payload := Args{string(make([]byte, 200))}
+	total := uint64(0)
+	for total <= 1000 {
+		total += harness.push(t, "BURST", payload)
+	}
+	select {
+	case event := <-harness.exceeded:
+		if event.Direction != Inbound || event.Bytes != total || event.Limit != 1000 || event.Window != time.Minute {
+			t.Fatalf("unexpected event: %+v (expected %d bytes)", event, total)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no bandwidth exceeded event")
+	}
+	// The limit is reported once, while it stays exceeded.
+	total += harness.push(t, "BURST", payload)
+	select {
+	case event := <-harness.exceeded:
+		t.Fatalf("unexpected second event: %+v", event)
+	default:
+	}
+	marshaler, _ := harness.attendant.Bandwidth()
+	if inbound, outbound := marshaler.Usage(); inbound != total || outbound != 0 {
+		t.Fatalf("unexpected usage: %d, %d (expected %d, 0)", inbound, outbound, total)
+	}
+}
+
+
+func TestBandwidthOutboundBurst(t *testing.T) {
+	harness := newBandwidthHarness(t, 0, 500, false)
+	go func() {
+		// noinspection GoUnhandledErrorResult
+		io.Copy(io.Discard, harness.remote)
+	}()
+	payload := Args{string(make([]byte, 100))}
+	frameSize := uint64(len(jsonFrame(t, "BURST", payload)))
+	total := uint64(0)
+	for total <= 500 {
+		if err := harness.attendant.Send("BURST", payload, nil); err != nil {
+			t.Fatal(err)
+		}
+		total += frameSize
+	}
+	select {
+	case event := <-harness.exceeded:
+		if event.Direction != Outbound || event.Bytes != total || event.Limit != 500 {
+			t.Fatalf("unexpected event: %+v (expected %d bytes)", event, total)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no bandwidth exceeded event")
+	}
+}
+
+
+func TestBandwidthLimitsAtRuntime(t *testing.T) {
+	harness := newBandwidthHarness(t, 1000, 0, false)
+	marshaler, ok := harness.attendant.Bandwidth()
+	if !ok {
+		t.Fatal("the attendant has no bandwidth marshaler")
+	}
+	marshaler.SetLimits(10000, 0)
+	payload := Args{string(make([]byte, 200))}
+	total := uint64(0)
+	for total <= 1000 {
+		total += harness.push(t, "BURST", payload)
+	}
+	select {
+	case event := <-harness.exceeded:
+		t.Fatalf("the raised limit must not be exceeded: %+v", event)
+	default:
+	}
+	// Shrinking the window forgets the old traffic.
+	marshaler.SetWindow(time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if inbound, _ := marshaler.Usage(); inbound != 0 {
+		t.Fatalf("the old traffic must be out of the window, but %d bytes remain", inbound)
+	}
+}
+
+
+func TestBandwidthCloseOnExceed(t *testing.T) {
+	harness := newBandwidthHarness(t, 100, 0, true)
+	frame := jsonFrame(t, "BURST", Args{string(make([]byte, 200))})
+	if _, err := harness.remote.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-harness.stopped:
+		var exceeded BandwidthExceededError
+		if event.StopType != AttendantAbnormalStop || !errors.Is(event.Error, ErrBandwidthExceeded) ||
+			!errors.As(event.Error, &exceeded) || exceeded.Bytes != uint64(len(frame)) {
+			t.Fatalf("unexpected stop: %v, %v", event.StopType, event.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the attendant did not stop")
+	}
+	select {
+	case <-harness.messages:
+		t.Fatal("the exceeding message must not be delivered")
+	default:
+	}
+}
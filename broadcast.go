@@ -0,0 +1,52 @@
+package chasqui
+
+import (
+	"errors"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// A failed send of a broadcast: the ID of the attendant, and
+// the send error.
+type BroadcastFailure struct {
+	AttendantID uint64
+	Err         error
+}
+
+
+// The result of a broadcast: how many attendants were running
+// when it started (targeted), how many sends succeeded, how
+// many attendants were skipped because they stopped meanwhile,
+// and the failed sends (in no particular order).
+type BroadcastResult struct {
+	Targeted  int
+	Succeeded int
+	Skipped   int
+	Failures  []BroadcastFailure
+}
+
+
+// Sends a message to all the running attendants (a snapshot
+// of them, taken when called), as Send does. Attendants which
+// stop meanwhile are skipped, instead of being told as
+// failures. It may be called from any goroutine.
+func (server *Server) Broadcast(command string, args Args, kwargs KWArgs) BroadcastResult {
+	return broadcastTo(server.snapshotAttendants(), command, args, kwargs)
+}
+
+
+// Sends a message to each of the given attendants, telling the
+// ones which stopped meanwhile as skipped.
+func broadcastTo(attendants []*Attendant, command string, args Args, kwargs KWArgs) BroadcastResult {
+	result := BroadcastResult{Targeted: len(attendants)}
+	for _, attendant := range attendants {
+		if err := attendant.Send(command, args, kwargs); err == nil {
+			result.Succeeded++
+		} else if errors.Is(err, ErrAttendantStopped) {
+			result.Skipped++
+		} else {
+			result.Failures = append(result.Failures, BroadcastFailure{attendant.id, err})
+		}
+	}
+	return result
+}
@@ -0,0 +1,189 @@
+package chasqui
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+)
+
+
+// A connection refusing every write.
+type refusingConn struct {
+	net.Conn
+}
+
+
+var errWriteRefused = errors.New("write refused")
+
+
+func (refusingConn) Write([]byte) (int, error) {
+	return 0, errWriteRefused
+}
+
+
+func TestBroadcastClassification(t *testing.T) {
+	server := newTestServer(1)
+	running, runningRemote, started, _ := newPipeAttendant()
+	stopped, _, _, _ := newPipeAttendant()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	refusing := NewAttendant(
+		refusingConn{local}, &json.JSONMessageMarshaler{}, 0, make(chan AttendantStartedEvent, 1),
+		make(chan AttendantStoppedEvent, 1), make(chan MessageEvent, 1), make(chan ThrottledEvent, 1),
+	)
+	for _, attendant := range []*Attendant{running, stopped, refusing} {
+		if err := attendant.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-started
+	// noinspection GoUnhandledErrorResult
+	stopped.Stop()
+	within(t, 2*time.Second, "Wait", stopped.Wait)
+	server.attendants = Attendants{running: true, stopped: true, refusing: true}
+
+	result := server.Broadcast("HELLO", nil, nil)
+	if result.Targeted != 3 || result.Succeeded != 1 || result.Skipped != 1 || len(result.Failures) != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if failure := result.Failures[0]; failure.AttendantID != refusing.ID() || !errors.Is(failure.Err, errWriteRefused) {
+		t.Fatalf("unexpected failure: %+v", failure)
+	}
+	for _, attendant := range []*Attendant{running, refusing} {
+		// noinspection GoUnhandledErrorResult
+		attendant.Stop()
+		within(t, 2*time.Second, "Wait", attendant.Wait)
+	}
+	// noinspection GoUnhandledErrorResult
+	runningRemote.Close()
+}
+
+
+func TestBroadcastTaggedClassification(t *testing.T) {
+	server := newTestServer(1)
+	newTagged := func(conn net.Conn, tags ...string) *Attendant {
+		attendant := NewAttendant(
+			conn, &json.JSONMessageMarshaler{}, 0, make(chan AttendantStartedEvent, 1),
+			make(chan AttendantStoppedEvent, 1), make(chan MessageEvent, 1), make(chan ThrottledEvent, 1),
+			withTagIndex(&server.tags),
+		)
+		for _, tag := range tags {
+			attendant.AddTag(tag)
+		}
+		return attendant
+	}
+	pipe := func() net.Conn {
+		local, remote := net.Pipe()
+		t.Cleanup(func() {
+			// noinspection GoUnhandledErrorResult
+			remote.Close()
+		})
+		go func() {
+			// noinspection GoUnhandledErrorResult
+			io.Copy(io.Discard, remote)
+		}()
+		return local
+	}
+	running := newTagged(pipe(), "room:lobby")
+	stopped := newTagged(pipe(), "room:lobby")
+	refusing := newTagged(refusingConn{pipe()}, "room:lobby")
+	untagged := newTagged(pipe(), "room:game")
+	for _, attendant := range []*Attendant{running, stopped, refusing, untagged} {
+		if err := attendant.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// noinspection GoUnhandledErrorResult
+	stopped.Stop()
+	within(t, 2*time.Second, "Wait", stopped.Wait)
+
+	result := server.BroadcastTagged("room:lobby", "HELLO", nil, nil)
+	if result.Targeted != 3 || result.Succeeded != 1 || result.Skipped != 1 || len(result.Failures) != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if failure := result.Failures[0]; failure.AttendantID != refusing.ID() || !errors.Is(failure.Err, errWriteRefused) {
+		t.Fatalf("unexpected failure: %+v", failure)
+	}
+	if result := server.BroadcastTagged("room:none", "HELLO", nil, nil); result.Targeted != 0 || result.Failures != nil {
+		t.Fatalf("an unused tag must target nobody: %+v", result)
+	}
+	for _, attendant := range []*Attendant{running, refusing, untagged} {
+		// noinspection GoUnhandledErrorResult
+		attendant.Stop()
+		within(t, 2*time.Second, "Wait", attendant.Wait)
+	}
+}
+
+func TestBroadcastWhileDisconnecting(t *testing.T) {
+	const clients = 100
+	const leaving = 30
+	server := newTestServer(clients)
+	stop := consumeEvents(server)
+	defer stop()
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		within(t, 5*time.Second, "Stop", func() {
+			// noinspection GoUnhandledErrorResult
+			server.Stop()
+		})
+	}()
+	conns := make([]net.Conn, clients)
+	for index := range conns {
+		conn, _ := dialTest(t, server.TCPAddr())
+		defer conn.Close()
+		conns[index] = conn
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.snapshotAttendants()) < clients {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d attendants started", len(server.snapshotAttendants()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// The staying clients read the broadcast in background.
+	var received sync.WaitGroup
+	received.Add(clients - leaving)
+	for _, conn := range conns[leaving:] {
+		conn := conn
+		go func() {
+			defer received.Done()
+			// noinspection GoUnhandledErrorResult
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buffer := make([]byte, 256)
+			if n, err := conn.Read(buffer); err != nil || !strings.Contains(string(buffer[:n]), "SHOUT") {
+				t.Errorf("staying client got %q (%v)", buffer[:n], err)
+			}
+		}()
+	}
+	var closing sync.WaitGroup
+	closing.Add(leaving)
+	for _, conn := range conns[:leaving] {
+		conn := conn
+		go func() {
+			defer closing.Done()
+			// noinspection GoUnhandledErrorResult
+			conn.Close()
+		}()
+	}
+	result := server.Broadcast("SHOUT", nil, nil)
+	closing.Wait()
+	if result.Targeted != clients {
+		t.Fatalf("targeted %d attendants", result.Targeted)
+	}
+	if total := result.Succeeded + result.Skipped + len(result.Failures); total != result.Targeted {
+		t.Fatalf("%+v does not add up", result)
+	}
+	if result.Succeeded < clients-leaving || len(result.Failures) > leaving {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	within(t, 5*time.Second, "staying clients", received.Wait)
+}
@@ -0,0 +1,94 @@
+package chasqui
+
+import (
+	"encoding/json"
+	. "github.com/universe-10th/chasqui/types"
+	"sync"
+)
+
+
+// The reserved command of the notice telling the peer why the
+// connection is being closed. Its "code" and "text" kwargs
+// tell the reason.
+const CloseCommand = "__CLOSE"
+
+
+// The reason a peer gave when closing the connection (see
+// Attendant.StopWithReason). Codes are application-specific.
+type CloseReason struct {
+	Code int
+	Text string
+}
+
+
+// The close reason received from the peer, if any.
+type closeReasonState struct {
+	mutex  sync.Mutex
+	reason *CloseReason
+}
+
+
+// Sends a close notice with the given reason, and then stops
+// the attendant as StopWith does (the wait is bounded, and the
+// attendant is stopped anyway). Attendants on the other side
+// report the reason in their stopped event.
+func (attendant *Attendant) StopWithReason(code int, text string) error {
+	return attendant.StopWith(CloseCommand, Args{}, KWArgs{"code": code, "text": text})
+}
+
+
+// Returns the close reason received from the peer, if any.
+func (attendant *Attendant) CloseReason() (CloseReason, bool) {
+	attendant.closeReason.mutex.Lock()
+	defer attendant.closeReason.mutex.Unlock()
+	if attendant.closeReason.reason == nil {
+		return CloseReason{}, false
+	}
+	return *attendant.closeReason.reason, true
+}
+
+
+// Handles the close notices. Returns true if the given message
+// was a close notice (which must not be conveyed as a regular
+// message), keeping its reason.
+func (attendant *Attendant) handleCloseNotice(message Message) bool {
+	if message.Command() != CloseCommand {
+		return false
+	}
+	kwargs := message.KWArgs()
+	reason := &CloseReason{Code: closeCode(kwargs["code"])}
+	reason.Text, _ = kwargs["text"].(string)
+	attendant.closeReason.mutex.Lock()
+	defer attendant.closeReason.mutex.Unlock()
+	attendant.closeReason.reason = reason
+	return true
+}
+
+
+// Gets the close code from any numeric value (each marshaler
+// decodes numbers its own way). Other values give 0.
+func closeCode(value interface{}) int {
+	switch typed := value.(type) {
+	case int:
+		return typed
+	case int32:
+		return int(typed)
+	case int64:
+		return int(typed)
+	case uint:
+		return int(typed)
+	case uint32:
+		return int(typed)
+	case uint64:
+		return int(typed)
+	case float32:
+		return int(typed)
+	case float64:
+		return int(typed)
+	case json.Number:
+		code, _ := typed.Int64()
+		return int(code)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,210 @@
+package chasqui
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+
+// The size the coalescing buffer is flushed at, when none
+// is given.
+const DefaultCoalescingBytes = 16 * 1024
+
+
+// The coalescing state of an attendant: while the window is
+// positive, the written data is kept in a buffer, which is
+// flushed to the connection once the window elapses (since
+// the first pending write), once it reaches the maximum size,
+// or when explicitly told to. The frames stay intact, since
+// the data is flushed in the order it was written.
+type coalescer struct {
+	mutex     sync.Mutex
+	attendant *Attendant
+	target    io.Writer
+	window    time.Duration
+	maxBytes  int
+	buffer    []byte
+	timer     *time.Timer
+	armed     bool
+}
+
+
+// A connection whose writes go through the coalescer.
+type coalescedConnection struct {
+	io.Reader
+	coalescer *coalescer
+}
+
+
+// Writes through the coalescer.
+func (connection coalescedConnection) Write(data []byte) (int, error) {
+	return connection.coalescer.write(data)
+}
+
+
+// Returns the remote address of the connection, so the wrapped
+// marshalers may still tell it (e.g. to log it).
+func (connection coalescedConnection) RemoteAddr() net.Addr {
+	return remoteAddrOf(connection.Reader)
+}
+
+
+// Writes the data, either right away (when not coalescing) or
+// to the buffer (flushing it if it reaches the maximum size).
+func (coalescer *coalescer) write(data []byte) (int, error) {
+	coalescer.mutex.Lock()
+	defer coalescer.mutex.Unlock()
+	if coalescer.window == 0 {
+		if err := coalescer.flushLocked(); err != nil {
+			return 0, err
+		}
+		return coalescer.target.Write(data)
+	}
+	coalescer.buffer = append(coalescer.buffer, data...)
+	if len(coalescer.buffer) >= coalescer.maxBytes {
+		if err := coalescer.flushLocked(); err != nil {
+			return 0, err
+		}
+	} else if !coalescer.armed {
+		coalescer.armed = true
+		coalescer.attendant.resources.addTimers(1)
+		coalescer.timer = time.AfterFunc(coalescer.window, coalescer.elapsed)
+	}
+	return len(data), nil
+}
+
+
+// Flushes the buffer once the window elapsed.
+func (coalescer *coalescer) elapsed() {
+	coalescer.attendant.resources.addTimers(-1)
+	// noinspection GoUnhandledErrorResult
+	coalescer.attendant.Flush()
+}
+
+
+// Disarms the window timer, if armed. The coalescer mutex
+// must be held.
+func (coalescer *coalescer) disarmLocked() {
+	if coalescer.armed {
+		coalescer.armed = false
+		if coalescer.timer.Stop() {
+			// Otherwise, the timer fired and accounts for
+			// itself.
+			coalescer.attendant.resources.addTimers(-1)
+		}
+	}
+}
+
+
+// Writes the buffered data to the connection. The coalescer
+// mutex must be held.
+func (coalescer *coalescer) flushLocked() error {
+	coalescer.disarmLocked()
+	if len(coalescer.buffer) == 0 {
+		return nil
+	}
+	_, err := coalescer.target.Write(coalescer.buffer)
+	coalescer.buffer = coalescer.buffer[:0]
+	return err
+}
+
+
+// Tells whether there is buffered data.
+func (coalescer *coalescer) pending() bool {
+	coalescer.mutex.Lock()
+	defer coalescer.mutex.Unlock()
+	return len(coalescer.buffer) > 0
+}
+
+
+// Discards the buffered data, once the attendant stopped.
+func (coalescer *coalescer) discard() {
+	coalescer.mutex.Lock()
+	defer coalescer.mutex.Unlock()
+	coalescer.disarmLocked()
+	coalescer.buffer = nil
+}
+
+
+// Enables (with a positive window) or disables the coalescing
+// of the writes: the sent messages are kept in a buffer, which
+// is written to the connection once the window elapses (since
+// the first pending message), once it reaches maxBytes (a
+// non-positive value means DefaultCoalescingBytes), or when
+// Flush is called. This trades latency for fewer and larger
+// writes (e.g. under heavy broadcasts of small messages). The
+// sends succeed once the message is buffered: a failed flush
+// stops the attendant abnormally. Disabling it flushes the
+// pending messages. The default is not coalescing at all.
+func (attendant *Attendant) SetCoalescing(window time.Duration, maxBytes int) {
+	if window < 0 {
+		window = 0
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultCoalescingBytes
+	}
+	attendant.coalescer.mutex.Lock()
+	attendant.coalescer.window = window
+	attendant.coalescer.maxBytes = maxBytes
+	attendant.coalescer.mutex.Unlock()
+	if window == 0 {
+		// noinspection GoUnhandledErrorResult
+		attendant.Flush()
+	}
+}
+
+
+// Returns the coalescing window and maximum size (a zero
+// window means not coalescing).
+func (attendant *Attendant) Coalescing() (time.Duration, int) {
+	attendant.coalescer.mutex.Lock()
+	defer attendant.coalescer.mutex.Unlock()
+	return attendant.coalescer.window, attendant.coalescer.maxBytes
+}
+
+
+// Writes the messages pending in the coalescing buffer (if
+// any) to the connection right away, as any other write (so
+// the write timeout and the stall timeout apply). A failure
+// stops the attendant abnormally.
+func (attendant *Attendant) Flush() error {
+	return attendant.flushWithin(-1)
+}
+
+
+// Writes the messages pending in the coalescing buffer (if
+// any), waiting for the send slot and writing within the given
+// time (negative means no bound other than the write timeout).
+// Returns a SendTimeoutError if the slot is not taken in time.
+func (attendant *Attendant) flushWithin(wait time.Duration) error {
+	if !attendant.coalescer.pending() {
+		return nil
+	} else if attendant.Status() == AttendantStopped || attendant.closing() {
+		return AttendantIsStopped(true)
+	}
+	start := time.Now()
+	if !attendant.acquireSendSlot(wait) {
+		return SendTimeoutError{wait}
+	}
+	defer attendant.releaseSendSlot()
+	deadline := time.Time{}
+	if timeout := attendant.WriteTimeout(); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if wait >= 0 && (deadline.IsZero() || start.Add(wait).Before(deadline)) {
+		deadline = start.Add(wait)
+	}
+	// noinspection GoUnhandledErrorResult
+	attendant.connection.SetWriteDeadline(deadline)
+	unwatch := attendant.watchStall()
+	attendant.coalescer.mutex.Lock()
+	err := attendant.coalescer.flushLocked()
+	attendant.coalescer.mutex.Unlock()
+	unwatch()
+	if _, isNetError := err.(net.Error); isNetError && !isClosedSocketError(err) {
+		attendant.abort(err)
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package chasqui
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// A writer counting the writes made on it (each one would be
+// a write syscall on a real socket).
+type countingWriter struct {
+	writes int
+	bytes  int
+}
+
+
+func (writer *countingWriter) Write(data []byte) (int, error) {
+	writer.writes++
+	writer.bytes += len(data)
+	return len(data), nil
+}
+
+
+// Writes small frames through the coalescer alone, without
+// coalescing and with each buffer size (the window is long
+// enough for the size to trigger every flush).
+func BenchmarkCoalescerWrite(b *testing.B) {
+	frame := []byte(`{"command":"tick","args":[12345,"some text"],"kwargs":{}}` + "\n")
+	for _, maxBytes := range []int{0, 1024, DefaultCoalescingBytes, 64 * 1024} {
+		b.Run("maxBytes=" + strconv.Itoa(maxBytes), func(b *testing.B) {
+			target := &countingWriter{}
+			coalescer := &coalescer{attendant: &Attendant{}, target: target, maxBytes: maxBytes}
+			if maxBytes > 0 {
+				coalescer.window = time.Hour
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(frame)))
+			b.ResetTimer()
+			for index := 0; index < b.N; index++ {
+				if _, err := coalescer.write(frame); err != nil {
+					b.Fatalf("write: %v", err)
+				}
+			}
+			b.StopTimer()
+			coalescer.mutex.Lock()
+			// noinspection GoUnhandledErrorResult
+			coalescer.flushLocked()
+			coalescer.mutex.Unlock()
+			b.ReportMetric(float64(target.writes) / float64(b.N), "writes/op")
+		})
+	}
+}
+
+
+// Sends small messages through an attendant writing to a peer
+// which reads everything, with and without coalescing.
+func BenchmarkCoalescedSend(b *testing.B) {
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		b.Run("window=" + window.String(), func(b *testing.B) {
+			benchmarkPipeAttendant(b, func(attendant *Attendant, index int) error {
+				if index == 0 {
+					attendant.SetCoalescing(window, 0)
+				}
+				return attendant.Send("tick", Args{index, "some text"}, nil)
+			})
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package chasqui
+
+import (
+	"sync"
+	"time"
+)
+
+
+// The lapse between two sweeps of the expired context entries.
+// Expired entries are also removed when accessed, so sweeps
+// only matter for entries nobody accesses anymore.
+const ContextSweepInterval = time.Second
+
+
+// Callbacks run when a context entry expires (either when it is
+// accessed, or swept), with the attendant, the key and the value
+// of the entry. They run out of any lock of the attendant.
+type ContextExpiredFunc func(attendant *Attendant, key string, value interface{})
+
+
+// An expired context entry, pending to be notified.
+type expiredEntry struct {
+	key   string
+	value interface{}
+}
+
+
+// Sweeps the expired context entries of many attendants (e.g.
+// the ones of a server) with a single timer. Its goroutine only
+// runs while there are attendants with expiring entries.
+type contextSweeper struct {
+	mutex      sync.Mutex
+	attendants map[*Attendant]bool
+	running    bool
+	idle       chan struct{}
+	resources  *resourceCounter
+}
+
+
+// The sweeper of the attendants not belonging to a server.
+var defaultContextSweeper = &contextSweeper{}
+
+
+// Starts tracking an attendant with expiring entries, and runs
+// the sweep loop if it was not running.
+func (sweeper *contextSweeper) track(attendant *Attendant) {
+	sweeper.mutex.Lock()
+	defer sweeper.mutex.Unlock()
+	if sweeper.attendants == nil {
+		sweeper.attendants = make(map[*Attendant]bool)
+		sweeper.idle = make(chan struct{}, 1)
+	}
+	sweeper.attendants[attendant] = true
+	if !sweeper.running {
+		sweeper.running = true
+		sweeper.resources.spawn(sweeper.sweepLoop)
+	}
+}
+
+
+// Stops tracking an attendant, waking the sweep loop (so it
+// finishes right away) if no attendants remain.
+func (sweeper *contextSweeper) untrack(attendant *Attendant) {
+	sweeper.mutex.Lock()
+	defer sweeper.mutex.Unlock()
+	if sweeper.attendants[attendant] {
+		delete(sweeper.attendants, attendant)
+		if len(sweeper.attendants) == 0 {
+			select {
+			case sweeper.idle <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+
+// Takes a snapshot of the tracked attendants, or marks the
+// sweep loop as finished if there are none.
+func (sweeper *contextSweeper) snapshot() ([]*Attendant, bool) {
+	sweeper.mutex.Lock()
+	defer sweeper.mutex.Unlock()
+	if len(sweeper.attendants) == 0 {
+		sweeper.running = false
+		return nil, false
+	}
+	attendants := make([]*Attendant, 0, len(sweeper.attendants))
+	for attendant := range sweeper.attendants {
+		attendants = append(attendants, attendant)
+	}
+	return attendants, true
+}
+
+
+// The sweep loop removes the expired entries of the tracked
+// attendants periodically, and forgets the attendants having
+// no expiring entries anymore.
+func (sweeper *contextSweeper) sweepLoop() {
+	ticker := time.NewTicker(ContextSweepInterval)
+	sweeper.resources.addTimers(1)
+	defer sweeper.resources.addTimers(-1)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			attendants, ok := sweeper.snapshot()
+			if !ok {
+				return
+			}
+			for _, attendant := range attendants {
+				// Each attendant takes part in the sweeps with
+				// its own offset.
+				if !attendant.expireContext(now.Add(-attendant.jitterOffset(ContextSweepInterval))) {
+					sweeper.untrack(attendant)
+				}
+			}
+		case <-sweeper.idle:
+			if _, ok := sweeper.snapshot(); !ok {
+				return
+			}
+		}
+	}
+}
+
+
+// Sets a context element by its key, which is transparently
+// absent once the given time elapses (it is removed either when
+// accessed, or by a periodic sweep). Setting the key again, in
+// any way, replaces the expiration. A non-positive time means
+// the element never expires (as with SetContext).
+func (attendant *Attendant) SetContextTTL(key string, value interface{}, ttl time.Duration) {
+	if ttl <= 0 {
+		attendant.SetContext(key, value)
+		return
+	}
+	attendant.contextMutex.Lock()
+	attendant.context[key] = value
+	if attendant.contextDeadlines == nil {
+		attendant.contextDeadlines = make(map[string]time.Time)
+	}
+	attendant.contextDeadlines[key] = time.Now().Add(ttl)
+	attendant.contextMutex.Unlock()
+	if attendant.Status() != AttendantStopped {
+		attendant.sweeper.track(attendant)
+	}
+}
+
+
+// Sets the callback run when a context entry expires (nil
+// means none).
+func (attendant *Attendant) OnContextExpired(callback ContextExpiredFunc) {
+	attendant.contextMutex.Lock()
+	defer attendant.contextMutex.Unlock()
+	attendant.contextExpired = callback
+}
+
+
+// Tells whether a context entry is expired at the given
+// instant. The context mutex must be held.
+func (attendant *Attendant) contextExpiredAt(key string, now time.Time) bool {
+	deadline, ok := attendant.contextDeadlines[key]
+	return ok && !now.Before(deadline)
+}
+
+
+// Removes the expired context entries, and runs the expiration
+// callback (if any) for each of them. Returns whether there are
+// still expiring entries.
+func (attendant *Attendant) expireContext(now time.Time) bool {
+	attendant.contextMutex.Lock()
+	var expired []expiredEntry
+	for key, deadline := range attendant.contextDeadlines {
+		if !now.Before(deadline) {
+			expired = append(expired, expiredEntry{key, attendant.context[key]})
+			delete(attendant.context, key)
+			delete(attendant.contextDeadlines, key)
+		}
+	}
+	remaining := len(attendant.contextDeadlines) > 0
+	callback := attendant.contextExpired
+	attendant.contextMutex.Unlock()
+	if callback != nil {
+		for _, entry := range expired {
+			callback(attendant, entry.key, entry.value)
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,409 @@
+package chasqui
+
+import (
+	. "github.com/universe-10th/chasqui/types"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+
+// The default maximum size of the datagrams a datagram
+// dispatcher takes (the largest UDP payload over IPv4).
+// Larger datagrams are dropped.
+const DefaultMaxDatagramSize = 65507
+
+
+// The datagrams each peer may have pending (received, but not
+// read by its attendant yet). Further ones are dropped.
+const datagramInboxSize = 64
+
+
+// A connection to a single peer of a datagram dispatcher. The
+// datagrams of the peer are read one after the other, as if
+// they were a stream, and each write is sent as a datagram.
+type datagramConn struct {
+	socket       *net.UDPConn
+	remote       *net.UDPAddr
+	inbox        chan []byte
+	current      []byte
+	closed       chan struct{}
+	closeOnce    sync.Once
+	onClose      func(*datagramConn)
+	mutex        sync.Mutex
+	readDeadline time.Time
+}
+
+
+// Reads the pending data of the current datagram, or waits for
+// the next one (until the read deadline, if any).
+func (conn *datagramConn) Read(data []byte) (int, error) {
+	if len(conn.current) == 0 {
+		conn.mutex.Lock()
+		deadline := conn.readDeadline
+		conn.mutex.Unlock()
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case datagram := <-conn.inbox:
+			conn.current = datagram
+		case <-conn.closed:
+			return 0, net.ErrClosed
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	read := copy(data, conn.current)
+	conn.current = conn.current[read:]
+	return read, nil
+}
+
+
+// Sends the data to the peer, as a single datagram.
+func (conn *datagramConn) Write(data []byte) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+		return conn.socket.WriteToUDP(data, conn.remote)
+	}
+}
+
+
+// Queues a datagram received from the peer. Returns false
+// (dropping it) if the peer has too many pending datagrams.
+func (conn *datagramConn) push(datagram []byte) bool {
+	select {
+	case conn.inbox <- datagram:
+		return true
+	default:
+		return false
+	}
+}
+
+
+// Closes the connection: pending reads fail, and the peer is
+// forgotten by the dispatcher. The socket is kept open.
+func (conn *datagramConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+		conn.onClose(conn)
+	})
+	return nil
+}
+
+
+// Returns the address of the dispatcher socket.
+func (conn *datagramConn) LocalAddr() net.Addr {
+	return conn.socket.LocalAddr()
+}
+
+
+// Returns the address of the peer.
+func (conn *datagramConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+
+// Sets the read deadline (writes are never blocked).
+func (conn *datagramConn) SetDeadline(deadline time.Time) error {
+	return conn.SetReadDeadline(deadline)
+}
+
+
+// Sets the read deadline.
+func (conn *datagramConn) SetReadDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.readDeadline = deadline
+	return nil
+}
+
+
+// Writes are never blocked: the write deadline is ignored.
+func (conn *datagramConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+
+// A lifecycle for UDP sockets: the received datagrams are
+// told apart by their remote address, and each peer gets its
+// own pseudo-attendant (with its own marshaler) which takes
+// one message per datagram. The attendants trigger the same
+// events as the ones of a Server (MessageEvent, ThrottledEvent,
+// AttendantStartedEvent and AttendantStoppedEvent), and send
+// each message back to their peer as a datagram (so marshalers
+// must write each message at once, as the bundled ones do).
+// Peers silent for longer than the idle timeout expire (their
+// attendants stop with an idle stop), and a new attendant is
+// created if they send again.
+type DatagramDispatcher struct {
+	mutex                 sync.Mutex
+	socket                *net.UDPConn
+	factory               MarshalerFactory
+	throttle              time.Duration
+	idleTimeout           time.Duration
+	maxDatagramSize       int
+	options               []AttendantOption
+	peers                 map[string]*datagramPeer
+	droppedDatagrams      uint64
+	attendantStartedEvent chan AttendantStartedEvent
+	messageEvent          chan MessageEvent
+	throttledEvent        chan ThrottledEvent
+	attendantStoppedEvent chan AttendantStoppedEvent
+	resources             resourceCounter
+}
+
+
+// A peer of a datagram dispatcher: its connection, and the
+// attendant reading it.
+type datagramPeer struct {
+	conn      *datagramConn
+	attendant *Attendant
+}
+
+
+// Returns a read-only channel with all the "attendant started"
+// events.
+func (dispatcher *DatagramDispatcher) AttendantStartedEvent() <-chan AttendantStartedEvent {
+	return dispatcher.attendantStartedEvent
+}
+
+
+// Returns a read-only channel with all the "message" events.
+func (dispatcher *DatagramDispatcher) MessageEvent() <-chan MessageEvent {
+	return dispatcher.messageEvent
+}
+
+
+// Returns a read-only channel with all the "throttled" events.
+func (dispatcher *DatagramDispatcher) ThrottledEvent() <-chan ThrottledEvent {
+	return dispatcher.throttledEvent
+}
+
+
+// Returns a read-only channel with all the "attendant stopped"
+// events.
+func (dispatcher *DatagramDispatcher) AttendantStoppedEvent() <-chan AttendantStoppedEvent {
+	return dispatcher.attendantStoppedEvent
+}
+
+
+// Returns the current listen address of the dispatcher, if
+// running. Returns an error if it is not running.
+func (dispatcher *DatagramDispatcher) Addr() (net.Addr, error) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	if dispatcher.socket != nil {
+		return dispatcher.socket.LocalAddr(), nil
+	} else {
+		return nil, DispatcherNotListeningError(true)
+	}
+}
+
+
+// Counts the datagrams dropped so far: the oversized ones, and
+// the ones arriving while their peer had too many pending.
+func (dispatcher *DatagramDispatcher) DroppedDatagrams() uint64 {
+	return atomic.LoadUint64(&dispatcher.droppedDatagrams)
+}
+
+
+// Enumerates the attendants of the current peers.
+func (dispatcher *DatagramDispatcher) Enumerate(callback func(*Attendant)) {
+	for _, attendant := range dispatcher.attendants() {
+		callback(attendant)
+	}
+}
+
+
+// Returns the attendants of the current peers.
+func (dispatcher *DatagramDispatcher) attendants() []*Attendant {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	attendants := make([]*Attendant, 0, len(dispatcher.peers))
+	for _, peer := range dispatcher.peers {
+		attendants = append(attendants, peer.attendant)
+	}
+	return attendants
+}
+
+
+// Returns the resources currently owned by this dispatcher:
+// the read loop goroutine, the socket, and the ones of the
+// attendants of its peers.
+func (dispatcher *DatagramDispatcher) ResourceCounts() ResourceCounts {
+	return dispatcher.resources.counts()
+}
+
+
+// Binds the UDP socket and runs the read loop in a separate
+// goroutine. Returns the closer: a function which closes the
+// socket and stops the attendants of all the peers (it may be
+// called many times: only the first one counts).
+func (dispatcher *DatagramDispatcher) Run(host string) (func(), error) {
+	dispatcher.mutex.Lock()
+	if dispatcher.socket != nil {
+		dispatcher.mutex.Unlock()
+		return nil, DispatcherAlreadyListeningError(true)
+	}
+	if address, errHost := net.ResolveUDPAddr("udp", host); errHost != nil {
+		dispatcher.mutex.Unlock()
+		return nil, errHost
+	} else if socket, errListen := net.ListenUDP("udp", address); errListen != nil {
+		dispatcher.mutex.Unlock()
+		return nil, errListen
+	} else {
+		dispatcher.socket = socket
+		dispatcher.resources.addConnections(1)
+	}
+	socket := dispatcher.socket
+	dispatcher.mutex.Unlock()
+
+	quit := make(chan uint8)
+	dispatcher.resources.spawn(func() {
+		dispatcher.readLoop(socket, quit)
+		// noinspection GoUnhandledErrorResult
+		socket.Close()
+		dispatcher.mutex.Lock()
+		dispatcher.socket = nil
+		dispatcher.mutex.Unlock()
+		dispatcher.resources.addConnections(-1)
+		for _, attendant := range dispatcher.attendants() {
+			// noinspection GoUnhandledErrorResult
+			attendant.Stop()
+		}
+	})
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+			// noinspection GoUnhandledErrorResult
+			socket.Close()
+		})
+	}, nil
+}
+
+
+// Reads the datagrams and hands them to their peers, until the
+// socket is closed or fails.
+func (dispatcher *DatagramDispatcher) readLoop(socket *net.UDPConn, quit chan uint8) {
+	// One byte more, to tell the oversized datagrams apart.
+	buffer := make([]byte, dispatcher.maxDatagramSize + 1)
+	var backoff acceptBackoff
+	for {
+		size, remote, err := socket.ReadFromUDP(buffer)
+		if err != nil {
+			if isClosedSocketError(err) {
+				return
+			}
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			if !isTemporaryAcceptError(err) {
+				return
+			}
+			backoff.next()
+			if !backoff.wait(&dispatcher.resources, quit) {
+				return
+			}
+			continue
+		}
+		backoff.reset()
+		if size > dispatcher.maxDatagramSize {
+			atomic.AddUint64(&dispatcher.droppedDatagrams, 1)
+			continue
+		}
+		dispatcher.deliver(remote, append([]byte(nil), buffer[:size]...))
+	}
+}
+
+
+// Hands a datagram to its peer, creating (and starting) the
+// peer if new.
+func (dispatcher *DatagramDispatcher) deliver(remote *net.UDPAddr, datagram []byte) {
+	key := remote.String()
+	dispatcher.mutex.Lock()
+	peer, ok := dispatcher.peers[key]
+	if !ok {
+		conn := &datagramConn{
+			socket:  dispatcher.socket,
+			remote:  remote,
+			inbox:   make(chan []byte, datagramInboxSize),
+			closed:  make(chan struct{}),
+			onClose: dispatcher.forget,
+		}
+		options := append([]AttendantOption{withResourceParent(&dispatcher.resources)}, dispatcher.options...)
+		attendant := NewAttendant(
+			conn, dispatcher.factory, dispatcher.throttle, dispatcher.attendantStartedEvent,
+			dispatcher.attendantStoppedEvent, dispatcher.messageEvent, dispatcher.throttledEvent, options...,
+		)
+		attendant.SetIdleTimeout(dispatcher.idleTimeout)
+		peer = &datagramPeer{conn, attendant}
+		dispatcher.peers[key] = peer
+	}
+	dispatcher.mutex.Unlock()
+	if !peer.conn.push(datagram) {
+		atomic.AddUint64(&dispatcher.droppedDatagrams, 1)
+	}
+	if !ok {
+		// noinspection GoUnhandledErrorResult
+		peer.attendant.Start()
+	}
+}
+
+
+// Forgets a peer, once its connection is closed.
+func (dispatcher *DatagramDispatcher) forget(conn *datagramConn) {
+	key := conn.remote.String()
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
+	if peer, ok := dispatcher.peers[key]; ok && peer.conn == conn {
+		delete(dispatcher.peers, key)
+	}
+}
+
+
+// Creates a new datagram dispatcher, ready to be used. Peers
+// expire after being silent for the idle timeout (zero means
+// never), and datagrams larger than maxDatagramSize (zero
+// means DefaultMaxDatagramSize) are dropped. The options are
+// given to the attendant of each peer.
+func NewDatagramDispatcher(factory MarshalerFactory, activityBufferSize, lifecycleBufferSize uint,
+	                       defaultThrottle, idleTimeout time.Duration, maxDatagramSize uint,
+	                       options ...AttendantOption) *DatagramDispatcher {
+	if factory == nil {
+		panic(ArgumentError{"NewDatagramDispatcher:factory"})
+	}
+	if maxDatagramSize == 0 {
+		maxDatagramSize = DefaultMaxDatagramSize
+	}
+	if idleTimeout < 0 {
+		idleTimeout = -idleTimeout
+	}
+	return &DatagramDispatcher{
+		factory:               factory,
+		throttle:              defaultThrottle,
+		idleTimeout:           idleTimeout,
+		maxDatagramSize:       int(maxDatagramSize),
+		options:               options,
+		peers:                 make(map[string]*datagramPeer),
+		attendantStartedEvent: make(chan AttendantStartedEvent, lifecycleBufferSize),
+		messageEvent:          make(chan MessageEvent, activityBufferSize),
+		throttledEvent:        make(chan ThrottledEvent, activityBufferSize),
+		attendantStoppedEvent: make(chan AttendantStoppedEvent, lifecycleBufferSize),
+	}
+}
@@ -0,0 +1,196 @@
+package chasqui
+
+import (
+	. "github.com/universe-10th/chasqui/types"
+	"sync"
+	"sync/atomic"
+)
+
+
+// A subscriber waiting for messages of a given command.
+type demultiplexerSubscriber struct {
+	channel chan Message
+	dropped uint64
+}
+
+
+// Demultiplexers route the messages received by a client to
+// subscribers, by command, so several concurrent workflows
+// can share a single connection: each workflow subscribes to
+// the commands it waits for, and all the subscribers of a
+// command receive a copy of each matching message, in wire
+// order. Messages matching no subscriber go to the default
+// channel.
+//
+// Each subscriber (and the default channel) has a bounded
+// buffer: messages not fitting in it are dropped and counted.
+// When the client stops, all the channels are closed.
+//
+// A demultiplexer consumes the client's MessageEvent channel,
+// so it must be created before starting the client, and the
+// client should not be funneled for its messages at the same
+// time (FunnelClientWith would compete for them).
+type Demultiplexer struct {
+	client         *Attendant
+	bufferSize     uint
+	mutex          sync.Mutex
+	subscribers    map[string][]*demultiplexerSubscriber
+	defaultChannel *demultiplexerSubscriber
+	done           chan uint8
+	closed         bool
+}
+
+
+// Subscribes to a command. Returns the channel receiving the
+// matching messages, and a function to cancel the subscription
+// (which closes the channel).
+func (demultiplexer *Demultiplexer) On(command string) (<-chan Message, func()) {
+	subscriber := &demultiplexerSubscriber{channel: make(chan Message, demultiplexer.bufferSize)}
+	demultiplexer.mutex.Lock()
+	defer demultiplexer.mutex.Unlock()
+	if demultiplexer.closed {
+		close(subscriber.channel)
+		return subscriber.channel, func() {}
+	}
+	demultiplexer.subscribers[command] = append(demultiplexer.subscribers[command], subscriber)
+	var once sync.Once
+	return subscriber.channel, func() {
+		once.Do(func() {
+			demultiplexer.cancel(command, subscriber)
+		})
+	}
+}
+
+
+// Removes and closes a subscriber.
+func (demultiplexer *Demultiplexer) cancel(command string, subscriber *demultiplexerSubscriber) {
+	demultiplexer.mutex.Lock()
+	defer demultiplexer.mutex.Unlock()
+	if demultiplexer.closed {
+		return
+	}
+	subscribers := demultiplexer.subscribers[command]
+	for index, current := range subscribers {
+		if current == subscriber {
+			subscribers = append(subscribers[:index:index], subscribers[index + 1:]...)
+			break
+		}
+	}
+	if len(subscribers) == 0 {
+		delete(demultiplexer.subscribers, command)
+	} else {
+		demultiplexer.subscribers[command] = subscribers
+	}
+	close(subscriber.channel)
+}
+
+
+// Returns the channel receiving the messages that match no
+// subscriber.
+func (demultiplexer *Demultiplexer) Default() <-chan Message {
+	return demultiplexer.defaultChannel.channel
+}
+
+
+// Returns how many messages were dropped for the subscriber
+// owning the given channel (or the default channel), because
+// its buffer was full.
+func (demultiplexer *Demultiplexer) Dropped(channel <-chan Message) uint64 {
+	demultiplexer.mutex.Lock()
+	defer demultiplexer.mutex.Unlock()
+	if channel == demultiplexer.defaultChannel.channel {
+		return atomic.LoadUint64(&demultiplexer.defaultChannel.dropped)
+	}
+	for _, subscribers := range demultiplexer.subscribers {
+		for _, subscriber := range subscribers {
+			if subscriber.channel == channel {
+				return atomic.LoadUint64(&subscriber.dropped)
+			}
+		}
+	}
+	return 0
+}
+
+
+// Delivers a message to its subscribers, or to the default
+// channel. It never blocks.
+func (demultiplexer *Demultiplexer) deliver(message Message) {
+	demultiplexer.mutex.Lock()
+	defer demultiplexer.mutex.Unlock()
+	subscribers := demultiplexer.subscribers[message.Command()]
+	if len(subscribers) == 0 {
+		subscribers = []*demultiplexerSubscriber{demultiplexer.defaultChannel}
+	}
+	for _, subscriber := range subscribers {
+		select {
+		case subscriber.channel <- message:
+		default:
+			atomic.AddUint64(&subscriber.dropped, 1)
+		}
+	}
+}
+
+
+// Closes all the channels.
+func (demultiplexer *Demultiplexer) close() {
+	demultiplexer.mutex.Lock()
+	defer demultiplexer.mutex.Unlock()
+	demultiplexer.closed = true
+	for _, subscribers := range demultiplexer.subscribers {
+		for _, subscriber := range subscribers {
+			close(subscriber.channel)
+		}
+	}
+	demultiplexer.subscribers = nil
+	close(demultiplexer.defaultChannel.channel)
+}
+
+
+// The routing loop. When the client stops, the pending messages
+// are still routed before closing the channels: they were all
+// queued before the teardown started.
+func (demultiplexer *Demultiplexer) loop() {
+	messages := demultiplexer.client.MessageEvent()
+	for {
+		select {
+		case event := <-messages:
+			demultiplexer.deliver(event.Message)
+		case <-demultiplexer.done:
+			for {
+				select {
+				case event := <-messages:
+					demultiplexer.deliver(event.Message)
+				default:
+					demultiplexer.close()
+					return
+				}
+			}
+		}
+	}
+}
+
+
+// Creates a demultiplexer around a client (which must not be
+// started yet), with the given buffer size for each subscriber
+// and for the default channel.
+func NewDemultiplexer(client *Attendant, bufferSize uint) *Demultiplexer {
+	if client == nil {
+		panic(ArgumentError{"NewDemultiplexer:client"})
+	}
+	if bufferSize == 0 {
+		bufferSize = 1
+	}
+	demultiplexer := &Demultiplexer{
+		client:         client,
+		bufferSize:     bufferSize,
+		subscribers:    make(map[string][]*demultiplexerSubscriber),
+		defaultChannel: &demultiplexerSubscriber{channel: make(chan Message, bufferSize)},
+		done:           make(chan uint8),
+	}
+	client.OnTeardown(TeardownResolveWaiters, func() error {
+		close(demultiplexer.done)
+		return nil
+	})
+	client.resources.spawn(demultiplexer.loop)
+	return demultiplexer
+}
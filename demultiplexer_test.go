@@ -0,0 +1,213 @@
+package chasqui
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// Runs a server sending back each received message as it is,
+// in the order they arrive. Returns the function stopping it.
+func runEchoServer(t *testing.T) (*Server, func()) {
+	server := newTestServer(16)
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-quit:
+				return
+			case event := <-server.MessageEvent():
+				message := event.Message
+				// noinspection GoUnhandledErrorResult
+				event.Attendant.Send(message.Command(), message.Args(), message.KWArgs())
+			case <-server.StartedEvent():
+			case <-server.StoppedEvent():
+			case <-server.AttendantStartedEvent():
+			case <-server.AttendantStoppedEvent():
+			case <-server.ThrottledEvent():
+			case <-server.SendFailedEvent():
+			}
+		}
+	}()
+	return server, func() {
+		// noinspection GoUnhandledErrorResult
+		server.Stop()
+		close(quit)
+		<-done
+	}
+}
+
+
+// Creates a demultiplexed client of the server, consuming its
+// lifecycle events. The client is not started.
+func newDemultiplexedClient(t *testing.T, server *Server, bufferSize uint) (*Attendant, *Demultiplexer) {
+	conn, err := net.DialTimeout("tcp", server.TCPAddr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(conn, &json.JSONMessageMarshaler{}, 0, 16)
+	demultiplexer := NewDemultiplexer(client, bufferSize)
+	go func() {
+		<-client.StartedEvent()
+		<-client.StoppedEvent()
+	}()
+	return client, demultiplexer
+}
+
+
+// Takes the next message from a channel, failing the test if
+// it does not arrive in time (or the channel is closed).
+func nextDemultiplexed(t *testing.T, channel <-chan Message, what string) Message {
+	t.Helper()
+	select {
+	case message, ok := <-channel:
+		if !ok {
+			t.Fatalf("%s: the channel is closed", what)
+		}
+		return message
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s: no message arrived", what)
+	}
+	return nil
+}
+
+
+// Expects a channel to be closed (after any pending message).
+func expectClosed(t *testing.T, channel <-chan Message, what string) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-channel:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("%s: the channel is not closed", what)
+		}
+	}
+}
+
+
+func TestDemultiplexerRouting(t *testing.T) {
+	server, stopServer := runEchoServer(t)
+	defer stopServer()
+	client, demultiplexer := newDemultiplexedClient(t, server, 64)
+	commands := []string{"INVENTORY_RESULT", "QUEST_RESULT", "CHAT"}
+	channels := map[string]<-chan Message{}
+	cancels := map[string]func(){}
+	for _, command := range commands {
+		channels[command], cancels[command] = demultiplexer.On(command)
+	}
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	const count = 40
+
+	// Three workflows, each sending and awaiting its command.
+	var group sync.WaitGroup
+	for _, command := range commands {
+		group.Add(1)
+		go func(command string) {
+			defer group.Done()
+			for index := 0; index < count; index++ {
+				if err := client.Send(command, Args{index}, nil); err != nil {
+					t.Errorf("%s: send: %v", command, err)
+					return
+				}
+			}
+		}(command)
+	}
+	for _, command := range commands {
+		group.Add(1)
+		go func(command string) {
+			defer group.Done()
+			for index := 0; index < count; index++ {
+				select {
+				case message := <-channels[command]:
+					if message.Command() != command {
+						t.Errorf("%s received %s", command, message.Command())
+					} else if sequence, _ := message.Args()[0].(float64); int(sequence) != index {
+						t.Errorf("%s: expected #%d, got #%v", command, index, message.Args()[0])
+					}
+				case <-time.After(2 * time.Second):
+					t.Errorf("%s: #%d did not arrive", command, index)
+					return
+				}
+			}
+		}(command)
+	}
+	if err := client.Send("UNKNOWN", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if message := nextDemultiplexed(t, demultiplexer.Default(), "default"); message.Command() != "UNKNOWN" {
+		t.Fatalf("the default channel received %s", message.Command())
+	}
+	group.Wait()
+
+	// Once canceled, the messages go to the default channel.
+	cancels["CHAT"]()
+	cancels["CHAT"]()
+	expectClosed(t, channels["CHAT"], "canceled")
+	if err := client.Send("CHAT", Args{"hello"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if message := nextDemultiplexed(t, demultiplexer.Default(), "default"); message.Command() != "CHAT" {
+		t.Fatalf("the default channel received %s", message.Command())
+	}
+
+	// Stopping the client closes the remaining channels.
+	// noinspection GoUnhandledErrorResult
+	client.Stop()
+	expectClosed(t, channels["INVENTORY_RESULT"], "INVENTORY_RESULT")
+	expectClosed(t, channels["QUEST_RESULT"], "QUEST_RESULT")
+	expectClosed(t, demultiplexer.Default(), "default")
+	if late, cancel := demultiplexer.On("LATE"); late != nil {
+		cancel()
+		expectClosed(t, late, "late")
+	}
+}
+
+
+func TestDemultiplexerDrops(t *testing.T) {
+	server, stopServer := runEchoServer(t)
+	defer stopServer()
+	client, demultiplexer := newDemultiplexedClient(t, server, 2)
+	slow, _ := demultiplexer.On("SLOW")
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer client.Stop()
+	for index := 0; index < 10; index++ {
+		if err := client.Send("SLOW", Args{index}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Once the mark arrives, all the previous ones were routed.
+	if err := client.Send("MARK", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	nextDemultiplexed(t, demultiplexer.Default(), "default")
+	if dropped := demultiplexer.Dropped(slow); dropped != 8 {
+		t.Fatalf("expected 8 dropped messages, got %d", dropped)
+	}
+	for index := 0; index < 2; index++ {
+		if sequence := nextDemultiplexed(t, slow, "slow").Args()[0]; sequence != float64(index) {
+			t.Fatalf("expected #%d, got #%v", index, sequence)
+		}
+	}
+	if dropped := demultiplexer.Dropped(demultiplexer.Default()); dropped != 0 {
+		t.Fatalf("the default channel dropped %d messages", dropped)
+	}
+}
@@ -1,8 +1,14 @@
 package chasqui
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 
@@ -27,13 +33,17 @@ func (DispatcherNotListeningError) Error() string {
 
 
 // Callback to report when a dispatcher successfully ran
-// its lifecycle.
+// its lifecycle. The address is the one actually bound (e.g.
+// telling the port chosen by the system, when binding port
+// 0). It is nil when running over a given listener which is
+// not a TCP one.
 type OnDispatcherStart func(*Dispatcher, *net.TCPAddr)
 
 
 // Callback to report when an dispatcher could successfully
-// accept an incoming connection.
-type OnDispatcherAcceptSuccess func(*Dispatcher, *net.TCPConn)
+// accept an incoming connection (a *net.TCPConn, or a
+// *tls.Conn when running with TLS).
+type OnDispatcherAcceptSuccess func(*Dispatcher, net.Conn)
 
 
 // Callback to report when an dispatcher failed to accept
@@ -41,9 +51,11 @@ type OnDispatcherAcceptSuccess func(*Dispatcher, *net.TCPConn)
 type OnDispatcherAcceptError func(*Dispatcher, error)
 
 
-// Callback to report when an dispatcher successfully ended
-// its lifecycle.
-type OnDispatcherStop func(*Dispatcher)
+// Callback to report when an dispatcher ended its lifecycle,
+// telling why (see DispatcherStopReason) and the underlying
+// error (nil for requested stops, unless the listener could
+// not be closed).
+type OnDispatcherStop func(*Dispatcher, DispatcherStopReason, error)
 
 
 // A server lifecycle for TCP sockets. It does not provide
@@ -54,21 +66,77 @@ type OnDispatcherStop func(*Dispatcher)
 //
 // When invoking its Run method, it will return either an
 // error or a "closer" function: a function with no args /
-// return value that will close the server. This implies
-// that the lifecycle will run on its own goroutine.
+// return value that will close the server (even while no
+// connection arrives, and safely when called many times).
+// This implies that the lifecycle will run on its own
+// goroutine. The closer returns once the lifecycle fully
+// finished (so it must not be called from the callbacks),
+// and the dispatcher may be run again afterwards.
 type Dispatcher struct {
+	// The counters go first, so they are aligned for the
+	// atomic operations on 32 bits platforms.
+	stats           dispatcherStats
 	mutex           sync.Mutex
-	listener        *net.TCPListener
+	listener        net.Listener
 	onStart         OnDispatcherStart
 	onAcceptSuccess OnDispatcherAcceptSuccess
 	onAcceptError   OnDispatcherAcceptError
 	onStop          OnDispatcherStop
+	resources       resourceCounter
+	// Whether the listeners given to RunWithListener are
+	// left open on stop.
+	keepListener    bool
+	// The network it listens on, and whether its
+	// listeners are created with SO_REUSEPORT.
+	network         string
+	reusePort       bool
+	// How long a single Accept may block (zero means
+	// forever), and the channel closed once the accepting
+	// is resumed (nil while not paused).
+	pollInterval    time.Duration
+	resumed         chan struct{}
+	// The channel closed once the current (or last) accept
+	// loop finished.
+	done            chan struct{}
+	// The optional filter and veto of the accepted
+	// connections.
+	acceptFilter    AcceptFilter
+	acceptVeto      AcceptVeto
+	onReject        OnDispatcherReject
+}
+
+
+// Options configure a dispatcher on construction (see
+// NewDispatcher).
+type DispatcherOption func(*Dispatcher)
+
+
+// Tells whether the dispatcher owns the listeners given to
+// RunWithListener (the default): owned listeners are closed
+// when the dispatcher stops. Listeners not owned are left
+// open (their accept deadline is used to interrupt a pending
+// Accept, when supported: otherwise, the accept loop ends on
+// the next accepted connection, which is closed), and are not
+// accounted among the dispatcher resources.
+func WithListenerOwnership(owned bool) DispatcherOption {
+	return func(dispatcher *Dispatcher) {
+		dispatcher.keepListener = !owned
+	}
+}
+
+
+// Listeners supporting an accept deadline, like the TCP ones.
+type deadlineListener interface {
+	SetDeadline(time.Time) error
 }
 
 
 // Returns the current listen address of the dispatcher,
-// if running. Returns an error if it is not running.
+// if running. Returns an error if it is not running. It may
+// be called from any goroutine, even while stopping.
 func (dispatcher *Dispatcher) Addr() (net.Addr, error) {
+	dispatcher.mutex.Lock()
+	defer dispatcher.mutex.Unlock()
 	if dispatcher.listener != nil {
 		return dispatcher.listener.Addr(), nil
 	} else {
@@ -77,73 +145,398 @@ func (dispatcher *Dispatcher) Addr() (net.Addr, error) {
 }
 
 
+// Returns the current listen address of the dispatcher as a
+// TCP address (e.g. to tell the port chosen by the system,
+// when binding port 0), or nil if it is not running. It is
+// never nil once Run (or RunTLS) returned without error,
+// until the dispatcher stops.
+func (dispatcher *Dispatcher) TCPAddr() *net.TCPAddr {
+	if addr, err := dispatcher.Addr(); err != nil {
+		return nil
+	} else {
+		tcpAddr, _ := addr.(*net.TCPAddr)
+		return tcpAddr
+	}
+}
+
+
 // Runs the server lifecycle in a separate goroutine. The
 // only job of this server is to run the accept loop and
-// report any error being triggered.
+// report any error being triggered. It returns once the
+// listener is bound, so Addr and TCPAddr tell the actual
+// address right away (the start callback runs afterwards,
+// in the background). The returned closer blocks until the
+// loop fully finished: the listener is closed (so the port
+// is free to bind again) and onStop ran.
 func (dispatcher *Dispatcher) Run(host string) (func(), error) {
+	return closable(func(ctx context.Context) (<-chan struct{}, error) {
+		return dispatcher.run(ctx, host, nil)
+	})
+}
+
+
+// Runs the server lifecycle as Run does, but stopping it when
+// the given context is done (instead of by means of a closer).
+// Blocks until the lifecycle fully finished, and returns the
+// error of the context (e.g. context.Canceled), or the one
+// preventing it from listening.
+func (dispatcher *Dispatcher) RunContext(ctx context.Context, host string) error {
+	done, err := dispatcher.run(ctx, host, nil)
+	if err != nil {
+		return err
+	}
+	<-done
+	return ctx.Err()
+}
+
+
+// Runs the server lifecycle in a separate goroutine, as Run
+// does, but accepting TLS connections with the given config
+// (which must have a certificate). The handshake is made on
+// the first read or write of each connection, so a failed one
+// does not block the accept loop: it makes the attendant stop
+// abnormally instead.
+func (dispatcher *Dispatcher) RunTLS(host string, config *tls.Config) (func(), error) {
+	if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil &&
+		config.GetConfigForClient == nil) {
+		panic(ArgumentError{"RunTLS:config"})
+	}
+	return closable(func(ctx context.Context) (<-chan struct{}, error) {
+		return dispatcher.run(ctx, host, config)
+	})
+}
+
+
+// Runs the server lifecycle in a separate goroutine, as Run
+// does, but over the given listener (e.g. one created by a TLS
+// terminator, a test, or inherited from the parent process),
+// instead of listening by itself. Whether the listener is
+// closed on stop depends on the ownership (see
+// WithListenerOwnership).
+func (dispatcher *Dispatcher) RunWithListener(listener net.Listener) (func(), error) {
+	if listener == nil {
+		panic(ArgumentError{"RunWithListener:listener"})
+	}
+	return closable(func(ctx context.Context) (<-chan struct{}, error) {
+		return dispatcher.runWithListener(ctx, listener)
+	})
+}
+
+
+// Runs the accept loop over the given listener in a separate
+// goroutine, until the context is done. Whether the listener
+// is owned depends on the ownership option.
+func (dispatcher *Dispatcher) runWithListener(ctx context.Context, listener net.Listener) (<-chan struct{}, error) {
+	dispatcher.mutex.Lock()
 	if dispatcher.listener != nil {
+		dispatcher.mutex.Unlock()
+		return nil, DispatcherAlreadyListeningError(true)
+	}
+	dispatcher.listener = listener
+	owned := !dispatcher.keepListener
+	if owned {
+		dispatcher.resources.addConnections(1)
+	}
+	dispatcher.mutex.Unlock()
+	finalHost, _ := listener.Addr().(*net.TCPAddr)
+	return dispatcher.serve(ctx, listener, finalHost, owned), nil
+}
+
+
+// Runs a lifecycle by means of the given function, under a
+// context cancelled by the returned closer. The closer returns
+// once the lifecycle fully finished.
+func closable(run func(context.Context) (<-chan struct{}, error)) (func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done, err := run(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+
+// Listens on the given host (with TLS, if a config is given)
+// and runs the accept loop in a separate goroutine, until the
+// context is done. Returns a channel closed once it finished.
+func (dispatcher *Dispatcher) run(ctx context.Context, host string, config *tls.Config) (<-chan struct{}, error) {
+	if dispatcher.listening() {
 		return nil, DispatcherAlreadyListeningError(true)
 	}
+	listener, finalHost, err := listen(dispatcher.network, host, config, dispatcher.reusePort)
+	if err != nil {
+		return nil, err
+	}
+	done, err := dispatcher.adopt(ctx, listener, finalHost)
+	if err != nil {
+		// noinspection GoUnhandledErrorResult
+		listener.Close()
+	}
+	return done, err
+}
+
 
-	// Start to listen, and keep the listener.
-	var finalHost *net.TCPAddr
+// Tells whether the dispatcher is currently listening.
+func (dispatcher *Dispatcher) listening() bool {
 	dispatcher.mutex.Lock()
-	if host, errHost := net.ResolveTCPAddr("tcp", host); errHost != nil {
-		return nil, errHost
-	} else if listener, errListen := net.ListenTCP("tcp", host); errListen != nil {
-		return nil, errListen
+	defer dispatcher.mutex.Unlock()
+	return dispatcher.listener != nil
+}
+
+
+// Starts to listen on the given host, in the given network
+// (with TLS, if a config is given, and SO_REUSEPORT, if told
+// so). Returns the listener and the address actually bound
+// (e.g. telling the port chosen by the system, when binding
+// port 0). Resolution errors tell the network and host.
+func listen(network, host string, config *tls.Config, reusePort bool) (net.Listener, *net.TCPAddr, error) {
+	var listener net.Listener
+	address, err := net.ResolveTCPAddr(network, host)
+	if err != nil {
+		return nil, nil, ResolveError{network, host, err}
+	}
+	if reusePort {
+		listener, err = listenReusePort(network, address)
 	} else {
-		finalHost = host
-		dispatcher.listener = listener
+		listener, err = net.ListenTCP(network, address)
 	}
+	if err != nil {
+		return nil, nil, err
+	}
+	finalHost, _ := listener.Addr().(*net.TCPAddr)
+	if config != nil {
+		return tlsListener{tls.NewListener(listener, config), listener.(deadlineListener)}, finalHost, nil
+	} else {
+		return listener, finalHost, nil
+	}
+}
+
+
+// Keeps the given listener (owning it), and runs the accept
+// loop over it in a separate goroutine, until the context is
+// done. Fails if the dispatcher is already listening.
+func (dispatcher *Dispatcher) adopt(ctx context.Context, listener net.Listener, finalHost *net.TCPAddr) (<-chan struct{}, error) {
+	dispatcher.mutex.Lock()
+	if dispatcher.listener != nil {
+		dispatcher.mutex.Unlock()
+		return nil, DispatcherAlreadyListeningError(true)
+	}
+	dispatcher.listener = listener
+	dispatcher.resources.addConnections(1)
 	dispatcher.mutex.Unlock()
+	return dispatcher.serve(ctx, listener, finalHost, true), nil
+}
+
 
-	// Create the channel to send the quit signal.
+// Runs the accept loop over the given listener, in a separate
+// goroutine, until the context is done. Returns a channel
+// closed once the loop finished. Listeners not owned are left
+// open on stop.
+func (dispatcher *Dispatcher) serve(ctx context.Context, listener net.Listener, finalHost *net.TCPAddr, owned bool) <-chan struct{} {
+	// Create the channel to send the quit signal, and
+	// the one telling the loop finished.
 	quit := make(chan uint8)
+	done := make(chan struct{})
+	dispatcher.mutex.Lock()
+	dispatcher.done = done
+	dispatcher.mutex.Unlock()
+
+	// The listener is closed once (either to interrupt the loop,
+	// or once it finished), keeping the error.
+	var closeOnce sync.Once
+	var closeErr error
+	closeListener := func() error {
+		closeOnce.Do(func() {
+			closeErr = listener.Close()
+		})
+		return closeErr
+	}
 
 	// Launch the goroutine. Such goroutine will
-	// be stopped by the quit signal. Listeners will
-	// never report when they are closed, since they
-	// got accepted the first time. The only way to
-	// stop them, is gracefully.
-	go func(){
+	// be stopped by the quit signal, or by a failure
+	// of the listener (e.g. closed by other means),
+	// which is told to onStop as an abnormal stop.
+	dispatcher.stats.reset()
+	dispatcher.resources.spawn(func(){
 		if dispatcher.onStart != nil {
-			dispatcher.onStart(dispatcher, finalHost)
+			dispatcher.guard("start", func() {
+				dispatcher.onStart(dispatcher, finalHost)
+			})
 		}
-		Loop: for {
-			select {
-			case <-quit:
-				break Loop
-			default:
-				if conn, err := dispatcher.listener.Accept(); err != nil {
-					if dispatcher.onAcceptError != nil {
-						dispatcher.onAcceptError(dispatcher, err)
+		reason, err := dispatcher.runAcceptLoop(func() (reason DispatcherStopReason, stopErr error) {
+			var backoff acceptBackoff
+			Loop: for {
+				select {
+				case <-quit:
+					break Loop
+				default:
+					// Paused dispatchers park here, and polling
+					// ones wake up from Accept once in a while,
+					// so the pause is honored promptly.
+					if !dispatcher.waitAcceptResumed(quit) {
+						break Loop
 					}
-				} else {
-					if dispatcher.onAcceptSuccess != nil {
-						dispatcher.onAcceptSuccess(dispatcher, conn.(*net.TCPConn))
+					polling := dispatcher.armAcceptPoll(listener)
+					if conn, err := listener.Accept(); err != nil {
+						// Closing the listener is how the closer
+						// interrupts a blocked Accept: that is a
+						// clean exit, and not reported.
+						// Otherwise, the listener failed.
+						if isClosedSocketError(err) {
+							select {
+							case <-quit:
+							default:
+								reason, stopErr = DispatcherStopListenerError, err
+							}
+							break Loop
+						}
+						select {
+						case <-quit:
+							break Loop
+						default:
+						}
+						// Neither are the poll wake-ups.
+						if polling && errors.Is(err, os.ErrDeadlineExceeded) {
+							continue
+						}
+						atomic.AddUint64(&dispatcher.stats.failed, 1)
+						// Temporary failures (e.g. running out of
+						// file descriptors) are retried after an
+						// increasing delay, instead of spinning.
+						if !isTemporaryAcceptError(err) {
+							dispatcher.reportError(err)
+							continue
+						}
+						delay := backoff.next()
+						dispatcher.reportError(TemporaryAcceptError{err, delay})
+						if !backoff.wait(&dispatcher.resources, quit) {
+							break Loop
+						}
+					} else {
+						backoff.reset()
+						// A listener which could not be interrupted
+						// may still accept a connection once told to
+						// quit: it is not handed over.
+						select {
+						case <-quit:
+							// noinspection GoUnhandledErrorResult
+							conn.Close()
+							break Loop
+						default:
+						}
+						atomic.StoreInt64(&dispatcher.stats.lastAcceptAt, time.Now().UnixNano())
+						admitted := false
+						if !dispatcher.guard("accept filter", func() {
+							admitted = dispatcher.admit(conn)
+						}) {
+							// noinspection GoUnhandledErrorResult
+							conn.Close()
+						}
+						if !admitted {
+							continue
+						}
+						atomic.AddUint64(&dispatcher.stats.accepted, 1)
+						if dispatcher.onAcceptSuccess != nil {
+							dispatcher.guard("accept success", func() {
+								dispatcher.onAcceptSuccess(dispatcher, conn)
+							})
+						}
 					}
 				}
 			}
+			return
+		})
+		if owned {
+			if closeErr := closeListener(); closeErr != nil && !isClosedSocketError(closeErr) && err == nil {
+				reason, err = DispatcherStopListenerError, closeErr
+			}
+		} else if deadline, ok := listener.(deadlineListener); ok {
+			// noinspection GoUnhandledErrorResult
+			deadline.SetDeadline(time.Time{})
 		}
 		if dispatcher.onStop != nil {
-			dispatcher.onStop(dispatcher)
+			dispatcher.guard("stop", func() {
+				dispatcher.onStop(dispatcher, reason, err)
+			})
 		}
-		// noinspection GoUnhandledErrorResult
-		dispatcher.listener.Close()
+		dispatcher.mutex.Lock()
 		dispatcher.listener = nil
-	}()
-	return func() { close(quit) }, nil
+		dispatcher.mutex.Unlock()
+		if owned {
+			dispatcher.resources.addConnections(-1)
+		}
+		close(done)
+	})
+
+	// Once the context is done, the loop is signalled and the
+	// listener is closed (or, if not owned, its accept deadline
+	// expires), so a pending Accept returns right away.
+	dispatcher.resources.spawn(func() {
+		select {
+		case <-ctx.Done():
+			close(quit)
+			if owned {
+				// noinspection GoUnhandledErrorResult
+				closeListener()
+			} else if deadline, ok := listener.(deadlineListener); ok {
+				// noinspection GoUnhandledErrorResult
+				deadline.SetDeadline(time.Unix(1, 0))
+			}
+		case <-done:
+		}
+	})
+	return done
 }
 
 
-// Creates a new dispatcher, ready to be used.
+// Waits until the accept loop finished (e.g. while another
+// goroutine calls the closer, or once the context given to
+// RunContext is done), for up to the given time. Tells
+// whether it finished (dispatchers not running are).
+func (dispatcher *Dispatcher) Wait(timeout time.Duration) bool {
+	dispatcher.mutex.Lock()
+	done := dispatcher.done
+	dispatcher.mutex.Unlock()
+	if done == nil {
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+
+// Returns the resources currently owned by this dispatcher:
+// the accept loop goroutines and the listener.
+func (dispatcher *Dispatcher) ResourceCounts() ResourceCounts {
+	return dispatcher.resources.counts()
+}
+
+
+// Creates a new dispatcher, ready to be used. Optional
+// settings are configured by means of the trailing options.
 func NewDispatcher(onStart OnDispatcherStart, onAcceptSuccess OnDispatcherAcceptSuccess,
-				   onAcceptError OnDispatcherAcceptError, onStop OnDispatcherStop) *Dispatcher {
-	return &Dispatcher{
+				   onAcceptError OnDispatcherAcceptError, onStop OnDispatcherStop,
+				   options ...DispatcherOption) *Dispatcher {
+	dispatcher := &Dispatcher{
 		onStart: onStart,
 		onAcceptSuccess: onAcceptSuccess,
 		onAcceptError: onAcceptError,
 		onStop: onStop,
+		pollInterval: DefaultAcceptPollInterval,
+		network: "tcp",
+	}
+	for _, option := range options {
+		option(dispatcher)
 	}
+	return dispatcher
 }
\ No newline at end of file
@@ -0,0 +1,105 @@
+package chasqui
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+
+func TestDispatcherRunAfterFailedRun(t *testing.T) {
+	dispatcher := NewDispatcher(nil, nil, nil, nil)
+	if _, err := dispatcher.Run("unresolvable.invalid:1"); !errors.Is(err, ErrResolve) {
+		t.Fatalf("want a resolution error, got %v", err)
+	}
+	if _, err := dispatcher.Run("127.0.0.1:99999"); err == nil {
+		t.Fatal("want an error for an invalid port")
+	}
+	var closer func()
+	within(t, time.Second, "Run", func() {
+		var err error
+		if closer, err = dispatcher.Run("127.0.0.1:0"); err != nil {
+			t.Errorf("run after failures: %v", err)
+		}
+	})
+	if closer == nil {
+		t.FailNow()
+	}
+	if dispatcher.TCPAddr() == nil {
+		t.Fatal("no address while running")
+	}
+	closer()
+}
+
+
+func TestDispatcherAddrDuringShutdown(t *testing.T) {
+	dispatcher := NewDispatcher(nil, nil, nil, nil)
+	for round := 0; round < 50; round++ {
+		closer, err := dispatcher.Run("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		quit := make(chan struct{})
+		var group sync.WaitGroup
+		for index := 0; index < 4; index++ {
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				for {
+					select {
+					case <-quit:
+						return
+					default:
+						// noinspection GoUnhandledErrorResult
+						dispatcher.Addr()
+					}
+				}
+			}()
+		}
+		closer()
+		close(quit)
+		group.Wait()
+		if _, err := dispatcher.Addr(); !errors.Is(err, ErrNotListening) {
+			t.Fatalf("round %d: Addr after stop returned %v", round, err)
+		}
+	}
+}
+
+
+func TestDispatcherRunStopCycles(t *testing.T) {
+	accepted := make(chan struct{}, 1)
+	dispatcher := NewDispatcher(nil, func(_ *Dispatcher, conn net.Conn) {
+		// noinspection GoUnhandledErrorResult
+		conn.Close()
+		accepted <- struct{}{}
+	}, nil, nil)
+	port := 0
+	for cycle := 0; cycle < 100; cycle++ {
+		// The same port is bound on every cycle, so a leaked
+		// listener fails the next run.
+		closer, err := dispatcher.Run("127.0.0.1:" + strconv.Itoa(port))
+		if err != nil {
+			t.Fatalf("cycle %d: run: %v", cycle, err)
+		}
+		port = dispatcher.TCPAddr().Port
+		conn, _ := dialTest(t, dispatcher.TCPAddr())
+		<-accepted
+		// noinspection GoUnhandledErrorResult
+		conn.Close()
+		closer()
+		if _, err := dispatcher.Addr(); !errors.Is(err, ErrNotListening) {
+			t.Fatalf("cycle %d: still listening after the closer returned", cycle)
+		}
+	}
+	// The goroutines finish right after the closer returns.
+	deadline := time.Now().Add(time.Second)
+	for dispatcher.resources.counts() != (ResourceCounts{}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("resources not released: %+v", dispatcher.resources.counts())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,75 @@
+package chasqui
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+
+// A snapshot of the counters of a dispatcher, since it last
+// started running: the connections accepted (and handed over),
+// the ones rejected by the accept filter or veto, the accept
+// failures (including the temporary ones), and the instant of
+// the last accepted connection (zero if none).
+type DispatcherStats struct {
+	Accepted     uint64
+	Rejected     uint64
+	Failed       uint64
+	LastAcceptAt time.Time
+}
+
+
+// The counters of a dispatcher. The instant is kept in unix
+// nanoseconds, and zero means none.
+type dispatcherStats struct {
+	accepted     uint64
+	rejected     uint64
+	failed       uint64
+	lastAcceptAt int64
+}
+
+
+// Resets the counters, once the dispatcher starts running.
+func (stats *dispatcherStats) reset() {
+	atomic.StoreUint64(&stats.accepted, 0)
+	atomic.StoreUint64(&stats.rejected, 0)
+	atomic.StoreUint64(&stats.failed, 0)
+	atomic.StoreInt64(&stats.lastAcceptAt, 0)
+}
+
+
+// Takes a snapshot of the counters.
+func (stats *dispatcherStats) snapshot() DispatcherStats {
+	return DispatcherStats{
+		Accepted:     atomic.LoadUint64(&stats.accepted),
+		Rejected:     atomic.LoadUint64(&stats.rejected),
+		Failed:       atomic.LoadUint64(&stats.failed),
+		LastAcceptAt: unixInstant(atomic.LoadInt64(&stats.lastAcceptAt)),
+	}
+}
+
+
+// Returns a snapshot of the counters of the dispatcher, since
+// it last started running. It may be called from any
+// goroutine.
+func (dispatcher *Dispatcher) Stats() DispatcherStats {
+	return dispatcher.stats.snapshot()
+}
+
+
+// Returns a snapshot of the counters of the dispatchers of the
+// server, added up (see RunMulti), since it last started
+// running. It may be called from any goroutine.
+func (server *Server) DispatcherStats() DispatcherStats {
+	var total DispatcherStats
+	for _, dispatcher := range server.allDispatchers() {
+		stats := dispatcher.Stats()
+		total.Accepted += stats.Accepted
+		total.Rejected += stats.Rejected
+		total.Failed += stats.Failed
+		if stats.LastAcceptAt.After(total.LastAcceptAt) {
+			total.LastAcceptAt = stats.LastAcceptAt
+		}
+	}
+	return total
+}
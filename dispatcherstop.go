@@ -0,0 +1,118 @@
+package chasqui
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+
+// The reason the accept loop of a dispatcher finished.
+type DispatcherStopReason int
+
+
+const (
+	// The stop was requested (by the closer, or the context
+	// given to RunContext).
+	DispatcherStopRequested DispatcherStopReason = iota
+	// The listener failed: it stopped accepting without being
+	// told to (e.g. it was closed by other means), or it could
+	// not be closed on stop.
+	DispatcherStopListenerError
+	// The accept loop panicked (e.g. inside the Accept method
+	// of a custom listener).
+	DispatcherStopPanic
+)
+
+
+// The name of the reason.
+func (reason DispatcherStopReason) String() string {
+	switch reason {
+	case DispatcherStopRequested:
+		return "requested"
+	case DispatcherStopListenerError:
+		return "listener error"
+	case DispatcherStopPanic:
+		return "panic"
+	default:
+		return "unknown"
+	}
+}
+
+
+// Tells whether the reason is an abnormal one (i.e. not
+// requested).
+func (reason DispatcherStopReason) Abnormal() bool {
+	return reason != DispatcherStopRequested
+}
+
+
+// Error reporting the accept loop of a dispatcher panicked,
+// ending it (see DispatcherStopPanic). It tells the panic
+// value and the stack of the panic, and matches
+// ErrAcceptLoopPanic.
+type AcceptLoopPanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+
+// The error message.
+func (err AcceptLoopPanicError) Error() string {
+	return fmt.Sprintf("dispatcher accept loop panicked: %v", err.Value)
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err AcceptLoopPanicError) Is(target error) bool {
+	return target == ErrAcceptLoopPanic
+}
+
+
+// Runs the accept loop, recovering from its panic. Returns
+// why it finished, and the underlying error (if abnormal).
+func (dispatcher *Dispatcher) runAcceptLoop(loop func() (DispatcherStopReason, error)) (reason DispatcherStopReason, err error) {
+	returned := false
+	defer func() {
+		if !returned {
+			reason, err = DispatcherStopPanic, AcceptLoopPanicError{recover(), debug.Stack()}
+		}
+	}()
+	reason, err = loop()
+	returned = true
+	return
+}
+
+
+// Records the stop of one of the dispatchers of the server:
+// the first abnormal one is kept, to be told by the stopped
+// event. If it happens on its own (i.e. not while stopping),
+// the stopped event is triggered right away (and not again
+// by Stop).
+func (server *Server) recordDispatcherStop(_dispatcher *Dispatcher, reason DispatcherStopReason, err error) {
+	if !reason.Abnormal() {
+		return
+	}
+	server.logger.Errorf("server dispatcher stopped abnormally (%s): %v", reason, err)
+	server.stopMutex.Lock()
+	if !server.stopReason.Abnormal() {
+		server.stopReason, server.stopErr = reason, err
+	}
+	emit := !server.stopEmitted
+	select {
+	case <-server.stopping:
+		emit = false
+	default:
+	}
+	if emit {
+		server.stopEmitted = true
+	}
+	server.stopMutex.Unlock()
+	if emit {
+		// The accept loop runs this, and stopping waits for it.
+		select {
+		case server.stoppedEvent <- ServerStoppedEvent{reason, err}:
+		case <-server.stopping:
+			server.logger.Warnf("server dropped its stopped event while stopping")
+		}
+	}
+}
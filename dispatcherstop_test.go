@@ -0,0 +1,93 @@
+package chasqui
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+
+// A listener whose Accept panics.
+type panickingListener struct {
+	net.Listener
+}
+
+
+func (panickingListener) Accept() (net.Conn, error) {
+	panic("accept exploded")
+}
+
+
+// Waits for the stopped event of a server.
+func waitServerStopped(t *testing.T, server *Server) ServerStoppedEvent {
+	t.Helper()
+	select {
+	case event := <-server.StoppedEvent():
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no stopped event")
+		return ServerStoppedEvent{}
+	}
+}
+
+
+func TestServerStoppedEventOnListenerClosed(t *testing.T) {
+	server := newTestServer(4)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RunWithListener(listener); err != nil {
+		t.Fatal(err)
+	}
+	<-server.StartedEvent()
+	// noinspection GoUnhandledErrorResult
+	listener.Close()
+	if event := waitServerStopped(t, server); event.Reason != DispatcherStopListenerError || event.Err == nil {
+		t.Fatalf("stopped with %s (%v)", event.Reason, event.Err)
+	}
+	within(t, 2*time.Second, "Stop", func() {
+		// noinspection GoUnhandledErrorResult
+		server.Stop()
+	})
+	if len(server.StoppedEvent()) != 0 {
+		t.Fatal("Stop triggered a second stopped event")
+	}
+}
+
+
+func TestServerStoppedEventOnAcceptPanic(t *testing.T) {
+	server := newTestServer(4)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RunWithListener(panickingListener{listener}); err != nil {
+		t.Fatal(err)
+	}
+	event := waitServerStopped(t, server)
+	if event.Reason != DispatcherStopPanic || !errors.Is(event.Err, ErrAcceptLoopPanic) {
+		t.Fatalf("stopped with %s (%v)", event.Reason, event.Err)
+	}
+	within(t, 2*time.Second, "Stop", func() {
+		// noinspection GoUnhandledErrorResult
+		server.Stop()
+	})
+}
+
+
+func TestServerStoppedEventOnRequestedStop(t *testing.T) {
+	server := newTestServer(4)
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	within(t, 2*time.Second, "Stop", func() {
+		if err := server.Stop(); err != nil {
+			t.Error(err)
+		}
+	})
+	if event := waitServerStopped(t, server); event.Reason != DispatcherStopRequested || event.Err != nil {
+		t.Fatalf("stopped with %s (%v)", event.Reason, event.Err)
+	}
+}
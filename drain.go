@@ -0,0 +1,129 @@
+package chasqui
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+
+// Error returned by Drain when the pending writes were not
+// flushed in time (the attendant is stopped anyway).
+type DrainTimeoutError struct {
+	Timeout time.Duration
+}
+
+
+// The error message.
+func (err DrainTimeoutError) Error() string {
+	return "attendant could not flush its pending writes within " + err.Timeout.String()
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err DrainTimeoutError) Is(target error) bool {
+	return target == ErrDrainTimeout
+}
+
+
+// Tells whether the attendant is draining (see Drain).
+func (attendant *Attendant) Draining() bool {
+	return atomic.LoadInt32(&attendant.draining) == 1
+}
+
+
+// Gracefully stops the attendant: the newly received messages
+// are no longer conveyed (they are still read, and discarded,
+// so the peer is not blocked writing to us: a paused reading
+// is resumed), the pending writes are flushed (the ones in the
+// outgoing queue, or the direct one in progress), and then the
+// attendant is stopped as Stop does (producing a local stop).
+// Sends made while draining are still written, if they are
+// made before the flush completes. If the writes are not
+// flushed within the given time (e.g. the peer does not read),
+// the attendant is stopped anyway (which makes the pending
+// write fail) and a DrainTimeoutError is returned. Attendants
+// not started are just stopped.
+func (attendant *Attendant) Drain(timeout time.Duration) error {
+	switch attendant.Status() {
+	case AttendantNew:
+		return attendant.Stop()
+	case AttendantStopped:
+		return AttendantIsAlreadyStopped(true)
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	if atomic.CompareAndSwapInt32(&attendant.draining, 0, 1) {
+		attendant.logger.Debugf("attendant %d draining", attendant.id)
+	}
+	attendant.ResumeReading()
+	var err error
+	if !attendant.flush(timeout) {
+		err = DrainTimeoutError{timeout}
+	}
+	if stopErr := attendant.Stop(); stopErr != nil {
+		return stopErr
+	}
+	return err
+}
+
+
+// Waits until the pending writes are done (and flushed, if
+// the writes are coalesced), at most the given time. Returns
+// whether they were done in time.
+func (attendant *Attendant) flush(timeout time.Duration) bool {
+	start := time.Now()
+	if attendant.sendQueue != nil {
+		if !attendant.sendQueue.flush(timeout) {
+			return false
+		}
+	} else if !attendant.acquireSendSlot(timeout) {
+		return false
+	} else {
+		attendant.releaseSendSlot()
+	}
+	remaining := timeout - time.Since(start)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return attendant.flushWithin(remaining) == nil
+}
+
+
+// Gracefully stops the server: it stops accepting connections,
+// drains all the attendants concurrently (see Attendant.Drain)
+// until the given time elapses, and stops the ones still
+// running by then. Besides that, it behaves as Stop.
+func (server *Server) StopDraining(timeout time.Duration) error {
+	if server.runningCloser(false) == nil {
+		return DispatcherNotListeningError(true)
+	}
+	server.drainDeadline = time.Now().Add(timeout)
+	defer func() {
+		server.drainDeadline = time.Time{}
+	}()
+	return server.Stop()
+}
+
+
+// Drains all the attendants concurrently, until the given
+// deadline, when the server is being stopped gracefully.
+func (server *Server) drainAttendants(deadline time.Time) {
+	var attendants []*Attendant
+	server.Enumerate(func(attendant *Attendant) {
+		attendants = append(attendants, attendant)
+	})
+	var group sync.WaitGroup
+	group.Add(len(attendants))
+	for _, attendant := range attendants {
+		attendant := attendant
+		go func() {
+			defer group.Done()
+			if err := attendant.Drain(time.Until(deadline)); err != nil {
+				server.logger.Debugf("server drained attendant %d: %v", attendant.ID(), err)
+			}
+		}()
+	}
+	group.Wait()
+}
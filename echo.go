@@ -0,0 +1,163 @@
+package chasqui
+
+import (
+	. "github.com/universe-10th/chasqui/types"
+	"strconv"
+	"sync"
+	"time"
+)
+
+
+// The command of the probes sent by MeasureEchoLatency. Its
+// "seq" kwarg tells the probe apart from the others.
+const EchoProbeCommand = "__ECHO_PROBE"
+
+
+// Error raised when an echo probe does not come back in time.
+type EchoTimeoutError struct {
+	Timeout time.Duration
+}
+
+
+// The error message.
+func (err EchoTimeoutError) Error() string {
+	return "echo did not come back within " + err.Timeout.String()
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err EchoTimeoutError) Is(target error) bool {
+	return target == ErrEchoTimeout
+}
+
+
+// The echo mode of an attendant: whether it is enabled, and
+// the prefix added to the echoed commands.
+type echoState struct {
+	mutex   sync.Mutex
+	enabled bool
+	prefix  string
+}
+
+
+// The round-trip latencies measured over several echoes.
+type EchoLatency struct {
+	Samples int
+	Min     time.Duration
+	Avg     time.Duration
+	Max     time.Duration
+}
+
+
+// Enables or disables the echo mode, for connection diagnostics.
+// While enabled, each received message is sent back right away,
+// with the given prefix added to its command (e.g. "ECHO:") and
+// the same args and kwargs, instead of being conveyed: it never
+// reaches the application. Messages are still counted and
+// throttled (throttled messages are not echoed).
+func (attendant *Attendant) SetEchoMode(enabled bool, prefix string) {
+	attendant.echo.mutex.Lock()
+	defer attendant.echo.mutex.Unlock()
+	attendant.echo.enabled = enabled
+	attendant.echo.prefix = prefix
+}
+
+
+// Tells whether the echo mode is enabled, and its prefix.
+func (attendant *Attendant) EchoMode() (bool, string) {
+	attendant.echo.mutex.Lock()
+	defer attendant.echo.mutex.Unlock()
+	return attendant.echo.enabled, attendant.echo.prefix
+}
+
+
+// Sends a received message back, if the echo mode is enabled.
+// Returns whether it did.
+func (attendant *Attendant) echoBack(message Message) bool {
+	enabled, prefix := attendant.EchoMode()
+	if !enabled {
+		return false
+	}
+	// noinspection GoUnhandledErrorResult
+	attendant.Send(prefix + message.Command(), message.Args(), message.KWArgs())
+	return true
+}
+
+
+// Sends the given number of echo probes, one at a time, through
+// a running client whose peer is in echo mode with the given
+// prefix, and measures their round-trip latencies. Each probe
+// must come back within the given time. The client messages
+// are taken meanwhile: the ones not being the expected echo are
+// discarded, so nothing else should consume them.
+func MeasureEchoLatency(client *Attendant, samples int, prefix string, timeout time.Duration) (EchoLatency, error) {
+	return measureEchoLatency(client, samples, prefix, timeout, time.Now)
+}
+
+
+// Measures the echo latencies, telling the instants with the
+// given clock.
+func measureEchoLatency(
+	client *Attendant, samples int, prefix string, timeout time.Duration, now func() time.Time,
+) (EchoLatency, error) {
+	if client == nil {
+		panic(ArgumentError{"MeasureEchoLatency:client"})
+	}
+	if samples <= 0 {
+		panic(ArgumentError{"MeasureEchoLatency:samples"})
+	}
+	latencies := make([]time.Duration, 0, samples)
+	for index := 0; index < samples; index++ {
+		seq := strconv.Itoa(index)
+		sentAt := now()
+		if err := client.Send(EchoProbeCommand, Args{}, KWArgs{"seq": seq}); err != nil {
+			return summarizeLatencies(latencies), err
+		}
+		if err := awaitEcho(client, prefix + EchoProbeCommand, seq, timeout); err != nil {
+			return summarizeLatencies(latencies), err
+		}
+		latencies = append(latencies, now().Sub(sentAt))
+	}
+	return summarizeLatencies(latencies), nil
+}
+
+
+// Waits until the given echo arrives to the client, discarding
+// other messages, at most the given time.
+func awaitEcho(client *Attendant, command, seq string, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case event := <-client.MessageEvent():
+			if event.Message.Command() == command && event.Message.KWArgs()["seq"] == seq {
+				return nil
+			}
+		case <-client.done:
+			return AttendantIsStopped(true)
+		case <-timer.C:
+			return EchoTimeoutError{timeout}
+		}
+	}
+}
+
+
+// Computes the minimum, average and maximum latencies.
+func summarizeLatencies(latencies []time.Duration) EchoLatency {
+	if len(latencies) == 0 {
+		return EchoLatency{}
+	}
+	summary := EchoLatency{Samples: len(latencies), Min: latencies[0], Max: latencies[0]}
+	total := time.Duration(0)
+	for _, latency := range latencies {
+		if latency < summary.Min {
+			summary.Min = latency
+		}
+		if latency > summary.Max {
+			summary.Max = latency
+		}
+		total += latency
+	}
+	summary.Avg = total / time.Duration(len(latencies))
+	return summary
+}
@@ -1,5 +1,7 @@
 package chasqui
 
+import "errors"
+
 
 // An error in an argument while instantiating anything in this library.
 type ArgumentError struct {
@@ -16,4 +18,48 @@ func (argumentError ArgumentError) Argument() string {
 // Returns the error message.
 func (argumentError ArgumentError) Error() string {
 	return "Argument error: " + argumentError.argument
-}
\ No newline at end of file
+}
+
+// Sentinel errors, to be matched with errors.Is against the
+// errors returned by this library (even when wrapped). The
+// ones of the boolean error types are just their values, so
+// comparing against those types keeps working.
+var (
+	ErrInvalidArgument         = errors.New("invalid argument")
+	ErrAttendantNotNew         error = AttendantIsNotNew(true)
+	ErrAttendantStopped        error = AttendantIsStopped(true)
+	ErrAttendantAlreadyStopped error = AttendantIsAlreadyStopped(true)
+	ErrAlreadyListening        error = DispatcherAlreadyListeningError(true)
+	ErrNotListening            error = DispatcherNotListeningError(true)
+	ErrRelayClosed             error = RelayIsClosed(true)
+	ErrSendQueueFull           error = SendQueueFullError(true)
+	ErrSendQueueOverflow       error = SendQueueOverflowError(true)
+	ErrSendQueueRequired       error = SendQueueRequiredError(true)
+	ErrWriteClosed             error = WriteClosedError(true)
+	ErrHalfCloseUnsupported    error = HalfCloseUnsupportedError(true)
+	ErrSendUnsupported         error = SendUnsupportedError(true)
+	ErrReusePortUnsupported    error = ReusePortUnsupportedError(true)
+	ErrListenerFileUnsupported error = ListenerFileUnsupportedError(true)
+	ErrSendTimeout             = errors.New("send timeout")
+	ErrBandwidthExceeded       = errors.New("bandwidth exceeded")
+	ErrByteRateExceeded        = errors.New("byte rate exceeded")
+	ErrKeepaliveTimeout        = errors.New("keepalive timeout")
+	ErrFeatureConflict         = errors.New("feature conflict")
+	ErrTeardownFailed          = errors.New("teardown failed")
+	ErrAuthRejected            = errors.New("authentication rejected")
+	ErrThrottleEscalated       = errors.New("throttle escalated")
+	ErrWriteStalled            = errors.New("write stalled")
+	ErrDrainTimeout            = errors.New("drain timeout")
+	ErrEchoTimeout             = errors.New("echo timeout")
+	ErrProxyHeader             = errors.New("invalid PROXY protocol header")
+	ErrSocketActivation        = errors.New("socket activation failed")
+	ErrResolve                 = errors.New("address resolution failed")
+	ErrCallbackPanic           = errors.New("callback panicked")
+	ErrAcceptLoopPanic         = errors.New("accept loop panicked")
+)
+
+
+// Tells whether the error matches the given sentinel.
+func (argumentError ArgumentError) Is(target error) bool {
+	return target == ErrInvalidArgument
+}
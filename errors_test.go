@@ -0,0 +1,133 @@
+package chasqui
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+
+// Wraps the error twice, as callers usually do.
+func wrapTwice(err error) error {
+	return fmt.Errorf("outer: %w", fmt.Errorf("inner: %w", err))
+}
+
+
+func TestAttendantErrorsMatchThroughWrapping(t *testing.T) {
+	attendant, remote, _, stopped := newPipeAttendant()
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	startAgain := attendant.Start()
+	if err := attendant.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	<-stopped
+	stopAgain := attendant.Stop()
+	sendStopped := attendant.Send("PING", nil, nil)
+
+	for _, check := range []struct {
+		name     string
+		err      error
+		sentinel error
+		legacy   error
+	}{
+		{"Start twice", startAgain, ErrAttendantNotNew, AttendantIsNotNew(true)},
+		{"Stop twice", stopAgain, ErrAttendantAlreadyStopped, AttendantIsAlreadyStopped(true)},
+		{"Send after stop", sendStopped, ErrAttendantStopped, AttendantIsStopped(true)},
+	} {
+		if check.err != check.legacy {
+			t.Errorf("%s: the legacy comparison must keep working, got: %v", check.name, check.err)
+		}
+		for _, err := range []error{check.err, wrapTwice(check.err)} {
+			if !errors.Is(err, check.sentinel) {
+				t.Errorf("%s: %v must match %v", check.name, err, check.sentinel)
+			}
+		}
+	}
+	var stoppedError AttendantIsStopped
+	if !errors.As(wrapTwice(sendStopped), &stoppedError) || !bool(stoppedError) {
+		t.Errorf("the legacy type must be extracted through wrapping")
+	}
+	// Already stopped is a case of stopped, but not the other
+	// way around.
+	if !errors.Is(wrapTwice(stopAgain), ErrAttendantStopped) || errors.Is(sendStopped, ErrAttendantAlreadyStopped) {
+		t.Errorf("only the already stopped error must match both sentinels")
+	}
+}
+
+
+func TestServerErrorsMatchThroughWrapping(t *testing.T) {
+	server := newTestServer(16)
+	stopConsuming := consumeEvents(server)
+	defer stopConsuming()
+	if err := server.Stop(); !errors.Is(wrapTwice(err), ErrNotListening) || err != DispatcherNotListeningError(true) {
+		t.Fatalf("stopping an idle server must tell it is not listening, got: %v", err)
+	}
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer server.Stop()
+	if err := server.Run("127.0.0.1:0"); !errors.Is(wrapTwice(err), ErrAlreadyListening) {
+		t.Fatalf("running a running server must tell it is already listening, got: %v", err)
+	}
+
+	// Errors of the network come unchanged, or wrapped.
+	other := newTestServer(16)
+	err := other.Run(server.TCPAddr().String())
+	var opError *net.OpError
+	if err == nil || !errors.As(wrapTwice(err), &opError) || opError.Op != "listen" {
+		// noinspection GoUnhandledErrorResult
+		other.Stop()
+		t.Fatalf("listening on a taken address must extract a listen *net.OpError, got: %v", err)
+	}
+	err = other.Run("127.0.0.1:99999")
+	var resolveError ResolveError
+	if !errors.Is(wrapTwice(err), ErrResolve) || !errors.As(wrapTwice(err), &resolveError) ||
+		resolveError.Host != "127.0.0.1:99999" || errors.Unwrap(resolveError) == nil {
+		t.Fatalf("an unresolvable host must match ErrResolve and keep its cause, got: %v", err)
+	}
+}
+
+
+func TestArgumentErrorsMatchThroughWrapping(t *testing.T) {
+	var recovered interface{}
+	func() {
+		defer func() {
+			recovered = recover()
+		}()
+		WithDispatcherNetwork("udp")
+	}()
+	err, ok := recovered.(error)
+	if !ok {
+		t.Fatalf("an invalid argument must panic with an error, got: %v", recovered)
+	}
+	var argumentError ArgumentError
+	if !errors.Is(wrapTwice(err), ErrInvalidArgument) || !errors.As(wrapTwice(err), &argumentError) ||
+		argumentError.Argument() != "WithDispatcherNetwork:network" {
+		t.Fatalf("unexpected argument error: %v", err)
+	}
+}
+
+
+func TestWrappingErrorsUnwrapToTheirCause(t *testing.T) {
+	cause := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}
+	for _, err := range []error{
+		TemporaryAcceptError{Err: cause},
+		TeardownError{Err: cause},
+		ShutdownForcedError{Err: cause},
+		ResolveError{Err: cause},
+	} {
+		var opError *net.OpError
+		if !errors.As(wrapTwice(err), &opError) || opError != cause {
+			t.Errorf("%T must unwrap to its cause", err)
+		}
+	}
+	if !errors.Is(TeardownError{Err: cause}, ErrTeardownFailed) {
+		t.Errorf("a teardown error must match ErrTeardownFailed")
+	}
+}
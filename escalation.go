@@ -0,0 +1,166 @@
+package chasqui
+
+import (
+	"fmt"
+	. "github.com/universe-10th/chasqui/types"
+	"time"
+)
+
+
+// What to do when an attendant keeps being throttled (see
+// Attendant.SetThrottleEscalation). Actions are created with
+// EscalateDisconnect or EscalateSlowdown.
+type EscalationAction struct {
+	disconnect bool
+	code       int
+	reason     string
+	factor     float64
+	duration   time.Duration
+}
+
+
+// Returns an action disconnecting the attendant: a close
+// notice with the given code and reason (see CloseReason) is
+// sent to the peer, and then the attendant is stopped
+// abnormally with a ThrottleEscalatedError.
+func EscalateDisconnect(code int, reason string) EscalationAction {
+	return EscalationAction{disconnect: true, code: code, reason: reason}
+}
+
+
+// Returns an action multiplying the lapse-based throttles
+// (the general one and the command ones) by the given factor
+// for the given time. Throttle policies and byte throttles
+// are not affected. Factors below 1 are taken as 1.
+func EscalateSlowdown(factor float64, duration time.Duration) EscalationAction {
+	if factor < 1 {
+		factor = 1
+	}
+	return EscalationAction{factor: factor, duration: duration}
+}
+
+
+// Error used to abort an attendant disconnected due to a
+// throttle escalation.
+type ThrottleEscalatedError struct {
+	Violations int
+	Reason     string
+}
+
+
+// The error message.
+func (err ThrottleEscalatedError) Error() string {
+	return fmt.Sprintf("throttle escalated after %d violations: %s", err.Violations, err.Reason)
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err ThrottleEscalatedError) Is(target error) bool {
+	return target == ErrThrottleEscalated
+}
+
+
+// The throttle escalation of an attendant: how many violations
+// within the window trigger the action, the instants of the
+// recent violations, and the current slowdown (if any).
+type throttleEscalation struct {
+	maxViolations int
+	window        time.Duration
+	action        EscalationAction
+	violations    []time.Time
+	slowFactor    float64
+	slowUntil     time.Time
+}
+
+
+// Forgets the violations that happened before the window.
+func (escalation *throttleEscalation) decay(now time.Time) {
+	kept := 0
+	for _, instant := range escalation.violations {
+		if now.Sub(instant) < escalation.window {
+			escalation.violations[kept] = instant
+			kept++
+		}
+	}
+	escalation.violations = escalation.violations[:kept]
+}
+
+
+// Scales a lapse-based throttle, while slowed down.
+func (escalation *throttleEscalation) scale(now time.Time, lapse time.Duration) time.Duration {
+	if escalation != nil && now.Before(escalation.slowUntil) {
+		return time.Duration(float64(lapse) * escalation.slowFactor)
+	}
+	return lapse
+}
+
+
+// Sets the throttle escalation of the current attendant: once
+// its messages are throttled maxViolations times within the
+// given window (older violations decay), the action is taken
+// and the count starts over. A zero maxViolations or window
+// removes the escalation.
+func (attendant *Attendant) SetThrottleEscalation(maxViolations int, window time.Duration, action EscalationAction) {
+	attendant.throttleMutex.Lock()
+	defer attendant.throttleMutex.Unlock()
+	if maxViolations <= 0 || window <= 0 {
+		attendant.escalation = nil
+	} else {
+		attendant.escalation = &throttleEscalation{
+			maxViolations: maxViolations, window: window, action: action,
+		}
+	}
+}
+
+
+// Returns the current count of throttle violations within the
+// escalation window. It is always zero without an escalation.
+func (attendant *Attendant) ThrottleViolations() int {
+	attendant.throttleMutex.Lock()
+	defer attendant.throttleMutex.Unlock()
+	if attendant.escalation == nil {
+		return 0
+	}
+	attendant.escalation.decay(time.Now())
+	return len(attendant.escalation.violations)
+}
+
+
+// Counts a throttle violation and, if it reaches the maximum,
+// takes the escalation action. It runs in the read loop, so
+// disconnections send their close notice right away.
+func (attendant *Attendant) violate(now time.Time) {
+	attendant.throttleMutex.Lock()
+	escalation := attendant.escalation
+	if escalation == nil {
+		attendant.throttleMutex.Unlock()
+		return
+	}
+	escalation.decay(now)
+	escalation.violations = append(escalation.violations, now)
+	violations := len(escalation.violations)
+	if violations < escalation.maxViolations {
+		attendant.throttleMutex.Unlock()
+		return
+	}
+	escalation.violations = escalation.violations[:0]
+	action := escalation.action
+	if !action.disconnect {
+		escalation.slowFactor = action.factor
+		escalation.slowUntil = now.Add(action.duration)
+	}
+	attendant.throttleMutex.Unlock()
+
+	if action.disconnect {
+		attendant.logger.Warnf("attendant %d disconnected after %d throttle violations", attendant.id, violations)
+		timeout := attendant.WriteTimeout()
+		if timeout == 0 {
+			timeout = DefaultFarewellTimeout
+		}
+		// noinspection GoUnhandledErrorResult
+		attendant.sendFlushed(timeout, CloseCommand, Args{}, KWArgs{"code": action.code, "text": action.reason})
+		attendant.abort(ThrottleEscalatedError{violations, action.reason})
+	} else {
+		attendant.logger.Warnf("attendant %d slowed down after %d throttle violations", attendant.id, violations)
+	}
+}
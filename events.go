@@ -0,0 +1,180 @@
+package chasqui
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+
+// What to do when a message or throttled event is triggered
+// but its channel is full (i.e. the consumer stalls):
+// - Block: Wait until there is room (the read loop stalls).
+// - Drop: Discard the new event.
+// - DropOldest: Discard the oldest event waiting in the
+//   channel to make room. Beware: channels shared among
+//   attendants (e.g. in a server) may discard the events
+//   of another attendant. Unbuffered channels discard the
+//   new event instead.
+// Dropped events are counted (see Attendant.DroppedEvents).
+// Start and stop events are always delivered.
+type EventDeliveryPolicy int
+const (
+	EventDeliveryBlock EventDeliveryPolicy = iota
+	EventDeliveryDrop
+	EventDeliveryDropOldest
+)
+
+
+// The minimum lapse between two overflow events of the
+// same attendant.
+const EventOverflowInterval = time.Second
+
+
+// Event reporting an attendant is dropping events because
+// their channels are full. It is triggered at most once
+// per EventOverflowInterval for each attendant, and it is
+// also discarded if its own channel is full. Dropped is
+// the total count of dropped events of the attendant.
+type EventOverflowEvent struct {
+	Attendant   *Attendant
+	AttendantID uint64
+	Dropped     uint64
+}
+
+
+// Returns how many events this attendant dropped due to its
+// event delivery policy.
+func (attendant *Attendant) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&attendant.droppedEvents)
+}
+
+
+// Returns a read-only channel with all the "event overflow"
+// events. It will be nil unless a channel was given on
+// construction.
+func (attendant *Attendant) EventOverflowEvent() <-chan EventOverflowEvent {
+	return attendant.eventOverflowEvent
+}
+
+
+// Counts a dropped event, and logs it and triggers the
+// overflow event if the last one was long enough ago.
+func (attendant *Attendant) dropEvent() {
+	dropped := atomic.AddUint64(&attendant.droppedEvents, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&attendant.lastOverflow)
+	if last != 0 && now - last < int64(EventOverflowInterval) {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&attendant.lastOverflow, last, now) {
+		attendant.logger.Warnf("attendant %d is dropping events (%d so far)", attendant.id, dropped)
+		event := EventOverflowEvent{attendant, attendant.id, dropped}
+		if attendant.unified() {
+			select {
+			case attendant.events <- event:
+			default:
+			}
+		} else if attendant.eventOverflowEvent != nil {
+			select {
+			case attendant.eventOverflowEvent <- event:
+			default:
+			}
+		}
+	}
+}
+
+
+// Delivers a message event according to the event delivery
+// policy, to the current channel (or echoes the message back,
+// in echo mode). Blocking deliveries give up when the quit
+// channel is closed (nil means never), returning false, and
+// move on if the attendant is rebound meanwhile.
+func (attendant *Attendant) deliverMessage(event MessageEvent, quit <-chan struct{}) bool {
+	if attendant.echoBack(event.Message) {
+		return true
+	} else if attendant.unified() {
+		return attendant.deliverUnified(event, quit)
+	}
+	channel, rebound := attendant.messageBinding()
+	switch attendant.eventDelivery {
+	case EventDeliveryDrop:
+		select {
+		case channel <- event:
+		default:
+			attendant.dropEvent()
+		}
+	case EventDeliveryDropOldest:
+		for {
+			select {
+			case channel <- event:
+				return true
+			default:
+			}
+			select {
+			case <-channel:
+				attendant.dropEvent()
+			default:
+				// Nothing to evict: the new one is dropped.
+				attendant.dropEvent()
+				return true
+			}
+		}
+	default:
+		for {
+			select {
+			case channel <- event:
+				return true
+			case <-rebound:
+				channel, rebound = attendant.messageBinding()
+			case <-quit:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+
+// Delivers a throttled event according to the event delivery
+// policy, to the current channel. Blocking deliveries move on
+// if the attendant is rebound meanwhile.
+func (attendant *Attendant) deliverThrottled(event ThrottledEvent) {
+	if attendant.unified() {
+		attendant.deliverUnified(event, nil)
+		return
+	}
+	channel, rebound := attendant.throttledBinding()
+	switch attendant.eventDelivery {
+	case EventDeliveryDrop:
+		select {
+		case channel <- event:
+		default:
+			attendant.dropEvent()
+		}
+	case EventDeliveryDropOldest:
+		for {
+			select {
+			case channel <- event:
+				return
+			default:
+			}
+			select {
+			case <-channel:
+				attendant.dropEvent()
+			default:
+				// Nothing to evict: the new one is dropped.
+				attendant.dropEvent()
+				return
+			}
+		}
+	default:
+		for {
+			select {
+			case channel <- event:
+				return
+			case <-rebound:
+				channel, rebound = attendant.throttledBinding()
+			}
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package chasqui
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+
+// The status of an optional feature of a server: whether
+// it is enabled, its effective parameters, and any soft
+// warning about its configuration.
+type FeatureStatus struct {
+	Name       string
+	Enabled    bool
+	Parameters map[string]interface{}
+	Warnings   []string
+}
+
+
+// Error raised when running a server whose features are
+// configured in a way that cannot work.
+type FeatureConflictError struct {
+	Problems []string
+}
+
+
+// The error message.
+func (err FeatureConflictError) Error() string {
+	return "feature conflicts: " + strings.Join(err.Problems, "; ")
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err FeatureConflictError) Is(target error) bool {
+	return target == ErrFeatureConflict
+}
+
+
+// A known bad combination of features. Checks are run
+// against the effective feature statuses, and return an
+// empty string when the combination is fine. Fatal checks
+// prevent the server from running, while the others just
+// add a warning to the involved feature.
+type featureCheck struct {
+	feature string
+	fatal   bool
+	check   func(map[string]FeatureStatus) string
+}
+
+
+// The table of known bad feature combinations.
+var featureChecks = []featureCheck{
+	{"bandwidth", false, func(features map[string]FeatureStatus) string {
+		bandwidth := features["bandwidth"]
+		if bandwidth.Enabled && bandwidth.Parameters["inboundLimit"] == uint64(0) &&
+			bandwidth.Parameters["outboundLimit"] == uint64(0) {
+			return "bandwidth accounting is enabled but both limits are zero: nothing will be enforced"
+		}
+		return ""
+	}},
+	{"warmup", false, func(features map[string]FeatureStatus) string {
+		warmup := features["warmup"]
+		if rate, _ := warmup.Parameters["finalRate"].(float64); warmup.Enabled && rate == 0 {
+			return "the warmup rates are zero: no connection will be admitted until Ready is called"
+		}
+		return ""
+	}},
+	{"keepalive", true, func(features map[string]FeatureStatus) string {
+		keepalive, idleTimeout := features["keepalive"], features["idleTimeout"]
+		interval, _ := keepalive.Parameters["interval"].(time.Duration)
+		timeout, _ := idleTimeout.Parameters["timeout"].(time.Duration)
+		if keepalive.Enabled && idleTimeout.Enabled && interval > 0 && interval >= timeout {
+			return "the keepalive interval is not below the idle timeout: live peers may be stopped as idle"
+		}
+		return ""
+	}},
+	{"proxyProtocol", true, func(features map[string]FeatureStatus) string {
+		if features["proxyProtocol"].Enabled && features["tls"].Enabled {
+			return "the PROXY header is read after the TLS handshake, while balancers send it before: " +
+			       "terminate TLS in the balancer, or do not expect the PROXY header"
+		}
+		return ""
+	}},
+	{"writeTimeout", false, func(features map[string]FeatureStatus) string {
+		writeTimeout := features["writeTimeout"]
+		if timeout, _ := writeTimeout.Parameters["timeout"].(time.Duration); writeTimeout.Enabled && timeout < 10 * time.Millisecond {
+			return "the write timeout is below 10ms: healthy connections will likely be aborted"
+		}
+		return ""
+	}},
+}
+
+
+// Computes the status of each known feature, in order.
+func (server *Server) featureStatuses() []FeatureStatus {
+	statuses := []FeatureStatus{
+		{
+			Name:       "throttle",
+			Enabled:    server.defaultThrottle > 0 || server.throttlePolicy != nil,
+			Parameters: map[string]interface{}{
+				"lapse": server.defaultThrottle, "policy": server.throttlePolicy != nil, "delay": server.throttleDelay,
+			},
+		},
+		{
+			Name:       "writeTimeout",
+			Enabled:    server.writeTimeout > 0,
+			Parameters: map[string]interface{}{"timeout": server.writeTimeout},
+		},
+		{
+			Name:       "writeStallTimeout",
+			Enabled:    server.stallTimeout > 0,
+			Parameters: map[string]interface{}{"timeout": server.stallTimeout},
+		},
+		{
+			Name:       "idleTimeout",
+			Enabled:    server.idleTimeout > 0,
+			Parameters: map[string]interface{}{"timeout": server.idleTimeout},
+		},
+		{
+			Name:       "firstMessageTimeout",
+			Enabled:    server.firstMessageTimeout > 0,
+			Parameters: map[string]interface{}{"timeout": server.firstMessageTimeout},
+		},
+		{
+			Name:       "maxLifetime",
+			Enabled:    server.maxLifetime > 0,
+			Parameters: map[string]interface{}{
+				"lifetime": server.maxLifetime, "code": server.expiryCode, "text": server.expiryText,
+			},
+		},
+		{
+			Name:       "sendQueue",
+			Enabled:    server.sendQueueCapacity > 0,
+			Parameters: map[string]interface{}{
+				"capacity": server.sendQueueCapacity, "policy": server.sendQueuePolicy,
+			},
+		},
+		{
+			Name:       "auth",
+			Enabled:    server.authHandler != nil,
+			Parameters: map[string]interface{}{"notify": server.authNotify},
+		},
+		{
+			Name:       "slowConsumer",
+			Enabled:    server.slowConsumerGrace > 0,
+			Parameters: map[string]interface{}{
+				"threshold": server.slowConsumerThreshold, "grace": server.slowConsumerGrace,
+			},
+		},
+		{
+			Name:       "readBuffer",
+			Enabled:    server.readBufferSize > 0,
+			Parameters: map[string]interface{}{"size": server.readBufferSize},
+		},
+		{
+			Name:       "halfClose",
+			Enabled:    server.halfClose,
+			Parameters: map[string]interface{}{},
+		},
+		{
+			Name:       "acceptPolicy",
+			Enabled:    server.acceptPolicy != nil,
+			Parameters: map[string]interface{}{},
+		},
+		{
+			Name:       "acceptFilter",
+			Enabled:    server.acceptFilter != nil,
+			Parameters: map[string]interface{}{},
+		},
+		{
+			Name:       "acceptVeto",
+			Enabled:    server.acceptVeto != nil,
+			Parameters: map[string]interface{}{},
+		},
+		{
+			Name:       "reusePort",
+			Enabled:    server.reusePort,
+			Parameters: map[string]interface{}{},
+		},
+		{
+			Name:       "tlsVerify",
+			Enabled:    server.tlsVerify != nil,
+			Parameters: map[string]interface{}{"handshakeTimeout": server.tlsHandshakeTimeout},
+		},
+		{
+			Name:       "proxyProtocol",
+			Enabled:    server.proxyHeaderTimeout > 0,
+			Parameters: map[string]interface{}{"headerTimeout": server.proxyHeaderTimeout},
+		},
+		{
+			Name:       "tls",
+			Enabled:    atomic.LoadInt32(&server.runningTLS) == 1,
+			Parameters: map[string]interface{}{},
+		},
+		{
+			Name:       "jitter",
+			Enabled:    server.jitter > 0,
+			Parameters: map[string]interface{}{"fraction": server.jitter},
+		},
+		{
+			Name:       "eventDelivery",
+			Enabled:    server.eventDelivery != EventDeliveryBlock,
+			Parameters: map[string]interface{}{"policy": server.eventDelivery},
+		},
+	}
+	if server.keepalive != nil {
+		statuses = append(statuses, FeatureStatus{
+			Name:    "keepalive",
+			Enabled: true,
+			Parameters: map[string]interface{}{
+				"interval": server.keepalive.Interval, "maxMissed": server.keepalive.MaxMissed,
+				"pingCommand": server.keepalive.PingCommand, "pongCommand": server.keepalive.PongCommand,
+				"warnAfter": server.keepalive.WarnAfter, "killAfter": server.keepalive.KillAfter,
+			},
+		})
+	} else {
+		statuses = append(statuses, FeatureStatus{Name: "keepalive", Parameters: map[string]interface{}{}})
+	}
+	if limiter := server.acceptRate; limiter != nil {
+		statuses = append(statuses, FeatureStatus{
+			Name:    "acceptRateLimit",
+			Enabled: true,
+			Parameters: map[string]interface{}{
+				"rate": limiter.config.Rate, "burst": limiter.config.Burst,
+				"maxTracked": limiter.config.MaxTracked, "busyCommand": limiter.config.BusyCommand,
+			},
+		})
+	} else {
+		statuses = append(statuses, FeatureStatus{Name: "acceptRateLimit", Parameters: map[string]interface{}{}})
+	}
+	if escalation := server.escalation; escalation != nil {
+		statuses = append(statuses, FeatureStatus{
+			Name:    "throttleEscalation",
+			Enabled: true,
+			Parameters: map[string]interface{}{
+				"maxViolations": escalation.maxViolations, "window": escalation.window,
+				"disconnect": escalation.action.disconnect,
+			},
+		})
+	} else {
+		statuses = append(statuses, FeatureStatus{Name: "throttleEscalation", Parameters: map[string]interface{}{}})
+	}
+	if server.tcpTuning != nil {
+		statuses = append(statuses, FeatureStatus{
+			Name:    "tcpTuning",
+			Enabled: true,
+			Parameters: map[string]interface{}{
+				"noDelay": server.tcpTuning.NoDelay, "keepAlive": server.tcpTuning.KeepAlive,
+				"keepAlivePeriod": server.tcpTuning.KeepAlivePeriod, "readBuffer": server.tcpTuning.ReadBuffer,
+				"writeBuffer": server.tcpTuning.WriteBuffer,
+			},
+		})
+	} else {
+		statuses = append(statuses, FeatureStatus{Name: "tcpTuning", Parameters: map[string]interface{}{}})
+	}
+	if server.warmup != nil {
+		statuses = append(statuses, FeatureStatus{
+			Name:    "warmup",
+			Enabled: true,
+			Parameters: map[string]interface{}{
+				"duration": server.warmup.duration, "initialRate": server.warmup.initialRate,
+				"finalRate": server.warmup.finalRate, "retryAfter": server.warmup.retryAfter,
+			},
+		})
+	} else {
+		statuses = append(statuses, FeatureStatus{Name: "warmup", Parameters: map[string]interface{}{}})
+	}
+	if bandwidth, ok := server.factory.(*BandwidthMarshaler); ok {
+		inbound, outbound := bandwidth.Limits()
+		statuses = append(statuses, FeatureStatus{
+			Name:    "bandwidth",
+			Enabled: true,
+			Parameters: map[string]interface{}{
+				"window": bandwidth.Window(), "inboundLimit": inbound, "outboundLimit": outbound,
+				"closeOnExceed": bandwidth.CloseOnExceed(),
+			},
+		})
+	} else {
+		statuses = append(statuses, FeatureStatus{Name: "bandwidth", Parameters: map[string]interface{}{}})
+	}
+	return statuses
+}
+
+
+// Computes the status of each known feature and runs the
+// table of checks. Returns an error if any fatal check
+// failed.
+func (server *Server) checkFeatures() ([]FeatureStatus, error) {
+	statuses := server.featureStatuses()
+	byName := make(map[string]FeatureStatus, len(statuses))
+	for _, status := range statuses {
+		byName[status.Name] = status
+	}
+	var problems []string
+	for _, check := range featureChecks {
+		if problem := check.check(byName); problem != "" {
+			if check.fatal {
+				problems = append(problems, problem)
+			}
+			for index := range statuses {
+				if statuses[index].Name == check.feature {
+					statuses[index].Warnings = append(statuses[index].Warnings, problem)
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return statuses, FeatureConflictError{problems}
+	}
+	return statuses, nil
+}
+
+
+// Reports each known feature of this server: whether it is
+// enabled, its effective parameters, and any warning about
+// its configuration.
+func (server *Server) Features() []FeatureStatus {
+	statuses, _ := server.checkFeatures()
+	return statuses
+}
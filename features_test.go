@@ -0,0 +1,87 @@
+package chasqui
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+func TestRunRefusesKeepaliveNotBelowIdleTimeout(t *testing.T) {
+	server := newTestServer(16, WithIdleTimeout(time.Second),
+		WithAttendantKeepalive(Keepalive{Interval: 2 * time.Second}))
+	err := server.Run("127.0.0.1:0")
+	var conflict FeatureConflictError
+	if !errors.Is(err, ErrFeatureConflict) || !errors.As(err, &conflict) {
+		t.Fatalf("expected a feature conflict, got: %v", err)
+	}
+	if len(conflict.Problems) != 1 || !strings.Contains(conflict.Problems[0], "keepalive interval") {
+		t.Fatalf("unexpected problems: %v", conflict.Problems)
+	}
+	if server.TCPAddr() != nil {
+		t.Fatalf("a refused server must not be listening")
+	}
+	if err := server.Stop(); !errors.Is(err, ErrNotListening) {
+		t.Fatalf("expected the refused server not to be listening, got: %v", err)
+	}
+}
+
+
+func TestRunAcceptsKeepaliveBelowIdleTimeout(t *testing.T) {
+	server := newTestServer(16, WithIdleTimeout(2 * time.Second),
+		WithAttendantKeepalive(Keepalive{Interval: time.Second}))
+	stopConsuming := consumeEvents(server)
+	defer stopConsuming()
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	// noinspection GoUnhandledErrorResult
+	server.Stop()
+}
+
+
+func TestRunTLSRefusesProxyProtocol(t *testing.T) {
+	server := newTestServer(16, WithProxyProtocol(time.Second))
+	err := server.RunTLS("127.0.0.1:0", &tls.Config{})
+	var conflict FeatureConflictError
+	if !errors.As(err, &conflict) || len(conflict.Problems) != 1 ||
+		!strings.Contains(conflict.Problems[0], "PROXY header") {
+		t.Fatalf("expected a proxyProtocol conflict, got: %v", err)
+	}
+	// The same server is fine without TLS.
+	stopConsuming := consumeEvents(server)
+	defer stopConsuming()
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	for _, feature := range server.Features() {
+		if feature.Name == "tls" && feature.Enabled {
+			t.Errorf("the tls feature must be disabled when running without TLS")
+		}
+	}
+	// noinspection GoUnhandledErrorResult
+	server.Stop()
+}
+
+
+func TestSoftFeatureProblemsOnlyWarn(t *testing.T) {
+	server := newTestServer(16, WithWriteTimeout(time.Millisecond))
+	stopConsuming := consumeEvents(server)
+	defer stopConsuming()
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatalf("a soft problem must not prevent running: %v", err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer server.Stop()
+	for _, feature := range server.Features() {
+		if feature.Name == "writeTimeout" {
+			if len(feature.Warnings) != 1 {
+				t.Fatalf("expected one writeTimeout warning, got: %v", feature.Warnings)
+			}
+			return
+		}
+	}
+	t.Fatalf("the writeTimeout feature is not reported")
+}
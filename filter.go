@@ -0,0 +1,186 @@
+package chasqui
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+
+// Filters the incoming connections by their remote address,
+// right when they are accepted: connections it returns false
+// for are closed right away, so they never get an attendant
+// (nor a goroutine, nor a marshaler).
+type AcceptFilter func(addr net.Addr) bool
+
+
+// Callback to report when a dispatcher rejected (and closed)
+// a connection, by means of its accept filter or veto, and
+// why.
+type OnDispatcherReject func(*Dispatcher, net.Addr, RejectReason)
+
+
+// Event reporting the server rejected a connection by means
+// of its accept filter (see WithAcceptFilter), its accept
+// veto (see WithAcceptVeto), its maintenance mode (see
+// MaintenanceMode), or its TLS handshake (see WithTLSVerify),
+// as told by the reason. The TLS rejections also tell the
+// error.
+type ConnectionRejectedEvent struct {
+	Addr   net.Addr
+	Reason RejectReason
+	Err    error
+}
+
+
+// Makes the dispatcher filter the accepted connections: the
+// rejected ones are closed right away, and reported to the
+// given callback (if any) instead of the accept success one.
+func WithDispatcherAcceptFilter(filter AcceptFilter, onRejected OnDispatcherReject) DispatcherOption {
+	return func(dispatcher *Dispatcher) {
+		dispatcher.acceptFilter = filter
+		dispatcher.onReject = onRejected
+	}
+}
+
+
+// Tells whether the dispatcher keeps a connection, according
+// to its accept filter and veto. Rejected connections are
+// closed and reported.
+func (dispatcher *Dispatcher) admit(conn net.Conn) bool {
+	reason := NotRejected
+	if dispatcher.acceptFilter != nil && !dispatcher.acceptFilter(conn.RemoteAddr()) {
+		reason = RejectedByFilter
+	} else if dispatcher.acceptVeto != nil {
+		reason = dispatcher.acceptVeto(conn)
+	}
+	if reason == NotRejected {
+		return true
+	}
+	// noinspection GoUnhandledErrorResult
+	conn.Close()
+	atomic.AddUint64(&dispatcher.stats.rejected, 1)
+	if dispatcher.onReject != nil {
+		dispatcher.onReject(dispatcher, conn.RemoteAddr(), reason)
+	}
+	return false
+}
+
+
+// A list of networks (and single addresses), which may be
+// changed at any time, from any goroutine. It provides ready
+// made accept filters (see Deny and Allow).
+type CIDRList struct {
+	mutex    sync.RWMutex
+	networks map[string]*net.IPNet
+}
+
+
+// Parses a network (e.g. "10.0.0.0/8") or a single address
+// (e.g. "10.0.0.1", taken as "10.0.0.1/32").
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	if ip := net.ParseIP(cidr); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	return network, err
+}
+
+
+// Adds a network (or a single address). Returns an error if it
+// cannot be parsed.
+func (list *CIDRList) Add(cidr string) error {
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.networks[network.String()] = network
+	return nil
+}
+
+
+// Removes a network (or a single address). Returns whether it
+// was in the list.
+func (list *CIDRList) Remove(cidr string) bool {
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	if _, ok := list.networks[network.String()]; !ok {
+		return false
+	}
+	delete(list.networks, network.String())
+	return true
+}
+
+
+// Tells whether the address belongs to any of the networks.
+func (list *CIDRList) Contains(ip net.IP) bool {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	for _, network := range list.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+
+// Tells whether the IP of the given address belongs to any of
+// the networks. Addresses without an IP never do.
+func (list *CIDRList) containsAddr(addr net.Addr) bool {
+	var ip net.IP
+	switch address := addr.(type) {
+	case *net.TCPAddr:
+		ip = address.IP
+	case *net.UDPAddr:
+		ip = address.IP
+	default:
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	return ip != nil && list.Contains(ip)
+}
+
+
+// Returns an accept filter rejecting the addresses in the list
+// (a ban list). Later changes to the list take effect for the
+// next connections.
+func (list *CIDRList) Deny() AcceptFilter {
+	return func(addr net.Addr) bool {
+		return !list.containsAddr(addr)
+	}
+}
+
+
+// Returns an accept filter rejecting the addresses not in the
+// list. Later changes to the list take effect for the next
+// connections.
+func (list *CIDRList) Allow() AcceptFilter {
+	return func(addr net.Addr) bool {
+		return list.containsAddr(addr)
+	}
+}
+
+
+// Creates a new list with the given networks (or single
+// addresses). Returns an error if any of them cannot be
+// parsed.
+func NewCIDRList(cidrs ...string) (*CIDRList, error) {
+	list := &CIDRList{networks: make(map[string]*net.IPNet)}
+	for _, cidr := range cidrs {
+		if err := list.Add(cidr); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
@@ -1,3 +1,5 @@
 module github.com/universe-10th/chasqui
 
-go 1.12
+go 1.16
+
+require github.com/google/flatbuffers v23.5.26+incompatible
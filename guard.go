@@ -0,0 +1,57 @@
+package chasqui
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+
+// Error reporting a dispatcher callback panicked. The accept
+// loop recovers and keeps running, and reports it as an accept
+// error (see OnDispatcherAcceptError). It tells which callback
+// panicked ("start", "accept filter", "accept success" or
+// "stop"), the panic value, and the stack of the panic. It
+// also matches ErrCallbackPanic.
+type CallbackPanicError struct {
+	Callback string
+	Value    interface{}
+	Stack    []byte
+}
+
+
+// The error message.
+func (err CallbackPanicError) Error() string {
+	return fmt.Sprintf("dispatcher %s callback panicked: %v", err.Callback, err.Value)
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err CallbackPanicError) Is(target error) bool {
+	return target == ErrCallbackPanic
+}
+
+
+// Runs a callback, recovering from its panic (which is then
+// reported as an accept error). Tells whether it returned
+// normally.
+func (dispatcher *Dispatcher) guard(callback string, call func()) (returned bool) {
+	defer func() {
+		if !returned {
+			dispatcher.reportError(CallbackPanicError{callback, recover(), debug.Stack()})
+		}
+	}()
+	call()
+	return true
+}
+
+
+// Reports an error to the accept error callback, if any. A
+// panic there is recovered, but not reported again.
+func (dispatcher *Dispatcher) reportError(err error) {
+	if dispatcher.onAcceptError == nil {
+		return
+	}
+	// noinspection GoUnhandledErrorResult
+	defer func() { recover() }()
+	dispatcher.onAcceptError(dispatcher, err)
+}
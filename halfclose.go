@@ -0,0 +1,151 @@
+package chasqui
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+
+// Error raised when sending through an attendant whose
+// writing side was closed (see CloseWrite).
+type WriteClosedError bool
+
+
+// The error message.
+func (WriteClosedError) Error() string {
+	return "attendant cannot send - its writing side is closed"
+}
+
+
+// Error raised when closing the writing side of a connection
+// not supporting it (only TCP and TLS connections do).
+type HalfCloseUnsupportedError bool
+
+
+// The error message.
+func (HalfCloseUnsupportedError) Error() string {
+	return "attendant connection does not support closing only its writing side"
+}
+
+
+// Event reporting the peer closed its writing side, while the
+// writing side of the attendant is still open: the attendant
+// may still send messages (e.g. the responses to the requests
+// of the peer), and it is stopped once it calls CloseWrite
+// or Stop.
+type AttendantHalfClosedEvent struct {
+	Attendant   *Attendant
+	AttendantID uint64
+}
+
+
+// The states of the writing side of an attendant.
+const (
+	writeOpen = iota
+	writeClosing
+	writeClosed
+)
+
+
+// The half-close state of an attendant: the state of its
+// writing side, the signal telling it is closed, and whether
+// the peer closed its own writing side.
+type halfCloseState struct {
+	state int32
+	done  chan struct{}
+	once  sync.Once
+	peer  int32
+}
+
+
+// Returns a read-only channel with all the "half closed"
+// events. It will be nil unless a channel was given on
+// construction.
+func (attendant *Attendant) HalfClosedEvent() <-chan AttendantHalfClosedEvent {
+	return attendant.halfClosedEvent
+}
+
+
+// Tells whether the writing side of the attendant is closed
+// (or being closed, after flushing the pending writes).
+func (attendant *Attendant) WriteClosed() bool {
+	return atomic.LoadInt32(&attendant.halfClose.state) != writeOpen
+}
+
+
+// Closes the writing side of the connection, telling the peer
+// no more messages will be sent, while still receiving its
+// messages until it closes. The pending writes (the outgoing
+// queue, or the direct write in progress) are flushed first,
+// bounded by the write timeout of the attendant (or the
+// DefaultFarewellTimeout, if it has none). From then on, the
+// sends fail with WriteClosedError. If the peer already closed
+// its writing side, the attendant is stopped remotely. Calling
+// Stop afterwards still produces a local stop.
+func (attendant *Attendant) CloseWrite() error {
+	if attendant.Status() == AttendantStopped {
+		return AttendantIsStopped(true)
+	}
+	closer, ok := attendant.connection.(writeCloser)
+	if !ok {
+		return HalfCloseUnsupportedError(true)
+	}
+	if !atomic.CompareAndSwapInt32(&attendant.halfClose.state, writeOpen, writeClosing) {
+		return WriteClosedError(true)
+	}
+	timeout := attendant.WriteTimeout()
+	if timeout == 0 {
+		timeout = DefaultFarewellTimeout
+	}
+	attendant.flush(timeout)
+	atomic.StoreInt32(&attendant.halfClose.state, writeClosed)
+	err := closer.CloseWrite()
+	attendant.halfClose.once.Do(func() {
+		close(attendant.halfClose.done)
+	})
+	attendant.logger.Debugf("attendant %d closed its writing side", attendant.id)
+	return err
+}
+
+
+// Tells whether nothing can be written anymore, since the
+// writing side is closed.
+func (attendant *Attendant) writeShut() bool {
+	return atomic.LoadInt32(&attendant.halfClose.state) == writeClosed
+}
+
+
+// Tells whether either side of the connection is closed, so
+// keepalive pings cannot be sent or answered anymore.
+func (attendant *Attendant) halfClosed() bool {
+	return attendant.WriteClosed() || atomic.LoadInt32(&attendant.halfClose.peer) == 1
+}
+
+
+// When the peer closed its writing side while ours is still
+// open (and half-closes are listened to), triggers the "half
+// closed" event and waits until our writing side is closed,
+// or the attendant is told to stop.
+func (attendant *Attendant) awaitHalfClose() {
+	if attendant.halfClosedEvent == nil || atomic.LoadInt32(&attendant.stopping) != stopUnclaimed ||
+		atomic.LoadInt32(&attendant.halfClose.state) != writeOpen {
+		return
+	}
+	atomic.StoreInt32(&attendant.halfClose.peer, 1)
+	attendant.logger.Debugf("attendant %d was half-closed by the peer", attendant.id)
+	if attendant.unified() {
+		if !attendant.emitUnified(AttendantHalfClosedEvent{attendant, attendant.id}, attendant.pause.interrupted) {
+			return
+		}
+	} else {
+		select {
+		case attendant.halfClosedEvent <- AttendantHalfClosedEvent{attendant, attendant.id}:
+		case <-attendant.pause.interrupted:
+			return
+		}
+	}
+	select {
+	case <-attendant.halfClose.done:
+	case <-attendant.pause.interrupted:
+	}
+}
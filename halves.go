@@ -0,0 +1,67 @@
+package chasqui
+
+import (
+	. "github.com/universe-10th/chasqui/types"
+	"io"
+	"net"
+	"time"
+)
+
+
+// Error raised when sending through an attendant created
+// without a sending half (i.e. a receive-only attendant).
+type SendUnsupportedError bool
+
+
+// The error message.
+func (SendUnsupportedError) Error() string {
+	return "attendant has no sender: it is receive-only"
+}
+
+
+// Receivers for send-only attendants: they discard whatever
+// the peer sends, and only report the close of the connection.
+type drainReceiver struct {
+	reader io.Reader
+}
+
+
+// Discards the incoming bytes until the connection is closed.
+func (receiver drainReceiver) Receive() (Message, error, bool) {
+	if _, err := io.Copy(io.Discard, receiver.reader); err != nil {
+		return nil, err, false
+	}
+	return nil, io.EOF, true
+}
+
+
+// Creates a new attendant from separate receiving and sending
+// halves, instead of a full marshaler. Receive-only tools (e.g.
+// recorders) pass a nil sender factory, so every send fails
+// with a SendUnsupportedError. Send-only tools (e.g. feeders)
+// pass a nil receiver factory, so the incoming bytes are just
+// discarded until the peer closes. At least one of them must
+// be given, and both halves wrap the same (buffered)
+// connection. The rest behaves like NewAttendant.
+func NewAttendantFromHalves(connection net.Conn, receivers ReceiverFactory, senders SenderFactory,
+	                        throttle time.Duration, startedEvent chan AttendantStartedEvent,
+	                        stoppedEvent chan AttendantStoppedEvent, messageEvent chan MessageEvent,
+	                        throttledEvent chan ThrottledEvent, options ...AttendantOption) *Attendant {
+	if connection == nil {
+		panic(ArgumentError{"NewAttendantFromHalves:connection"})
+	}
+	if receivers == nil && senders == nil {
+		panic(ArgumentError{"NewAttendantFromHalves:receivers"})
+	}
+	return newAttendant(connection, func(buffer io.ReadWriter) (MessageReceiver, MessageSender) {
+		var receiver MessageReceiver = drainReceiver{buffer}
+		var sender MessageSender
+		if receivers != nil {
+			receiver = receivers.CreateReceiver(buffer)
+		}
+		if senders != nil {
+			sender = senders.CreateSender(buffer)
+		}
+		return receiver, sender
+	}, throttle, startedEvent, stoppedEvent, messageEvent, throttledEvent, options...)
+}
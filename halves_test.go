@@ -0,0 +1,157 @@
+package chasqui
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// A bare message, holding only a command.
+type lineMessage string
+
+
+func (message lineMessage) Command() string {
+	return string(message)
+}
+
+
+func (lineMessage) Args() Args {
+	return nil
+}
+
+
+func (lineMessage) KWArgs() KWArgs {
+	return nil
+}
+
+
+// A receive-only fake: one command per line. It implements
+// neither Send nor Create.
+type lineReceiver struct {
+	reader *bufio.Reader
+}
+
+
+func (receiver *lineReceiver) Receive() (Message, error, bool) {
+	line, err := receiver.reader.ReadString('\n')
+	if err != nil {
+		return nil, err, err == io.EOF
+	}
+	return lineMessage(strings.TrimSuffix(line, "\n")), nil, false
+}
+
+
+type lineReceiverFactory struct{}
+
+
+func (lineReceiverFactory) CreateReceiver(buffer io.ReadWriter) MessageReceiver {
+	return &lineReceiver{bufio.NewReader(buffer)}
+}
+
+
+// A send-only factory, taking just the sending half of
+// the JSON marshaler.
+type jsonSenderFactory struct{}
+
+
+func (jsonSenderFactory) CreateSender(buffer io.ReadWriter) MessageSender {
+	return (&json.JSONMessageMarshaler{}).Create(buffer)
+}
+
+
+func TestAttendantReceiveOnly(t *testing.T) {
+	local, remote := net.Pipe()
+	started := make(chan AttendantStartedEvent, 1)
+	stopped := make(chan AttendantStoppedEvent, 1)
+	messages := make(chan MessageEvent, 4)
+	attendant := NewAttendantFromHalves(
+		local, lineReceiverFactory{}, nil, 0, started, stopped, messages, make(chan ThrottledEvent, 4),
+	)
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if _, err := remote.Write([]byte("HELLO\nWORLD\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range []string{"HELLO", "WORLD"} {
+		select {
+		case event := <-messages:
+			if event.Message.Command() != command {
+				t.Fatalf("received %q, expected %q", event.Message.Command(), command)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", command)
+		}
+	}
+	if err := attendant.Send("PING", nil, nil); !errors.Is(err, ErrSendUnsupported) {
+		t.Fatalf("receive-only Send returned %v", err)
+	}
+	// noinspection GoUnhandledErrorResult
+	remote.Close()
+	within(t, 2*time.Second, "Wait", attendant.Wait)
+	if event := <-stopped; event.StopType != AttendantRemoteStop {
+		t.Fatalf("stopped as %s (%v)", event.StopType, event.Error)
+	}
+}
+
+
+func TestAttendantSendOnly(t *testing.T) {
+	local, remote := net.Pipe()
+	started := make(chan AttendantStartedEvent, 1)
+	stopped := make(chan AttendantStoppedEvent, 1)
+	messages := make(chan MessageEvent, 4)
+	attendant := NewAttendantFromHalves(
+		local, nil, jsonSenderFactory{}, 0, started, stopped, messages, make(chan ThrottledEvent, 4),
+	)
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	// Incoming bytes are discarded, whatever they are.
+	if _, err := remote.Write([]byte("not a message\n")); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// noinspection GoUnhandledErrorResult
+		attendant.Send("PING", Args{1}, nil)
+	}()
+	// noinspection GoUnhandledErrorResult
+	remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(remote).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(line, "PING") {
+		t.Fatalf("sent %q", line)
+	}
+	// noinspection GoUnhandledErrorResult
+	remote.Close()
+	within(t, 2*time.Second, "Wait", attendant.Wait)
+	if event := <-stopped; event.StopType != AttendantRemoteStop {
+		t.Fatalf("stopped as %s (%v)", event.StopType, event.Error)
+	}
+	if len(messages) != 0 {
+		t.Fatalf("send-only attendant emitted %d messages", len(messages))
+	}
+}
+
+
+func TestNewAttendantFromHalvesNeedsOne(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic without halves")
+		}
+	}()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	NewAttendantFromHalves(local, nil, nil, 0, nil, nil, nil, nil)
+}
@@ -0,0 +1,112 @@
+package chasqui
+
+import (
+	"net"
+	"os"
+)
+
+
+// Error raised when the listener of a dispatcher cannot be
+// exported as a file (e.g. a custom listener not backed by a
+// socket).
+type ListenerFileUnsupportedError bool
+
+
+// The error message.
+func (ListenerFileUnsupportedError) Error() string {
+	return "the listener cannot be exported as a file"
+}
+
+
+// Listeners exporting their socket as a file, like
+// *net.TCPListener.
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+
+// Returns a file holding a duplicate of the listening socket
+// of the dispatcher (the TCP one, when running with TLS), to
+// hand it over to another process (e.g. in the ExtraFiles of
+// an exec.Cmd, for a zero-downtime restart): the new process
+// runs with it by means of RunWithListenerFile, while this one
+// keeps accepting until stopped, so there is no accept gap.
+// The socket stays open until both the file and the listener
+// are closed, so the caller must close the file once handed
+// over. Returns an error if the dispatcher is not running, or
+// its listener cannot be exported.
+func (dispatcher *Dispatcher) ListenerFile() (*os.File, error) {
+	dispatcher.mutex.Lock()
+	listener := dispatcher.listener
+	dispatcher.mutex.Unlock()
+	if listener == nil {
+		return nil, DispatcherNotListeningError(true)
+	}
+	if wrapped, ok := listener.(tlsListener); ok {
+		listener, _ = wrapped.deadline.(net.Listener)
+	}
+	if exported, ok := listener.(fileListener); ok {
+		return exported.File()
+	}
+	return nil, ListenerFileUnsupportedError(true)
+}
+
+
+// Runs the server lifecycle as RunWithListener does, but over
+// a listening socket inherited as a file (see ListenerFile).
+// The file is closed once the listener is created from it (the
+// listener keeps its own duplicate), even on failure.
+func (dispatcher *Dispatcher) RunWithListenerFile(file *os.File) (func(), error) {
+	if file == nil {
+		panic(ArgumentError{"RunWithListenerFile:file"})
+	}
+	listener, err := listenerFromFile(file)
+	if err != nil {
+		return nil, err
+	}
+	closer, err := dispatcher.RunWithListener(listener)
+	if err != nil {
+		// noinspection GoUnhandledErrorResult
+		listener.Close()
+	}
+	return closer, err
+}
+
+
+// Creates a listener from an inherited socket file, closing
+// the file.
+func listenerFromFile(file *os.File) (net.Listener, error) {
+	// noinspection GoUnhandledErrorResult
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+
+// Returns a file holding a duplicate of the listening socket
+// of the server (see Dispatcher.ListenerFile). Servers run by
+// RunMulti or RunWithListeners export their first listener.
+func (server *Server) ListenerFile() (*os.File, error) {
+	return server.dispatcher.ListenerFile()
+}
+
+
+// Runs the server as RunWithListener does, but over a
+// listening socket inherited as a file (see
+// Dispatcher.RunWithListenerFile). The old process hands its
+// socket over by means of ListenerFile and then drains by
+// means of Shutdown, while this one accepts the new
+// connections.
+func (server *Server) RunWithListenerFile(file *os.File) error {
+	if file == nil {
+		panic(ArgumentError{"RunWithListenerFile:file"})
+	}
+	listener, err := listenerFromFile(file)
+	if err != nil {
+		return err
+	}
+	if err = server.RunWithListener(listener); err != nil {
+		// noinspection GoUnhandledErrorResult
+		listener.Close()
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package chasqui
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+)
+
+
+// Creates a server speaking JSON, with the given options.
+func newTestServer(lifecycleBufferSize uint, options ...ServerOption) *Server {
+	return NewServer(&json.JSONMessageMarshaler{}, 1024, lifecycleBufferSize, 0, options...)
+}
+
+
+// Consumes all the events of a server in the background, until
+// the returned function is called.
+func consumeEvents(server *Server) func() {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-quit:
+				return
+			case <-server.StartedEvent():
+			case <-server.AcceptFailedEvent():
+			case <-server.StoppedEvent():
+			case <-server.AttendantStartedEvent():
+			case <-server.MessageEvent():
+			case <-server.ThrottledEvent():
+			case <-server.AttendantStoppedEvent():
+			case <-server.SendFailedEvent():
+			case <-server.MessageRejectedEvent():
+			case <-server.ConnectionRejectedEvent():
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+
+// Runs the function, failing the test if it does not return
+// within the given time.
+func within(t *testing.T, timeout time.Duration, what string, call func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		call()
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("%s did not finish within %s", what, timeout)
+	}
+}
+
+
+// Connects to the given address, failing the test otherwise.
+func dialTest(t *testing.T, addr net.Addr) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr.String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+
+// Waits until the server reports no owned resources, failing
+// the test otherwise.
+func waitResourcesReleased(t *testing.T, server *Server) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		counts := server.ResourceCounts()
+		if counts == (ResourceCounts{}) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("resources not released: %+v", counts)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+
+// A JSON message, as read by a raw peer.
+type wireFrame struct {
+	C   string
+	A   []interface{}
+	KWA map[string]interface{}
+}
+
+
+// The attendant lifecycle events of a server, forwarded by a
+// background consumer of all its events (see watchServer).
+type serverWatch struct {
+	started chan *Attendant
+	stopped chan AttendantStoppedEvent
+	stop    func()
+}
+
+
+// Consumes all the events of a server in the background,
+// forwarding the attendant started and stopped events (the
+// channels have room for the given amount of them), until
+// the stop function is called.
+func watchServer(server *Server, capacity int) *serverWatch {
+	watch := &serverWatch{
+		started: make(chan *Attendant, capacity),
+		stopped: make(chan AttendantStoppedEvent, capacity),
+	}
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-quit:
+				return
+			case event := <-server.AttendantStartedEvent():
+				watch.started <- event.Attendant
+			case event := <-server.AttendantStoppedEvent():
+				watch.stopped <- event
+			case <-server.StartedEvent():
+			case <-server.AcceptFailedEvent():
+			case <-server.StoppedEvent():
+			case <-server.MessageEvent():
+			case <-server.ThrottledEvent():
+			case <-server.SendFailedEvent():
+			case <-server.ConnectionRejectedEvent():
+			case <-server.MessageRejectedEvent():
+			}
+		}
+	}()
+	watch.stop = func() {
+		close(quit)
+		<-done
+	}
+	return watch
+}
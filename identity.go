@@ -0,0 +1,183 @@
+package chasqui
+
+import (
+	"crypto/x509"
+	"net"
+	"strconv"
+	"sync"
+)
+
+
+// The sources the identity of a peer may come from, by their
+// precedence (the latter ones take precedence over the former
+// ones).
+type IdentitySource int
+
+
+const (
+	// The attendant itself: its ID, and the address of its
+	// connection. Every attendant has this identity.
+	IdentityFromConnection IdentitySource = iota
+	// The address told by the PROXY protocol header of the
+	// connection (see WithProxyProtocol).
+	IdentityFromProxy
+	// The certificate the peer sent in the TLS handshake
+	// (e.g. when running with a config requiring client
+	// certificates).
+	IdentityFromCertificate
+	// The identity set by the application (e.g. by the
+	// authentication handler, on login) by means of
+	// Attendant.SetIdentity.
+	IdentityFromAuth
+)
+
+
+// Returns the name of the source.
+func (source IdentitySource) String() string {
+	switch source {
+	case IdentityFromConnection:
+		return "connection"
+	case IdentityFromProxy:
+		return "proxy"
+	case IdentityFromCertificate:
+		return "certificate"
+	case IdentityFromAuth:
+		return "auth"
+	default:
+		return "unknown"
+	}
+}
+
+
+// The kinds of principal an identity tells.
+const (
+	// The principal is the ID of the attendant.
+	IdentityKindAttendant = "attendant"
+	// The principal is the address of the peer.
+	IdentityKindAddress = "address"
+	// The principal is the common name of the subject of the
+	// peer certificate.
+	IdentityKindCertificate = "certificate"
+)
+
+
+// The identity of the peer of an attendant: the kind of its
+// principal (one of the IdentityKind constants, or any kind
+// given to Attendant.SetIdentity), the principal itself, some
+// attributes describing it further (depending on the source),
+// and the source it comes from. The attributes must not be
+// changed.
+type Identity struct {
+	Kind       string
+	Principal  string
+	Attributes map[string]interface{}
+	Source     IdentitySource
+}
+
+
+// The identity set by the application, if any.
+type identityState struct {
+	mutex sync.RWMutex
+	auth  *Identity
+}
+
+
+// Sets the identity of the peer (e.g. from the authentication
+// handler, once the login is accepted, or when the session is
+// resumed), replacing the one set before, if any. It takes
+// precedence over any other source (see Identity). It is safe
+// to call it from any goroutine, and the change is atomic.
+func (attendant *Attendant) SetIdentity(kind, principal string, attributes map[string]interface{}) {
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+	attendant.identity.mutex.Lock()
+	defer attendant.identity.mutex.Unlock()
+	attendant.identity.auth = &Identity{kind, principal, attributes, IdentityFromAuth}
+}
+
+
+// Removes the identity set by the application (e.g. on logout),
+// if any. The other sources apply again.
+func (attendant *Attendant) ClearIdentity() {
+	attendant.identity.mutex.Lock()
+	defer attendant.identity.mutex.Unlock()
+	attendant.identity.auth = nil
+}
+
+
+// Returns the identities of the peer, one per source which
+// applies, by decreasing precedence: the one set by the
+// application (see SetIdentity), the one of the peer
+// certificate, the one of the PROXY protocol header, and the
+// one of the connection (which always applies, and so it is
+// always the last one). It is safe to call it from any
+// goroutine.
+func (attendant *Attendant) Identities() []Identity {
+	var identities []Identity
+	attendant.identity.mutex.RLock()
+	if auth := attendant.identity.auth; auth != nil {
+		identities = append(identities, *auth)
+	}
+	attendant.identity.mutex.RUnlock()
+	if certificates := attendant.PeerCertificates(); certificates != nil {
+		identities = append(identities, certificateIdentity(certificates))
+	}
+	if addr, ok := proxiedAddr(attendant.connection); ok {
+		identities = append(identities, Identity{
+			IdentityKindAddress, addr.String(), map[string]interface{}{"addr": addr}, IdentityFromProxy,
+		})
+	}
+	return append(identities, Identity{
+		IdentityKindAttendant, strconv.FormatUint(attendant.id, 10),
+		map[string]interface{}{"id": attendant.id, "addr": attendant.RemoteAddr()}, IdentityFromConnection,
+	})
+}
+
+
+// Returns the identity of the peer: the one of the source with
+// the highest precedence among the ones which apply (see
+// Identities), and whether it comes from any source other than
+// the connection itself (i.e. whether the peer was identified
+// beyond the ID of its attendant). It is safe to call it from
+// any goroutine.
+func (attendant *Attendant) Identity() (Identity, bool) {
+	identity := attendant.Identities()[0]
+	return identity, identity.Source != IdentityFromConnection
+}
+
+
+// Makes the identity of a peer certificate chain: the common
+// name of the leaf subject, with the chain, the subject, the
+// issuer and the names of the leaf as attributes.
+func certificateIdentity(certificates []*x509.Certificate) Identity {
+	leaf := certificates[0]
+	return Identity{
+		IdentityKindCertificate, leaf.Subject.CommonName, map[string]interface{}{
+			"certificates": certificates,
+			"subject":      leaf.Subject.String(),
+			"issuer":       leaf.Issuer.String(),
+			"serialNumber": leaf.SerialNumber.String(),
+			"dnsNames":     leaf.DNSNames,
+			"emails":       leaf.EmailAddresses,
+		}, IdentityFromCertificate,
+	}
+}
+
+
+// Returns the address told by the PROXY protocol header of the
+// connection, if it (or any connection it wraps) has one.
+func proxiedAddr(connection net.Conn) (net.Addr, bool) {
+	for {
+		switch conn := connection.(type) {
+		case proxiedConn:
+			return conn.remote, true
+		case proxiedWriteCloserConn:
+			return conn.remote, true
+		case netConnWrapper:
+			connection = conn.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
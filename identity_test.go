@@ -0,0 +1,223 @@
+package chasqui
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// Creates an (unstarted) attendant over the given connection.
+func newIdentityAttendant(conn net.Conn, options ...AttendantOption) (*Attendant, chan AttendantStoppedEvent) {
+	stopped := make(chan AttendantStoppedEvent, 1)
+	return NewAttendant(
+		conn, &json.JSONMessageMarshaler{}, 0, make(chan AttendantStartedEvent, 1), stopped,
+		make(chan MessageEvent, 4), make(chan ThrottledEvent, 4), options...,
+	), stopped
+}
+
+
+// Makes a TLS session over a pipe, where the client sends a
+// certificate issued for the given name. Returns the server
+// end (handshake done).
+func newCertifiedPipe(t *testing.T, name string) net.Conn {
+	t.Helper()
+	authority := newTestAuthority(t, "test authority")
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		// noinspection GoUnhandledErrorResult
+		remote.Close()
+	})
+	server := tls.Server(local, &tls.Config{
+		Certificates: []tls.Certificate{authority.issue(t, "server")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    authority.pool(),
+	})
+	client := tls.Client(remote, &tls.Config{
+		RootCAs:      authority.pool(),
+		ServerName:   "127.0.0.1",
+		Certificates: []tls.Certificate{authority.issue(t, name)},
+	})
+	handshaken := make(chan error, 1)
+	go func() {
+		handshaken <- client.Handshake()
+	}()
+	if err := server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-handshaken; err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+
+// Tells the sources of the given identities, in order.
+func identitySources(identities []Identity) []IdentitySource {
+	sources := make([]IdentitySource, len(identities))
+	for index, identity := range identities {
+		sources[index] = identity.Source
+	}
+	return sources
+}
+
+
+func TestIdentitySourcesAndPrecedence(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.10").To4(), Port: 51000}
+	for _, combination := range []struct {
+		name      string
+		conn      func() net.Conn
+		principal string
+		sources   []IdentitySource
+	}{
+		{
+			"connection", func() net.Conn {
+				local, _ := net.Pipe()
+				return local
+			}, "", []IdentitySource{IdentityFromConnection},
+		},
+		{
+			"proxy", func() net.Conn {
+				local, _ := net.Pipe()
+				return proxyConnection(local, client)
+			}, client.String(), []IdentitySource{IdentityFromProxy, IdentityFromConnection},
+		},
+		{
+			"certificate", func() net.Conn {
+				return newCertifiedPipe(t, "billing-service")
+			}, "billing-service", []IdentitySource{IdentityFromCertificate, IdentityFromConnection},
+		},
+		{
+			"certificate behind proxy", func() net.Conn {
+				return proxyConnection(newCertifiedPipe(t, "billing-service"), client)
+			}, "billing-service", []IdentitySource{IdentityFromCertificate, IdentityFromProxy, IdentityFromConnection},
+		},
+	} {
+		attendant, _ := newIdentityAttendant(combination.conn())
+		principal := combination.principal
+		if principal == "" {
+			principal = strconv.FormatUint(attendant.ID(), 10)
+		}
+		identity, identified := attendant.Identity()
+		if identity.Principal != principal || identity.Source != combination.sources[0] ||
+			identified != (combination.sources[0] != IdentityFromConnection) {
+			t.Errorf("%s: unexpected identity: %+v (identified: %v)", combination.name, identity, identified)
+		}
+		sources := identitySources(attendant.Identities())
+		if len(sources) != len(combination.sources) {
+			t.Errorf("%s: expected the sources %v, got: %v", combination.name, combination.sources, sources)
+			continue
+		}
+		for index := range sources {
+			if sources[index] != combination.sources[index] {
+				t.Errorf("%s: expected the sources %v, got: %v", combination.name, combination.sources, sources)
+			}
+		}
+
+		// The identity set by the application takes precedence
+		// over all of them, until cleared.
+		attendant.SetIdentity("user", "alice", nil)
+		if identity, identified := attendant.Identity(); identity.Principal != "alice" || identity.Kind != "user" ||
+			identity.Source != IdentityFromAuth || !identified {
+			t.Errorf("%s: the identity set by the application must win, got: %+v", combination.name, identity)
+		}
+		attendant.ClearIdentity()
+		if identity, _ := attendant.Identity(); identity.Principal != principal {
+			t.Errorf("%s: the former identity must apply once cleared, got: %+v", combination.name, identity)
+		}
+	}
+}
+
+
+func TestIdentityFromCertificateAttributes(t *testing.T) {
+	attendant, _ := newIdentityAttendant(newCertifiedPipe(t, "billing-service"))
+	identity, _ := attendant.Identity()
+	if identity.Kind != IdentityKindCertificate || identity.Attributes["subject"] != "CN=billing-service" ||
+		identity.Attributes["issuer"] != "CN=test authority" {
+		t.Fatalf("unexpected certificate identity: %+v", identity)
+	}
+	if certificates := attendant.PeerCertificates(); len(certificates) == 0 ||
+		identity.Attributes["certificates"] == nil {
+		t.Fatalf("the identity must carry the peer certificates")
+	}
+}
+
+
+func TestIdentityOnLoginAndResume(t *testing.T) {
+	local, remote := net.Pipe()
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	authenticated := make(chan AttendantAuthenticatedEvent, 1)
+	attendant, stopped := newIdentityAttendant(local, WithAuthenticatedEvent(authenticated),
+		WithAuth(func(attendant *Attendant, message Message) (bool, string) {
+			if message.Command() != "LOGIN" {
+				return false, "login first"
+			}
+			attendant.SetIdentity("user", message.Args()[0].(string), map[string]interface{}{"session": 1})
+			return true, ""
+		}, false))
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if identity, identified := attendant.Identity(); identified || identity.Source != IdentityFromConnection {
+		t.Fatalf("the peer must not be identified before the login, got: %+v", identity)
+	}
+	peer := (&json.JSONMessageMarshaler{}).Create(remote)
+	if err := peer.Send("LOGIN", Args{"alice"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	within(t, 2 * time.Second, "the login", func() {
+		<-authenticated
+	})
+	if identity, _ := attendant.Identity(); identity.Principal != "alice" || identity.Attributes["session"] != 1 {
+		t.Fatalf("the login must set the identity, got: %+v", identity)
+	}
+
+	// Resuming sessions replace the identity atomically: readers
+	// never see the principal of one with the attributes of
+	// another.
+	var group sync.WaitGroup
+	quit := make(chan struct{})
+	for reader := 0; reader < 4; reader++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				identity, _ := attendant.Identity()
+				if identity.Principal != "alice" &&
+					identity.Principal != "user-" + strconv.Itoa(identity.Attributes["session"].(int)) {
+					t.Errorf("torn identity: %+v", identity)
+					return
+				}
+			}
+		}()
+	}
+	for session := 2; session <= 200; session++ {
+		attendant.SetIdentity("user", "user-" + strconv.Itoa(session), map[string]interface{}{"session": session})
+	}
+	close(quit)
+	group.Wait()
+
+	// The stopped event tells the final identity.
+	// noinspection GoUnhandledErrorResult
+	attendant.Stop()
+	select {
+	case event := <-stopped:
+		if event.Identity.Principal != "user-200" || event.Identity.Source != IdentityFromAuth {
+			t.Fatalf("the stopped event must tell the final identity, got: %+v", event.Identity)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no stopped event")
+	}
+}
@@ -0,0 +1,82 @@
+package chasqui
+
+import (
+	"math"
+	"time"
+)
+
+
+// The default jitter fraction of the attendants (see WithJitter).
+const DefaultJitterFraction = 0.1
+
+
+// Makes the periodic activities of the attendant (the pings of
+// the keepalive, the idle timeout, the maximum lifetime, the
+// slow consumer checks and the sweep of its expiring context
+// entries) be offset by up to the given fraction of their
+// period. The offset is derived from the ID of the attendant:
+// it is always the same for an attendant, but spread among
+// them, so attendants created in the same instant (e.g. on a
+// reconnect storm) do not act in lockstep. The fraction must
+// be between 0 (no jitter) and 1. By default, it is
+// DefaultJitterFraction.
+func WithJitter(fraction float64) AttendantOption {
+	if fraction < 0 || fraction > 1 || math.IsNaN(fraction) {
+		panic(ArgumentError{"WithJitter:fraction"})
+	}
+	return func(attendant *Attendant) {
+		attendant.jitter = fraction
+	}
+}
+
+
+// Makes each new attendant offset its periodic activities by
+// up to the given fraction of their period (see WithJitter).
+func WithAttendantJitter(fraction float64) ServerOption {
+	if fraction < 0 || fraction > 1 || math.IsNaN(fraction) {
+		panic(ArgumentError{"WithAttendantJitter:fraction"})
+	}
+	return func(server *Server) {
+		server.jitter = fraction
+	}
+}
+
+
+// Spreads an ID uniformly over [0, 1), by mixing its bits
+// (SplitMix64), so consecutive IDs get unrelated values.
+func spreadID(id uint64) float64 {
+	id += 0x9e3779b97f4a7c15
+	id = (id ^ (id >> 30)) * 0xbf58476d1ce4e5b9
+	id = (id ^ (id >> 27)) * 0x94d049bb133111eb
+	id ^= id >> 31
+	return float64(id >> 11) / (1 << 53)
+}
+
+
+// Returns the offset of a periodic activity of the attendant
+// with the given period: up to the jitter fraction of it.
+func (attendant *Attendant) jitterOffset(period time.Duration) time.Duration {
+	if attendant.jitter == 0 || period <= 0 {
+		return 0
+	}
+	return time.Duration(spreadID(attendant.id) * attendant.jitter * float64(period))
+}
+
+
+// Waits the offset of a periodic activity of the attendant,
+// with the given period, before it starts ticking. Returns
+// false if the quit channel was closed meanwhile.
+func (attendant *Attendant) awaitJitter(period time.Duration, quit <-chan struct{}) bool {
+	offset := attendant.jitterOffset(period)
+	if offset == 0 {
+		return true
+	}
+	timer := time.NewTimer(offset)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-quit:
+		return false
+	}
+}
@@ -0,0 +1,166 @@
+package chasqui
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+)
+
+
+// Creates the given amount of attendants at once, with the
+// given jitter fraction (they are never started).
+func newJitteredAttendants(t *testing.T, count int, fraction float64) []*Attendant {
+	attendants := make([]*Attendant, count)
+	for index := range attendants {
+		local, remote := net.Pipe()
+		t.Cleanup(func() {
+			// noinspection GoUnhandledErrorResult
+			local.Close()
+			// noinspection GoUnhandledErrorResult
+			remote.Close()
+		})
+		attendants[index] = NewAttendant(
+			local, &json.JSONMessageMarshaler{}, 0, make(chan AttendantStartedEvent, 1),
+			make(chan AttendantStoppedEvent, 1), make(chan MessageEvent, 1), make(chan ThrottledEvent, 1),
+			WithJitter(fraction),
+		)
+	}
+	return attendants
+}
+
+
+// Counts the first heartbeats of the attendants per tick, as
+// if all of them started at the same (fake) instant.
+func heartbeatsPerTick(attendants []*Attendant, interval, tick time.Duration) map[int]int {
+	startedAt := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	counts := make(map[int]int)
+	for _, attendant := range attendants {
+		firstPing := startedAt.Add(attendant.jitterOffset(interval) + interval)
+		counts[int(firstPing.Sub(startedAt) / tick)]++
+	}
+	return counts
+}
+
+
+func TestJitterSpreadsTheHeartbeatsOfAStorm(t *testing.T) {
+	const count = 1000
+	const interval = 10 * time.Second
+	const tick = 100 * time.Millisecond
+	const fraction = 0.5
+
+	// Without jitter, all the heartbeats come in a single tick.
+	if counts := heartbeatsPerTick(newJitteredAttendants(t, count, 0), interval, tick); len(counts) != 1 ||
+		counts[int(interval / tick)] != count {
+		t.Fatalf("without jitter, all the heartbeats must come at the interval: %v", counts)
+	}
+
+	// With jitter, they spread over the ticks of the jitter
+	// window, close to evenly.
+	counts := heartbeatsPerTick(newJitteredAttendants(t, count, fraction), interval, tick)
+	first := int(interval / tick)
+	window := int(fraction * float64(interval) / float64(tick))
+	expected := count / window
+	busy := 0
+	for index, sent := range counts {
+		if index < first || index >= first + window {
+			t.Fatalf("%d heartbeats came at tick %d, out of the jitter window [%d, %d)", sent, index, first, first + window)
+		}
+		if sent > 3 * expected {
+			t.Fatalf("%d heartbeats came at tick %d, expected about %d per tick", sent, index, expected)
+		}
+		busy++
+	}
+	if busy < window * 9 / 10 {
+		t.Fatalf("the heartbeats came in only %d of the %d ticks of the jitter window", busy, window)
+	}
+}
+
+
+func TestJitterOffsetIsStablePerAttendant(t *testing.T) {
+	const period = time.Minute
+	for _, fraction := range []float64{0, 0.1, 1} {
+		for _, attendant := range newJitteredAttendants(t, 100, fraction) {
+			offset := attendant.jitterOffset(period)
+			if offset < 0 || float64(offset) > fraction * float64(period) {
+				t.Fatalf("offset %v of attendant %d is out of [0, %v]", offset, attendant.ID(),
+					time.Duration(fraction * float64(period)))
+			}
+			if again := attendant.jitterOffset(period); again != offset {
+				t.Fatalf("the offset of attendant %d changed from %v to %v", attendant.ID(), offset, again)
+			}
+		}
+	}
+	if offset := newJitteredAttendants(t, 1, 1)[0].jitterOffset(0); offset != 0 {
+		t.Fatalf("no period must mean no offset, got: %v", offset)
+	}
+}
+
+
+func TestJitterOffsetsTheTimers(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	const tolerance = 10 * time.Millisecond
+
+	// The first ping comes once past the offset.
+	local, remote := socketPair(t)
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	pinger := NewAttendant(
+		local, &json.JSONMessageMarshaler{}, 0, make(chan AttendantStartedEvent, 1),
+		make(chan AttendantStoppedEvent, 1), make(chan MessageEvent, 1), make(chan ThrottledEvent, 1),
+		WithJitter(1), WithKeepalive(Keepalive{Interval: interval, MaxMissed: 100}),
+	)
+	started := time.Now()
+	if err := pinger.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// noinspection GoUnhandledErrorResult
+		pinger.Stop()
+		pinger.Wait()
+	}()
+	// noinspection GoUnhandledErrorResult
+	remote.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := bufio.NewReader(remote).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed, expected := time.Since(started), interval + pinger.jitterOffset(interval); elapsed < expected - tolerance {
+		t.Fatalf("the first ping came after %v, expected at least %v", elapsed, expected)
+	}
+
+	// The idle timeout is extended by the offset.
+	idle, _, _, stopped := newPipeAttendant()
+	WithJitter(1)(idle)
+	idle.SetIdleTimeout(interval)
+	started = time.Now()
+	if err := idle.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-stopped:
+		if event.StopType != AttendantIdleStop {
+			t.Fatalf("unexpected stop: %v (%v)", event.StopType, event.Error)
+		}
+		if elapsed, expected := time.Since(started), interval + idle.jitterOffset(interval); elapsed < expected - tolerance {
+			t.Fatalf("the idle attendant stopped after %v, expected at least %v", elapsed, expected)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the idle attendant did not stop")
+	}
+}
+
+
+func TestJitterFractionMustBeValid(t *testing.T) {
+	for _, fraction := range []float64{-0.1, 1.5} {
+		func() {
+			defer func() {
+				if _, ok := recover().(ArgumentError); !ok {
+					t.Errorf("the fraction %v must be rejected", fraction)
+				}
+			}()
+			WithJitter(fraction)
+		}()
+	}
+}
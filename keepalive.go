@@ -0,0 +1,180 @@
+package chasqui
+
+import (
+	"fmt"
+	. "github.com/universe-10th/chasqui/types"
+	"sync/atomic"
+	"time"
+)
+
+
+// The default reserved commands of the keepalive messages.
+const (
+	DefaultPingCommand = "__PING"
+	DefaultPongCommand = "__PONG"
+)
+
+
+// Error used to abort an attendant whose peer missed too
+// many consecutive pongs.
+type KeepaliveTimeoutError struct {
+	Missed   uint
+	Interval time.Duration
+}
+
+
+// The error message.
+func (err KeepaliveTimeoutError) Error() string {
+	return fmt.Sprintf("keepalive timeout: %d consecutive pongs missed (interval: %s)", err.Missed, err.Interval)
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err KeepaliveTimeoutError) Is(target error) bool {
+	return target == ErrKeepaliveTimeout
+}
+
+
+// The keepalive configuration of an attendant. Attendants
+// with a keepalive configuration reply each ping with a
+// pong, and neither of them are conveyed as messages. If
+// the interval is positive, the attendant also sends a ping
+// each interval, and stops abnormally (with a keepalive
+// timeout error) once MaxMissed consecutive pings are not
+// replied. The reserved commands can be changed to avoid
+// collisions with the application protocol (both peers
+// must agree on them).
+//
+// Pinging attendants may also tell the silence of their peers
+// apart: once nothing (not even a pong) is received for
+// WarnAfter, an unresponsive event is triggered, and another
+// one once the peer is heard again. Once nothing is received
+// for KillAfter, the attendant stops abnormally (with an
+// UnresponsiveError): this replaces the MaxMissed rule. The
+// silence is checked each interval. Zero means none of them.
+type Keepalive struct {
+	Interval    time.Duration
+	MaxMissed   uint
+	PingCommand string
+	PongCommand string
+	WarnAfter   time.Duration
+	KillAfter   time.Duration
+}
+
+
+// Fills the defaults of a keepalive configuration.
+func (keepalive Keepalive) normalized() Keepalive {
+	if keepalive.Interval < 0 {
+		keepalive.Interval = -keepalive.Interval
+	}
+	if keepalive.MaxMissed == 0 {
+		keepalive.MaxMissed = 3
+	}
+	if keepalive.PingCommand == "" {
+		keepalive.PingCommand = DefaultPingCommand
+	}
+	if keepalive.PongCommand == "" {
+		keepalive.PongCommand = DefaultPongCommand
+	}
+	if keepalive.WarnAfter < 0 {
+		keepalive.WarnAfter = -keepalive.WarnAfter
+	}
+	if keepalive.KillAfter < 0 {
+		keepalive.KillAfter = -keepalive.KillAfter
+	}
+	return keepalive
+}
+
+
+// The keepalive state of an attendant: the configuration,
+// the count of pings not replied yet, the signals to stop
+// the ping loop and to tell it finished, and whether the peer
+// is unresponsive (and since when it is silent).
+type keepaliveState struct {
+	config       Keepalive
+	missed       uint32
+	quit         chan struct{}
+	done         chan struct{}
+	unresponsive int32
+	silentSince  time.Time
+}
+
+
+// Handles the keepalive messages. Returns true if the given
+// message was a keepalive message (which must not be conveyed
+// as a regular message).
+func (attendant *Attendant) handleKeepalive(message Message) bool {
+	if attendant.keepalive == nil {
+		return false
+	}
+	switch message.Command() {
+	case attendant.keepalive.config.PingCommand:
+		// noinspection GoUnhandledErrorResult
+		attendant.Send(attendant.keepalive.config.PongCommand, Args{}, KWArgs{})
+		return true
+	case attendant.keepalive.config.PongCommand:
+		atomic.StoreUint32(&attendant.keepalive.missed, 0)
+		return true
+	default:
+		return false
+	}
+}
+
+
+// The ping loop sends a ping each interval (counted once past
+// the jitter offset of the attendant), and aborts the
+// attendant when too many consecutive pings were missed (or
+// the peer was silent for too long). It also tells when the
+// peer becomes unresponsive, and when it recovers. It stops
+// pinging once the connection is half-closed.
+func (attendant *Attendant) pingLoop() {
+	keepalive := attendant.keepalive
+	defer close(keepalive.done)
+	attendant.resources.addTimers(1)
+	defer attendant.resources.addTimers(-1)
+	if !attendant.awaitJitter(keepalive.config.Interval, keepalive.quit) {
+		return
+	}
+	ticker := time.NewTicker(keepalive.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if attendant.halfClosed() {
+				// Pings cannot be sent or answered anymore.
+				continue
+			}
+			switch verdict, silentFor := keepalive.assess(now, attendant.lastHeardAt()); verdict {
+			case responsivenessKill:
+				attendant.abort(UnresponsiveError{silentFor})
+				return
+			case responsivenessWarn, responsivenessRecover:
+				if !attendant.emitUnresponsive(verdict == responsivenessWarn, silentFor) {
+					return
+				}
+			}
+			missed := atomic.AddUint32(&keepalive.missed, 1) - 1
+			if keepalive.config.KillAfter == 0 && uint(missed) >= keepalive.config.MaxMissed {
+				attendant.abort(KeepaliveTimeoutError{uint(missed), keepalive.config.Interval})
+				return
+			}
+			// noinspection GoUnhandledErrorResult
+			attendant.Send(keepalive.config.PingCommand, Args{}, KWArgs{})
+		case <-keepalive.quit:
+			return
+		}
+	}
+}
+
+
+// Registers the teardown callback of the keepalive: the
+// ping loop is stopped once the connection is released.
+func (attendant *Attendant) registerKeepaliveTeardown() {
+	attendant.teardown.register(TeardownReleaseResources, func() error {
+		if keepalive := attendant.keepalive; keepalive != nil && keepalive.config.Interval > 0 {
+			close(keepalive.quit)
+			<-keepalive.done
+		}
+		return nil
+	})
+}
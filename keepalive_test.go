@@ -0,0 +1,118 @@
+package chasqui
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+)
+
+
+// A connection whose writes are delayed.
+type delayedConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+
+func (conn delayedConn) Write(data []byte) (int, error) {
+	time.Sleep(conn.delay)
+	return conn.Conn.Write(data)
+}
+
+
+// A started attendant with its message and stopped events.
+type keepalivePeer struct {
+	attendant *Attendant
+	messages  chan MessageEvent
+	stopped   chan AttendantStoppedEvent
+}
+
+
+func newKeepalivePeer(t *testing.T, conn net.Conn, keepalive Keepalive) *keepalivePeer {
+	peer := &keepalivePeer{
+		messages: make(chan MessageEvent, 16),
+		stopped:  make(chan AttendantStoppedEvent, 1),
+	}
+	peer.attendant = NewAttendant(
+		conn, &json.JSONMessageMarshaler{}, 0, make(chan AttendantStartedEvent, 1), peer.stopped,
+		peer.messages, make(chan ThrottledEvent, 16), WithKeepalive(keepalive),
+	)
+	if err := peer.attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// noinspection GoUnhandledErrorResult
+		peer.attendant.Stop()
+		peer.attendant.Wait()
+	})
+	return peer
+}
+
+
+// Connects two sockets through the loopback interface.
+func socketPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return accepted, dialed
+}
+
+
+func TestKeepaliveHappyPath(t *testing.T) {
+	local, remote := socketPair(t)
+	commands := Keepalive{PingCommand: "HB?", PongCommand: "HB!"}
+	pinging := commands
+	pinging.Interval = 20 * time.Millisecond
+	pinger := newKeepalivePeer(t, local, pinging)
+	ponger := newKeepalivePeer(t, remote, commands)
+	select {
+	case event := <-pinger.stopped:
+		t.Fatalf("the pinger stopped: %v, %v", event.StopType, event.Error)
+	case event := <-ponger.stopped:
+		t.Fatalf("the ponger stopped: %v, %v", event.StopType, event.Error)
+	case event := <-pinger.messages:
+		t.Fatalf("a keepalive message was conveyed: %s", event.Message.Command())
+	case event := <-ponger.messages:
+		t.Fatalf("a keepalive message was conveyed: %s", event.Message.Command())
+	case <-time.After(400 * time.Millisecond):
+	}
+	if in := pinger.attendant.Stats().MessagesIn; in < 5 {
+		t.Fatalf("expected several pongs, got %d messages", in)
+	}
+}
+
+
+func TestKeepaliveTimeout(t *testing.T) {
+	local, remote := socketPair(t)
+	pinger := newKeepalivePeer(t, local, Keepalive{Interval: 20 * time.Millisecond, MaxMissed: 3})
+	// The pongs arrive way too late.
+	newKeepalivePeer(t, delayedConn{remote, 500 * time.Millisecond}, Keepalive{})
+	start := time.Now()
+	select {
+	case event := <-pinger.stopped:
+		var timeout KeepaliveTimeoutError
+		if event.StopType != AttendantAbnormalStop || !errors.Is(event.Error, ErrKeepaliveTimeout) ||
+			!errors.As(event.Error, &timeout) || timeout.Missed != 3 {
+			t.Fatalf("unexpected stop: %v, %v", event.StopType, event.Error)
+		}
+		if elapsed := time.Since(start); elapsed < 60 * time.Millisecond {
+			t.Fatalf("stopped too early (%v)", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the pinger did not time out")
+	}
+}
@@ -0,0 +1,167 @@
+package chasqui
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+
+// The default reason of the close notice sent to the peers of
+// expired attendants (see SetMaxLifetime).
+const (
+	DefaultExpiryCode = 0
+	DefaultExpiryText = "connection expired"
+)
+
+
+// The maximum lifetime of an attendant: the lifetime (zero
+// means none), the reason told to the peer, the timer firing
+// the expiry, and whether the attendant expired.
+type lifetimeState struct {
+	mutex    sync.Mutex
+	lifetime time.Duration
+	code     int
+	text     string
+	timer    *time.Timer
+	armed    bool
+	stopped  bool
+	expired  int32
+}
+
+
+// Gets the maximum lifetime of the attendant (zero means none).
+func (attendant *Attendant) MaxLifetime() time.Duration {
+	attendant.lifetime.mutex.Lock()
+	defer attendant.lifetime.mutex.Unlock()
+	return attendant.lifetime.lifetime
+}
+
+
+// Sets the maximum lifetime of the attendant, counted since it
+// started (e.g. to force the peers to reconnect periodically).
+// Once reached, the attendant is stopped gracefully, as with
+// StopWithReason (see SetExpiryReason), and its stopped event
+// tells an AttendantExpiredStop. It may be changed while
+// running: if the new lifetime is already reached, it expires
+// right away. The lifetime is extended by the jitter offset of
+// the attendant (see WithJitter). Zero means no maximum
+// lifetime. Negative ones will be negated, to positive.
+func (attendant *Attendant) SetMaxLifetime(lifetime time.Duration) {
+	if lifetime < 0 {
+		lifetime = -lifetime
+	}
+	attendant.lifetime.mutex.Lock()
+	defer attendant.lifetime.mutex.Unlock()
+	attendant.lifetime.lifetime = lifetime
+	if attendant.Status() == AttendantRunning {
+		attendant.armLifetimeLocked(time.Now())
+	}
+}
+
+
+// Sets the reason told to the peer when the attendant expires
+// (by default, DefaultExpiryCode and DefaultExpiryText).
+func (attendant *Attendant) SetExpiryReason(code int, text string) {
+	attendant.lifetime.mutex.Lock()
+	defer attendant.lifetime.mutex.Unlock()
+	attendant.lifetime.code = code
+	attendant.lifetime.text = text
+}
+
+
+// Computes the time remaining until the attendant expires at
+// the given instant, and whether it has a maximum lifetime.
+func (attendant *Attendant) lifetimeRemaining(now time.Time) (time.Duration, bool) {
+	lifetime := attendant.lifetime.lifetime
+	startedAt := atomic.LoadInt64(&attendant.stats.startedAt)
+	if lifetime == 0 || startedAt == 0 {
+		return 0, false
+	}
+	remaining := time.Unix(0, startedAt).Add(lifetime + attendant.jitterOffset(lifetime)).Sub(now)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, true
+}
+
+
+// Arms (or re-arms) the expiry timer, according to the time
+// remaining at the given instant. The lifetime mutex must be
+// held.
+func (attendant *Attendant) armLifetimeLocked(now time.Time) {
+	attendant.disarmLifetimeLocked()
+	if attendant.lifetime.stopped {
+		return
+	}
+	if remaining, ok := attendant.lifetimeRemaining(now); ok {
+		attendant.lifetime.armed = true
+		attendant.resources.addTimers(1)
+		attendant.lifetime.timer = time.AfterFunc(remaining, attendant.expire)
+	}
+}
+
+
+// Disarms the expiry timer, if armed. The lifetime mutex must
+// be held.
+func (attendant *Attendant) disarmLifetimeLocked() {
+	if attendant.lifetime.armed {
+		attendant.lifetime.armed = false
+		if attendant.lifetime.timer.Stop() {
+			// Otherwise, the timer fired and accounts for
+			// itself.
+			attendant.resources.addTimers(-1)
+		}
+	}
+}
+
+
+// Arms the expiry timer, once the attendant started.
+func (attendant *Attendant) startLifetime() {
+	attendant.lifetime.mutex.Lock()
+	defer attendant.lifetime.mutex.Unlock()
+	attendant.armLifetimeLocked(time.Now())
+}
+
+
+// Stops the attendant gracefully once it expires.
+func (attendant *Attendant) expire() {
+	defer attendant.resources.addTimers(-1)
+	attendant.lifetime.mutex.Lock()
+	if attendant.lifetime.stopped {
+		attendant.lifetime.mutex.Unlock()
+		return
+	}
+	code, text := attendant.lifetime.code, attendant.lifetime.text
+	attendant.lifetime.mutex.Unlock()
+	if atomic.LoadInt32(&attendant.stopping) != stopUnclaimed {
+		return
+	}
+	atomic.StoreInt32(&attendant.lifetime.expired, 1)
+	attendant.logger.Debugf("attendant %d expired", attendant.id)
+	// noinspection GoUnhandledErrorResult
+	attendant.StopWithReason(code, text)
+}
+
+
+// Tells the type of a local stop: expired attendants stop with
+// their own type.
+func (attendant *Attendant) localStopType() AttendantStopType {
+	if atomic.LoadInt32(&attendant.lifetime.expired) == 1 {
+		return AttendantExpiredStop
+	}
+	return AttendantLocalStop
+}
+
+
+// Registers the teardown callback of the maximum lifetime: the
+// expiry timer is cancelled once the connection is released.
+func (attendant *Attendant) registerLifetimeTeardown() {
+	attendant.teardown.register(TeardownReleaseResources, func() error {
+		attendant.lifetime.mutex.Lock()
+		defer attendant.lifetime.mutex.Unlock()
+		attendant.lifetime.stopped = true
+		attendant.disarmLifetimeLocked()
+		return nil
+	})
+}
@@ -0,0 +1,153 @@
+package chasqui
+
+import (
+	"context"
+	"net"
+)
+
+
+// Runs the server as Run does, but listening on all the given
+// hosts at once: each one has its own dispatcher, but all of
+// them hand their connections to the same attendant set, and
+// trigger the same events (a started event per address). If
+// any host cannot be bound, the ones already bound are closed
+// and the server does not run. Stop closes all of them.
+func (server *Server) RunMulti(hosts ...string) error {
+	if len(hosts) == 0 {
+		panic(ArgumentError{"RunMulti:hosts"})
+	}
+	return server.run(false, func() (func(), error) {
+		return server.runDispatchers(hosts)
+	})
+}
+
+
+// Runs the server as RunMulti does, but over the given
+// listeners (e.g. the ones passed by systemd: see
+// ListenersFromEnv), each one with its own dispatcher. Whether
+// they are closed on stop depends on the ownership (see
+// WithDispatcherOptions and WithListenerOwnership).
+func (server *Server) RunWithListeners(listeners ...net.Listener) error {
+	if len(listeners) == 0 {
+		panic(ArgumentError{"RunWithListeners:listeners"})
+	}
+	for _, listener := range listeners {
+		if listener == nil {
+			panic(ArgumentError{"RunWithListeners:listeners"})
+		}
+	}
+	return server.run(false, func() (func(), error) {
+		dispatchers, err := server.idleDispatchers(len(listeners))
+		if err != nil {
+			return nil, err
+		}
+		return serveAll(len(dispatchers), func(ctx context.Context, index int) (<-chan struct{}, error) {
+			return dispatchers[index].runWithListener(ctx, listeners[index])
+		})
+	})
+}
+
+
+// Returns the current listen addresses of the server, if
+// running (only one, unless run by RunMulti or
+// RunWithListeners). Returns an
+// empty list if it is not running.
+func (server *Server) Addrs() []net.Addr {
+	var addrs []net.Addr
+	for _, dispatcher := range server.allDispatchers() {
+		if addr, err := dispatcher.Addr(); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+
+// Returns the main dispatcher, and the extra ones created
+// for RunMulti (or RunWithListeners).
+func (server *Server) allDispatchers() []*Dispatcher {
+	return append([]*Dispatcher{server.dispatcher}, server.extraDispatchers...)
+}
+
+
+// Returns the given number of dispatchers (the main one, and
+// as many extra ones as needed), ensuring none of them is
+// listening.
+func (server *Server) idleDispatchers(count int) ([]*Dispatcher, error) {
+	for len(server.extraDispatchers) < count - 1 {
+		dispatcher := server.newDispatcher()
+		if server.dispatcher.AcceptingPaused() {
+			dispatcher.PauseAccepting()
+		}
+		server.extraDispatchers = append(server.extraDispatchers, dispatcher)
+	}
+	dispatchers := server.allDispatchers()[:count]
+	for _, dispatcher := range dispatchers {
+		if dispatcher.listening() {
+			return nil, DispatcherAlreadyListeningError(true)
+		}
+	}
+	return dispatchers, nil
+}
+
+
+// Binds all the hosts first (closing the bound ones if any of
+// them fails), and then runs one dispatcher over each of them.
+// Returns a closer stopping all of them.
+func (server *Server) runDispatchers(hosts []string) (func(), error) {
+	dispatchers, err := server.idleDispatchers(len(hosts))
+	if err != nil {
+		return nil, err
+	}
+
+	listeners := make([]net.Listener, 0, len(hosts))
+	finalHosts := make([]*net.TCPAddr, 0, len(hosts))
+	closeListeners := func() {
+		for _, listener := range listeners {
+			// noinspection GoUnhandledErrorResult
+			listener.Close()
+		}
+	}
+	for index, host := range hosts {
+		listener, finalHost, err := listen(dispatchers[index].network, host, nil, dispatchers[index].reusePort)
+		if err != nil {
+			closeListeners()
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+		finalHosts = append(finalHosts, finalHost)
+	}
+
+	closer, err := serveAll(len(dispatchers), func(ctx context.Context, index int) (<-chan struct{}, error) {
+		return dispatchers[index].adopt(ctx, listeners[index], finalHosts[index])
+	})
+	if err != nil {
+		closeListeners()
+	}
+	return closer, err
+}
+
+
+// Runs the given number of accept loops by means of the given
+// function, under the same context. Returns a closer stopping
+// all of them. If any of them fails, the ones already running
+// are stopped.
+func serveAll(count int, serve func(context.Context, int) (<-chan struct{}, error)) (func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dones := make([]<-chan struct{}, 0, count)
+	closeAll := func() {
+		cancel()
+		for _, done := range dones {
+			<-done
+		}
+	}
+	for index := 0; index < count; index++ {
+		done, err := serve(ctx, index)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		dones = append(dones, done)
+	}
+	return closeAll, nil
+}
@@ -0,0 +1,104 @@
+package chasqui
+
+import (
+	"fmt"
+	"log"
+)
+
+
+// Loggers take the messages the library logs at its key points:
+// start and stop of servers and attendants, abnormal errors,
+// dropped events and errors that would be otherwise ignored.
+// They must be safe to use from many goroutines at once.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+
+// A logger discarding everything. It is the default one.
+type nopLogger struct{}
+
+
+// Discards a debug message.
+func (nopLogger) Debugf(string, ...interface{}) {}
+
+
+// Discards an info message.
+func (nopLogger) Infof(string, ...interface{}) {}
+
+
+// Discards a warning message.
+func (nopLogger) Warnf(string, ...interface{}) {}
+
+
+// Discards an error message.
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+
+// Returns a logger discarding everything.
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+
+// A logger writing to a standard library logger, prefixing
+// each message with its level.
+type stdLogger struct {
+	logger *log.Logger
+}
+
+
+// Writes a message with its level.
+func (logger stdLogger) output(level, format string, args []interface{}) {
+	// noinspection GoUnhandledErrorResult
+	logger.logger.Output(3, level + " " + fmt.Sprintf(format, args...))
+}
+
+
+// Writes a debug message.
+func (logger stdLogger) Debugf(format string, args ...interface{}) {
+	logger.output("DEBUG", format, args)
+}
+
+
+// Writes an info message.
+func (logger stdLogger) Infof(format string, args ...interface{}) {
+	logger.output("INFO", format, args)
+}
+
+
+// Writes a warning message.
+func (logger stdLogger) Warnf(format string, args ...interface{}) {
+	logger.output("WARN", format, args)
+}
+
+
+// Writes an error message.
+func (logger stdLogger) Errorf(format string, args ...interface{}) {
+	logger.output("ERROR", format, args)
+}
+
+
+// Returns a logger writing to the given standard library
+// logger (nil means the standard logger of the log package).
+func NewStdLogger(logger *log.Logger) Logger {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return stdLogger{logger}
+}
+
+
+// Returns the logger of the attendant.
+func (attendant *Attendant) Logger() Logger {
+	return attendant.logger
+}
+
+
+// Returns the logger of the server.
+func (server *Server) Logger() Logger {
+	return server.logger
+}
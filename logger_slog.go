@@ -0,0 +1,58 @@
+//go:build go1.21
+// +build go1.21
+
+package chasqui
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+
+// A logger writing to a structured logger. Messages are
+// formatted before being handed to it.
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+
+// Writes a message with its level.
+func (logger slogLogger) log(level slog.Level, format string, args []interface{}) {
+	logger.logger.Log(context.Background(), level, fmt.Sprintf(format, args...))
+}
+
+
+// Writes a debug message.
+func (logger slogLogger) Debugf(format string, args ...interface{}) {
+	logger.log(slog.LevelDebug, format, args)
+}
+
+
+// Writes an info message.
+func (logger slogLogger) Infof(format string, args ...interface{}) {
+	logger.log(slog.LevelInfo, format, args)
+}
+
+
+// Writes a warning message.
+func (logger slogLogger) Warnf(format string, args ...interface{}) {
+	logger.log(slog.LevelWarn, format, args)
+}
+
+
+// Writes an error message.
+func (logger slogLogger) Errorf(format string, args ...interface{}) {
+	logger.log(slog.LevelError, format, args)
+}
+
+
+// Returns a logger writing to the given structured logger
+// (nil means the default one of the slog package). Only
+// available when built with Go 1.21 or later.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return slogLogger{logger}
+}
@@ -0,0 +1,532 @@
+package flatbuf
+
+import (
+	"encoding/binary"
+	"fmt"
+	flatbuffers "github.com/google/flatbuffers/go"
+	. "github.com/universe-10th/chasqui/types"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+
+// The default cap for incoming frames, when none
+// is configured in the factory.
+const DefaultMaxFrameSize = 1 << 20
+
+
+// The maximum nesting level of list/map values.
+// Frames going deeper are considered malformed.
+const MaxDepth = 32
+
+
+// Error raised when an incoming frame announces a
+// length greater than the configured cap.
+type FrameTooLargeError struct {
+	Size uint32
+	Max  uint32
+}
+
+
+// The error message.
+func (err FrameTooLargeError) Error() string {
+	return fmt.Sprintf("flatbuf: frame of %d bytes exceeds the cap of %d bytes", err.Size, err.Max)
+}
+
+
+// Error raised when an incoming frame is not a well
+// formed message table.
+type MalformedFrameError struct {
+	Reason string
+}
+
+
+// The error message.
+func (err MalformedFrameError) Error() string {
+	return "flatbuf: malformed frame: " + err.Reason
+}
+
+
+// Error raised when a value cannot be represented in
+// the flatbuffers message schema.
+type UnsupportedValueError struct {
+	Value interface{}
+}
+
+
+// The error message.
+func (err UnsupportedValueError) Error() string {
+	return fmt.Sprintf("flatbuf: unsupported value of type %T", err.Value)
+}
+
+
+// The lazy message implementation. It reads the command
+// and the arguments from the underlying buffer only when
+// they are requested, and caches the results.
+//
+// By default, each message owns its buffer. If the
+// marshaler was configured to reuse frames, the buffer
+// belongs to the marshaler and will be reused by the next
+// Receive call, so this message will only be valid until
+// then: use Copy() to keep it for longer.
+// Values returned by Command(), Args() and KWArgs() are
+// always copies and remain valid forever.
+type message struct {
+	root    fbMessage
+	command *string
+	args    Args
+	kwargs  KWArgs
+}
+
+
+// Retrieves the command of this message, as
+// per the interface implementation.
+func (msg *message) Command() string {
+	if msg.command == nil {
+		command := string(msg.root.rawCommand())
+		msg.command = &command
+	}
+	return *msg.command
+}
+
+
+// Retrieves the args of this message, as
+// per the interface implementation.
+func (msg *message) Args() Args {
+	if msg.args == nil {
+		count := msg.root.argsLen()
+		if count == 0 {
+			return nil
+		}
+		args := make(Args, count)
+		for index := 0; index < count; index++ {
+			args[index] = decodeValue(msg.root.arg(index))
+		}
+		msg.args = args
+	}
+	return msg.args
+}
+
+
+// Retrieves the kwargs of this message, as
+// per the interface implementation. The map
+// is only built when this method is invoked.
+func (msg *message) KWArgs() KWArgs {
+	if msg.kwargs == nil {
+		count := msg.root.kwargsLen()
+		if count == 0 {
+			return nil
+		}
+		kwargs := make(KWArgs, count)
+		for index := 0; index < count; index++ {
+			kwarg := msg.root.kwarg(index)
+			kwargs[string(kwarg.rawKey())] = decodeKWArgValue(kwarg)
+		}
+		msg.kwargs = kwargs
+	}
+	return msg.kwargs
+}
+
+
+// Copies this message into a new one owning its
+// own buffer, so it survives further Receive calls.
+func (msg *message) Copy() Message {
+	buffer := make([]byte, len(msg.root.table.Bytes))
+	copy(buffer, msg.root.table.Bytes)
+	return &message{root: fbMessage{flatbuffers.Table{Bytes: buffer, Pos: msg.root.table.Pos}}}
+}
+
+
+// Decodes a single value into its go counterpart.
+func decodeValue(value fbValue) interface{} {
+	switch value.kind() {
+	case KindBool:
+		return value.boolean()
+	case KindInt:
+		return value.integer()
+	case KindFloat:
+		return value.float()
+	case KindTime:
+		return time.Unix(0, value.integer()).In(time.FixedZone("", int(value.offset())))
+	case KindString:
+		return string(value.rawString())
+	case KindBytes:
+		raw := value.rawBytes()
+		result := make([]byte, len(raw))
+		copy(result, raw)
+		return result
+	case KindList:
+		count := value.listLen()
+		list := make([]interface{}, count)
+		for index := 0; index < count; index++ {
+			list[index] = decodeValue(value.listItem(index))
+		}
+		return list
+	case KindMap:
+		count := value.mapLen()
+		entries := make(map[string]interface{}, count)
+		for index := 0; index < count; index++ {
+			entry := value.mapItem(index)
+			entries[string(entry.rawKey())] = decodeKWArgValue(entry)
+		}
+		return entries
+	default:
+		return nil
+	}
+}
+
+
+// Decodes the value of a key/value entry.
+func decodeKWArgValue(kwarg fbKWArg) interface{} {
+	if value, ok := kwarg.value(); ok {
+		return decodeValue(value)
+	}
+	return nil
+}
+
+
+// Walks the whole message to ensure every offset is
+// in bounds, so the lazy accessors never panic later.
+// This walk does not allocate.
+func validate(buffer []byte) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = MalformedFrameError{fmt.Sprint(recovered)}
+		}
+	}()
+
+	if len(buffer) < flatbuffers.SizeUOffsetT {
+		return MalformedFrameError{"frame too short"}
+	}
+	root := rootMessage(buffer)
+	root.rawCommand()
+	if err := checkVector(buffer, root.argsLen()); err != nil {
+		return err
+	}
+	for index, count := 0, root.argsLen(); index < count; index++ {
+		if err := validateValue(buffer, root.arg(index), 1); err != nil {
+			return err
+		}
+	}
+	if err := checkVector(buffer, root.kwargsLen()); err != nil {
+		return err
+	}
+	for index, count := 0, root.kwargsLen(); index < count; index++ {
+		if err := validateKWArg(buffer, root.kwarg(index), 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+
+// Ensures a vector length is plausible for the buffer.
+func checkVector(buffer []byte, count int) error {
+	if count < 0 || count * flatbuffers.SizeUOffsetT > len(buffer) {
+		return MalformedFrameError{"vector length out of bounds"}
+	}
+	return nil
+}
+
+
+// Validates a single value, recursively.
+func validateValue(buffer []byte, value fbValue, depth int) error {
+	if depth > MaxDepth {
+		return MalformedFrameError{"nesting too deep"}
+	}
+	switch value.kind() {
+	case KindNil:
+	case KindBool:
+		value.boolean()
+	case KindInt:
+		value.integer()
+	case KindTime:
+		value.integer()
+		value.offset()
+	case KindFloat:
+		value.float()
+	case KindString:
+		value.rawString()
+	case KindBytes:
+		value.rawBytes()
+	case KindList:
+		count := value.listLen()
+		if err := checkVector(buffer, count); err != nil {
+			return err
+		}
+		for index := 0; index < count; index++ {
+			if err := validateValue(buffer, value.listItem(index), depth + 1); err != nil {
+				return err
+			}
+		}
+	case KindMap:
+		count := value.mapLen()
+		if err := checkVector(buffer, count); err != nil {
+			return err
+		}
+		for index := 0; index < count; index++ {
+			if err := validateKWArg(buffer, value.mapItem(index), depth + 1); err != nil {
+				return err
+			}
+		}
+	default:
+		return MalformedFrameError{fmt.Sprintf("unknown value kind: %d", value.kind())}
+	}
+	return nil
+}
+
+
+// Validates a key/value entry, recursively.
+func validateKWArg(buffer []byte, kwarg fbKWArg, depth int) error {
+	kwarg.rawKey()
+	if value, ok := kwarg.value(); ok {
+		return validateValue(buffer, value, depth)
+	}
+	return nil
+}
+
+
+// Builds a single value, recursively. Nested objects
+// must be created before the value table starts.
+func buildValue(builder *flatbuffers.Builder, value interface{}, depth int) (flatbuffers.UOffsetT, error) {
+	if depth > MaxDepth {
+		return 0, UnsupportedValueError{value}
+	}
+
+	var kind Kind
+	var boolean bool
+	var integer int64
+	var float float64
+	var offset int32
+	var child flatbuffers.UOffsetT
+	var childSlot flatbuffers.VOffsetT
+
+	switch typed := value.(type) {
+	case nil:
+		kind = KindNil
+	case bool:
+		kind, boolean = KindBool, typed
+	case string:
+		kind, child, childSlot = KindString, builder.CreateString(typed), valueString
+	case []byte:
+		kind, child, childSlot = KindBytes, builder.CreateByteVector(typed), valueBytes
+	case time.Time:
+		_, zoneOffset := typed.Zone()
+		kind, integer, offset = KindTime, typed.UnixNano(), int32(zoneOffset)
+	default:
+		reflected := reflect.ValueOf(value)
+		switch reflected.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			kind, integer = KindInt, reflected.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			kind, integer = KindInt, int64(reflected.Uint())
+		case reflect.Float32, reflect.Float64:
+			kind, float = KindFloat, reflected.Float()
+		case reflect.Slice, reflect.Array:
+			count := reflected.Len()
+			offsets := make([]flatbuffers.UOffsetT, count)
+			for index := 0; index < count; index++ {
+				if offset, err := buildValue(builder, reflected.Index(index).Interface(), depth + 1); err != nil {
+					return 0, err
+				} else {
+					offsets[index] = offset
+				}
+			}
+			kind, child, childSlot = KindList, buildTableVector(builder, offsets), valueList
+		case reflect.Map:
+			if reflected.Type().Key().Kind() != reflect.String {
+				return 0, UnsupportedValueError{value}
+			}
+			if offset, err := buildEntries(builder, reflected, depth + 1); err != nil {
+				return 0, err
+			} else {
+				kind, child, childSlot = KindMap, offset, valueMap
+			}
+		default:
+			return 0, UnsupportedValueError{value}
+		}
+	}
+
+	builder.StartObject(valueFields)
+	builder.PrependInt8Slot(slotIndex(valueKind), int8(kind), int8(KindNil))
+	switch kind {
+	case KindBool:
+		builder.PrependBoolSlot(slotIndex(valueBool), boolean, false)
+	case KindInt:
+		builder.PrependInt64Slot(slotIndex(valueInt), integer, 0)
+	case KindTime:
+		builder.PrependInt64Slot(slotIndex(valueInt), integer, 0)
+		builder.PrependInt32Slot(slotIndex(valueOffset), offset, 0)
+	case KindFloat:
+		builder.PrependFloat64Slot(slotIndex(valueFloat), float, 0)
+	}
+	if childSlot != 0 {
+		builder.PrependUOffsetTSlot(slotIndex(childSlot), child, 0)
+	}
+	return builder.EndObject(), nil
+}
+
+
+// Builds a vector of key/value entries out of a map
+// with string keys. Keys are sorted, so the output is
+// deterministic.
+func buildEntries(builder *flatbuffers.Builder, reflected reflect.Value, depth int) (flatbuffers.UOffsetT, error) {
+	keys := make([]string, 0, reflected.Len())
+	for _, key := range reflected.MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	offsets := make([]flatbuffers.UOffsetT, len(keys))
+	for index, key := range keys {
+		item := reflected.MapIndex(reflect.ValueOf(key).Convert(reflected.Type().Key())).Interface()
+		if value, err := buildValue(builder, item, depth); err != nil {
+			return 0, err
+		} else {
+			keyOffset := builder.CreateString(key)
+			builder.StartObject(kwargFields)
+			builder.PrependUOffsetTSlot(slotIndex(kwargKey), keyOffset, 0)
+			builder.PrependUOffsetTSlot(slotIndex(kwargValue), value, 0)
+			offsets[index] = builder.EndObject()
+		}
+	}
+	return buildTableVector(builder, offsets), nil
+}
+
+
+// Builds a vector of already-built tables.
+func buildTableVector(builder *flatbuffers.Builder, offsets []flatbuffers.UOffsetT) flatbuffers.UOffsetT {
+	builder.StartVector(flatbuffers.SizeUOffsetT, len(offsets), flatbuffers.SizeUOffsetT)
+	for index := len(offsets) - 1; index >= 0; index-- {
+		builder.PrependUOffsetT(offsets[index])
+	}
+	return builder.EndVector(len(offsets))
+}
+
+
+// Converts a vtable offset into a builder slot index.
+func slotIndex(offset flatbuffers.VOffsetT) int {
+	return int(offset - 4) / 2
+}
+
+
+// Marshals FlatBuffers messages around a read-writer.
+// Each message is framed with a 4-byte little-endian
+// length prefix. Incoming frames longer than the max
+// frame size are rejected.
+//
+// By default, a new buffer is allocated for each frame,
+// so the received messages remain valid forever (which
+// is needed when they are queued, as attendants do).
+// Setting ReuseFrames reuses a single incoming buffer
+// instead, and the received messages are only valid until
+// the next call to Receive (they have a Copy() method to
+// keep them): only use it with synchronous consumers,
+// reading each message before receiving the next one.
+type FlatBufMessageMarshaler struct {
+	MaxFrameSize uint32
+	ReuseFrames  bool
+	buffer       io.ReadWriter
+	header       [4]byte
+	frame        []byte
+	builder      *flatbuffers.Builder
+	mutex        sync.Mutex
+	lastSize     int
+}
+
+
+// Receives a FlatBuffers message from the underlying
+// buffer (socket, most likely).
+func (marshaler *FlatBufMessageMarshaler) Receive() (Message, error, bool) {
+	if _, err := io.ReadFull(marshaler.buffer, marshaler.header[:]); err != nil {
+		return nil, err, err == io.EOF
+	}
+	size := binary.LittleEndian.Uint32(marshaler.header[:])
+	if size > marshaler.MaxFrameSize {
+		return nil, FrameTooLargeError{size, marshaler.MaxFrameSize}, false
+	}
+	marshaler.lastSize = 4 + int(size)
+
+	var frame []byte
+	if marshaler.ReuseFrames {
+		if uint32(cap(marshaler.frame)) < size {
+			marshaler.frame = make([]byte, size)
+		}
+		frame = marshaler.frame[:size]
+	} else {
+		frame = make([]byte, size)
+	}
+	if _, err := io.ReadFull(marshaler.buffer, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err, false
+	}
+	if err := validate(frame); err != nil {
+		return nil, err, false
+	}
+	return &message{root: rootMessage(frame)}, nil, false
+}
+
+
+// The size of the last received frame, including its
+// length prefix.
+func (marshaler *FlatBufMessageMarshaler) LastFrameSize() int {
+	return marshaler.lastSize
+}
+
+
+// Sends a FlatBuffers message via the underlying buffer
+// (socket, most likely).
+func (marshaler *FlatBufMessageMarshaler) Send(command string, args Args, kwargs KWArgs) error {
+	marshaler.mutex.Lock()
+	defer marshaler.mutex.Unlock()
+
+	builder := marshaler.builder
+	builder.Reset()
+	argOffsets := make([]flatbuffers.UOffsetT, len(args))
+	for index, arg := range args {
+		if offset, err := buildValue(builder, arg, 1); err != nil {
+			return err
+		} else {
+			argOffsets[index] = offset
+		}
+	}
+	argsOffset := buildTableVector(builder, argOffsets)
+	kwargsOffset, err := buildEntries(builder, reflect.ValueOf(map[string]interface{}(kwargs)), 1)
+	if err != nil {
+		return err
+	}
+	commandOffset := builder.CreateString(command)
+	builder.StartObject(messageFields)
+	builder.PrependUOffsetTSlot(slotIndex(messageCommand), commandOffset, 0)
+	builder.PrependUOffsetTSlot(slotIndex(messageArgs), argsOffset, 0)
+	builder.PrependUOffsetTSlot(slotIndex(messageKWArgs), kwargsOffset, 0)
+	builder.Finish(builder.EndObject())
+
+	payload := builder.FinishedBytes()
+	frame := make([]byte, 4 + len(payload))
+	binary.LittleEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+	_, err = marshaler.buffer.Write(frame)
+	return err
+}
+
+
+// Creates a new instance of FlatBuffers marshaler around
+// a buffer (socket, most likely), keeping the settings
+// of this instance.
+func (marshaler *FlatBufMessageMarshaler) Create(buffer io.ReadWriter) MessageMarshaler {
+	maxFrameSize := marshaler.MaxFrameSize
+	if maxFrameSize == 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &FlatBufMessageMarshaler{
+		MaxFrameSize: maxFrameSize,
+		ReuseFrames:  marshaler.ReuseFrames,
+		buffer:       buffer,
+		builder:      flatbuffers.NewBuilder(256),
+	}
+}
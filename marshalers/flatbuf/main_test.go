@@ -0,0 +1,201 @@
+package flatbuf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// A read-writer over separate input and output buffers.
+type pipeBuffer struct {
+	input  io.Reader
+	output bytes.Buffer
+}
+
+
+func (buffer *pipeBuffer) Read(data []byte) (int, error) {
+	return buffer.input.Read(data)
+}
+
+
+func (buffer *pipeBuffer) Write(data []byte) (int, error) {
+	return buffer.output.Write(data)
+}
+
+
+// A reader repeating the same data forever.
+type loopReader struct {
+	data     []byte
+	position int
+}
+
+
+func (reader *loopReader) Read(data []byte) (int, error) {
+	n := copy(data, reader.data[reader.position:])
+	reader.position = (reader.position + n) % len(reader.data)
+	return n, nil
+}
+
+
+// Encodes messages with the given factory, failing the
+// test on errors.
+func encodeWith(t testing.TB, factory MarshalerFactory, messages ...[]interface{}) []byte {
+	buffer := &pipeBuffer{}
+	marshaler := factory.Create(buffer)
+	for _, msg := range messages {
+		args, _ := msg[1].(Args)
+		kwargs, _ := msg[2].(KWArgs)
+		if err := marshaler.Send(msg[0].(string), args, kwargs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buffer.output.Bytes()
+}
+
+
+// Creates a marshaler reading the given input.
+func newReading(prototype *FlatBufMessageMarshaler, input []byte) MessageMarshaler {
+	return prototype.Create(&pipeBuffer{input: bytes.NewReader(input)})
+}
+
+
+func TestRoundTrip(t *testing.T) {
+	stamp := time.Date(2024, 2, 29, 13, 14, 15, 16, time.FixedZone("", 3600))
+	args := Args{nil, true, int64(-5), 2.5, "text", []byte{1, 2}, stamp, []interface{}{int64(1), "a"}}
+	kwargs := KWArgs{"map": map[string]interface{}{"x": int64(1)}, "nil": nil, "text": "value"}
+	input := encodeWith(t, &FlatBufMessageMarshaler{}, []interface{}{"ALL", args, kwargs})
+	received, err, _ := newReading(&FlatBufMessageMarshaler{}, input).Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Command() != "ALL" {
+		t.Fatalf("command %q", received.Command())
+	}
+	receivedArgs := received.Args()
+	if receivedStamp, ok := receivedArgs[6].(time.Time); !ok || !receivedStamp.Equal(stamp) {
+		t.Fatalf("time %v, expected %v", receivedArgs[6], stamp)
+	}
+	receivedArgs[6] = stamp
+	if !reflect.DeepEqual(receivedArgs, args) {
+		t.Fatalf("args %#v, expected %#v", receivedArgs, args)
+	}
+	if !reflect.DeepEqual(received.KWArgs(), kwargs) {
+		t.Fatalf("kwargs %#v, expected %#v", received.KWArgs(), kwargs)
+	}
+}
+
+
+// Receives all the given payloads before reading any of
+// them, as the attendant message queue does.
+func receiveQueued(t *testing.T, prototype *FlatBufMessageMarshaler, count int) []Message {
+	messages := make([][]interface{}, count)
+	for index := range messages {
+		messages[index] = []interface{}{"MSG", Args{fmt.Sprintf("payload-%03d", index)}, nil}
+	}
+	marshaler := newReading(prototype, encodeWith(t, &FlatBufMessageMarshaler{}, messages...))
+	received := make([]Message, count)
+	for index := range received {
+		var err error
+		if received[index], err, _ = marshaler.Receive(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return received
+}
+
+
+func TestMessagesOwnTheirFramesByDefault(t *testing.T) {
+	for index, received := range receiveQueued(t, &FlatBufMessageMarshaler{}, 200) {
+		if arg := received.Args()[0]; arg != fmt.Sprintf("payload-%03d", index) {
+			t.Fatalf("message %d read %v", index, arg)
+		}
+	}
+}
+
+
+func TestReusedFramesNeedCopies(t *testing.T) {
+	prototype := &FlatBufMessageMarshaler{ReuseFrames: true}
+	marshaler := newReading(prototype, encodeWith(t, &FlatBufMessageMarshaler{},
+		[]interface{}{"MSG", Args{"payload-000"}, nil}, []interface{}{"MSG", Args{"payload-001"}, nil},
+	))
+	first, err, _ := marshaler.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := first.(interface{ Copy() Message }).Copy()
+	if _, err, _ := marshaler.Receive(); err != nil {
+		t.Fatal(err)
+	}
+	// The first message now reads the reused buffer, while
+	// its copy is still valid.
+	if arg := first.Args()[0]; arg != "payload-001" {
+		t.Fatalf("reused frame read %v", arg)
+	}
+	if arg := kept.Args()[0]; arg != "payload-000" {
+		t.Fatalf("copy read %v", arg)
+	}
+}
+
+
+func TestFramingErrors(t *testing.T) {
+	frame := encodeWith(t, &FlatBufMessageMarshaler{}, []interface{}{"PING", Args{"some text"}, nil})
+	if _, err, graceful := newReading(&FlatBufMessageMarshaler{}, nil).Receive(); err != io.EOF || !graceful {
+		t.Fatalf("empty input gave %v (graceful: %v)", err, graceful)
+	}
+	var tooLarge FrameTooLargeError
+	if _, err, _ := newReading(&FlatBufMessageMarshaler{MaxFrameSize: 8}, frame).Receive(); !errors.As(err, &tooLarge) {
+		t.Fatalf("oversized frame gave %v", err)
+	}
+	for length := 1; length < len(frame); length++ {
+		if _, err, graceful := newReading(&FlatBufMessageMarshaler{}, frame[:length]).Receive(); err == nil || graceful {
+			t.Fatalf("prefix of %d bytes gave %v (graceful: %v)", length, err, graceful)
+		}
+	}
+	garbage := append([]byte{16, 0, 0, 0}, bytes.Repeat([]byte{0xff}, 16)...)
+	var malformed MalformedFrameError
+	if _, err, _ := newReading(&FlatBufMessageMarshaler{}, garbage).Receive(); !errors.As(err, &malformed) {
+		t.Fatalf("garbage gave %v", err)
+	}
+}
+
+
+// Benchmarks receiving a message (and reading its command
+// and args) with the given marshaler.
+func benchmarkReceive(b *testing.B, encoder, decoder MarshalerFactory) {
+	input := encodeWith(b, encoder, []interface{}{
+		"MOVE", Args{int64(12), int64(-3), 0.5, "north"}, KWArgs{"speed": int64(4)},
+	})
+	marshaler := decoder.Create(&pipeBuffer{input: &loopReader{data: input}})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for index := 0; index < b.N; index++ {
+		if received, err, _ := marshaler.Receive(); err != nil {
+			b.Fatal(err)
+		} else if received.Command() == "" || len(received.Args()) != 4 {
+			b.Fatal("unexpected message")
+		}
+	}
+}
+
+
+func BenchmarkReceiveFlatBuf(b *testing.B) {
+	benchmarkReceive(b, &FlatBufMessageMarshaler{}, &FlatBufMessageMarshaler{})
+}
+
+
+func BenchmarkReceiveFlatBufReusingFrames(b *testing.B) {
+	benchmarkReceive(b, &FlatBufMessageMarshaler{}, &FlatBufMessageMarshaler{ReuseFrames: true})
+}
+
+
+func BenchmarkReceiveJSON(b *testing.B) {
+	benchmarkReceive(b, &json.JSONMessageMarshaler{}, &json.JSONMessageMarshaler{})
+}
@@ -0,0 +1,222 @@
+package flatbuf
+
+import (
+	flatbuffers "github.com/google/flatbuffers/go"
+)
+
+
+// The kind of a single value. Each kind tells which
+// field of the Value table holds the actual data.
+type Kind int8
+const (
+	KindNil Kind = iota
+	KindBool
+	KindInt
+	KindFloat
+	KindString
+	KindBytes
+	KindList
+	KindMap
+	KindTime
+)
+
+
+// Slots (vtable offsets) of the Value table fields.
+const (
+	valueKind   = 4
+	valueBool   = 6
+	valueInt    = 8
+	valueFloat  = 10
+	valueString = 12
+	valueBytes  = 14
+	valueList   = 16
+	valueMap    = 18
+	valueOffset = 20
+	valueFields = 9
+)
+
+
+// Slots (vtable offsets) of the KWArg table fields.
+const (
+	kwargKey    = 4
+	kwargValue  = 6
+	kwargFields = 2
+)
+
+
+// Slots (vtable offsets) of the Message table fields.
+const (
+	messageCommand = 4
+	messageArgs    = 6
+	messageKWArgs  = 8
+	messageFields  = 3
+)
+
+
+// Accessor for the Value table.
+type fbValue struct {
+	table flatbuffers.Table
+}
+
+
+// Accessor for the KWArg table.
+type fbKWArg struct {
+	table flatbuffers.Table
+}
+
+
+// Accessor for the Message (root) table.
+type fbMessage struct {
+	table flatbuffers.Table
+}
+
+
+// Initializes a root message accessor over a buffer.
+func rootMessage(buffer []byte) fbMessage {
+	offset := flatbuffers.GetUOffsetT(buffer)
+	return fbMessage{flatbuffers.Table{Bytes: buffer, Pos: offset}}
+}
+
+
+// Gets the raw bytes of a string field, without copying.
+func rawString(table *flatbuffers.Table, slot flatbuffers.VOffsetT) []byte {
+	if offset := flatbuffers.UOffsetT(table.Offset(slot)); offset != 0 {
+		return table.ByteVector(offset + table.Pos)
+	}
+	return nil
+}
+
+
+// Gets the length of a vector field.
+func vectorLen(table *flatbuffers.Table, slot flatbuffers.VOffsetT) int {
+	if offset := flatbuffers.UOffsetT(table.Offset(slot)); offset != 0 {
+		return table.VectorLen(offset)
+	}
+	return 0
+}
+
+
+// Gets the j-th table in a vector of tables.
+func vectorTable(table *flatbuffers.Table, slot flatbuffers.VOffsetT, j int) flatbuffers.Table {
+	offset := flatbuffers.UOffsetT(table.Offset(slot))
+	position := table.Vector(offset) + flatbuffers.UOffsetT(j) * flatbuffers.SizeUOffsetT
+	return flatbuffers.Table{Bytes: table.Bytes, Pos: table.Indirect(position)}
+}
+
+
+// Gets a nested table field.
+func nestedTable(table *flatbuffers.Table, slot flatbuffers.VOffsetT) (flatbuffers.Table, bool) {
+	if offset := flatbuffers.UOffsetT(table.Offset(slot)); offset != 0 {
+		return flatbuffers.Table{Bytes: table.Bytes, Pos: table.Indirect(offset + table.Pos)}, true
+	}
+	return flatbuffers.Table{}, false
+}
+
+
+// The raw command bytes.
+func (message fbMessage) rawCommand() []byte {
+	return rawString(&message.table, messageCommand)
+}
+
+
+// The number of positional arguments.
+func (message fbMessage) argsLen() int {
+	return vectorLen(&message.table, messageArgs)
+}
+
+
+// The j-th positional argument.
+func (message fbMessage) arg(j int) fbValue {
+	return fbValue{vectorTable(&message.table, messageArgs, j)}
+}
+
+
+// The number of named arguments.
+func (message fbMessage) kwargsLen() int {
+	return vectorLen(&message.table, messageKWArgs)
+}
+
+
+// The j-th named argument.
+func (message fbMessage) kwarg(j int) fbKWArg {
+	return fbKWArg{vectorTable(&message.table, messageKWArgs, j)}
+}
+
+
+// The raw key bytes.
+func (kwarg fbKWArg) rawKey() []byte {
+	return rawString(&kwarg.table, kwargKey)
+}
+
+
+// The value. A missing value stands for nil.
+func (kwarg fbKWArg) value() (fbValue, bool) {
+	table, ok := nestedTable(&kwarg.table, kwargValue)
+	return fbValue{table}, ok
+}
+
+
+// The kind of this value.
+func (value fbValue) kind() Kind {
+	return Kind(value.table.GetInt8Slot(valueKind, int8(KindNil)))
+}
+
+
+// The bool content of this value.
+func (value fbValue) boolean() bool {
+	return value.table.GetBoolSlot(valueBool, false)
+}
+
+
+// The integer content of this value.
+func (value fbValue) integer() int64 {
+	return value.table.GetInt64Slot(valueInt, 0)
+}
+
+
+// The float content of this value.
+func (value fbValue) float() float64 {
+	return value.table.GetFloat64Slot(valueFloat, 0)
+}
+
+
+// The raw string content of this value.
+func (value fbValue) rawString() []byte {
+	return rawString(&value.table, valueString)
+}
+
+
+// The bytes content of this value.
+func (value fbValue) rawBytes() []byte {
+	return rawString(&value.table, valueBytes)
+}
+
+
+// The zone offset (seconds east), for time values.
+func (value fbValue) offset() int32 {
+	return value.table.GetInt32Slot(valueOffset, 0)
+}
+
+
+// The number of elements, for list values.
+func (value fbValue) listLen() int {
+	return vectorLen(&value.table, valueList)
+}
+
+
+// The j-th element, for list values.
+func (value fbValue) listItem(j int) fbValue {
+	return fbValue{vectorTable(&value.table, valueList, j)}
+}
+
+
+// The number of entries, for map values.
+func (value fbValue) mapLen() int {
+	return vectorLen(&value.table, valueMap)
+}
+
+
+// The j-th entry, for map values.
+func (value fbValue) mapItem(j int) fbKWArg {
+	return fbKWArg{vectorTable(&value.table, valueMap, j)}
+}
@@ -36,37 +36,90 @@ func (msg message) KWArgs() KWArgs {
 }
 
 
-// Marshals JSON messages around a read-writer.
+// Converts the marked times (see types.TimeMarker) in
+// the args and kwargs into time.Time values.
+func (msg *message) unmarkTimes() *message {
+	UnmarkTimes(msg.A)
+	UnmarkTimes(msg.KWA)
+	return msg
+}
+
+
+// Marshals JSON messages around a read-writer. The
+// UTF-8 policy tells what to do with received strings
+// that are not valid UTF-8 (see UTF8Policy).
 type JSONMessageMarshaler struct {
-	encoder *json2.Encoder
-	decoder *json2.Decoder
+	UTF8Policy UTF8Policy
+	writer     io.Writer
+	decoder    *json2.Decoder
+	lastSize   int
 }
 
 
 // Receives a JSON message from the underlying
-// buffer (socket, most likely).
+// buffer (socket, most likely). Strings with invalid
+// UTF-8 are either sanitized or rejected, according
+// to the configured policy.
 func (marshaler *JSONMessageMarshaler) Receive() (Message, error, bool) {
 	msg := &message{}
+	offset := marshaler.decoder.InputOffset()
+	defer func() {
+		marshaler.lastSize = int(marshaler.decoder.InputOffset() - offset)
+	}()
+	if marshaler.UTF8Policy == UTF8Reject {
+		var raw json2.RawMessage
+		if err := marshaler.decoder.Decode(&raw); err != nil {
+			return nil, err, err == io.EOF
+		} else if offset := invalidUTF8Offset(raw); offset >= 0 {
+			return nil, InvalidUTF8Error{offset}, false
+		} else if err := json2.Unmarshal(raw, &msg); err != nil {
+			return nil, err, false
+		} else {
+			return msg.unmarkTimes(), nil, false
+		}
+	}
+	// The standard decoder already replaces invalid
+	// sequences with U+FFFD.
 	if err := marshaler.decoder.Decode(&msg); err != nil {
 		return nil, err, err == io.EOF
 	} else {
-		return msg, nil, false
+		return msg.unmarkTimes(), nil, false
 	}
 }
 
 
+// The size of the last received message, including the
+// separating whitespace before it.
+func (marshaler *JSONMessageMarshaler) LastFrameSize() int {
+	return marshaler.lastSize
+}
+
+
 // Sends a JSON message via the underlying buffer
-// (socket, most likely).
+// (socket, most likely). The args and kwargs are validated
+// and the message is fully encoded before writing, so
+// nothing is written when any of them is not serializable.
+// Times are conveyed in their marked form (see TimeMarker).
 func (marshaler *JSONMessageMarshaler) Send(command string, args Args, kwargs KWArgs) error {
-	return marshaler.encoder.Encode(message{command, args, kwargs})
+	if err := ValidateArgs(args, kwargs); err != nil {
+		return err
+	}
+	if encoded, err := json2.Marshal(message{command, MarkTimes(args).(Args), MarkTimes(kwargs).(KWArgs)}); err != nil {
+		return err
+	} else {
+		_, err = marshaler.writer.Write(append(encoded, '\n'))
+		return err
+	}
 }
 
 
 // Creates a new instance of JSON marshaler around
-// a buffer (socket, most likely).
+// a buffer (socket, most likely), keeping the settings
+// of this instance.
 func (marshaler *JSONMessageMarshaler) Create(buffer io.ReadWriter) MessageMarshaler {
 	return &JSONMessageMarshaler{
-		encoder: json2.NewEncoder(buffer),
-		decoder: json2.NewDecoder(buffer),
+		UTF8Policy: marshaler.UTF8Policy,
+		writer:     buffer,
+		decoder:    json2.NewDecoder(buffer),
 	}
 }
\ No newline at end of file
@@ -0,0 +1,182 @@
+package json
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// A connection keeping what is written to it, with nothing
+// to read.
+type recordingConnection struct {
+	bytes.Buffer
+}
+
+
+func (connection *recordingConnection) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+
+func TestSendWritesNothingWhenInvalid(t *testing.T) {
+	connection := &recordingConnection{}
+	marshaler := (&JSONMessageMarshaler{}).Create(connection)
+	for _, args := range []Args{
+		{"ok", make(chan int)},
+		{func() {}},
+		{math.NaN()},
+		{[]interface{}{"ok", math.Inf(1)}},
+	} {
+		var unserializable UnserializableValueError
+		if err := marshaler.Send("BAD", args, nil); !errors.As(err, &unserializable) {
+			t.Fatalf("expected an unserializable value error, got: %v", err)
+		}
+	}
+	if connection.Len() != 0 {
+		t.Fatalf("nothing must be written, but got: %q", connection.String())
+	}
+	if err := marshaler.Send("GOOD", Args{1}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if connection.Len() == 0 {
+		t.Fatalf("valid messages must be written")
+	}
+}
+
+
+// A connection replaying the given input, discarding writes.
+type inputConnection struct {
+	*bytes.Reader
+}
+
+
+func (connection inputConnection) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+
+// Frames holding invalid UTF-8: an overlong encoding of '/'
+// (raw bytes), a lone high surrogate and a lone low one (via
+// \u escapes), and a high surrogate followed by a non-low one,
+// in the command, the args and the kwargs.
+var invalidUTF8Frames = []string{
+	"{\"C\":\"SAY\",\"A\":[\"a\xc0\xafb\"],\"KWA\":{}}\n",
+	"{\"C\":\"SAY\",\"A\":[[\"x\",\"\\ud83d\"]],\"KWA\":{}}\n",
+	"{\"C\":\"SAY\",\"A\":[],\"KWA\":{\"name\":\"\\ude00\"}}\n",
+	"{\"C\":\"SAY\\ud83d\\u0041\",\"A\":[],\"KWA\":{}}\n",
+}
+
+
+func TestUTF8Sanitize(t *testing.T) {
+	input := strings.Join(invalidUTF8Frames, "") +
+		"{\"C\":\"SAY\",\"A\":[\"\\ud83d\\ude00 ok\"],\"KWA\":{}}\n"
+	marshaler := (&JSONMessageMarshaler{}).Create(inputConnection{bytes.NewReader([]byte(input))})
+	for index := 0; index < len(invalidUTF8Frames) + 1; index++ {
+		received, err, _ := marshaler.Receive()
+		if err != nil {
+			t.Fatalf("frame %d: unexpected error: %v", index, err)
+		}
+		strs := []string{received.Command()}
+		collectStrings(received.Args(), &strs)
+		collectStrings(received.KWArgs(), &strs)
+		replaced := false
+		for _, str := range strs {
+			if !utf8.ValidString(str) {
+				t.Fatalf("frame %d: invalid UTF-8 reached the message: %q", index, str)
+			}
+			replaced = replaced || strings.ContainsRune(str, utf8.RuneError)
+		}
+		if expected := index < len(invalidUTF8Frames); replaced != expected {
+			t.Fatalf("frame %d: expected replacement %v, got strings %q", index, expected, strs)
+		}
+	}
+}
+
+
+func TestUTF8Reject(t *testing.T) {
+	var input string
+	for _, frame := range invalidUTF8Frames {
+		input += frame + "{\"C\":\"NEXT\",\"A\":[\"\\ud83d\\ude00\"],\"KWA\":{}}\n"
+	}
+	marshaler := (&JSONMessageMarshaler{UTF8Policy: UTF8Reject}).Create(inputConnection{bytes.NewReader([]byte(input))})
+	for index := range invalidUTF8Frames {
+		_, err, graceful := marshaler.Receive()
+		var invalid InvalidUTF8Error
+		var rejection MessageRejectionError
+		if !errors.As(err, &invalid) || !errors.As(err, &rejection) || !rejection.MessageRejected() || graceful {
+			t.Fatalf("frame %d: expected a message rejection, got: %v", index, err)
+		}
+		// The stream stays consistent: the next message is read.
+		if received, err, _ := marshaler.Receive(); err != nil || received.Command() != "NEXT" ||
+			received.Args()[0] != "\U0001F600" {
+			t.Fatalf("frame %d: the next message was not read: %v, %v", index, received, err)
+		}
+	}
+	if _, err, graceful := marshaler.Receive(); err != io.EOF || !graceful {
+		t.Fatalf("expected a graceful end, got: %v", err)
+	}
+}
+
+
+// Collects all the strings in a value, recursively.
+func collectStrings(value interface{}, strs *[]string) {
+	switch typed := value.(type) {
+	case string:
+		*strs = append(*strs, typed)
+	case []interface{}:
+		for _, item := range typed {
+			collectStrings(item, strs)
+		}
+	case Args:
+		collectStrings([]interface{}(typed), strs)
+	case map[string]interface{}:
+		for key, item := range typed {
+			*strs = append(*strs, key)
+			collectStrings(item, strs)
+		}
+	case KWArgs:
+		collectStrings(map[string]interface{}(typed), strs)
+	}
+}
+
+
+func TestTimesRoundTrip(t *testing.T) {
+	instants := []time.Time{
+		time.Date(2024, 2, 29, 23, 59, 59, 999999999, time.UTC),
+		time.Date(1999, 12, 31, 1, 2, 3, 1, time.FixedZone("", -(3*3600 + 30*60))),
+		time.Date(2030, 6, 15, 12, 0, 0, 123456789, time.FixedZone("", 14*3600)),
+	}
+	connection := &recordingConnection{}
+	marshaler := (&JSONMessageMarshaler{}).Create(connection)
+	for _, instant := range instants {
+		if err := marshaler.Send("AT", Args{instant, []interface{}{instant}}, KWArgs{"at": instant}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.Contains(connection.String(), `{"$time":"2024-02-29T23:59:59.999999999Z"}`) {
+		t.Fatalf("the times are not marked on the wire: %s", connection.String())
+	}
+	receiver := (&JSONMessageMarshaler{}).Create(inputConnection{bytes.NewReader(connection.Bytes())})
+	for _, instant := range instants {
+		received, err, _ := receiver.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, expectedOffset := instant.Zone()
+		for _, value := range []interface{}{
+			received.Args()[0], received.Args()[1].([]interface{})[0], received.KWArgs()["at"],
+		} {
+			restored, ok := value.(time.Time)
+			if _, offset := restored.Zone(); !ok || !restored.Equal(instant) || offset != expectedOffset {
+				t.Fatalf("expected %v, got %#v", instant, value)
+			}
+		}
+	}
+}
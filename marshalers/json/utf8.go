@@ -0,0 +1,106 @@
+package json
+
+import (
+	"strconv"
+	"unicode/utf8"
+)
+
+
+// Tells how the strings in the received messages are
+// treated when they are not valid UTF-8:
+// - UTF8Sanitize: Invalid sequences (including overlong
+//   encodings and lone surrogates smuggled via \u escapes)
+//   are replaced with U+FFFD. This is the default.
+// - UTF8Reject: The message is rejected with an error of
+//   type InvalidUTF8Error. Only that message is discarded:
+//   the attendant keeps reading the next ones.
+type UTF8Policy int
+const (
+	UTF8Sanitize UTF8Policy = iota
+	UTF8Reject
+)
+
+
+// Error raised when a received message has strings that
+// are not valid UTF-8, and the policy is to reject them.
+type InvalidUTF8Error struct {
+	Offset int
+}
+
+
+// The error message.
+func (err InvalidUTF8Error) Error() string {
+	return "json: invalid UTF-8 in message at offset " + strconv.Itoa(err.Offset)
+}
+
+
+// Tells only the message is rejected (the whole JSON value
+// was consumed), so the next ones may still be read.
+func (InvalidUTF8Error) MessageRejected() bool {
+	return true
+}
+
+
+// Checks a raw JSON document for invalid UTF-8: both raw
+// invalid bytes, and \u escapes standing for lone surrogates.
+// Returns the offset of the first problem, or -1.
+func invalidUTF8Offset(raw []byte) int {
+	if !utf8.Valid(raw) {
+		for offset := 0; offset < len(raw); {
+			r, size := utf8.DecodeRune(raw[offset:])
+			if r == utf8.RuneError && size <= 1 {
+				return offset
+			}
+			offset += size
+		}
+	}
+
+	inString := false
+	for offset := 0; offset < len(raw); offset++ {
+		switch raw[offset] {
+		case '"':
+			inString = !inString
+		case '\\':
+			if !inString || offset + 1 >= len(raw) {
+				continue
+			}
+			offset++
+			if raw[offset] != 'u' {
+				continue
+			}
+			unit, ok := hexUnit(raw, offset + 1)
+			if !ok {
+				continue
+			}
+			switch {
+			case unit >= 0xD800 && unit < 0xDC00:
+				// A high surrogate: must be followed by a low one.
+				next, ok := hexUnit(raw, offset + 7)
+				if offset + 6 >= len(raw) || raw[offset + 5] != '\\' || raw[offset + 6] != 'u' || !ok ||
+					next < 0xDC00 || next >= 0xE000 {
+					return offset - 1
+				}
+				offset += 10
+			case unit >= 0xDC00 && unit < 0xE000:
+				// A low surrogate without a preceding high one.
+				return offset - 1
+			default:
+				offset += 4
+			}
+		}
+	}
+	return -1
+}
+
+
+// Parses the 4 hex digits of a \u escape.
+func hexUnit(raw []byte, offset int) (uint16, bool) {
+	if offset + 4 > len(raw) {
+		return 0, false
+	}
+	if value, err := strconv.ParseUint(string(raw[offset:offset + 4]), 16, 16); err != nil {
+		return 0, false
+	} else {
+		return uint16(value), true
+	}
+}
@@ -0,0 +1,203 @@
+package signed
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	. "github.com/universe-10th/chasqui/types"
+	"io"
+)
+
+
+// The kwarg used to carry the signature, when none
+// is configured in the factory.
+const DefaultSignatureKey = "__signature"
+
+
+// Signers compute and verify signatures over the
+// canonical form of the messages.
+type Signer interface {
+	Sign(payload []byte) ([]byte, error)
+	Verify(payload, signature []byte) bool
+}
+
+
+// A signer based on HMAC-SHA256 and a shared key.
+type HMACSigner struct {
+	key []byte
+}
+
+
+// Computes the HMAC of the payload.
+func (signer HMACSigner) Sign(payload []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, signer.key)
+	mac.Write(payload)
+	return mac.Sum(nil), nil
+}
+
+
+// Verifies the HMAC of the payload, in constant time.
+func (signer HMACSigner) Verify(payload, signature []byte) bool {
+	expected, _ := signer.Sign(payload)
+	return hmac.Equal(expected, signature)
+}
+
+
+// Creates a new HMAC-SHA256 signer with the given key.
+func NewHMACSigner(key []byte) HMACSigner {
+	return HMACSigner{key}
+}
+
+
+// Error raised when an incoming message has no
+// signature, or it is not a hex string.
+type SignatureMissingError bool
+
+
+// The error message.
+func (SignatureMissingError) Error() string {
+	return "signed: message signature is missing or not a hex string"
+}
+
+
+// Error raised when an incoming message has an
+// invalid signature.
+type SignatureInvalidError bool
+
+
+// The error message.
+func (SignatureInvalidError) Error() string {
+	return "signed: message signature is invalid"
+}
+
+
+// The internal structure to pass verified messages,
+// which do not include the signature kwarg anymore.
+type message struct {
+	command string
+	args    Args
+	kwargs  KWArgs
+}
+
+
+// Retrieves the command of this message, as
+// per the interface implementation.
+func (msg message) Command() string {
+	return msg.command
+}
+
+
+// Retrieves the args of this message, as
+// per the interface implementation.
+func (msg message) Args() Args {
+	return msg.args
+}
+
+
+// Retrieves the kwargs of this message, as
+// per the interface implementation.
+func (msg message) KWArgs() KWArgs {
+	return msg.kwargs
+}
+
+
+// Wraps another marshaler factory so each outgoing
+// message gets a signature kwarg computed over its
+// canonical form (see types.CanonicalEncode), and each
+// incoming message is verified (and the signature kwarg
+// removed) before being returned. Messages without a
+// valid signature are considered abnormal errors, and
+// will close the connection. Integers are signed by their
+// exact digits: if the wrapped marshaler cannot carry them
+// exactly (e.g. JSON beyond 2^53), the altered message
+// fails the verification.
+type SignedMessageMarshaler struct {
+	Factory      MarshalerFactory
+	Signer       Signer
+	SignatureKey string
+	inner        MessageMarshaler
+}
+
+
+// Receives and verifies a message from the wrapped
+// marshaler.
+func (marshaler *SignedMessageMarshaler) Receive() (Message, error, bool) {
+	received, err, graceful := marshaler.inner.Receive()
+	if err != nil {
+		return nil, err, graceful
+	}
+
+	kwargs := KWArgs{}
+	var signature []byte
+	for key, value := range received.KWArgs() {
+		if key != marshaler.SignatureKey {
+			kwargs[key] = value
+		} else if encoded, ok := value.(string); ok {
+			signature, _ = hex.DecodeString(encoded)
+		}
+	}
+	if len(signature) == 0 {
+		return nil, SignatureMissingError(true), false
+	}
+	if payload, err := CanonicalEncode(received.Command(), received.Args(), kwargs); err != nil {
+		return nil, err, false
+	} else if !marshaler.Signer.Verify(payload, signature) {
+		return nil, SignatureInvalidError(true), false
+	}
+	if len(kwargs) == 0 {
+		kwargs = nil
+	}
+	return message{received.Command(), received.Args(), kwargs}, nil, false
+}
+
+
+// The size of the last message received by the wrapped
+// marshaler, if it can tell it (0 otherwise).
+func (marshaler *SignedMessageMarshaler) LastFrameSize() int {
+	if sizer, ok := marshaler.inner.(FrameSizer); ok {
+		return sizer.LastFrameSize()
+	}
+	return 0
+}
+
+
+// Signs and sends a message via the wrapped marshaler.
+// The given kwargs are not modified.
+func (marshaler *SignedMessageMarshaler) Send(command string, args Args, kwargs KWArgs) error {
+	payload, err := CanonicalEncode(command, args, kwargs)
+	if err != nil {
+		return err
+	}
+	signature, err := marshaler.Signer.Sign(payload)
+	if err != nil {
+		return err
+	}
+	signedKWArgs := make(KWArgs, len(kwargs) + 1)
+	for key, value := range kwargs {
+		signedKWArgs[key] = value
+	}
+	signedKWArgs[marshaler.SignatureKey] = hex.EncodeToString(signature)
+	return marshaler.inner.Send(command, args, signedKWArgs)
+}
+
+
+// Creates a new signed marshaler around a buffer (socket,
+// most likely), wrapping a new instance of the inner one.
+func (marshaler *SignedMessageMarshaler) Create(buffer io.ReadWriter) MessageMarshaler {
+	if marshaler.Factory == nil {
+		panic("signed: a wrapped marshaler factory is required")
+	}
+	if marshaler.Signer == nil {
+		panic("signed: a signer is required")
+	}
+	signatureKey := marshaler.SignatureKey
+	if signatureKey == "" {
+		signatureKey = DefaultSignatureKey
+	}
+	return &SignedMessageMarshaler{
+		Factory:      marshaler.Factory,
+		Signer:       marshaler.Signer,
+		SignatureKey: signatureKey,
+		inner:        marshaler.Factory.Create(buffer),
+	}
+}
@@ -0,0 +1,445 @@
+package tlv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	. "github.com/universe-10th/chasqui/types"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+
+// Framing spec. A message is laid out like this:
+//
+//   uvarint(len(command)) command
+//   uvarint(len(args))    [tag value]...
+//   uvarint(len(kwargs))  [uvarint(len(key)) key tag value]...
+//
+// Where each value is encoded according to its tag:
+//
+//   TagNil:     no payload.
+//   TagBool:    one byte, 0 or 1.
+//   TagInt64:   a signed (zig-zag) varint.
+//   TagFloat64: 8 bytes, little-endian IEEE 754 bits.
+//   TagString:  uvarint(len) followed by UTF-8 bytes.
+//   TagBytes:   uvarint(len) followed by raw bytes.
+//   TagTime:    varint(unix seconds), uvarint(nanoseconds),
+//               and varint(zone offset, in seconds east).
+//
+// Implementations in other languages only need to follow
+// these constants to interoperate.
+const (
+	TagNil     byte = 0
+	TagBool    byte = 1
+	TagInt64   byte = 2
+	TagFloat64 byte = 3
+	TagString  byte = 4
+	TagBytes   byte = 5
+	TagTime    byte = 6
+)
+
+
+// The default cap for any length field (command, key,
+// string or bytes payload) and for the argument counts.
+const DefaultMaxLength = 1 << 20
+
+
+// Chunks up to this length are allocated at once, and
+// longer ones grow as their bytes arrive.
+const chunkPreallocation = 4096
+
+
+// Error raised when a value cannot be represented
+// with any of the available tags.
+type UnsupportedValueError struct {
+	Value interface{}
+}
+
+
+// The error message.
+func (err UnsupportedValueError) Error() string {
+	return fmt.Sprintf("tlv: unsupported value of type %T", err.Value)
+}
+
+
+// Error raised when an incoming message has an unknown
+// tag or a length beyond the configured cap.
+type MalformedMessageError struct {
+	Reason string
+}
+
+
+// The error message.
+func (err MalformedMessageError) Error() string {
+	return "tlv: malformed message: " + err.Reason
+}
+
+
+// The internal structure to pass TLV messages.
+type message struct {
+	command string
+	args    Args
+	kwargs  KWArgs
+}
+
+
+// Retrieves the command of this message, as
+// per the interface implementation.
+func (msg message) Command() string {
+	return msg.command
+}
+
+
+// Retrieves the args of this message, as
+// per the interface implementation.
+func (msg message) Args() Args {
+	return msg.args
+}
+
+
+// Retrieves the kwargs of this message, as
+// per the interface implementation.
+func (msg message) KWArgs() KWArgs {
+	return msg.kwargs
+}
+
+
+// Appends a single tagged value to the output.
+func appendValue(output []byte, value interface{}) ([]byte, error) {
+	switch typed := value.(type) {
+	case nil:
+		return append(output, TagNil), nil
+	case bool:
+		if typed {
+			return append(output, TagBool, 1), nil
+		}
+		return append(output, TagBool, 0), nil
+	case int:
+		return appendInt(output, int64(typed)), nil
+	case int8:
+		return appendInt(output, int64(typed)), nil
+	case int16:
+		return appendInt(output, int64(typed)), nil
+	case int32:
+		return appendInt(output, int64(typed)), nil
+	case int64:
+		return appendInt(output, typed), nil
+	case uint8:
+		return appendInt(output, int64(typed)), nil
+	case uint16:
+		return appendInt(output, int64(typed)), nil
+	case uint32:
+		return appendInt(output, int64(typed)), nil
+	case float32:
+		return appendFloat(output, float64(typed)), nil
+	case float64:
+		return appendFloat(output, typed), nil
+	case string:
+		return appendString(append(output, TagString), typed), nil
+	case []byte:
+		output = appendUvarint(append(output, TagBytes), uint64(len(typed)))
+		return append(output, typed...), nil
+	case time.Time:
+		return appendTime(output, typed), nil
+	default:
+		return output, UnsupportedValueError{value}
+	}
+}
+
+
+// Appends an unsigned varint.
+func appendUvarint(output []byte, value uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(output, scratch[:binary.PutUvarint(scratch[:], value)]...)
+}
+
+
+// Appends a tagged, signed varint.
+func appendInt(output []byte, value int64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	output = append(output, TagInt64)
+	return append(output, scratch[:binary.PutVarint(scratch[:], value)]...)
+}
+
+
+// Appends a tagged float.
+func appendFloat(output []byte, value float64) []byte {
+	var scratch [8]byte
+	binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(value))
+	return append(append(output, TagFloat64), scratch[:]...)
+}
+
+
+// Appends a tagged time.
+func appendTime(output []byte, value time.Time) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	_, offset := value.Zone()
+	output = append(output, TagTime)
+	output = append(output, scratch[:binary.PutVarint(scratch[:], value.Unix())]...)
+	output = appendUvarint(output, uint64(value.Nanosecond()))
+	return append(output, scratch[:binary.PutVarint(scratch[:], int64(offset))]...)
+}
+
+
+// Appends a length-prefixed string (without tag).
+func appendString(output []byte, value string) []byte {
+	return append(appendUvarint(output, uint64(len(value))), value...)
+}
+
+
+// Encodes a whole message.
+func encode(command string, args Args, kwargs KWArgs) ([]byte, error) {
+	output := appendString(make([]byte, 0, 64), command)
+	output = appendUvarint(output, uint64(len(args)))
+	for _, arg := range args {
+		var err error
+		if output, err = appendValue(output, arg); err != nil {
+			return nil, err
+		}
+	}
+	output = appendUvarint(output, uint64(len(kwargs)))
+	for key, value := range kwargs {
+		var err error
+		if output, err = appendValue(appendString(output, key), value); err != nil {
+			return nil, err
+		}
+	}
+	return output, nil
+}
+
+
+// A buffered reader counting the consumed bytes.
+type countingReader struct {
+	*bufio.Reader
+	count int
+}
+
+
+// Reads a byte, counting it.
+func (reader *countingReader) ReadByte() (byte, error) {
+	value, err := reader.Reader.ReadByte()
+	if err == nil {
+		reader.count++
+	}
+	return value, err
+}
+
+
+// Reads bytes, counting them.
+func (reader *countingReader) Read(data []byte) (int, error) {
+	n, err := reader.Reader.Read(data)
+	reader.count += n
+	return n, err
+}
+
+
+// Marshals TLV messages around a read-writer. Incoming
+// lengths and counts beyond the max length are rejected
+// as malformed messages.
+type TLVMessageMarshaler struct {
+	MaxLength uint64
+	reader    *countingReader
+	writer    io.Writer
+	mutex     sync.Mutex
+	lastSize  int
+}
+
+
+// Reads an unsigned varint, checking it against the cap.
+func (marshaler *TLVMessageMarshaler) readLength() (uint64, error) {
+	if length, err := binary.ReadUvarint(marshaler.reader); err != nil {
+		return 0, err
+	} else if length > marshaler.MaxLength {
+		return 0, MalformedMessageError{fmt.Sprintf("length %d exceeds the cap of %d", length, marshaler.MaxLength)}
+	} else {
+		return length, nil
+	}
+}
+
+
+// Reads a length-prefixed chunk of bytes. Long chunks
+// grow as their bytes arrive, so a forged length does not
+// allocate the whole cap up front.
+func (marshaler *TLVMessageMarshaler) readChunk() ([]byte, error) {
+	if length, err := marshaler.readLength(); err != nil {
+		return nil, err
+	} else if length <= chunkPreallocation {
+		chunk := make([]byte, length)
+		_, err = io.ReadFull(marshaler.reader, chunk)
+		return chunk, err
+	} else {
+		var chunk bytes.Buffer
+		if _, err := io.CopyN(&chunk, marshaler.reader, int64(length)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return chunk.Bytes(), nil
+	}
+}
+
+
+// Reads a single tagged value.
+func (marshaler *TLVMessageMarshaler) readValue() (interface{}, error) {
+	tag, err := marshaler.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case TagNil:
+		return nil, nil
+	case TagBool:
+		if value, err := marshaler.reader.ReadByte(); err != nil {
+			return nil, err
+		} else if value > 1 {
+			return nil, MalformedMessageError{fmt.Sprintf("invalid bool byte: %d", value)}
+		} else {
+			return value == 1, nil
+		}
+	case TagInt64:
+		return binary.ReadVarint(marshaler.reader)
+	case TagFloat64:
+		var scratch [8]byte
+		if _, err := io.ReadFull(marshaler.reader, scratch[:]); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(scratch[:])), nil
+	case TagString:
+		chunk, err := marshaler.readChunk()
+		return string(chunk), err
+	case TagBytes:
+		return marshaler.readChunk()
+	case TagTime:
+		return marshaler.readTime()
+	default:
+		return nil, MalformedMessageError{fmt.Sprintf("unknown tag: %d", tag)}
+	}
+}
+
+
+// Reads the payload of a time value.
+func (marshaler *TLVMessageMarshaler) readTime() (time.Time, error) {
+	if seconds, err := binary.ReadVarint(marshaler.reader); err != nil {
+		return time.Time{}, err
+	} else if nanoseconds, err := binary.ReadUvarint(marshaler.reader); err != nil {
+		return time.Time{}, err
+	} else if nanoseconds >= uint64(time.Second) {
+		return time.Time{}, MalformedMessageError{fmt.Sprintf("invalid nanoseconds: %d", nanoseconds)}
+	} else if offset, err := binary.ReadVarint(marshaler.reader); err != nil {
+		return time.Time{}, err
+	} else if offset <= -86400 || offset >= 86400 {
+		return time.Time{}, MalformedMessageError{fmt.Sprintf("invalid zone offset: %d", offset)}
+	} else {
+		return time.Unix(seconds, int64(nanoseconds)).In(time.FixedZone("", int(offset))), nil
+	}
+}
+
+
+// Reads the body of a message, once its first byte
+// is known to be available.
+func (marshaler *TLVMessageMarshaler) readMessage() (*message, error) {
+	command, err := marshaler.readChunk()
+	if err != nil {
+		return nil, err
+	}
+	msg := &message{command: string(command)}
+	if count, err := marshaler.readLength(); err != nil {
+		return nil, err
+	} else if count > 0 {
+		// The count comes from the wire: the arguments grow
+		// as they arrive instead of being pre-sized by it.
+		for index := uint64(0); index < count; index++ {
+			if value, err := marshaler.readValue(); err != nil {
+				return nil, err
+			} else {
+				msg.args = append(msg.args, value)
+			}
+		}
+	}
+	if count, err := marshaler.readLength(); err != nil {
+		return nil, err
+	} else if count > 0 {
+		msg.kwargs = KWArgs{}
+		for index := uint64(0); index < count; index++ {
+			if key, err := marshaler.readChunk(); err != nil {
+				return nil, err
+			} else if value, err := marshaler.readValue(); err != nil {
+				return nil, err
+			} else {
+				msg.kwargs[string(key)] = value
+			}
+		}
+	}
+	return msg, nil
+}
+
+
+// Receives a TLV message from the underlying buffer
+// (socket, most likely). Only an EOF right at a message
+// boundary is considered a graceful close: a truncated
+// message is an abnormal one.
+func (marshaler *TLVMessageMarshaler) Receive() (Message, error, bool) {
+	if _, err := marshaler.reader.Peek(1); err != nil {
+		return nil, err, err == io.EOF
+	}
+	marshaler.reader.count = 0
+	msg, err := marshaler.readMessage()
+	marshaler.lastSize = marshaler.reader.count
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err, false
+	} else {
+		return msg, nil, false
+	}
+}
+
+
+// The size of the last received message.
+func (marshaler *TLVMessageMarshaler) LastFrameSize() int {
+	return marshaler.lastSize
+}
+
+
+// Sends a TLV message via the underlying buffer (socket,
+// most likely). The whole message is encoded before the
+// write, so nothing is written on encoding errors.
+func (marshaler *TLVMessageMarshaler) Send(command string, args Args, kwargs KWArgs) error {
+	if payload, err := encode(command, args, kwargs); err != nil {
+		return err
+	} else {
+		marshaler.mutex.Lock()
+		defer marshaler.mutex.Unlock()
+		_, err = marshaler.writer.Write(payload)
+		return err
+	}
+}
+
+
+// Creates a new instance of TLV marshaler around a buffer
+// (socket, most likely), keeping the settings of this
+// instance. Buffers already having a buffered reader (see
+// BufferedReadWriter) are not buffered again.
+func (marshaler *TLVMessageMarshaler) Create(buffer io.ReadWriter) MessageMarshaler {
+	maxLength := marshaler.MaxLength
+	if maxLength == 0 {
+		maxLength = DefaultMaxLength
+	}
+	var reader *bufio.Reader
+	if buffered, ok := buffer.(BufferedReadWriter); ok {
+		reader = buffered.BufferedReader()
+	} else {
+		reader = bufio.NewReader(buffer)
+	}
+	return &TLVMessageMarshaler{
+		MaxLength: maxLength,
+		reader:    &countingReader{Reader: reader},
+		writer:    buffer,
+	}
+}
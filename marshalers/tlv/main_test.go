@@ -0,0 +1,193 @@
+package tlv
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// A read-writer over separate input and output buffers.
+type pipeBuffer struct {
+	input  *bytes.Reader
+	output bytes.Buffer
+}
+
+
+func (buffer *pipeBuffer) Read(data []byte) (int, error) {
+	return buffer.input.Read(data)
+}
+
+
+func (buffer *pipeBuffer) Write(data []byte) (int, error) {
+	return buffer.output.Write(data)
+}
+
+
+// Creates a marshaler reading the given input.
+func newTestMarshaler(input []byte) (*TLVMessageMarshaler, *pipeBuffer) {
+	buffer := &pipeBuffer{input: bytes.NewReader(input)}
+	return (&TLVMessageMarshaler{}).Create(buffer).(*TLVMessageMarshaler), buffer
+}
+
+
+// Encodes a message, failing the test on errors.
+func mustEncode(t testing.TB, command string, args Args, kwargs KWArgs) []byte {
+	marshaler, buffer := newTestMarshaler(nil)
+	if err := marshaler.Send(command, args, kwargs); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.output.Bytes()
+}
+
+
+func TestRoundTrip(t *testing.T) {
+	stamp := time.Date(2024, 2, 29, 13, 14, 15, 16, time.FixedZone("", -3*3600))
+	long := bytes.Repeat([]byte{7}, 3*chunkPreallocation+1)
+	cases := []struct {
+		command string
+		args    Args
+		kwargs  KWArgs
+	}{
+		{"EMPTY", nil, nil},
+		{"", Args{nil}, nil},
+		{"SCALARS", Args{true, false, int64(-1), int64(1 << 62), 3.25, "héllo", []byte{0, 1, 2}}, nil},
+		{"TIME", Args{stamp}, KWArgs{"at": stamp}},
+		{"LONG", Args{long, string(long)}, nil},
+		{"KWARGS", nil, KWArgs{"a": int64(1), "b": "two", "c": nil, "": 4.5}},
+	}
+	for _, test := range cases {
+		marshaler, _ := newTestMarshaler(mustEncode(t, test.command, test.args, test.kwargs))
+		received, err, graceful := marshaler.Receive()
+		if err != nil || graceful {
+			t.Fatalf("%s: %v (graceful: %v)", test.command, err, graceful)
+		}
+		if received.Command() != test.command {
+			t.Fatalf("command %q, expected %q", received.Command(), test.command)
+		}
+		if !equalValues(received.Args(), test.args) {
+			t.Fatalf("%s: args %#v, expected %#v", test.command, received.Args(), test.args)
+		}
+		if !equalValues(received.KWArgs(), test.kwargs) {
+			t.Fatalf("%s: kwargs %#v, expected %#v", test.command, received.KWArgs(), test.kwargs)
+		}
+		if _, err, graceful := marshaler.Receive(); err != io.EOF || !graceful {
+			t.Fatalf("%s: end of input gave %v (graceful: %v)", test.command, err, graceful)
+		}
+	}
+}
+
+
+// Compares decoded values, with times compared by instant
+// and offset, and empty containers equal to nil ones.
+func equalValues(received, expected interface{}) bool {
+	switch typed := expected.(type) {
+	case Args:
+		values, _ := received.(Args)
+		if len(values) != len(typed) {
+			return false
+		}
+		for index := range typed {
+			if !equalValues(values[index], typed[index]) {
+				return false
+			}
+		}
+		return true
+	case KWArgs:
+		values, _ := received.(KWArgs)
+		if len(values) != len(typed) {
+			return false
+		}
+		for key := range typed {
+			if value, ok := values[key]; !ok || !equalValues(value, typed[key]) {
+				return false
+			}
+		}
+		return true
+	case time.Time:
+		value, ok := received.(time.Time)
+		_, receivedOffset := value.Zone()
+		_, expectedOffset := typed.Zone()
+		return ok && value.Equal(typed) && receivedOffset == expectedOffset
+	default:
+		return reflect.DeepEqual(received, expected)
+	}
+}
+
+
+func TestTruncatedIsAbnormal(t *testing.T) {
+	frame := mustEncode(t, "TRUNCATED", Args{int64(300), "text", 1.5, time.Now()}, KWArgs{"key": []byte("value")})
+	for length := 1; length < len(frame); length++ {
+		marshaler, _ := newTestMarshaler(frame[:length])
+		if _, err, graceful := marshaler.Receive(); err == nil || graceful {
+			t.Fatalf("prefix of %d/%d bytes gave %v (graceful: %v)", length, len(frame), err, graceful)
+		}
+	}
+}
+
+
+// Returns the bytes allocated while receiving the frame,
+// which must fail.
+func receiveForged(t *testing.T, frame []byte) uint64 {
+	var before, after runtime.MemStats
+	marshaler, _ := newTestMarshaler(frame)
+	runtime.ReadMemStats(&before)
+	_, err, graceful := marshaler.Receive()
+	runtime.ReadMemStats(&after)
+	if err == nil || graceful {
+		t.Fatalf("forged frame gave %v (graceful: %v)", err, graceful)
+	}
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+
+func TestForgedLengthsDoNotPreallocate(t *testing.T) {
+	forged := [][]byte{
+		// A million args, a single one present.
+		append(appendUvarint(appendString(nil, "ARGS"), DefaultMaxLength), TagNil),
+		// A million kwargs, none present.
+		appendUvarint(appendUvarint(appendString(nil, "KWARGS"), 0), DefaultMaxLength),
+		// A 1MB command, a few bytes present.
+		append(appendUvarint(nil, DefaultMaxLength), "short"...),
+	}
+	for index, frame := range forged {
+		if allocated := receiveForged(t, frame); allocated > 64*1024 {
+			t.Fatalf("forged frame %d allocated %d bytes", index, allocated)
+		}
+	}
+}
+
+
+func FuzzReceive(f *testing.F) {
+	f.Add(mustEncode(f, "PING", nil, nil))
+	f.Add(mustEncode(f, "ALL", Args{nil, true, int64(-7), 2.5, "s", []byte{1}, time.Unix(0, 1)}, KWArgs{"k": "v"}))
+	f.Add(append(appendUvarint(appendString(nil, "ARGS"), DefaultMaxLength), TagNil))
+	f.Add([]byte{0x80})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		marshaler, _ := newTestMarshaler(data)
+		for {
+			received, err, graceful := marshaler.Receive()
+			if err != nil {
+				// Only a clean end of input is graceful.
+				if graceful != (err == io.EOF) {
+					t.Fatalf("%v reported as graceful: %v", err, graceful)
+				}
+				return
+			}
+			// Whatever is received must be encodable again.
+			frame, err := encode(received.Command(), received.Args(), received.KWArgs())
+			if err != nil {
+				t.Fatalf("received an unencodable message: %v", err)
+			}
+			again, _ := newTestMarshaler(frame)
+			if decoded, err, _ := again.Receive(); err != nil || decoded.Command() != received.Command() {
+				t.Fatalf("re-encoded message did not round-trip: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,92 @@
+package wirelog
+
+import (
+	"fmt"
+	. "github.com/universe-10th/chasqui/types"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+
+// Loggers receive a copy of the bytes going through the
+// wire, with their direction, the instant they were read
+// or written, and the remote address of the connection
+// (nil if the buffer is not a connection).
+type WireLogger func(direction Direction, payload []byte, instant time.Time, remote net.Addr)
+
+
+// Creates a logger writing one line per chunk to the given
+// writer: the instant, the direction, the remote address,
+// and the quoted payload. Lines are written atomically.
+func WriterLogger(writer io.Writer) WireLogger {
+	var mutex sync.Mutex
+	return func(direction Direction, payload []byte, instant time.Time, remote net.Addr) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		// noinspection GoUnhandledErrorResult
+		fmt.Fprintf(writer, "%s %s %v %q\n", instant.Format(time.RFC3339Nano), direction, remote, payload)
+	}
+}
+
+
+// Copies everything going through a read-writer to a logger.
+type loggingReadWriter struct {
+	buffer io.ReadWriter
+	logger WireLogger
+	remote net.Addr
+}
+
+
+// Reads, and logs a copy of the read bytes.
+func (wire *loggingReadWriter) Read(data []byte) (int, error) {
+	n, err := wire.buffer.Read(data)
+	if n > 0 {
+		wire.logger(Inbound, append([]byte(nil), data[:n]...), time.Now(), wire.remote)
+	}
+	return n, err
+}
+
+
+// Writes, and logs a copy of the written bytes.
+func (wire *loggingReadWriter) Write(data []byte) (int, error) {
+	n, err := wire.buffer.Write(data)
+	if n > 0 {
+		wire.logger(Outbound, append([]byte(nil), data[:n]...), time.Now(), wire.remote)
+	}
+	return n, err
+}
+
+
+// Wraps another marshaler factory, so every byte it writes
+// and reads is copied to a wire logger, without altering
+// the on-wire behavior. Outgoing chunks are whole encoded
+// frames (the bundled marshalers write each frame at once),
+// while incoming chunks are the raw reads from the socket,
+// which may hold partial or several frames.
+//
+// This is only a factory: it creates instances of the
+// inner marshaler. When no logger is set, they are created
+// as is: there is no overhead at all.
+type WireLoggingMarshaler struct {
+	Factory MarshalerFactory
+	Logger  WireLogger
+}
+
+
+// Creates a new instance of the inner marshaler, around a
+// logging wrapper of the buffer (socket, most likely).
+func (marshaler *WireLoggingMarshaler) Create(buffer io.ReadWriter) MessageMarshaler {
+	if marshaler.Factory == nil {
+		panic("wirelog: a wrapped marshaler factory is required")
+	}
+	if marshaler.Logger == nil {
+		return marshaler.Factory.Create(buffer)
+	}
+	var remote net.Addr
+	if conn, ok := buffer.(interface{ RemoteAddr() net.Addr }); ok {
+		remote = conn.RemoteAddr()
+	}
+	return marshaler.Factory.Create(&loggingReadWriter{buffer, marshaler.Logger, remote})
+}
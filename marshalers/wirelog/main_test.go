@@ -0,0 +1,148 @@
+package wirelog
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// The chunks logged for a connection, by direction.
+type capturedWire struct {
+	mutex    sync.Mutex
+	inbound  bytes.Buffer
+	outbound bytes.Buffer
+	remotes  []net.Addr
+}
+
+
+func (wire *capturedWire) log(direction Direction, payload []byte, instant time.Time, remote net.Addr) {
+	wire.mutex.Lock()
+	defer wire.mutex.Unlock()
+	if direction == Inbound {
+		wire.inbound.Write(payload)
+	} else {
+		wire.outbound.Write(payload)
+	}
+	wire.remotes = append(wire.remotes, remote)
+}
+
+
+func TestWireLogScriptedSession(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer listener.Close()
+	peer, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer peer.Close()
+	local, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := &capturedWire{}
+	messages := make(chan chasqui.MessageEvent, 4)
+	attendant := chasqui.NewAttendant(
+		local, &WireLoggingMarshaler{&json.JSONMessageMarshaler{}, wire.log}, 0,
+		make(chan chasqui.AttendantStartedEvent, 1), make(chan chasqui.AttendantStoppedEvent, 1),
+		messages, make(chan chasqui.ThrottledEvent, 4),
+	)
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer sends two requests (in a single write) and
+	// gets two responses.
+	sent := "{\"C\":\"LOGIN\",\"A\":[\"alice\"],\"KWA\":{}}\n{\"C\":\"LIST\",\"A\":[],\"KWA\":{\"page\":2}}\n"
+	if _, err := peer.Write([]byte(sent)); err != nil {
+		t.Fatal(err)
+	}
+	for index := 0; index < 2; index++ {
+		select {
+		case <-messages:
+		case <-time.After(time.Second):
+			t.Fatal("the requests did not arrive")
+		}
+	}
+	if err := attendant.Send("WELCOME", Args{"alice"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := attendant.Send("ITEMS", Args{[]interface{}{"sword", "shield"}}, KWArgs{"page": 2}); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(peer)
+	var received strings.Builder
+	for index := 0; index < 2; index++ {
+		// noinspection GoUnhandledErrorResult
+		peer.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		received.WriteString(line)
+	}
+	// noinspection GoUnhandledErrorResult
+	attendant.Stop()
+	attendant.Wait()
+
+	wire.mutex.Lock()
+	defer wire.mutex.Unlock()
+	if wire.inbound.String() != sent {
+		t.Errorf("the inbound log %q does not match the sent bytes %q", wire.inbound.String(), sent)
+	}
+	if wire.outbound.String() != received.String() {
+		t.Errorf("the outbound log %q does not match the received bytes %q", wire.outbound.String(), received.String())
+	}
+	for _, remote := range wire.remotes {
+		if remote == nil || remote.String() != peer.LocalAddr().String() {
+			t.Fatalf("expected the peer address %v, got %v", peer.LocalAddr(), remote)
+		}
+	}
+}
+
+
+func TestWireLogDisabled(t *testing.T) {
+	local, remote := net.Pipe()
+	// noinspection GoUnhandledErrorResult
+	defer local.Close()
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	created := (&WireLoggingMarshaler{Factory: &json.JSONMessageMarshaler{}}).Create(local)
+	if _, ok := created.(*json.JSONMessageMarshaler); !ok {
+		t.Fatalf("without a logger, the inner marshaler must be created as is, got %T", created)
+	}
+}
+
+
+func TestWriterLogger(t *testing.T) {
+	var output bytes.Buffer
+	logger := WriterLogger(&output)
+	instant := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+	logger(Inbound, []byte("{\"C\":\"A\"}\n"), instant, addr)
+	logger(Outbound, []byte("x"), instant, nil)
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected two lines, got: %q", output.String())
+	}
+	expected := instant.Format(time.RFC3339Nano) + " " + Inbound.String() + " 10.0.0.1:4000 " + `"{\"C\":\"A\"}\n"`
+	if lines[0] != expected {
+		t.Fatalf("expected %q, got %q", expected, lines[0])
+	}
+	if !strings.Contains(lines[1], " "+Outbound.String()+" <nil> ") {
+		t.Fatalf("unexpected line: %q", lines[1])
+	}
+}
@@ -0,0 +1,51 @@
+package chasqui
+
+import (
+	"errors"
+
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// Event reporting a received message was rejected by the
+// marshaler (e.g. for holding invalid UTF-8), while the
+// connection stays usable: the message is discarded and
+// the attendant keeps reading (see MessageRejectionError).
+type MessageRejectedEvent struct {
+	Attendant   *Attendant
+	AttendantID uint64
+	Error       error
+}
+
+
+// Returns a read-only channel with all the "message rejected"
+// events. It will be nil unless a channel was given on
+// construction.
+func (attendant *Attendant) MessageRejectedEvent() <-chan MessageRejectedEvent {
+	return attendant.messageRejectedEvent
+}
+
+
+// Tells whether a receive error only rejects the received
+// message (the wrapping marshalers may have wrapped it).
+func isMessageRejection(err error) bool {
+	var rejection MessageRejectionError
+	return errors.As(err, &rejection) && rejection.MessageRejected()
+}
+
+
+// Triggers a "message rejected" event, if anyone listens.
+// Gives up once the attendant is told to stop (the reading
+// is over, and nobody took the event).
+func (attendant *Attendant) emitMessageRejected(err error) {
+	attendant.logger.Debugf("attendant %d rejected a message: %v", attendant.id, err)
+	event := MessageRejectedEvent{attendant, attendant.id, err}
+	if attendant.unified() {
+		attendant.emitUnified(event, attendant.pause.interrupted)
+	} else if attendant.messageRejectedEvent != nil {
+		select {
+		case attendant.messageRejectedEvent <- event:
+		case <-attendant.pause.interrupted:
+		}
+	}
+}
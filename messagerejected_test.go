@@ -0,0 +1,58 @@
+package chasqui
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+)
+
+
+func TestRejectedMessagesKeepTheAttendantReading(t *testing.T) {
+	local, remote := net.Pipe()
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	messages := make(chan MessageEvent, 4)
+	rejected := make(chan MessageRejectedEvent, 4)
+	stopped := make(chan AttendantStoppedEvent, 1)
+	attendant := NewAttendant(
+		local, &json.JSONMessageMarshaler{UTF8Policy: json.UTF8Reject}, 0, make(chan AttendantStartedEvent, 1),
+		stopped, messages, make(chan ThrottledEvent, 4), WithMessageRejectedEvent(rejected),
+	)
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer attendant.Stop()
+	go func() {
+		// noinspection GoUnhandledErrorResult
+		remote.Write([]byte("{\"C\":\"BEFORE\",\"A\":[],\"KWA\":{}}\n" +
+			"{\"C\":\"BAD\",\"A\":[\"\\ud800\"],\"KWA\":{}}\n" +
+			"{\"C\":\"AFTER\",\"A\":[],\"KWA\":{}}\n"))
+	}()
+	expectCommand := func(command string) {
+		select {
+		case event := <-messages:
+			if event.Message.Command() != command {
+				t.Fatalf("expected %s, got %s", command, event.Message.Command())
+			}
+		case event := <-stopped:
+			t.Fatalf("the attendant stopped: %v, %v", event.StopType, event.Error)
+		case <-time.After(time.Second):
+			t.Fatalf("%s did not arrive", command)
+		}
+	}
+	expectCommand("BEFORE")
+	select {
+	case event := <-rejected:
+		var invalid json.InvalidUTF8Error
+		if event.Attendant != attendant || !errors.As(event.Error, &invalid) {
+			t.Fatalf("unexpected rejection: %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the message was not rejected")
+	}
+	expectCommand("AFTER")
+}
@@ -0,0 +1,147 @@
+package chasqui
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync"
+	"time"
+)
+
+
+// The default time given to the TLS handshake of each new
+// connection.
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
+
+// The context key under which the attendants of TLS
+// connections keep the peer certificate chain (see
+// Attendant.PeerCertificates), if the peer sent one.
+const PeerCertificatesKey = "__peerCertificates"
+
+
+// Verifies the state of a completed TLS handshake (e.g. the
+// subject or the organization of the peer certificate, when
+// requiring client certificates) before the attendant of the
+// connection starts. Returning an error rejects the connection.
+type OnTLSVerify func(remote net.Addr, state tls.ConnectionState) error
+
+
+// Connections telling the state of their TLS handshake, like
+// *tls.Conn.
+type tlsStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+
+// The TLS connections whose handshake is running, to close
+// them once the server stops accepting.
+type tlsHandshakeState struct {
+	mutex   sync.Mutex
+	pending map[net.Conn]struct{}
+}
+
+
+// Makes the server check the TLS handshake of each new
+// connection with the given callback, rejecting it when it
+// returns an error (see OnTLSVerify).
+func WithTLSVerify(verify OnTLSVerify) ServerOption {
+	return func(server *Server) {
+		server.tlsVerify = verify
+	}
+}
+
+
+// Sets the time given to the TLS handshake of each new
+// connection (zero means DefaultTLSHandshakeTimeout).
+func WithTLSHandshakeTimeout(timeout time.Duration) ServerOption {
+	if timeout < 0 {
+		panic(ArgumentError{"WithTLSHandshakeTimeout:timeout"})
+	}
+	return func(server *Server) {
+		server.tlsHandshakeTimeout = timeout
+	}
+}
+
+
+// Returns the peer certificate chain of the connection, if it
+// is a TLS one and the peer sent a certificate (e.g. when
+// running with a config requiring client certificates), or
+// nil otherwise. It is safe to call it from any goroutine.
+func (attendant *Attendant) PeerCertificates() []*x509.Certificate {
+	connection := attendant.connection
+	for {
+		if stater, ok := connection.(tlsStater); ok {
+			if certificates := stater.ConnectionState().PeerCertificates; len(certificates) > 0 {
+				return certificates
+			}
+			return nil
+		} else if wrapper, ok := connection.(netConnWrapper); ok {
+			connection = wrapper.NetConn()
+		} else {
+			return nil
+		}
+	}
+}
+
+
+// Makes the TLS handshake of a new connection in the
+// background, within the handshake timeout, and verifies it
+// (if told to). Then, hands the connection to the given
+// function. Failed or refused handshakes close the connection,
+// and trigger a ConnectionRejectedEvent.
+func (server *Server) acceptTLS(conn *tls.Conn, next func(net.Conn)) {
+	server.handshakes.mutex.Lock()
+	server.handshakes.pending[conn] = struct{}{}
+	server.handshakes.mutex.Unlock()
+	server.resources.addConnections(1)
+	server.resources.spawn(func() {
+		defer server.resources.addConnections(-1)
+		timeout := server.tlsHandshakeTimeout
+		if timeout == 0 {
+			timeout = DefaultTLSHandshakeTimeout
+		}
+		// noinspection GoUnhandledErrorResult
+		conn.SetDeadline(time.Now().Add(timeout))
+		reason, err := NotRejected, conn.Handshake()
+		if err != nil {
+			reason = RejectedByTLSHandshake
+		} else if server.tlsVerify != nil {
+			if err = server.tlsVerify(conn.RemoteAddr(), conn.ConnectionState()); err != nil {
+				reason = RejectedByTLSVerify
+			}
+		}
+		server.handshakes.mutex.Lock()
+		delete(server.handshakes.pending, conn)
+		server.handshakes.mutex.Unlock()
+		if err != nil {
+			server.logger.Debugf("server rejected a connection by %s (%s): %v", reason, conn.RemoteAddr(), err)
+			// noinspection GoUnhandledErrorResult
+			conn.Close()
+			select {
+			case server.rejectedEvent <- ConnectionRejectedEvent{conn.RemoteAddr(), reason, err}:
+			default:
+			}
+			return
+		}
+		// noinspection GoUnhandledErrorResult
+		conn.SetDeadline(time.Time{})
+		next(conn)
+	})
+}
+
+
+// Registers the teardown callback of the TLS handshakes: the
+// connections still making it are closed once the server
+// stops accepting.
+func (server *Server) registerTLSTeardown() {
+	server.teardown.register(TeardownStopAccepting, func() error {
+		server.handshakes.mutex.Lock()
+		defer server.handshakes.mutex.Unlock()
+		for conn := range server.handshakes.pending {
+			// noinspection GoUnhandledErrorResult
+			conn.Close()
+		}
+		return nil
+	})
+}
@@ -0,0 +1,179 @@
+package chasqui
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+
+// A local certificate authority, issuing certificates for the
+// tests.
+type testAuthority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+
+// Creates a local certificate authority.
+func newTestAuthority(t *testing.T, name string) *testAuthority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthority{certificate, key}
+}
+
+
+// Issues a certificate for the given name, valid for servers
+// (on the loopback address) and clients.
+func (authority *testAuthority) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, authority.certificate, &key.PublicKey, authority.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+
+// Returns a pool with the certificate of the authority.
+func (authority *testAuthority) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(authority.certificate)
+	return pool
+}
+
+
+func TestMutualTLS(t *testing.T) {
+	authority := newTestAuthority(t, "test authority")
+	rogue := newTestAuthority(t, "rogue authority")
+	server := newTestServer(16, WithTLSVerify(func(remote net.Addr, state tls.ConnectionState) error {
+		if state.PeerCertificates[0].Subject.CommonName == "blocked-service" {
+			return errors.New("blocked service")
+		}
+		return nil
+	}))
+	config := &tls.Config{
+		Certificates: []tls.Certificate{authority.issue(t, "server")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    authority.pool(),
+	}
+	if err := server.RunTLS("127.0.0.1:0", config); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer server.Stop()
+	<-server.StartedEvent()
+	dial := func(certificates ...tls.Certificate) *tls.Conn {
+		t.Helper()
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", server.TCPAddr().String(),
+			&tls.Config{RootCAs: authority.pool(), Certificates: certificates})
+		if err != nil {
+			// The server may refuse the handshake before the
+			// client ends it (e.g. in TLS 1.2).
+			return nil
+		}
+		return conn
+	}
+
+	// An accepted client tells its certificate chain.
+	accepted := dial(authority.issue(t, "trusted-service"))
+	if accepted == nil {
+		t.Fatal("the trusted client could not connect")
+	}
+	// noinspection GoUnhandledErrorResult
+	defer accepted.Close()
+	select {
+	case event := <-server.AttendantStartedEvent():
+		certificates := event.Attendant.PeerCertificates()
+		if len(certificates) == 0 || certificates[0].Subject.CommonName != "trusted-service" {
+			t.Fatalf("unexpected peer certificates: %v", certificates)
+		}
+		if chain, _ := event.Attendant.Context(PeerCertificatesKey); chain == nil ||
+			chain.([]*x509.Certificate)[0] != certificates[0] {
+			t.Fatalf("the peer certificates must be in the context, got: %v", chain)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the trusted client was not attended")
+	}
+
+	// The rejections are reported with their reason.
+	for _, rejection := range []struct {
+		name         string
+		certificates []tls.Certificate
+		reason       RejectReason
+	}{
+		{"blocked by the callback", []tls.Certificate{authority.issue(t, "blocked-service")}, RejectedByTLSVerify},
+		{"no certificate", nil, RejectedByTLSHandshake},
+		{"unknown authority", []tls.Certificate{rogue.issue(t, "trusted-service")}, RejectedByTLSHandshake},
+	} {
+		if conn := dial(rejection.certificates...); conn != nil {
+			// noinspection GoUnhandledErrorResult
+			defer conn.Close()
+		}
+		select {
+		case event := <-server.ConnectionRejectedEvent():
+			if event.Reason != rejection.reason || event.Err == nil {
+				t.Fatalf("%s: expected the reason %v, got: %v (%v)", rejection.name, rejection.reason,
+					event.Reason, event.Err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: no rejection event", rejection.name)
+		}
+		select {
+		case event := <-server.AttendantStartedEvent():
+			t.Fatalf("%s: a rejected client was attended: %v", rejection.name, event.Attendant.RemoteAddr())
+		default:
+		}
+	}
+}
+
+
+func TestPeerCertificatesWithoutTLS(t *testing.T) {
+	attendant, remote, _, _ := newPipeAttendant()
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	if certificates := attendant.PeerCertificates(); certificates != nil {
+		t.Fatalf("a plain connection has no peer certificates, got: %v", certificates)
+	}
+}
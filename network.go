@@ -0,0 +1,68 @@
+package chasqui
+
+import (
+	"net"
+)
+
+
+// Error raised when the host to listen on cannot be resolved
+// in the network of the dispatcher. It also matches
+// ErrResolve.
+type ResolveError struct {
+	Network string
+	Host    string
+	Err     error
+}
+
+
+// The error message.
+func (err ResolveError) Error() string {
+	return "cannot resolve " + err.Host + " in network " + err.Network + ": " + err.Err.Error()
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err ResolveError) Is(target error) bool {
+	return target == ErrResolve
+}
+
+
+// Returns the underlying error.
+func (err ResolveError) Unwrap() error {
+	return err.Err
+}
+
+
+// Tells whether the network is one a dispatcher may listen on.
+func validNetwork(network string) bool {
+	return network == "tcp" || network == "tcp4" || network == "tcp6"
+}
+
+
+// Makes the dispatcher listen on the given network: "tcp" (by
+// default: the host resolves to IPv4 or IPv6, as the system
+// prefers), "tcp4" or "tcp6" (e.g. to pick the family of a
+// dual-stack host name). Any other network panics. It has no
+// effect on RunWithListener.
+func WithDispatcherNetwork(network string) DispatcherOption {
+	if !validNetwork(network) {
+		panic(ArgumentError{"WithDispatcherNetwork:network"})
+	}
+	return func(dispatcher *Dispatcher) {
+		dispatcher.network = network
+	}
+}
+
+
+// Tells the family of a bound address: "tcp4" or "tcp6" (the
+// IPv6 wildcard of a "tcp" listener also takes IPv4 peers, on
+// dual-stack systems). Empty when there is no address.
+func addressFamily(addr *net.TCPAddr) string {
+	if addr == nil {
+		return ""
+	} else if addr.IP.To4() != nil {
+		return "tcp4"
+	} else {
+		return "tcp6"
+	}
+}
@@ -0,0 +1,630 @@
+package chasqui
+
+import "time"
+
+
+// Options configure optional features and events of an
+// attendant on construction (see NewAttendant).
+type AttendantOption func(*Attendant)
+
+
+// Sets the channel receiving the "bandwidth exceeded" events.
+// Those events are only triggered when the attendant uses a
+// BandwidthMarshaler.
+func WithBandwidthExceededEvent(bandwidthExceededEvent chan BandwidthExceededEvent) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.bandwidthExceededEvent = bandwidthExceededEvent
+	}
+}
+
+
+// Sets the channel receiving the "event overflow" events.
+// Those events are only triggered when the attendant drops
+// events (see WithEventDelivery).
+func WithEventOverflowEvent(eventOverflowEvent chan EventOverflowEvent) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.eventOverflowEvent = eventOverflowEvent
+	}
+}
+
+
+// Sets the channel receiving the "authenticated" events.
+// Those events are only triggered when the attendant has an
+// authentication phase (see WithAuth).
+func WithAuthenticatedEvent(authenticatedEvent chan AttendantAuthenticatedEvent) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.authenticatedEvent = authenticatedEvent
+	}
+}
+
+
+// Sets the channel receiving the "slow consumer" events.
+// Those events are only triggered when the attendant has
+// slow consumer detection (see WithSlowConsumer).
+func WithSlowConsumerEvent(slowConsumerEvent chan SlowConsumerEvent) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.slowConsumerEvent = slowConsumerEvent
+	}
+}
+
+
+// Sets the channel receiving the "unresponsive" events. Those
+// events are only triggered when the attendant has a keepalive
+// warning time (see Keepalive.WarnAfter).
+func WithUnresponsiveEvent(unresponsiveEvent chan AttendantUnresponsiveEvent) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.unresponsiveEvent = unresponsiveEvent
+	}
+}
+
+
+// Sets the channel receiving the "half closed" events. Giving
+// it changes how the peer closing its writing side is handled:
+// instead of stopping remotely, the attendant triggers this
+// event and keeps running (only sending) until its writing
+// side is closed too (see CloseWrite), or it is stopped.
+func WithHalfClosedEvent(halfClosedEvent chan AttendantHalfClosedEvent) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.halfClosedEvent = halfClosedEvent
+	}
+}
+
+
+// Sets the channel receiving the "message rejected" events.
+// Those events are only triggered when the marshaler rejects
+// single messages (see types.MessageRejectionError).
+func WithMessageRejectedEvent(messageRejectedEvent chan MessageRejectedEvent) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.messageRejectedEvent = messageRejectedEvent
+	}
+}
+
+
+// Sets the channel receiving the "send failed" events. Those
+// events are only triggered when the attendant has an outgoing
+// queue (see WithSendQueue).
+func WithSendFailedEvent(sendFailedEvent chan SendFailedEvent) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.sendFailedEvent = sendFailedEvent
+	}
+}
+
+
+// Sets the unified channel: all the events of the attendant
+// (the started, stopped, message and throttled ones, and the
+// optional ones) are triggered through it, in the order they
+// occur, instead of through their own channels (which are not
+// used at all, so no event is delivered twice). The started
+// event comes strictly before any other, and the stopped event
+// strictly last. Rebinding (see Attendant.Rebind) does not move
+// the messages away from this channel. Half-closes are still
+// enabled by giving a "half closed" channel (see
+// WithHalfClosedEvent), but their events come through this one.
+func WithUnifiedEvents(events chan AttendantEvent) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.events = events
+	}
+}
+
+
+// Makes the attendant detect whether it is a slow consumer:
+// when its pending sends (see Attendant.PendingSends) stay
+// above the threshold for longer than the grace period, the
+// slow consumer event is triggered, and again once they are
+// back to the threshold or below. A zero grace period means
+// no detection at all.
+func WithSlowConsumer(threshold uint, grace time.Duration) AttendantOption {
+	return func(attendant *Attendant) {
+		if grace > 0 {
+			if attendant.slowConsumer == nil {
+				attendant.registerSlowConsumerTeardown()
+			}
+			attendant.slowConsumer = &slowConsumerState{
+				threshold: int(threshold),
+				grace:     grace,
+				quit:      make(chan struct{}),
+				done:      make(chan struct{}),
+			}
+		} else {
+			attendant.slowConsumer = nil
+		}
+	}
+}
+
+
+// Gives the attendant an authentication phase: until the
+// handler accepts a message, the received messages are only
+// taken by the handler (they are neither conveyed nor
+// throttled). Once accepted, the authenticated event is
+// triggered and the messages flow normally. If rejected, the
+// attendant is stopped (with AttendantAuthRejected as stop
+// type) and, if told to notify, an AuthRejectedCommand notice is
+// sent before. A nil handler means no authentication phase.
+func WithAuth(handler AuthHandler, notify bool) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.auth.handler = handler
+		attendant.auth.notify = notify
+	}
+}
+
+
+// Sets what the attendant does when its message and throttled
+// channels are full (see EventDeliveryPolicy).
+func WithEventDelivery(policy EventDeliveryPolicy) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.eventDelivery = policy
+	}
+}
+
+
+// Gives the attendant an outgoing queue with the given
+// capacity and overflow policy (see Attendant.Send). A
+// capacity of 0 means no queue at all.
+func WithSendQueue(capacity uint, policy SendQueuePolicy) AttendantOption {
+	return func(attendant *Attendant) {
+		if capacity > 0 {
+			if attendant.sendQueue == nil {
+				attendant.registerSendQueueTeardown()
+			}
+			attendant.sendQueue = newSendQueue(capacity, policy)
+		} else {
+			attendant.sendQueue = nil
+		}
+	}
+}
+
+
+// Enables the keepalive (ping/pong) messages on the attendant
+// (see Keepalive).
+func WithKeepalive(keepalive Keepalive) AttendantOption {
+	return func(attendant *Attendant) {
+		if attendant.keepalive == nil {
+			attendant.registerKeepaliveTeardown()
+		}
+		attendant.keepalive = &keepaliveState{
+			config: keepalive.normalized(),
+			quit:   make(chan struct{}),
+			done:   make(chan struct{}),
+		}
+	}
+}
+
+
+// Makes the attendant delay its throttled messages instead
+// of discarding them: they are kept (up to the given capacity)
+// and conveyed, in order, once the throttle allows them. The
+// throttled events are only triggered for the messages not
+// fitting in the queue. A capacity of 0 means no delay.
+func WithThrottleDelay(capacity uint) AttendantOption {
+	return func(attendant *Attendant) {
+		if capacity > 0 {
+			if attendant.delayQueue == nil {
+				attendant.registerDelayTeardown()
+			}
+			attendant.delayQueue = &delayQueue{
+				capacity: int(capacity),
+				wake:     make(chan struct{}, 1),
+				quit:     make(chan struct{}),
+				done:     make(chan struct{}),
+			}
+		} else {
+			attendant.delayQueue = nil
+		}
+	}
+}
+
+
+// Sets the TCP tuning of the attendant (see SetTCPTuning).
+func WithTCPTuning(tuning TCPTuning) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.tcpTuning.tuning = &tuning
+	}
+}
+
+
+// Makes the attendant report a snapshot of its final context
+// in its stopped event (see Attendant.ContextSnapshot). It is
+// disabled by default, since contexts may be large.
+func WithStoppedContext(enabled bool) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.stoppedContext = enabled
+	}
+}
+
+
+// Sets the logger of the attendant (by default, nothing is
+// logged). Nil means the default one.
+func WithLogger(logger Logger) AttendantOption {
+	return func(attendant *Attendant) {
+		if logger == nil {
+			logger = nopLogger{}
+		}
+		attendant.logger = logger
+	}
+}
+
+
+// Makes the attendant read its connection through a buffered
+// reader of the given size, reused across messages, which is
+// handed to the marshaler (see types.BufferedReadWriter).
+// Zero means no buffer (the marshaler buffers on its own).
+func WithReadBufferSize(size uint) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.readBufferSize = int(size)
+	}
+}
+
+
+// Makes the expiring context elements of the attendant be
+// swept by the sweeper of its owner (e.g. a server).
+func withContextSweeper(sweeper *contextSweeper) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.sweeper = sweeper
+	}
+}
+
+
+// Makes the attendant also account its resources in the
+// counters of its owner (e.g. a server).
+func withResourceParent(parent *resourceCounter) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.resources.parent = parent
+	}
+}
+
+
+// Makes the attendant keep its tags in the index of its
+// owner (e.g. a server).
+func withTagIndex(index *tagIndex) AttendantOption {
+	return func(attendant *Attendant) {
+		attendant.tags.index = index
+	}
+}
+
+
+// Options configure optional features of a server on
+// construction (see NewServer).
+type ServerOption func(*Server)
+
+
+// Sets the write stall timeout of each new attendant (see
+// Attendant.SetWriteStallTimeout).
+func WithWriteStallTimeout(timeout time.Duration) ServerOption {
+	return func(server *Server) {
+		if timeout < 0 {
+			timeout = -timeout
+		}
+		server.stallTimeout = timeout
+	}
+}
+
+
+// Sets the write timeout of each new attendant (see
+// Attendant.SetWriteTimeout).
+func WithWriteTimeout(timeout time.Duration) ServerOption {
+	return func(server *Server) {
+		if timeout < 0 {
+			timeout = -timeout
+		}
+		server.writeTimeout = timeout
+	}
+}
+
+
+// Sets the idle timeout of each new attendant (see
+// Attendant.SetIdleTimeout).
+func WithIdleTimeout(timeout time.Duration) ServerOption {
+	return func(server *Server) {
+		if timeout < 0 {
+			timeout = -timeout
+		}
+		server.idleTimeout = timeout
+	}
+}
+
+
+// Sets the first message timeout of each new attendant (see
+// Attendant.SetFirstMessageTimeout).
+func WithFirstMessageTimeout(timeout time.Duration) ServerOption {
+	return func(server *Server) {
+		if timeout < 0 {
+			timeout = -timeout
+		}
+		server.firstMessageTimeout = timeout
+	}
+}
+
+
+// Sets the maximum lifetime of each new attendant, and the
+// reason told to their peers when they expire (see
+// Attendant.SetMaxLifetime and Attendant.SetExpiryReason).
+func WithMaxLifetime(lifetime time.Duration, code int, text string) ServerOption {
+	return func(server *Server) {
+		if lifetime < 0 {
+			lifetime = -lifetime
+		}
+		server.maxLifetime = lifetime
+		server.expiryCode = code
+		server.expiryText = text
+	}
+}
+
+
+// Gives each new attendant an outgoing queue (see
+// WithSendQueue).
+func WithAttendantSendQueue(capacity uint, policy SendQueuePolicy) ServerOption {
+	return func(server *Server) {
+		server.sendQueueCapacity = capacity
+		server.sendQueuePolicy = policy
+	}
+}
+
+
+// Makes the server warm up each time it runs: the accepted
+// connections are admitted at a rate (in connections per
+// second) ramping from the initial rate to the final one
+// over the given duration, or until Server.Ready is called.
+// Rejected connections get a RetryAfterCommand notice with
+// the given retry lapse, and are closed.
+func WithWarmup(duration time.Duration, initialRate, finalRate float64, retryAfter time.Duration) ServerOption {
+	return func(server *Server) {
+		if duration <= 0 {
+			server.warmup = nil
+			return
+		}
+		if initialRate < 0 {
+			initialRate = 0
+		}
+		if finalRate < initialRate {
+			finalRate = initialRate
+		}
+		if retryAfter < 0 {
+			retryAfter = -retryAfter
+		}
+		server.warmup = &warmup{
+			duration:    duration,
+			initialRate: initialRate,
+			finalRate:   finalRate,
+			retryAfter:  retryAfter,
+		}
+	}
+}
+
+
+// Makes the attendants of the server tell the half-closes of
+// their peers apart (see WithHalfClosedEvent), triggering the
+// "half closed" events of the server instead of stopping.
+func WithHalfClose() ServerOption {
+	return func(server *Server) {
+		server.halfClose = true
+	}
+}
+
+
+// Sets the policy deciding, by remote address, whether each
+// new connection is accepted, rejected silently, or rejected
+// with a single message (see AcceptPolicy). Rejected
+// connections never get an attendant, so they trigger no
+// events and are not enumerated. Nil means accepting all.
+func WithAcceptPolicy(policy AcceptPolicy) ServerOption {
+	return func(server *Server) {
+		server.acceptPolicy = policy
+	}
+}
+
+
+// Sets the accept filter of the server: the connections it
+// rejects are closed right away (before any accept policy),
+// and a ConnectionRejectedEvent is triggered instead of any
+// attendant event (those events are discarded when their
+// channel is full). Nil means accepting all (see CIDRList for
+// a ready made filter).
+func WithAcceptFilter(filter AcceptFilter) ServerOption {
+	return func(server *Server) {
+		server.acceptFilter = filter
+	}
+}
+
+
+// Sets the accept veto of the server: the connections it
+// rejects are closed right away (after the accept filter, and
+// before any accept policy), and a ConnectionRejectedEvent is
+// triggered instead of any attendant event (those events are
+// discarded when their channel is full). Nil means accepting
+// all. The maintenance mode (see MaintenanceMode) takes
+// precedence over it.
+func WithAcceptVeto(veto AcceptVeto) ServerOption {
+	return func(server *Server) {
+		server.acceptVeto = veto
+	}
+}
+
+
+// Makes the server listen on the given network: "tcp" (by
+// default), "tcp4" or "tcp6" (see WithDispatcherNetwork). Any
+// other network panics.
+func WithNetwork(network string) ServerOption {
+	if !validNetwork(network) {
+		panic(ArgumentError{"WithNetwork:network"})
+	}
+	return func(server *Server) {
+		server.network = network
+	}
+}
+
+
+// Limits the rate of new connections from each remote IP (see
+// AcceptRateLimit). The IP is the one of the socket (e.g. the
+// load balancer, behind a PROXY protocol one), and the limit
+// applies before anything else of the server (but after the
+// accept filter and veto). The ConnectionRateLimitedEvent
+// events are discarded when their channel is full.
+func WithAcceptRateLimit(limit AcceptRateLimit) ServerOption {
+	return func(server *Server) {
+		server.acceptRate = newAcceptRateLimiter(limit)
+	}
+}
+
+
+// Makes the server listen with SO_REUSEPORT (see
+// WithDispatcherReusePort), so several server processes may
+// listen on the same port at once (e.g. for zero-downtime
+// deploys). Only Linux supports it: on other platforms, Run
+// fails with ReusePortUnsupportedError.
+func WithReusePort(enabled bool) ServerOption {
+	return func(server *Server) {
+		server.reusePort = enabled
+	}
+}
+
+
+// Makes the server parse a PROXY protocol (v1 or v2) header
+// at the start of each new connection (e.g. behind a load
+// balancer), within the given time (zero means
+// DefaultProxyHeaderTimeout). The attendants tell the actual
+// peer address (see Attendant.RemoteAddr), and the accept
+// policy and the warmup see it too (but not the accept filter,
+// which runs before). Connections with a malformed or missing
+// header are closed, and trigger a ProxyHeaderRejectedEvent
+// (those events are discarded when their channel is full).
+func WithProxyProtocol(timeout time.Duration) ServerOption {
+	return func(server *Server) {
+		if timeout < 0 {
+			timeout = -timeout
+		} else if timeout == 0 {
+			timeout = DefaultProxyHeaderTimeout
+		}
+		server.proxyHeaderTimeout = timeout
+	}
+}
+
+
+// Sets the notice run for each running attendant when the
+// server shuts down (see Server.Shutdown), e.g. to tell the
+// peers to leave. It runs synchronously, once the server
+// stopped accepting connections, so it should be quick (a
+// panicking notice is logged). Nil means no notice.
+func WithShutdownNotice(notice ShutdownNoticeFunc) ServerOption {
+	return func(server *Server) {
+		server.shutdownNotice = notice
+	}
+}
+
+
+// Configures the dispatcher of the server, by means of the
+// given options (e.g. WithListenerOwnership).
+func WithDispatcherOptions(options ...DispatcherOption) ServerOption {
+	return func(server *Server) {
+		server.dispatcherOptions = append(server.dispatcherOptions, options...)
+	}
+}
+
+
+// Enables the keepalive (ping/pong) messages on each new
+// attendant (see WithKeepalive).
+func WithAttendantKeepalive(keepalive Keepalive) ServerOption {
+	return func(server *Server) {
+		normalized := keepalive.normalized()
+		server.keepalive = &normalized
+	}
+}
+
+
+// Gives each new attendant a throttle policy, created by the
+// given function (policies must not be shared among them).
+// See Attendant.SetThrottlePolicy.
+func WithThrottlePolicy(policy func() ThrottlePolicy) ServerOption {
+	return func(server *Server) {
+		server.throttlePolicy = policy
+	}
+}
+
+
+// Gives each new attendant a throttle escalation (see
+// Attendant.SetThrottleEscalation).
+func WithThrottleEscalation(maxViolations int, window time.Duration, action EscalationAction) ServerOption {
+	return func(server *Server) {
+		if maxViolations <= 0 || window <= 0 {
+			server.escalation = nil
+		} else {
+			server.escalation = &throttleEscalation{maxViolations: maxViolations, window: window, action: action}
+		}
+	}
+}
+
+
+// Makes each new attendant delay its throttled messages (see
+// WithThrottleDelay).
+func WithAttendantThrottleDelay(capacity uint) ServerOption {
+	return func(server *Server) {
+		server.throttleDelay = capacity
+	}
+}
+
+
+// Sets what each new attendant does when the message and
+// throttled channels are full (see WithEventDelivery).
+func WithAttendantEventDelivery(policy EventDeliveryPolicy) ServerOption {
+	return func(server *Server) {
+		server.eventDelivery = policy
+	}
+}
+
+
+// Sets the TCP tuning of each new attendant (see
+// WithTCPTuning).
+func WithAttendantTCPTuning(tuning TCPTuning) ServerOption {
+	return func(server *Server) {
+		server.tcpTuning = &tuning
+	}
+}
+
+
+// Makes each new attendant report a snapshot of its final
+// context in its stopped event (see WithStoppedContext).
+func WithAttendantStoppedContext(enabled bool) ServerOption {
+	return func(server *Server) {
+		server.stoppedContext = enabled
+	}
+}
+
+
+// Gives each new attendant an authentication phase (see
+// WithAuth).
+func WithAttendantAuth(handler AuthHandler, notify bool) ServerOption {
+	return func(server *Server) {
+		server.authHandler = handler
+		server.authNotify = notify
+	}
+}
+
+
+// Makes each new attendant detect whether it is a slow
+// consumer (see WithSlowConsumer).
+func WithAttendantSlowConsumer(threshold uint, grace time.Duration) ServerOption {
+	return func(server *Server) {
+		server.slowConsumerThreshold = threshold
+		server.slowConsumerGrace = grace
+	}
+}
+
+
+// Sets the logger of the server, also used by each new attendant
+// (by default, nothing is logged). Nil means the default one.
+func WithServerLogger(logger Logger) ServerOption {
+	return func(server *Server) {
+		if logger == nil {
+			logger = nopLogger{}
+		}
+		server.logger = logger
+	}
+}
+
+
+// Makes each new attendant read its connection through a
+// buffered reader of the given size (see WithReadBufferSize).
+func WithAttendantReadBufferSize(size uint) ServerOption {
+	return func(server *Server) {
+		server.readBufferSize = size
+	}
+}
@@ -0,0 +1,74 @@
+package chasqui
+
+import "sync"
+
+
+// The reading pause state of an attendant. While paused, the
+// resumed channel is open, and the read loop parks on it (or
+// on the interrupted channel, closed once the connection is
+// closed on our side).
+type pauseState struct {
+	mutex       sync.Mutex
+	resumed     chan struct{}
+	interrupted chan struct{}
+	interrupt   sync.Once
+}
+
+
+// Pauses the reading: the read loop stops receiving messages
+// (once the one being received, if any, is conveyed) until
+// ResumeReading is called, so the peer is pushed back by the
+// connection itself. The connection is not dropped, but the
+// idle timeout and the keepalive may still stop an attendant
+// paused for too long. Pausing a paused attendant does nothing.
+func (attendant *Attendant) PauseReading() {
+	attendant.pause.mutex.Lock()
+	defer attendant.pause.mutex.Unlock()
+	if attendant.pause.resumed == nil {
+		attendant.pause.resumed = make(chan struct{})
+	}
+}
+
+
+// Resumes the reading, right where it was paused. Resuming
+// an attendant not paused does nothing.
+func (attendant *Attendant) ResumeReading() {
+	attendant.pause.mutex.Lock()
+	defer attendant.pause.mutex.Unlock()
+	if attendant.pause.resumed != nil {
+		close(attendant.pause.resumed)
+		attendant.pause.resumed = nil
+	}
+}
+
+
+// Tells whether the reading is paused.
+func (attendant *Attendant) ReadingPaused() bool {
+	attendant.pause.mutex.Lock()
+	defer attendant.pause.mutex.Unlock()
+	return attendant.pause.resumed != nil
+}
+
+
+// Parks the read loop while the reading is paused, until it
+// is resumed or the connection is closed on our side.
+func (attendant *Attendant) waitResumed() {
+	attendant.pause.mutex.Lock()
+	resumed := attendant.pause.resumed
+	attendant.pause.mutex.Unlock()
+	if resumed != nil {
+		select {
+		case <-resumed:
+		case <-attendant.pause.interrupted:
+		}
+	}
+}
+
+
+// Wakes the read loop if it is parked, since the connection
+// is being closed on our side.
+func (attendant *Attendant) interruptPause() {
+	attendant.pause.interrupt.Do(func() {
+		close(attendant.pause.interrupted)
+	})
+}
@@ -0,0 +1,290 @@
+package chasqui
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// The time given to the peers to send their PROXY protocol
+// header, when none is given.
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+
+// The maximum length of a PROXY protocol v1 header, including
+// the trailing CRLF.
+const proxyV1MaxLength = 107
+
+
+// The signature starting a PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+
+// Error that tells a connection had a malformed (or missing)
+// PROXY protocol header.
+type ProxyHeaderError struct {
+	Reason string
+}
+
+
+// The error message.
+func (err ProxyHeaderError) Error() string {
+	return "invalid PROXY protocol header: " + err.Reason
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err ProxyHeaderError) Is(target error) bool {
+	return target == ErrProxyHeader
+}
+
+
+// Event reporting the server rejected (and closed) a
+// connection because its PROXY protocol header was malformed,
+// missing, or not sent in time (see WithProxyProtocol). The
+// address is the one of the socket (e.g. the load balancer).
+type ProxyHeaderRejectedEvent struct {
+	Addr  net.Addr
+	Error error
+}
+
+
+// A connection whose remote address is the one told by its
+// PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+
+// Returns the address told by the PROXY protocol header.
+func (conn proxiedConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+
+// Returns the wrapped connection (e.g. for TCP tuning).
+func (conn proxiedConn) NetConn() net.Conn {
+	return conn.Conn
+}
+
+
+// A proxied connection which may close its writing side.
+type proxiedWriteCloserConn struct {
+	proxiedConn
+}
+
+
+// Closes the writing side of the wrapped connection.
+func (conn proxiedWriteCloserConn) CloseWrite() error {
+	return conn.Conn.(writeCloser).CloseWrite()
+}
+
+
+// Wraps a connection so its remote address is the given one
+// (unless nil: the connection is kept as is then).
+func proxyConnection(conn net.Conn, remote net.Addr) net.Conn {
+	if remote == nil {
+		return conn
+	}
+	proxied := proxiedConn{conn, remote}
+	if _, ok := conn.(writeCloser); ok {
+		return proxiedWriteCloserConn{proxied}
+	}
+	return proxied
+}
+
+
+// Reads a PROXY protocol (v1 or v2) header, without reading
+// any byte beyond it. Returns the address of the actual peer,
+// or nil when the header tells to keep the one of the socket
+// (e.g. health checks of the proxy itself).
+func readProxyHeader(reader io.Reader) (net.Addr, error) {
+	first := make([]byte, 1)
+	if err := readProxyBytes(reader, first); err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyV1(reader)
+	case '\r':
+		return readProxyV2(reader)
+	default:
+		return nil, ProxyHeaderError{"missing"}
+	}
+}
+
+
+// Reads exactly the given bytes of a header. Failures (e.g.
+// the header is not sent in time) are told as header errors.
+func readProxyBytes(reader io.Reader, data []byte) error {
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return ProxyHeaderError{"not received (" + err.Error() + ")"}
+	}
+	return nil
+}
+
+
+// Reads the rest of a v1 (text) header, byte per byte, and
+// parses it.
+func readProxyV1(reader io.Reader) (net.Addr, error) {
+	line := []byte{'P'}
+	next := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, ProxyHeaderError{"v1 header too long"}
+		}
+		if err := readProxyBytes(reader, next); err != nil {
+			return nil, err
+		}
+		line = append(line, next[0])
+	}
+	return parseProxyV1(string(line[:len(line) - 2]))
+}
+
+
+// Parses a v1 header (without its trailing CRLF).
+func parseProxyV1(line string) (net.Addr, error) {
+	fields := strings.Split(line, " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, ProxyHeaderError{"missing"}
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, ProxyHeaderError{"unknown v1 protocol " + fields[1]}
+	}
+	if len(fields) != 6 {
+		return nil, ProxyHeaderError{"malformed v1 header"}
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, ProxyHeaderError{"malformed v1 address"}
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ProxyHeaderError{"malformed v1 port"}
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, ProxyHeaderError{"malformed v1 port"}
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+
+// Reads the rest of a v2 (binary) header, and parses it.
+func readProxyV2(reader io.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	header[0] = '\r'
+	if err := readProxyBytes(reader, header[1:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, ProxyHeaderError{"missing"}
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if err := readProxyBytes(reader, body); err != nil {
+		return nil, err
+	}
+	return parseProxyV2(header[12], header[13], body)
+}
+
+
+// Parses the version, command, family and addresses of a v2
+// header (the TLVs are ignored).
+func parseProxyV2(versionCommand, family byte, body []byte) (net.Addr, error) {
+	if versionCommand >> 4 != 2 {
+		return nil, ProxyHeaderError{"unsupported v2 version"}
+	}
+	switch versionCommand & 0x0f {
+	case 0:
+		// LOCAL: the proxy talks on its own behalf.
+		return nil, nil
+	case 1:
+	default:
+		return nil, ProxyHeaderError{"unknown v2 command"}
+	}
+	switch family >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, ProxyHeaderError{"short v2 IPv4 addresses"}
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, ProxyHeaderError{"short v2 IPv6 addresses"}
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		// Unspecified (or UNIX) addresses: the one of the
+		// socket is kept.
+		return nil, nil
+	}
+}
+
+
+// The connections whose PROXY protocol header is being read,
+// so they are closed if the server stops meanwhile.
+type proxyState struct {
+	mutex   sync.Mutex
+	pending map[net.Conn]struct{}
+}
+
+
+// Reads the PROXY protocol header of a new connection in the
+// background, within the header timeout. Then, hands the
+// connection (telling the actual peer address) to the given
+// function, or rejects it if the header is wrong.
+func (server *Server) acceptProxied(conn net.Conn, attend func(net.Conn)) {
+	server.proxy.mutex.Lock()
+	server.proxy.pending[conn] = struct{}{}
+	server.proxy.mutex.Unlock()
+	server.resources.addConnections(1)
+	server.resources.spawn(func() {
+		defer server.resources.addConnections(-1)
+		// noinspection GoUnhandledErrorResult
+		conn.SetReadDeadline(time.Now().Add(server.proxyHeaderTimeout))
+		remote, err := readProxyHeader(conn)
+		server.proxy.mutex.Lock()
+		delete(server.proxy.pending, conn)
+		server.proxy.mutex.Unlock()
+		if err != nil {
+			server.logger.Debugf("server rejected a connection without a valid PROXY header (%s): %v",
+				conn.RemoteAddr(), err)
+			// noinspection GoUnhandledErrorResult
+			conn.Close()
+			select {
+			case server.proxyRejectedEvent <- ProxyHeaderRejectedEvent{conn.RemoteAddr(), err}:
+			default:
+			}
+			return
+		}
+		// noinspection GoUnhandledErrorResult
+		conn.SetReadDeadline(time.Time{})
+		attend(proxyConnection(conn, remote))
+	})
+}
+
+
+// Registers the teardown callback of the PROXY protocol: the
+// connections whose header is still being read are closed
+// once the server stops accepting.
+func (server *Server) registerProxyTeardown() {
+	server.teardown.register(TeardownStopAccepting, func() error {
+		server.proxy.mutex.Lock()
+		defer server.proxy.mutex.Unlock()
+		for conn := range server.proxy.pending {
+			// noinspection GoUnhandledErrorResult
+			conn.Close()
+		}
+		return nil
+	})
+}
@@ -0,0 +1,197 @@
+package chasqui
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+
+// Builds a PROXY protocol v2 header for the given command and
+// family, with the given address block.
+func proxyV2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20 | command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+
+// Builds the address block of a v2 header, for a pair of
+// addresses of the same family.
+func proxyV2Addresses(source, destination *net.TCPAddr) []byte {
+	var block []byte
+	if ip := source.IP.To4(); ip != nil {
+		block = append(append(block, ip...), destination.IP.To4()...)
+	} else {
+		block = append(append(block, source.IP.To16()...), destination.IP.To16()...)
+	}
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], uint16(source.Port))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(destination.Port))
+	return append(block, ports...)
+}
+
+
+// The JSON traffic following the PROXY headers in the tests.
+const proxiedTraffic = "{\"C\":\"MOVE\",\"A\":[],\"KWA\":{}}\n"
+
+
+func TestReadProxyHeaderFixtures(t *testing.T) {
+	client4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.10").To4(), Port: 51000}
+	server4 := &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 443}
+	client6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 51000}
+	server6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	for _, fixture := range []struct {
+		name     string
+		header   []byte
+		expected *net.TCPAddr
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.10 198.51.100.1 51000 443\r\n"), client4},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::10 2001:db8::1 51000 443\r\n"), client6},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), nil},
+		{"v2 IPv4", proxyV2Header(1, 0x11, proxyV2Addresses(client4, server4)), client4},
+		{"v2 IPv6", proxyV2Header(1, 0x21, proxyV2Addresses(client6, server6)), client6},
+		{"v2 IPv4 with TLVs", proxyV2Header(1, 0x11, append(proxyV2Addresses(client4, server4), 0x04, 0, 1, 'x')), client4},
+		{"v2 LOCAL", proxyV2Header(0, 0x00, nil), nil},
+	} {
+		reader := bytes.NewReader(append(fixture.header, proxiedTraffic...))
+		remote, err := readProxyHeader(reader)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", fixture.name, err)
+			continue
+		}
+		if fixture.expected == nil {
+			if remote != nil {
+				t.Errorf("%s: the socket address must be kept, got: %v", fixture.name, remote)
+			}
+		} else if tcpAddr, ok := remote.(*net.TCPAddr); !ok || !tcpAddr.IP.Equal(fixture.expected.IP) ||
+			tcpAddr.Port != fixture.expected.Port {
+			t.Errorf("%s: expected %v, got: %v", fixture.name, fixture.expected, remote)
+		}
+		// Not a single application byte is consumed.
+		if rest, _ := io.ReadAll(reader); string(rest) != proxiedTraffic {
+			t.Errorf("%s: the application bytes were consumed, left: %q", fixture.name, rest)
+		}
+	}
+}
+
+
+func TestReadProxyHeaderRejectsMalformedHeaders(t *testing.T) {
+	for _, fixture := range []struct {
+		name   string
+		header []byte
+	}{
+		{"missing", []byte(proxiedTraffic)},
+		{"empty", nil},
+		{"v1 unknown protocol", []byte("PROXY UDP4 192.0.2.10 198.51.100.1 51000 443\r\n")},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::10 2001:db8::1 51000 443\r\n")},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.10 198.51.100.1 70000 443\r\n")},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.10 198.51.100.1\r\n")},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n")},
+		{"v1 unterminated", []byte("PROXY TCP4 192.0.2.10")},
+		{"v2 bad signature", append([]byte("\r\n\r\n\x00\r\nQUIZ\n"), 0x21, 0x11, 0, 0)},
+		{"v2 bad version", append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0)},
+		{"v2 unknown command", proxyV2Header(2, 0x11, make([]byte, 12))},
+		{"v2 short addresses", proxyV2Header(1, 0x11, make([]byte, 8))},
+		{"v2 truncated", proxyV2Header(1, 0x11, make([]byte, 12))[:20]},
+	} {
+		remote, err := readProxyHeader(bytes.NewReader(fixture.header))
+		var headerError ProxyHeaderError
+		if !errors.Is(err, ErrProxyHeader) || !errors.As(err, &headerError) {
+			t.Errorf("%s: expected a header error, got: %v (address: %v)", fixture.name, err, remote)
+		}
+	}
+}
+
+
+// Dials the server as a load balancer would: the header and
+// the first traffic go in a single write.
+func dialThroughBalancer(t *testing.T, server *Server, header []byte) net.Conn {
+	t.Helper()
+	conn, _ := dialTest(t, server.TCPAddr())
+	if _, err := conn.Write(append(append([]byte{}, header...), proxiedTraffic...)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+
+func TestProxyProtocolThroughFakeBalancer(t *testing.T) {
+	server := newTestServer(16, WithProxyProtocol(200 * time.Millisecond))
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer server.Stop()
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.10").To4(), Port: 51000}
+	for _, header := range [][]byte{
+		[]byte("PROXY TCP4 192.0.2.10 198.51.100.1 51000 443\r\n"),
+		proxyV2Header(1, 0x11, proxyV2Addresses(client, server.TCPAddr())),
+	} {
+		conn := dialThroughBalancer(t, server, header)
+		select {
+		case event := <-server.AttendantStartedEvent():
+			if event.Attendant.RemoteAddr().String() != client.String() {
+				t.Fatalf("the attendant must tell the client address %v, got: %v", client, event.Attendant.RemoteAddr())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no started event")
+		}
+		select {
+		case event := <-server.MessageEvent():
+			if event.Message.Command() != "MOVE" {
+				t.Fatalf("the traffic after the header was altered: %v", event.Message.Command())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("the traffic after the header did not arrive")
+		}
+		// noinspection GoUnhandledErrorResult
+		conn.Close()
+		<-server.AttendantStoppedEvent()
+	}
+
+	// Malformed and missing headers are rejected, with the
+	// address of the balancer.
+	for _, header := range [][]byte{[]byte("PROXY TCP4 nonsense\r\n"), nil} {
+		conn := dialThroughBalancer(t, server, header)
+		select {
+		case event := <-server.ProxyHeaderRejectedEvent():
+			if !errors.Is(event.Error, ErrProxyHeader) || event.Addr.String() != conn.LocalAddr().String() {
+				t.Fatalf("unexpected rejection: %v from %v", event.Error, event.Addr)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("the header %q was not rejected", header)
+		}
+		// noinspection GoUnhandledErrorResult
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("the rejected connection must be closed")
+		}
+		// noinspection GoUnhandledErrorResult
+		conn.Close()
+	}
+
+	// Silent connections are rejected after the timeout.
+	silent, _ := dialTest(t, server.TCPAddr())
+	// noinspection GoUnhandledErrorResult
+	defer silent.Close()
+	select {
+	case event := <-server.ProxyHeaderRejectedEvent():
+		if !errors.Is(event.Error, ErrProxyHeader) {
+			t.Fatalf("unexpected rejection: %v", event.Error)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the silent connection was not rejected")
+	}
+	select {
+	case event := <-server.AttendantStartedEvent():
+		t.Fatalf("a rejected connection was attended: %v", event.Attendant.RemoteAddr())
+	default:
+	}
+}
@@ -0,0 +1,93 @@
+package chasqui
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+
+// The longest window the receive rate can be computed for.
+const MaxRateWindow = 60 * time.Second
+
+
+// The number of one-second buckets of the receive rate.
+const rateBuckets = int64(MaxRateWindow / time.Second)
+
+
+// A bucket of the receive rate: the second (in unix time) it
+// counts, and the count of messages received in that second.
+type rateBucket struct {
+	second int64
+	count  int64
+}
+
+
+// A sliding window counter of the received messages, as a ring
+// of one-second buckets. It is only updated by the read loop,
+// and read atomically (without locks) from any goroutine.
+type receiveRate struct {
+	buckets [rateBuckets]rateBucket
+}
+
+
+// Counts a message received at the given instant.
+func (rate *receiveRate) count(now time.Time) {
+	second := now.Unix()
+	bucket := &rate.buckets[second % rateBuckets]
+	if atomic.LoadInt64(&bucket.second) != second {
+		// The bucket belonged to an older second: it starts
+		// over (only the read loop updates the buckets).
+		atomic.StoreInt64(&bucket.count, 0)
+		atomic.StoreInt64(&bucket.second, second)
+	}
+	atomic.AddInt64(&bucket.count, 1)
+}
+
+
+// Computes the rate (messages per second) over the given window
+// ending at the given instant. Windows are rounded up to whole
+// seconds (the current one included), up to MaxRateWindow.
+func (rate *receiveRate) at(now time.Time, window time.Duration) float64 {
+	seconds := int64((window + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	} else if seconds > rateBuckets {
+		seconds = rateBuckets
+	}
+	current := now.Unix()
+	total := int64(0)
+	for second := current - seconds + 1; second <= current; second++ {
+		bucket := &rate.buckets[second % rateBuckets]
+		if atomic.LoadInt64(&bucket.second) == second {
+			total += atomic.LoadInt64(&bucket.count)
+		}
+	}
+	return float64(total) / float64(seconds)
+}
+
+
+// Returns the recent receive rate of the attendant, in messages
+// per second, over the given window (e.g. the last 1s, 10s or
+// 60s). Windows are rounded up to whole seconds (the current
+// one included), up to MaxRateWindow. It is cheap, and safe to
+// call from any goroutine.
+func (attendant *Attendant) ReceiveRate(window time.Duration) float64 {
+	return attendant.receiveRate.at(time.Now(), window)
+}
+
+
+// Returns the running attendants receiving more than the given
+// rate (messages per second) over the given window (see
+// Attendant.ReceiveRate), e.g. to spot abusive peers.
+func (server *Server) AttendantsAboveRate(rate float64, window time.Duration) []*Attendant {
+	now := time.Now()
+	var above []*Attendant
+	server.attendantsMutex.RLock()
+	defer server.attendantsMutex.RUnlock()
+	for _, attendant := range server.attendantsByID {
+		if attendant.receiveRate.at(now, window) > rate {
+			above = append(above, attendant)
+		}
+	}
+	return above
+}
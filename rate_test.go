@@ -0,0 +1,76 @@
+package chasqui
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+
+// Counts a message on every iteration, as the read loop does,
+// moving to the next second every 1000 messages.
+func BenchmarkReceiveRateCount(b *testing.B) {
+	rate := &receiveRate{}
+	now := time.Unix(1000000, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for index := 0; index < b.N; index++ {
+		rate.count(now.Add(time.Duration(index / 1000) * time.Second))
+	}
+}
+
+
+// Reads the rate over each window while the read loop counts.
+func BenchmarkReceiveRateAt(b *testing.B) {
+	for _, window := range []time.Duration{time.Second, 10 * time.Second, MaxRateWindow} {
+		b.Run("window=" + strconv.Itoa(int(window / time.Second)) + "s", func(b *testing.B) {
+			rate := &receiveRate{}
+			now := time.Now()
+			for second := 0; second < int(rateBuckets); second++ {
+				rate.count(now.Add(-time.Duration(second) * time.Second))
+			}
+			quit := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for {
+					select {
+					case <-quit:
+						return
+					default:
+						rate.count(time.Now())
+					}
+				}
+			}()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for index := 0; index < b.N; index++ {
+				rate.at(now, window)
+			}
+			b.StopTimer()
+			close(quit)
+			<-done
+		})
+	}
+}
+
+
+// Scans a server with many attendants for the ones above a
+// rate (no connection is involved: the attendants are only
+// registered).
+func BenchmarkAttendantsAboveRate(b *testing.B) {
+	server := newTestServer(16)
+	now := time.Now()
+	for index := 0; index < 1000; index++ {
+		attendant := &Attendant{}
+		for count := 0; count < index % 20; count++ {
+			attendant.receiveRate.count(now)
+		}
+		server.attendantsByID[uint64(index)] = attendant
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for index := 0; index < b.N; index++ {
+		server.AttendantsAboveRate(10, 10 * time.Second)
+	}
+}
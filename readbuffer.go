@@ -0,0 +1,76 @@
+package chasqui
+
+import (
+	"bufio"
+	"io"
+	"net"
+)
+
+
+// The minimum size of a read buffer. Smaller sizes are
+// taken as this one.
+const MinReadBufferSize = 16
+
+
+// A connection read through a buffered reader, which is
+// reused across messages. Writes are not buffered.
+type bufferedConnection struct {
+	reader *bufio.Reader
+	writer io.Writer
+}
+
+
+// Reads from the buffered reader.
+func (connection bufferedConnection) Read(data []byte) (int, error) {
+	return connection.reader.Read(data)
+}
+
+
+// Writes to the connection.
+func (connection bufferedConnection) Write(data []byte) (int, error) {
+	return connection.writer.Write(data)
+}
+
+
+// Returns the buffered reader, so marshalers do not need to
+// buffer the connection again (see types.BufferedReadWriter).
+func (connection bufferedConnection) BufferedReader() *bufio.Reader {
+	return connection.reader
+}
+
+
+// Returns the remote address of the connection, so the wrapped
+// marshalers may still tell it (e.g. to log it).
+func (connection bufferedConnection) RemoteAddr() net.Addr {
+	return remoteAddrOf(connection.writer)
+}
+
+
+// Returns the remote address of a wrapped connection, or nil
+// if it cannot tell it.
+func remoteAddrOf(connection interface{}) net.Addr {
+	if addressed, ok := connection.(interface{ RemoteAddr() net.Addr }); ok {
+		return addressed.RemoteAddr()
+	}
+	return nil
+}
+
+
+// Wraps a connection with a buffered reader of the given size,
+// unless the size is zero (which means no buffer at all).
+func bufferConnection(connection io.ReadWriter, size int) io.ReadWriter {
+	if size <= 0 {
+		return connection
+	}
+	if size < MinReadBufferSize {
+		size = MinReadBufferSize
+	}
+	return bufferedConnection{bufio.NewReaderSize(connection, size), connection}
+}
+
+
+// Returns the size of the read buffer of this attendant (zero
+// means the connection is handed to the marshaler unbuffered).
+func (attendant *Attendant) ReadBufferSize() int {
+	return attendant.readBufferSize
+}
@@ -0,0 +1,93 @@
+package chasqui
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	"github.com/universe-10th/chasqui/marshalers/tlv"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// A connection replaying the same encoded messages forever,
+// counting the reads made on it (each one would be a read
+// syscall on a real socket). Writes are discarded.
+type replayConnection struct {
+	data     []byte
+	position int
+	reads    int
+}
+
+
+func (connection *replayConnection) Read(data []byte) (int, error) {
+	connection.reads++
+	n := copy(data, connection.data[connection.position:])
+	connection.position = (connection.position + n) % len(connection.data)
+	return n, nil
+}
+
+
+func (connection *replayConnection) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+
+// Encodes a batch of usual messages with the given marshaler.
+func encodeMessages(b *testing.B, factory MarshalerFactory) []byte {
+	encoded := &encodingConnection{}
+	marshaler := factory.Create(encoded)
+	for index := 0; index < 16; index++ {
+		if err := marshaler.Send(
+			"update", Args{index, "some text of a usual length", 3.5}, KWArgs{"key": "value"},
+		); err != nil {
+			b.Fatalf("encode: %v", err)
+		}
+	}
+	return encoded.Bytes()
+}
+
+
+// A connection keeping what is written to it.
+type encodingConnection struct {
+	bytes.Buffer
+}
+
+
+func (connection *encodingConnection) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+
+// Receives messages through a read buffer of each size (zero
+// leaves the buffering to the marshaler), with the given one.
+func benchmarkReadBuffer(b *testing.B, factory MarshalerFactory) {
+	data := encodeMessages(b, factory)
+	for _, size := range []int{0, MinReadBufferSize, 512, 4096, 65536} {
+		b.Run("size=" + strconv.Itoa(size), func(b *testing.B) {
+			connection := &replayConnection{data: data}
+			marshaler := factory.Create(bufferConnection(connection, size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for index := 0; index < b.N; index++ {
+				if _, err, _ := marshaler.Receive(); err != nil {
+					b.Fatalf("receive: %v", err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(connection.reads) / float64(b.N), "reads/op")
+		})
+	}
+}
+
+
+func BenchmarkReadBufferJSON(b *testing.B) {
+	benchmarkReadBuffer(b, &json.JSONMessageMarshaler{})
+}
+
+
+func BenchmarkReadBufferTLV(b *testing.B) {
+	benchmarkReadBuffer(b, &tlv.TLVMessageMarshaler{})
+}
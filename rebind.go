@@ -0,0 +1,55 @@
+package chasqui
+
+import "sync"
+
+
+// The binding of an attendant to its message and throttled
+// event channels. The rebound channel is closed (and replaced)
+// each time the attendant is rebound, so the deliveries waiting
+// on the former channels retry on the new ones.
+type eventBinding struct {
+	mutex   sync.RWMutex
+	rebound chan struct{}
+}
+
+
+// Moves the message flow of the attendant to other channels,
+// without dropping the connection (e.g. when moving it from a
+// lobby to a game instance). The swap is atomic: each message
+// (or throttled message) is delivered either to the former
+// channels or to the new ones, never to both and never lost,
+// and deliveries waiting on the former channels move on to the
+// new ones. Messages keep their order, so the cut-over point
+// is clean. The started and stopped channels are not changed.
+func (attendant *Attendant) Rebind(messageEvent chan MessageEvent, throttledEvent chan ThrottledEvent) {
+	if messageEvent == nil {
+		panic(ArgumentError{"Rebind:messageEvent"})
+	}
+	if throttledEvent == nil {
+		panic(ArgumentError{"Rebind:throttledEvent"})
+	}
+	attendant.binding.mutex.Lock()
+	defer attendant.binding.mutex.Unlock()
+	attendant.messageEvent = messageEvent
+	attendant.throttledEvent = throttledEvent
+	close(attendant.binding.rebound)
+	attendant.binding.rebound = make(chan struct{})
+}
+
+
+// Gets the current message channel, and the signal telling it
+// was replaced.
+func (attendant *Attendant) messageBinding() (chan MessageEvent, <-chan struct{}) {
+	attendant.binding.mutex.RLock()
+	defer attendant.binding.mutex.RUnlock()
+	return attendant.messageEvent, attendant.binding.rebound
+}
+
+
+// Gets the current throttled channel, and the signal telling
+// it was replaced.
+func (attendant *Attendant) throttledBinding() (chan ThrottledEvent, <-chan struct{}) {
+	attendant.binding.mutex.RLock()
+	defer attendant.binding.mutex.RUnlock()
+	return attendant.throttledEvent, attendant.binding.rebound
+}
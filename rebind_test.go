@@ -0,0 +1,177 @@
+package chasqui
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// Collects the sequence numbers of the messages arriving at a
+// channel, until told to stop.
+type sequenceCollector struct {
+	mutex     sync.Mutex
+	sequences []int
+	arrived   chan struct{}
+}
+
+
+// Collects in background from the given channel, until the
+// quit channel is closed.
+func collectSequences(channel chan MessageEvent, quit chan struct{}, group *sync.WaitGroup) *sequenceCollector {
+	collector := &sequenceCollector{arrived: make(chan struct{}, 1)}
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		for {
+			select {
+			case <-quit:
+				return
+			case event := <-channel:
+				collector.mutex.Lock()
+				collector.sequences = append(collector.sequences, int(event.Message.Args()[0].(float64)))
+				collector.mutex.Unlock()
+				select {
+				case collector.arrived <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return collector
+}
+
+
+// Returns the sequences collected so far.
+func (collector *sequenceCollector) collected() []int {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	return append([]int(nil), collector.sequences...)
+}
+
+
+func TestRebindWhileStreaming(t *testing.T) {
+	const total = 2000
+	local, remote := net.Pipe()
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	former := make(chan MessageEvent, 8)
+	attendant := NewAttendant(
+		local, &json.JSONMessageMarshaler{}, 0, make(chan AttendantStartedEvent, 1),
+		make(chan AttendantStoppedEvent, 1), former, make(chan ThrottledEvent, 1),
+	)
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// noinspection GoUnhandledErrorResult
+		attendant.Stop()
+		attendant.Wait()
+	}()
+
+	quit := make(chan struct{})
+	var group sync.WaitGroup
+	defer func() {
+		close(quit)
+		group.Wait()
+	}()
+	formerCollector := collectSequences(former, quit, &group)
+	go func() {
+		peer := (&json.JSONMessageMarshaler{}).Create(remote)
+		for sequence := 0; sequence < total; sequence++ {
+			if peer.Send("MOVE", Args{sequence}, nil) != nil {
+				return
+			}
+		}
+	}()
+
+	// Rebind in the middle of the stream.
+	for len(formerCollector.collected()) < total / 4 {
+		select {
+		case <-formerCollector.arrived:
+		case <-time.After(2 * time.Second):
+			t.Fatal("the stream did not start")
+		}
+	}
+	latter := make(chan MessageEvent, 8)
+	attendant.Rebind(latter, make(chan ThrottledEvent, 1))
+	latterCollector := collectSequences(latter, quit, &group)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(formerCollector.collected()) + len(latterCollector.collected()) < total {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d messages arrived",
+				len(formerCollector.collected()) + len(latterCollector.collected()), total)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Each message arrived exactly once, in order, and the former
+	// channel got a prefix of the stream.
+	formerSequences, latterSequences := formerCollector.collected(), latterCollector.collected()
+	if len(latterSequences) == 0 {
+		t.Fatal("no message arrived after the rebind")
+	}
+	for index, sequence := range append(formerSequences, latterSequences...) {
+		if sequence != index {
+			t.Fatalf("message %d arrived as %d (former: %d, latter: %d messages)",
+				index, sequence, len(formerSequences), len(latterSequences))
+		}
+	}
+}
+
+
+func TestRebindMovesWaitingDeliveries(t *testing.T) {
+	local, remote := net.Pipe()
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	// Nobody reads the former channels.
+	formerMessages, formerThrottled := make(chan MessageEvent), make(chan ThrottledEvent)
+	attendant := NewAttendant(
+		local, &json.JSONMessageMarshaler{}, time.Hour, make(chan AttendantStartedEvent, 1),
+		make(chan AttendantStoppedEvent, 1), formerMessages, formerThrottled,
+	)
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		// noinspection GoUnhandledErrorResult
+		attendant.Stop()
+		attendant.Wait()
+	}()
+	peer := (&json.JSONMessageMarshaler{}).Create(remote)
+	if err := peer.Send("MOVE", Args{0}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Let the delivery wait on the former channel.
+	time.Sleep(50 * time.Millisecond)
+	latterMessages, latterThrottled := make(chan MessageEvent, 1), make(chan ThrottledEvent, 1)
+	attendant.Rebind(latterMessages, latterThrottled)
+	select {
+	case event := <-latterMessages:
+		if event.Message.Command() != "MOVE" {
+			t.Fatalf("unexpected message: %v", event.Message.Command())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the waiting message did not move to the new channel")
+	}
+	// The throttled messages go to the new channel as well.
+	if err := peer.Send("MOVE", Args{1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-latterThrottled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the throttled message did not arrive at the new channel")
+	}
+	select {
+	case <-formerMessages:
+		t.Fatal("a message was delivered to the former channel")
+	case <-formerThrottled:
+		t.Fatal("a throttled message was delivered to the former channel")
+	default:
+	}
+}
@@ -0,0 +1,173 @@
+package chasqui
+
+import (
+	. "github.com/universe-10th/chasqui/types"
+	"sync"
+)
+
+
+// Error that tells when a relay is already closed.
+type RelayIsClosed bool
+
+
+// The error message.
+func (RelayIsClosed) Error() string {
+	return "relay cannot convey any message - it is closed"
+}
+
+
+// The default kwarg stamping the sequence of relayed messages.
+const DefaultRelaySequenceKey = "__seq"
+
+
+// A message waiting to be relayed.
+type relayedMessage struct {
+	command string
+	args    Args
+	kwargs  KWArgs
+}
+
+
+// Relays convey a stream of messages to a set of member
+// attendants, guaranteeing that all the members receive
+// the relayed messages in the same relative order, even
+// when they come from concurrent producers. A single
+// sequencer goroutine stamps each message with a strictly
+// increasing sequence number (in the SequenceKey kwarg)
+// and sends it to each member, in order.
+//
+// Members with an outgoing queue (see WithSendQueue) do
+// not stall the relay, and their writer goroutine keeps
+// the order. Members without it are written directly, so
+// a slow member delays the others (but never reorders).
+// Other messages sent to the members interleave freely
+// with the relayed ones.
+//
+// Members failing to take a relayed message (e.g. they are
+// stopped, or their queue rejected it) are removed. Beware:
+// queues evicting older messages (SendQueueDropOldest) may
+// still leave holes in the sequence of a member.
+type Relay struct {
+	SequenceKey string
+	mutex       sync.Mutex
+	members     map[*Attendant]bool
+	relayMutex  sync.Mutex
+	messages    chan relayedMessage
+	closed      bool
+	sequence    int64
+	resources   resourceCounter
+}
+
+
+// Adds a member to the relay. It will receive the messages
+// relayed from now on.
+func (relay *Relay) Join(attendant *Attendant) {
+	if attendant == nil {
+		panic(ArgumentError{"Relay.Join:attendant"})
+	}
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	relay.members[attendant] = true
+}
+
+
+// Removes a member from the relay.
+func (relay *Relay) Leave(attendant *Attendant) {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	delete(relay.members, attendant)
+}
+
+
+// Enumerates all the members using a callback.
+func (relay *Relay) Enumerate(callback func(*Attendant)) {
+	relay.mutex.Lock()
+	members := make([]*Attendant, 0, len(relay.members))
+	for member := range relay.members {
+		members = append(members, member)
+	}
+	relay.mutex.Unlock()
+	for _, member := range members {
+		callback(member)
+	}
+}
+
+
+// Relays a message to all the members. The relative order
+// of the relayed messages is the order of these calls. The
+// given kwargs are not modified. It blocks while the relay
+// buffer is full.
+func (relay *Relay) Relay(command string, args Args, kwargs KWArgs) error {
+	relay.relayMutex.Lock()
+	defer relay.relayMutex.Unlock()
+	if relay.closed {
+		return RelayIsClosed(true)
+	}
+	relay.messages <- relayedMessage{command, args, kwargs}
+	return nil
+}
+
+
+// Closes the relay. The messages already relayed are still
+// conveyed to the members before the sequencer finishes.
+func (relay *Relay) Close() error {
+	relay.relayMutex.Lock()
+	defer relay.relayMutex.Unlock()
+	if relay.closed {
+		return RelayIsClosed(true)
+	}
+	relay.closed = true
+	close(relay.messages)
+	return nil
+}
+
+
+// Returns the resources currently owned by this relay: its
+// sequencer goroutine, until it is closed and drained.
+func (relay *Relay) ResourceCounts() ResourceCounts {
+	return relay.resources.counts()
+}
+
+
+// The sequencer loop: stamps each message with the next
+// sequence number and sends it to each member.
+func (relay *Relay) sequencer() {
+	for message := range relay.messages {
+		relay.sequence++
+		stamped := make(KWArgs, len(message.kwargs) + 1)
+		for key, value := range message.kwargs {
+			stamped[key] = value
+		}
+		stamped[relay.SequenceKey] = relay.sequence
+
+		relay.mutex.Lock()
+		members := make([]*Attendant, 0, len(relay.members))
+		for member := range relay.members {
+			members = append(members, member)
+		}
+		relay.mutex.Unlock()
+
+		for _, member := range members {
+			if err := member.Send(message.command, message.args, stamped); err != nil {
+				relay.Leave(member)
+			}
+		}
+	}
+}
+
+
+// Creates a new relay, with the given buffer size for the
+// pending messages, and the kwarg to stamp the sequence
+// numbers with (DefaultRelaySequenceKey if empty).
+func NewRelay(sequenceKey string, bufferSize uint) *Relay {
+	if sequenceKey == "" {
+		sequenceKey = DefaultRelaySequenceKey
+	}
+	relay := &Relay{
+		SequenceKey: sequenceKey,
+		members:     make(map[*Attendant]bool),
+		messages:    make(chan relayedMessage, bufferSize),
+	}
+	relay.resources.spawn(relay.sequencer)
+	return relay
+}
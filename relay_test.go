@@ -0,0 +1,166 @@
+package chasqui
+
+import (
+	json2 "encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+func TestRelayOrderAcrossMembers(t *testing.T) {
+	const members, producers, perProducer = 5, 4, 60
+	server := newTestServer(64, WithAttendantSendQueue(16, SendQueueBlock))
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer server.Stop()
+	started := make(chan *Attendant, members)
+	stopConsuming := func() func() {
+		quit := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-quit:
+					return
+				case event := <-server.AttendantStartedEvent():
+					started <- event.Attendant
+				case <-server.StartedEvent():
+				case <-server.StoppedEvent():
+				case <-server.MessageEvent():
+				case <-server.AttendantStoppedEvent():
+				case <-server.SendFailedEvent():
+				}
+			}
+		}()
+		return func() {
+			close(quit)
+			<-done
+		}
+	}()
+	defer stopConsuming()
+
+	relay := NewRelay("", 8)
+	// noinspection GoUnhandledErrorResult
+	defer relay.Close()
+	received := make([][]string, members)
+	var readers sync.WaitGroup
+	for index := 0; index < members; index++ {
+		conn, reader := dialTest(t, server.TCPAddr())
+		// noinspection GoUnhandledErrorResult
+		defer conn.Close()
+		select {
+		case attendant := <-started:
+			relay.Join(attendant)
+		case <-time.After(2 * time.Second):
+			t.Fatal("the member did not start")
+		}
+		readers.Add(1)
+		go func(index int) {
+			defer readers.Done()
+			for count := 0; count < producers * perProducer; count++ {
+				// noinspection GoUnhandledErrorResult
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				line, err := reader.ReadBytes('\n')
+				if err != nil {
+					t.Errorf("member %d: read #%d: %v", index, count, err)
+					return
+				}
+				frame := wireFrame{}
+				if err := json2.Unmarshal(line, &frame); err != nil {
+					t.Errorf("member %d: decode #%d: %v", index, count, err)
+					return
+				}
+				if frame.KWA[DefaultRelaySequenceKey] != float64(count + 1) {
+					t.Errorf("member %d: expected the sequence %d, got %v", index, count + 1, frame.KWA[DefaultRelaySequenceKey])
+					return
+				}
+				received[index] = append(received[index], fmt.Sprint(frame.A...))
+			}
+		}(index)
+	}
+
+	var producing sync.WaitGroup
+	for producer := 0; producer < producers; producer++ {
+		producing.Add(1)
+		go func(producer int) {
+			defer producing.Done()
+			for index := 0; index < perProducer; index++ {
+				if err := relay.Relay("STATE", Args{producer, index}, nil); err != nil {
+					t.Errorf("producer %d: relay: %v", producer, err)
+					return
+				}
+			}
+		}(producer)
+	}
+	producing.Wait()
+	readers.Wait()
+	if t.Failed() {
+		return
+	}
+
+	// Every member saw the same stream, and each producer's
+	// messages in the order they were relayed.
+	for member := 1; member < members; member++ {
+		for index := range received[0] {
+			if received[member][index] != received[0][index] {
+				t.Fatalf("member %d diverges at #%d: %s instead of %s", member, index,
+					received[member][index], received[0][index])
+			}
+		}
+	}
+	next := make([]int, producers)
+	for _, entry := range received[0] {
+		var producer, index int
+		if _, err := fmt.Sscan(entry, &producer, &index); err != nil {
+			t.Fatal(err)
+		}
+		if index != next[producer] {
+			t.Fatalf("producer %d: expected #%d, got #%d", producer, next[producer], index)
+		}
+		next[producer]++
+	}
+}
+
+
+func TestRelayDropsFailingMembers(t *testing.T) {
+	attendant, remote, _, _ := newPipeAttendant()
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	attendant.Stop()
+	attendant.Wait()
+	relay := NewRelay("", 1)
+	relay.Join(attendant)
+	// Stopped: sending to it fails, so it leaves.
+	if err := relay.Relay("STATE", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := relay.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for relay.ResourceCounts() != (ResourceCounts{}) {
+		if time.Now().After(deadline) {
+			t.Fatal("the sequencer did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	members := 0
+	relay.Enumerate(func(*Attendant) { members++ })
+	if members != 0 {
+		t.Fatalf("the failing member was not removed")
+	}
+	if err := relay.Relay("STATE", nil, nil); err != RelayIsClosed(true) {
+		t.Fatalf("expected a closed relay, got: %v", err)
+	}
+}
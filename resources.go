@@ -0,0 +1,72 @@
+package chasqui
+
+import "sync/atomic"
+
+
+// The amount of resources owned by an attendant or server
+// at a given moment: running goroutines, pending timers,
+// and open connections (including listeners). Once an
+// attendant or server is fully stopped, they all should
+// return to zero.
+type ResourceCounts struct {
+	Goroutines  int
+	Timers      int
+	Connections int
+}
+
+
+// Counters of the owned resources. They are updated right
+// where each resource is acquired or released, and they
+// also update the parent counters (e.g. the server owning
+// an attendant), if any.
+type resourceCounter struct {
+	goroutines  int32
+	timers      int32
+	connections int32
+	parent      *resourceCounter
+}
+
+
+// Adds (or subtracts) running goroutines.
+func (counter *resourceCounter) addGoroutines(delta int32) {
+	for ; counter != nil; counter = counter.parent {
+		atomic.AddInt32(&counter.goroutines, delta)
+	}
+}
+
+
+// Adds (or subtracts) pending timers.
+func (counter *resourceCounter) addTimers(delta int32) {
+	for ; counter != nil; counter = counter.parent {
+		atomic.AddInt32(&counter.timers, delta)
+	}
+}
+
+
+// Adds (or subtracts) open connections.
+func (counter *resourceCounter) addConnections(delta int32) {
+	for ; counter != nil; counter = counter.parent {
+		atomic.AddInt32(&counter.connections, delta)
+	}
+}
+
+
+// Runs a function in a new goroutine, counting it while
+// it runs (even if it panics).
+func (counter *resourceCounter) spawn(function func()) {
+	counter.addGoroutines(1)
+	go func() {
+		defer counter.addGoroutines(-1)
+		function()
+	}()
+}
+
+
+// Takes a snapshot of the counters.
+func (counter *resourceCounter) counts() ResourceCounts {
+	return ResourceCounts{
+		Goroutines:  int(atomic.LoadInt32(&counter.goroutines)),
+		Timers:      int(atomic.LoadInt32(&counter.timers)),
+		Connections: int(atomic.LoadInt32(&counter.connections)),
+	}
+}
@@ -0,0 +1,38 @@
+package chasqui
+
+import (
+	"context"
+	"net"
+)
+
+
+// Error raised when listening with SO_REUSEPORT on a platform
+// not supporting it (see WithDispatcherReusePort).
+type ReusePortUnsupportedError bool
+
+
+// The error message.
+func (ReusePortUnsupportedError) Error() string {
+	return "SO_REUSEPORT is not supported on this platform"
+}
+
+
+// Makes the dispatcher create its listeners with SO_REUSEPORT,
+// so several processes (e.g. the old and the new one, during
+// a deploy) may listen on the same port at once, with the
+// kernel balancing the connections among them. It has no
+// effect on RunWithListener. Only Linux supports it: on other
+// platforms, listening fails with ReusePortUnsupportedError.
+func WithDispatcherReusePort(enabled bool) DispatcherOption {
+	return func(dispatcher *Dispatcher) {
+		dispatcher.reusePort = enabled
+	}
+}
+
+
+// Starts to listen on the given (resolved) address, in the
+// given network, with SO_REUSEPORT.
+func listenReusePort(network string, address *net.TCPAddr) (net.Listener, error) {
+	config := net.ListenConfig{Control: reusePortControl}
+	return config.Listen(context.Background(), network, address.String())
+}
@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package chasqui
+
+import (
+	"syscall"
+)
+
+
+// Sets SO_REUSEPORT on a socket, before it is bound.
+func reusePortControl(network, address string, conn syscall.RawConn) error {
+	var err error
+	if errControl := conn.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); errControl != nil {
+		return errControl
+	}
+	return err
+}
@@ -0,0 +1,9 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package chasqui
+
+
+// The SO_REUSEPORT socket option (the syscall package does not
+// define it on Linux).
+const soReusePort = 0xf
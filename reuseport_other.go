@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package chasqui
+
+import (
+	"syscall"
+)
+
+
+// SO_REUSEPORT is not supported here: binding always fails.
+func reusePortControl(network, address string, conn syscall.RawConn) error {
+	return ReusePortUnsupportedError(true)
+}
@@ -37,10 +37,8 @@ func (funnel SampleClientFunnel) Stopped(attendant *chasqui.Attendant, stopType
 }
 
 
-func MakeClient(host, clientName string, onExtraClose func()) (*chasqui.Attendant, error) {
-	if addr, err := net.ResolveTCPAddr("tcp", host); err != nil {
-		return nil, err
-	} else if conn, err := net.DialTCP("tcp", nil, addr); err != nil {
+func MakeClient(addr *net.TCPAddr, clientName string, onExtraClose func()) (*chasqui.Attendant, error) {
+	if conn, err := net.DialTCP("tcp", nil, addr); err != nil {
 		return nil, err
 	} else {
 		client := chasqui.NewClient(conn, &json.JSONMessageMarshaler{}, 0, 16)
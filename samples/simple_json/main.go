@@ -11,10 +11,14 @@ import (
 
 
 func main() {
-	if err := server.Run("0.0.0.0:3000"); err != nil {
-		fmt.Printf("An error was raised while trying to start the server at address 0.0.0.0:3000: %s\n", err)
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		fmt.Printf("An error was raised while trying to start the server at address 127.0.0.1:0: %s\n", err)
 		return
 	}
+	// The listener is bound once Run returns, so the actual
+	// address (with the port chosen by the system) is known.
+	addr := server.TCPAddr()
+	fmt.Printf("The server is listening at %s\n", addr)
 	chasqui.FunnelServerWith(server, SampleServerFunnel{})
 	defer func() {
 		if err := server.Stop(); err != nil {
@@ -37,7 +41,7 @@ func main() {
 			case "start":
 				if _, ok := clients[parts[1]]; ok {
 					fmt.Printf("Name in use: %s\n", parts[1])
-				} else if attendant, err := MakeClient("127.0.0.1:3000", parts[1], func() { delete(clients, parts[1]) }); err != nil {
+				} else if attendant, err := MakeClient(addr, parts[1], func() { delete(clients, parts[1]) }); err != nil {
 					fmt.Printf("Failed to make client %s: %s\n", parts[1], err)
 				} else {
 					clients[parts[1]] = attendant
@@ -55,6 +59,14 @@ func main() {
 				} else {
 					fmt.Printf("Invalid or unknown name: %s\n", subParts[0])
 				}
+			case "quit":
+				if attendant, ok := clients[parts[1]]; ok {
+					if err := attendant.Send("QUIT", nil, nil); err != nil {
+						fmt.Printf("Client %s failed to quit: %s\n", parts[1], err)
+					}
+				} else {
+					fmt.Printf("Invalid or unknown name: %s\n", parts[1])
+				}
 			case "stop":
 				if attendant, ok := clients[parts[1]]; ok {
 					// noinspection GoUnhandledErrorResult
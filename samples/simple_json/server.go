@@ -48,6 +48,10 @@ func (funnel SampleServerFunnel) MessageArrived(server *chasqui.Server, attendan
 			// noinspection GoUnhandledErrorResult
 			attendant.Send("NAME_MISSING", nil, nil)
 		}
+	case "QUIT":
+		if err := attendant.StopWith("GOODBYE", Args{"See you soon"}, nil); err != nil {
+			fmt.Printf("Remote: Failed to say GOODBYE: %s\n", err)
+		}
 	case "SHOUT":
 		args := message.Args()
 		if name, _ := attendant.Context("name"); name == nil {
@@ -59,11 +63,10 @@ func (funnel SampleServerFunnel) MessageArrived(server *chasqui.Server, attendan
 				fmt.Printf("Remote: Failed to respond SHOUT_MISSING to %s: %s\n", name, err)
 			}
 		} else {
-			server.Enumerate(func(target *chasqui.Attendant) {
-				if err := target.Send("SHOUTED", Args{name, args[0]}, nil); err != nil {
-					fmt.Printf("Remote: Failed to broadcast SHOUTED from %s: %s\n", name, err)
-				}
-			})
+			result := server.Broadcast("SHOUTED", Args{name, args[0]}, nil)
+			for _, failure := range result.Failures {
+				fmt.Printf("Remote: Failed to broadcast SHOUTED from %s to %d: %s\n", name, failure.AttendantID, failure.Err)
+			}
 		}
 	}
 }
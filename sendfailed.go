@@ -0,0 +1,49 @@
+package chasqui
+
+import "time"
+
+
+// Event reporting a queued send failed when it was written
+// (see WithSendQueue), so fire-and-forget senders learn about
+// it. It tells the command, how many args and kwargs it had,
+// the write error and when it failed. When the failure also
+// stops the attendant, this event is triggered before the
+// stopped event.
+type SendFailedEvent struct {
+	Attendant   *Attendant
+	AttendantID uint64
+	Command     string
+	ArgsCount   int
+	KWArgsCount int
+	Error       error
+	Instant     time.Time
+}
+
+
+// Returns a read-only channel with all the "send failed"
+// events. It will be nil unless a channel was given on
+// construction.
+func (attendant *Attendant) SendFailedEvent() <-chan SendFailedEvent {
+	return attendant.sendFailedEvent
+}
+
+
+// Triggers a send failed event, unless there is no channel
+// for them. Gives up once the outgoing queue is closed (the
+// attendant is stopping and nobody took the event).
+func (attendant *Attendant) emitSendFailed(send queuedSend, err error) {
+	if attendant.sendFailedEvent == nil && !attendant.unified() {
+		return
+	}
+	event := SendFailedEvent{
+		attendant, attendant.id, send.command, len(send.args), len(send.kwargs), err, time.Now(),
+	}
+	if attendant.unified() {
+		attendant.emitUnified(event, attendant.sendQueue.closing)
+		return
+	}
+	select {
+	case attendant.sendFailedEvent <- event:
+	case <-attendant.sendQueue.closing:
+	}
+}
@@ -0,0 +1,299 @@
+package chasqui
+
+import (
+	"errors"
+	. "github.com/universe-10th/chasqui/types"
+	"net"
+	"sync"
+	"time"
+)
+
+
+// Error raised when a message is dropped because the
+// outgoing queue of an attendant is full (or the message
+// was evicted by a newer one).
+type SendQueueFullError bool
+
+
+// The error message.
+func (SendQueueFullError) Error() string {
+	return "message dropped - the outgoing queue is full"
+}
+
+
+// Error used to abort an attendant whose outgoing queue
+// overflowed, under the SendQueueClose policy.
+type SendQueueOverflowError bool
+
+
+// The error message.
+func (SendQueueOverflowError) Error() string {
+	return "attendant closed - the outgoing queue overflowed"
+}
+
+
+// Error raised when sending without waiting (see TrySend)
+// through an attendant with no outgoing queue: the write
+// itself could block the caller.
+type SendQueueRequiredError bool
+
+
+// The error message.
+func (SendQueueRequiredError) Error() string {
+	return "sending without waiting requires an outgoing queue"
+}
+
+
+// What to do when a message is sent but the outgoing
+// queue of an attendant is full:
+// - Block: Wait until there is room in the queue.
+// - DropOldest: Evict the oldest pending message.
+// - DropNewest: Discard the message being sent.
+// - Close: Stop the attendant abnormally.
+type SendQueuePolicy int
+const (
+	SendQueueBlock SendQueuePolicy = iota
+	SendQueueDropOldest
+	SendQueueDropNewest
+	SendQueueClose
+)
+
+
+// A message waiting in the outgoing queue. The result
+// channel is only present for synchronous sends.
+type queuedSend struct {
+	command string
+	args    Args
+	kwargs  KWArgs
+	result  chan error
+}
+
+
+// Tells the result of a queued send, if anyone waits.
+func (send queuedSend) resolve(err error) {
+	if send.result != nil {
+		send.result <- err
+	}
+}
+
+
+// A bounded outgoing queue, drained by a single writer
+// goroutine. Once closed, the pending messages are
+// discarded and new ones are rejected.
+type sendQueue struct {
+	mutex    sync.Mutex
+	changed  *sync.Cond
+	pending  []queuedSend
+	capacity int
+	policy   SendQueuePolicy
+	closed   bool
+	writing  bool
+	closing  chan struct{}
+	done     chan struct{}
+}
+
+
+// Adds a message to the queue, according to the policy.
+func (queue *sendQueue) push(attendant *Attendant, send queuedSend) error {
+	queue.mutex.Lock()
+	if queue.policy == SendQueueBlock {
+		for !queue.closed && len(queue.pending) >= queue.capacity {
+			queue.changed.Wait()
+		}
+	}
+	if queue.closed {
+		queue.mutex.Unlock()
+		return AttendantIsStopped(true)
+	}
+	if len(queue.pending) >= queue.capacity {
+		switch queue.policy {
+		case SendQueueDropOldest:
+			evicted := queue.pending[0]
+			queue.pending[0] = queuedSend{}
+			queue.pending = queue.pending[1:]
+			evicted.resolve(SendQueueFullError(true))
+		case SendQueueDropNewest:
+			queue.mutex.Unlock()
+			return SendQueueFullError(true)
+		default:
+			queue.mutex.Unlock()
+			attendant.abort(SendQueueOverflowError(true))
+			return SendQueueOverflowError(true)
+		}
+	}
+	queue.pending = append(queue.pending, send)
+	queue.changed.Broadcast()
+	queue.mutex.Unlock()
+	return nil
+}
+
+
+// Adds a message to the queue only if there is room for it
+// within the given time (zero means not waiting at all),
+// regardless of the policy. Returns whether it was added.
+func (queue *sendQueue) offer(send queuedSend, wait time.Duration) (bool, error) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if wait > 0 && !queue.closed && len(queue.pending) >= queue.capacity {
+		expired := false
+		timer := time.AfterFunc(wait, func() {
+			queue.mutex.Lock()
+			expired = true
+			queue.changed.Broadcast()
+			queue.mutex.Unlock()
+		})
+		defer timer.Stop()
+		for !expired && !queue.closed && len(queue.pending) >= queue.capacity {
+			queue.changed.Wait()
+		}
+	}
+	if queue.closed {
+		return false, AttendantIsStopped(true)
+	} else if len(queue.pending) >= queue.capacity {
+		return false, nil
+	}
+	queue.pending = append(queue.pending, send)
+	queue.changed.Broadcast()
+	return true, nil
+}
+
+
+// Takes the next message from the queue, waiting for it.
+// Returns false once the queue is closed.
+func (queue *sendQueue) pop() (queuedSend, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	for !queue.closed && len(queue.pending) == 0 {
+		queue.changed.Wait()
+	}
+	if queue.closed {
+		return queuedSend{}, false
+	}
+	send := queue.pending[0]
+	queue.pending[0] = queuedSend{}
+	queue.pending = queue.pending[1:]
+	queue.writing = true
+	queue.changed.Broadcast()
+	return send, true
+}
+
+
+// Tells the message taken from the queue was written (or
+// failed to).
+func (queue *sendQueue) written() {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.writing = false
+	queue.changed.Broadcast()
+}
+
+
+// Waits until the queue is empty and no message is being
+// written, at most the given time. Returns whether that
+// happened in time (it never happens once closed, unless
+// it was empty already).
+func (queue *sendQueue) flush(wait time.Duration) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if !queue.closed && (len(queue.pending) > 0 || queue.writing) {
+		expired := false
+		timer := time.AfterFunc(wait, func() {
+			queue.mutex.Lock()
+			expired = true
+			queue.changed.Broadcast()
+			queue.mutex.Unlock()
+		})
+		defer timer.Stop()
+		for !expired && !queue.closed && (len(queue.pending) > 0 || queue.writing) {
+			queue.changed.Wait()
+		}
+	}
+	return len(queue.pending) == 0 && !queue.writing
+}
+
+
+// Closes the queue, discarding the pending messages.
+func (queue *sendQueue) close() {
+	queue.mutex.Lock()
+	pending := queue.pending
+	queue.pending = nil
+	if !queue.closed {
+		queue.closed = true
+		close(queue.closing)
+	}
+	queue.changed.Broadcast()
+	queue.mutex.Unlock()
+	for _, send := range pending {
+		send.resolve(AttendantIsStopped(true))
+	}
+}
+
+
+// The number of messages waiting in the queue.
+func (queue *sendQueue) length() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return len(queue.pending)
+}
+
+
+// Creates a new outgoing queue.
+func newSendQueue(capacity uint, policy SendQueuePolicy) *sendQueue {
+	queue := &sendQueue{
+		capacity: int(capacity),
+		policy:   policy,
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	queue.changed = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+
+// The writer loop drains the outgoing queue, writing each
+// message via the connection, until the queue is closed.
+// Failed writes trigger the send failed event (sends the
+// attendant refused because it was stopping do not count).
+// Write errors on the connection stop the attendant, since
+// the stream may be left in an inconsistent state (unless
+// the connection was already closed on our side).
+func (attendant *Attendant) writeLoop() {
+	defer close(attendant.sendQueue.done)
+	for {
+		if send, ok := attendant.sendQueue.pop(); !ok {
+			return
+		} else {
+			err := attendant.write(send.command, send.args, send.kwargs)
+			attendant.sendQueue.written()
+			if err != nil && err != AttendantIsStopped(true) {
+				attendant.emitSendFailed(send, err)
+			}
+			var netError net.Error
+			if errors.As(err, &netError) && !isClosedSocketError(err) {
+				attendant.abort(err)
+			}
+			send.resolve(err)
+		}
+	}
+}
+
+
+// Registers the teardown callbacks of the outgoing queue
+// (they do nothing if the queue is removed later on):
+// the pending messages are discarded once reads stop, and
+// the writer goroutine is waited for once the connection
+// is released.
+func (attendant *Attendant) registerSendQueueTeardown() {
+	attendant.teardown.register(TeardownDrainWrites, func() error {
+		if attendant.sendQueue != nil {
+			attendant.sendQueue.close()
+		}
+		return nil
+	})
+	attendant.teardown.register(TeardownReleaseResources, func() error {
+		if attendant.sendQueue != nil {
+			<-attendant.sendQueue.done
+		}
+		return nil
+	})
+}
@@ -0,0 +1,134 @@
+package chasqui
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// The policies which never stop the attendant, by name.
+var benchmarkedSendQueuePolicies = []struct {
+	name   string
+	policy SendQueuePolicy
+}{
+	{"Block", SendQueueBlock},
+	{"DropOldest", SendQueueDropOldest},
+	{"DropNewest", SendQueueDropNewest},
+}
+
+
+// Measures the queue alone: one producer pushing, and one
+// consumer popping as the writer loop does (without I/O).
+func BenchmarkSendQueuePushPop(b *testing.B) {
+	for _, entry := range benchmarkedSendQueuePolicies {
+		b.Run(entry.name, func(b *testing.B) {
+			queue := newSendQueue(64, entry.policy)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for {
+					if _, ok := queue.pop(); !ok {
+						return
+					}
+					queue.written()
+				}
+			}()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for index := 0; index < b.N; index++ {
+				if err := queue.push(nil, queuedSend{command: "tick"}); err != nil &&
+					!errors.Is(err, ErrSendQueueFull) {
+					b.Fatalf("push: %v", err)
+				}
+			}
+			b.StopTimer()
+			queue.close()
+			<-done
+		})
+	}
+}
+
+
+// Measures queued sends through an attendant writing to a
+// peer which reads everything (evictions under DropOldest
+// are not seen by the sender, so only DropNewest rejects).
+func BenchmarkSendQueueAttendant(b *testing.B) {
+	for _, entry := range benchmarkedSendQueuePolicies {
+		b.Run(entry.name, func(b *testing.B) {
+			local, remote := net.Pipe()
+			go func() {
+				// noinspection GoUnhandledErrorResult
+				io.Copy(io.Discard, remote)
+			}()
+			// noinspection GoUnhandledErrorResult
+			defer remote.Close()
+			attendant := NewAttendant(
+				local, &json.JSONMessageMarshaler{}, 0, make(chan AttendantStartedEvent, 4),
+				make(chan AttendantStoppedEvent, 4), make(chan MessageEvent, 16),
+				make(chan ThrottledEvent, 16), WithSendQueue(64, entry.policy),
+			)
+			if err := attendant.Start(); err != nil {
+				b.Fatalf("start: %v", err)
+			}
+			// noinspection GoUnhandledErrorResult
+			defer attendant.Stop()
+			rejected := 0
+			b.ReportAllocs()
+			b.ResetTimer()
+			for index := 0; index < b.N; index++ {
+				if err := attendant.Send("tick", Args{index}, nil); errors.Is(err, ErrSendQueueFull) {
+					rejected++
+				} else if err != nil {
+					b.Fatalf("send: %v", err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(rejected) / float64(b.N), "rejected/op")
+		})
+	}
+}
+
+
+// A connection whose writes fail with a network error, wrapped
+// (as marshalers or middleware may do).
+type wrappedNetErrorConn struct {
+	net.Conn
+}
+
+
+func (wrappedNetErrorConn) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("flaky link: %w", &net.OpError{Op: "write", Net: "tcp", Err: errors.New("broken pipe")})
+}
+
+
+func TestSendQueueAbortsOnWrappedNetErrors(t *testing.T) {
+	local, remote := net.Pipe()
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	stopped := make(chan AttendantStoppedEvent, 1)
+	attendant := NewAttendant(
+		wrappedNetErrorConn{local}, &json.JSONMessageMarshaler{}, 0, make(chan AttendantStartedEvent, 1), stopped,
+		make(chan MessageEvent, 1), make(chan ThrottledEvent, 1), WithSendQueue(4, SendQueueBlock),
+	)
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	attendant.Send("PING", nil, nil)
+	select {
+	case event := <-stopped:
+		var opError *net.OpError
+		if event.StopType != AttendantAbnormalStop || !errors.As(event.Error, &opError) {
+			t.Fatalf("the wrapped network error must abort the attendant, got: %v (%v)", event.StopType, event.Error)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the attendant was not aborted")
+	}
+}
@@ -0,0 +1,69 @@
+package chasqui
+
+import (
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// A sequenced send waiting for its turn.
+type sequencedSend struct {
+	command string
+	args    Args
+	kwargs  KWArgs
+	result  chan error
+}
+
+
+// The queue of pending sends sharing a sequence key.
+// Sequences exist only while they have pending sends:
+// once drained, they are removed from the attendant.
+type sendSequence struct {
+	pending []sequencedSend
+}
+
+
+// Writes a message via the connection, if it is not closed,
+// guaranteeing FIFO order among all the sends sharing the
+// same sequence key, even when they come from different
+// goroutines: the order is the one in which the calls were
+// issued. Sends with different keys (or plain Send calls)
+// interleave freely. This call blocks until the message is
+// written (or failed to).
+func (attendant *Attendant) SendSequenced(seqKey string, command string, args Args, kwargs KWArgs) error {
+	result := make(chan error, 1)
+	attendant.sequencesMutex.Lock()
+	sequence, exists := attendant.sequences[seqKey]
+	if !exists {
+		sequence = &sendSequence{}
+		attendant.sequences[seqKey] = sequence
+	}
+	sequence.pending = append(sequence.pending, sequencedSend{command, args, kwargs, result})
+	attendant.sequencesMutex.Unlock()
+
+	if !exists {
+		attendant.resources.spawn(func() {
+			attendant.sequenceLoop(seqKey, sequence)
+		})
+	}
+	return <-result
+}
+
+
+// Drains a sequence, sending its messages one by one, and
+// removes it from the attendant once it is empty.
+func (attendant *Attendant) sequenceLoop(seqKey string, sequence *sendSequence) {
+	for {
+		attendant.sequencesMutex.Lock()
+		if len(sequence.pending) == 0 {
+			delete(attendant.sequences, seqKey)
+			attendant.sequencesMutex.Unlock()
+			return
+		}
+		next := sequence.pending[0]
+		sequence.pending[0] = sequencedSend{}
+		sequence.pending = sequence.pending[1:]
+		attendant.sequencesMutex.Unlock()
+
+		next.result <- attendant.SendSync(next.command, next.args, next.kwargs)
+	}
+}
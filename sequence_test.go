@@ -0,0 +1,69 @@
+package chasqui
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// Runs a benchmark against a started pipe attendant.
+func benchmarkPipeAttendant(b *testing.B, send func(attendant *Attendant, index int) error) {
+	attendant, remote, _, _ := newPipeAttendant()
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	if err := attendant.Start(); err != nil {
+		b.Fatalf("start: %v", err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer attendant.Stop()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for index := 0; index < b.N; index++ {
+		if err := send(attendant, index); err != nil {
+			b.Fatalf("send: %v", err)
+		}
+	}
+}
+
+
+func BenchmarkSendSync(b *testing.B) {
+	benchmarkPipeAttendant(b, func(attendant *Attendant, index int) error {
+		return attendant.SendSync("tick", Args{index}, nil)
+	})
+}
+
+
+func BenchmarkSendSequenced(b *testing.B) {
+	benchmarkPipeAttendant(b, func(attendant *Attendant, index int) error {
+		return attendant.SendSequenced("ticks", "tick", Args{index}, nil)
+	})
+}
+
+
+func BenchmarkSendSequencedParallelKeys(b *testing.B) {
+	attendant, remote, _, _ := newPipeAttendant()
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	if err := attendant.Start(); err != nil {
+		b.Fatalf("start: %v", err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer attendant.Stop()
+	var keys int32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// Each goroutine keeps its own sequence, so they only
+		// contend on the connection.
+		key := "ticks-" + strconv.Itoa(int(atomic.AddInt32(&keys, 1)))
+		for index := 0; pb.Next(); index++ {
+			if err := attendant.SendSequenced(key, "tick", Args{index}, nil); err != nil {
+				b.Errorf("send: %v", err)
+				return
+			}
+		}
+	})
+}
@@ -1,8 +1,13 @@
 package chasqui
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	. "github.com/universe-10th/chasqui/types"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,9 +16,15 @@ import (
 type Attendants map[*Attendant]bool
 
 
-// Event reporting the server has started.
+// Event reporting the server has started, and
+// which optional features it runs with. The address
+// is the one actually bound (e.g. telling the port
+// chosen by the system, when binding port 0), and
+// the network tells its family ("tcp4" or "tcp6").
 type ServerStartedEvent struct {
-	Addr   *net.TCPAddr
+	Addr     *net.TCPAddr
+	Network  string
+	Features []FeatureStatus
 }
 
 
@@ -22,8 +33,17 @@ type ServerStartedEvent struct {
 type ServerAcceptFailedEvent error
 
 
-// Event reporting the server has stopped.
-type ServerStoppedEvent uint8
+// Event reporting the server has stopped. The reason is the
+// one of the first dispatcher which stopped abnormally while
+// running (e.g. its listener was closed by other means), with
+// the underlying error, or else DispatcherStopRequested (and a
+// nil error). It is triggered once per run: as soon as a
+// dispatcher stops abnormally on its own (the attendants keep
+// running until Stop is called), or else by Stop.
+type ServerStoppedEvent struct {
+	Reason DispatcherStopReason
+	Err    error
+}
 
 
 // A default teamwork of a dispatcher and all the
@@ -36,8 +56,66 @@ type ServerStoppedEvent uint8
 // the flows of the attendants to the flow of the
 // dispatcher.
 type Server struct {
+	factory               MarshalerFactory
+	defaultThrottle       time.Duration
+	throttlePolicy        func() ThrottlePolicy
+	escalation            *throttleEscalation
+	throttleDelay         uint
+	writeTimeout          time.Duration
+	stallTimeout          time.Duration
+	idleTimeout           time.Duration
+	firstMessageTimeout   time.Duration
+	maxLifetime           time.Duration
+	expiryCode            int
+	expiryText            string
+	keepalive             *Keepalive
+	sendQueueCapacity     uint
+	readBufferSize        uint
+	jitter                float64
+	sendQueuePolicy       SendQueuePolicy
+	warmup                *warmup
+	acceptPolicy          AcceptPolicy
+	acceptFilter          AcceptFilter
+	acceptVeto            AcceptVeto
+	acceptRate            *acceptRateLimiter
+	maintenance           int32
+	network               string
+	reusePort             bool
+	// The optional PROXY protocol parsing (a zero timeout
+	// means none).
+	proxyHeaderTimeout    time.Duration
+	proxy                 proxyState
+	// The optional verification of the TLS handshakes, the
+	// time given to them, and the ones still running.
+	tlsVerify             OnTLSVerify
+	tlsHandshakeTimeout   time.Duration
+	handshakes            tlsHandshakeState
+	// The deadline of a graceful stop, while it runs, and
+	// the notice run for each attendant on shutdown.
+	drainDeadline         time.Time
+	shutdownNotice        ShutdownNoticeFunc
 	dispatcher            *Dispatcher
+	dispatcherOptions     []DispatcherOption
+	// The extra dispatchers (see RunMulti), and how to
+	// create more of them.
+	extraDispatchers      []*Dispatcher
+	newDispatcher         func() *Dispatcher
+	// The running attendants, and also by ID, for lookups
+	// from any goroutine. Only the mapping lifecycle changes
+	// them, under the mutex.
 	attendants            Attendants
+	attendantsByID        map[uint64]*Attendant
+	attendantsMutex       sync.RWMutex
+	// The attendants about to report their start, and whether
+	// the mapping lifecycle is quitting (so no more of them
+	// are admitted).
+	pendingAttendants     int
+	quitting              bool
+	// The running attendants by tag.
+	tags                  tagIndex
+	// The sweeper of the expiring context elements of the
+	// attendants.
+	sweeper               contextSweeper
 	startedEvent          chan ServerStartedEvent
 	acceptFailedEvent     chan ServerAcceptFailedEvent
 	attendantStartedEvent chan AttendantStartedEvent
@@ -45,40 +123,398 @@ type Server struct {
 	throttledEvent        chan ThrottledEvent
 	attendantStoppedEvent chan AttendantStoppedEvent
 	stoppedEvent          chan ServerStoppedEvent
+	bandwidthEvent        chan BandwidthExceededEvent
+	overflowEvent         chan EventOverflowEvent
+	authenticatedEvent    chan AttendantAuthenticatedEvent
+	slowConsumerEvent     chan SlowConsumerEvent
+	sendFailedEvent       chan SendFailedEvent
+	halfClosedEvent       chan AttendantHalfClosedEvent
+	halfClose             bool
+	unresponsiveEvent     chan AttendantUnresponsiveEvent
+	messageRejectedEvent  chan MessageRejectedEvent
+	rejectedEvent         chan ConnectionRejectedEvent
+	proxyRejectedEvent    chan ProxyHeaderRejectedEvent
+	rateLimitedEvent      chan ConnectionRateLimitedEvent
+	eventDelivery         EventDeliveryPolicy
+	tcpTuning             *TCPTuning
+	stoppedContext        bool
+	authHandler           AuthHandler
+	authNotify            bool
+	slowConsumerThreshold uint
+	slowConsumerGrace     time.Duration
+	logger                Logger
+	// The closer of the running dispatchers, and whether it is
+	// being stopped, guarded by the run mutex (along with the
+	// stopping and stopped channels).
+	runMutex              sync.Mutex
 	closer                func()
+	stopInProgress        bool
+	// Whether it runs with TLS (1) or not (0), as told to
+	// the feature checks.
+	runningTLS            int32
+	// Intermediate events from the attendants, consumed by
+	// the mapping lifecycle the basic server implements, and
+	// the signal telling that lifecycle to finish.
+	internalStartedEvent  chan AttendantStartedEvent
+	internalStoppedEvent  chan AttendantStoppedEvent
+	quit                  chan uint8
+	lifecycleDone         chan struct{}
+	// Closed once the server starts stopping (so the events
+	// nobody consumes do not block it), and once it stopped
+	// (see RunContext).
+	stopping              chan struct{}
+	stopped               chan struct{}
+	// The first abnormal stop of its dispatchers, if any, and
+	// whether the stopped event was already triggered for it.
+	stopMutex             sync.Mutex
+	stopReason            DispatcherStopReason
+	stopErr               error
+	stopEmitted           bool
+	teardown              teardownPipeline
+	// The goroutines, timers and connections it owns,
+	// including the ones of its dispatcher and attendants.
+	resources             resourceCounter
 }
 
 
 // Runs the server. This implies running the underlying
 // dispatcher and relying on the callbacks to do their
-// job.
+// job. The configured features are checked beforehand,
+// and the server will not run if they have fatal flaws.
+// It returns once the listener is bound: from then on,
+// Addr and TCPAddr tell the actual address (e.g. the port
+// chosen by the system when binding port 0), with no need
+// to wait for the started event (which still comes).
 func (server *Server) Run(host string) error {
-	if closer, err := server.dispatcher.Run(host); err != nil {
+	return server.run(false, func() (func(), error) {
+		return server.dispatcher.Run(host)
+	})
+}
+
+
+// Runs the server as Run does, but stopping it (as Stop does)
+// when the given context is done. Blocks until the server
+// fully stopped, and returns the error preventing it from
+// running, the one of the stop (e.g. TeardownErrors), or else
+// the one of the context (e.g. context.Canceled). If the
+// server is stopped meanwhile by other means (e.g. Stop or
+// Shutdown), it returns nil.
+func (server *Server) RunContext(ctx context.Context, host string) error {
+	if err := server.Run(host); err != nil {
+		return err
+	}
+	server.runMutex.Lock()
+	stopped := server.stopped
+	server.runMutex.Unlock()
+	select {
+	case <-ctx.Done():
+		if err := server.Stop(); errors.Is(err, ErrNotListening) {
+			// Stopped meanwhile by other means.
+			<-stopped
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return ctx.Err()
+	case <-stopped:
+		return nil
+	}
+}
+
+
+// Runs the server as Run does, but accepting TLS connections
+// with the given config (see Dispatcher.RunTLS).
+func (server *Server) RunTLS(host string, config *tls.Config) error {
+	return server.run(true, func() (func(), error) {
+		return server.dispatcher.RunTLS(host, config)
+	})
+}
+
+
+// Runs the server as Run does, but over the given listener
+// (see Dispatcher.RunWithListener). By default, the listener
+// is closed when the server stops (see WithDispatcherOptions
+// and WithListenerOwnership).
+func (server *Server) RunWithListener(listener net.Listener) error {
+	return server.run(false, func() (func(), error) {
+		return server.dispatcher.RunWithListener(listener)
+	})
+}
+
+
+// Checks the features (telling whether it will run with TLS)
+// and runs the dispatcher by means of the given function, and
+// then the mapping lifecycle.
+func (server *Server) run(withTLS bool, runDispatcher func() (func(), error)) error {
+	server.runMutex.Lock()
+	defer server.runMutex.Unlock()
+	if server.closer != nil {
+		return DispatcherAlreadyListeningError(true)
+	}
+	if withTLS {
+		atomic.StoreInt32(&server.runningTLS, 1)
+	} else {
+		atomic.StoreInt32(&server.runningTLS, 0)
+	}
+	if _, err := server.checkFeatures(); err != nil {
+		return err
+	}
+	// The dispatcher callbacks may run as soon as it runs.
+	server.stopping = make(chan struct{})
+	server.stopMutex.Lock()
+	server.stopReason, server.stopErr, server.stopEmitted = DispatcherStopRequested, nil, false
+	server.stopMutex.Unlock()
+	if closer, err := runDispatcher(); err != nil {
 		return err
 	} else {
 		server.closer = closer
+		if server.warmup != nil {
+			server.warmup.start(time.Now())
+		}
+		server.attendantsMutex.Lock()
+		server.quitting = false
+		server.attendantsMutex.Unlock()
+		server.quit = make(chan uint8)
+		server.lifecycleDone = make(chan struct{})
+		server.stopped = make(chan struct{})
+		quit, done := server.quit, server.lifecycleDone
+		server.resources.spawn(func() {
+			server.lifecycle(quit)
+			close(done)
+		})
 		return nil
 	}
 }
 
 
-// Stops the server, if running.
+// The mapping lifecycle: keeps the set of attendants while
+// forwarding their started/stopped events. Once told to quit,
+// it stops all the attendants (even the ones reporting their
+// start afterwards) and keeps running until all of them are
+// stopped, so none of them blocks forever trying to report its
+// start or stop. While quitting, the events the channels have
+// no room for are dropped, so stopping never waits for them
+// to be consumed (e.g. when stopping from a funnel callback).
+func (server *Server) lifecycle(quit chan uint8) {
+	quitting := false
+	for !quitting || server.lifecycleBusy() {
+		select {
+		case event := <-server.internalStartedEvent:
+			server.attendantsMutex.Lock()
+			server.pendingAttendants--
+			server.attendants[event.Attendant] = true
+			server.attendantsByID[event.AttendantID] = event.Attendant
+			server.attendantsMutex.Unlock()
+			if !quitting {
+				select {
+				case server.attendantStartedEvent <- event:
+				case <-quit:
+					quitting, quit = true, nil
+					server.beginQuitting()
+					server.logger.Debugf("server dropped the started event of attendant %d while stopping",
+						event.AttendantID)
+				}
+			} else {
+				// noinspection GoUnhandledErrorResult
+				event.Attendant.Stop()
+				select {
+				case server.attendantStartedEvent <- event:
+				default:
+					server.logger.Debugf("server dropped the started event of attendant %d while stopping",
+						event.AttendantID)
+				}
+			}
+		case event := <-server.internalStoppedEvent:
+			server.attendantsMutex.Lock()
+			if server.attendants[event.Attendant] {
+				delete(server.attendants, event.Attendant)
+				delete(server.attendantsByID, event.AttendantID)
+			} else {
+				// Stopped before its start was reported.
+				server.pendingAttendants--
+			}
+			server.attendantsMutex.Unlock()
+			event.Attendant.detachTags()
+			if !quitting {
+				select {
+				case server.attendantStoppedEvent <- event:
+				case <-quit:
+					quitting, quit = true, nil
+					server.beginQuitting()
+					server.logger.Debugf("server dropped the stopped event of attendant %d while stopping",
+						event.AttendantID)
+				}
+			} else {
+				select {
+				case server.attendantStoppedEvent <- event:
+				default:
+					server.logger.Debugf("server dropped the stopped event of attendant %d while stopping",
+						event.AttendantID)
+				}
+			}
+		case <-quit:
+			quitting, quit = true, nil
+			server.beginQuitting()
+		}
+	}
+}
+
+
+// Refuses the new attendants from now on, and stops all the
+// running ones.
+func (server *Server) beginQuitting() {
+	server.attendantsMutex.Lock()
+	server.quitting = true
+	server.attendantsMutex.Unlock()
+	for _, attendant := range server.snapshotAttendants() {
+		// noinspection GoUnhandledErrorResult
+		attendant.Stop()
+	}
+}
+
+
+// Tells whether attendants are still running, or about to
+// report their start.
+func (server *Server) lifecycleBusy() bool {
+	server.attendantsMutex.RLock()
+	defer server.attendantsMutex.RUnlock()
+	return len(server.attendants) > 0 || server.pendingAttendants > 0
+}
+
+
+// Registers a new attendant about to start, unless the server
+// is stopping. Tells whether it was registered.
+func (server *Server) admitAttendant() bool {
+	server.attendantsMutex.Lock()
+	defer server.attendantsMutex.Unlock()
+	if server.quitting {
+		return false
+	}
+	server.pendingAttendants++
+	return true
+}
+
+
+// Unregisters an attendant which could not start.
+func (server *Server) dismissAttendant() {
+	server.attendantsMutex.Lock()
+	defer server.attendantsMutex.Unlock()
+	server.pendingAttendants--
+}
+
+
+// Stops the server, if running, by running its teardown
+// pipeline. The built-in teardown stops accepting connections
+// (StopAccepting), stops all the attendants and waits until
+// they all reported their stop (ReleaseResources), and
+// triggers the stopped event at the end of the last phase
+// (EmitStopped). It never waits for the events to be consumed:
+// the events the channels have no room for once stopping (the
+// server started, accept failed and stopped ones, and the ones
+// of the attendants) are dropped, so it may be called from a
+// funnel callback, or with nobody reading the events.
+// Failing callbacks do not prevent the server from stopping,
+// but they are reported as TeardownErrors. Once stopped, the
+// server may run again: its listeners are already closed by
+// then, so the same ports may be bound right away. It may be
+// called concurrently (e.g. while RunContext stops): only one
+// call stops the server, and the other ones (and the ones
+// made once stopped) return a DispatcherNotListeningError.
 func (server *Server) Stop() error {
-	if server.closer == nil {
+	server.runMutex.Lock()
+	if server.closer == nil || server.stopInProgress {
+		server.runMutex.Unlock()
 		return DispatcherNotListeningError(true)
 	} else {
-		server.closer()
-		server.Enumerate(func(attendant *Attendant) {
-			// noinspection GoUnhandledErrorResult
-			attendant.Stop()
-		})
-		server.attendants = Attendants{}
+		server.stopInProgress = true
+		server.signalStopping()
+		server.runMutex.Unlock()
+		// Neither Run nor Stop touch the closer meanwhile.
+		errs := server.teardown.run()
+		server.runMutex.Lock()
 		server.closer = nil
+		server.stopInProgress = false
+		close(server.stopped)
+		server.runMutex.Unlock()
+		for _, err := range errs {
+			server.logger.Errorf("server teardown failed: %v", err)
+		}
+		server.logger.Infof("server stopped")
+		server.stopMutex.Lock()
+		event := ServerStoppedEvent{server.stopReason, server.stopErr}
+		emit := !server.stopEmitted
+		server.stopEmitted = true
+		server.stopMutex.Unlock()
+		if emit {
+			select {
+			case server.stoppedEvent <- event:
+			default:
+				server.logger.Warnf("server dropped its stopped event: the channel is full")
+			}
+		}
+		if len(errs) > 0 {
+			return TeardownErrors(errs)
+		}
 		return nil
 	}
 }
 
 
+// Tells the event senders the server is stopping, so they
+// give up on the events nobody consumes. The run mutex must
+// be held.
+func (server *Server) signalStopping() {
+	select {
+	case <-server.stopping:
+	default:
+		close(server.stopping)
+	}
+}
+
+
+// Returns the closer of the running dispatchers, unless the
+// server is not running or already stopping (then, nil), and
+// tells the event senders the server is stopping if asked.
+func (server *Server) runningCloser(stopping bool) func() {
+	server.runMutex.Lock()
+	defer server.runMutex.Unlock()
+	if server.stopInProgress {
+		return nil
+	}
+	if stopping && server.closer != nil {
+		server.signalStopping()
+	}
+	return server.closer
+}
+
+
+// Registers a callback to run when the server stops, in the
+// given teardown phase.
+func (server *Server) OnTeardown(phase TeardownPhase, callback TeardownFunc) {
+	server.teardown.register(phase, callback)
+}
+
+
+// Registers the built-in teardown callbacks of a server.
+func (server *Server) registerTeardown() {
+	server.teardown.register(TeardownStopAccepting, func() error {
+		server.closer()
+		return nil
+	})
+	server.teardown.register(TeardownReleaseResources, func() error {
+		if !server.drainDeadline.IsZero() {
+			server.drainAttendants(server.drainDeadline)
+		}
+		// The mapping lifecycle stops all the attendants, and
+		// finishes once all of them reported their stop, so
+		// the server may run again.
+		close(server.quit)
+		<-server.lifecycleDone
+		return nil
+	})
+}
+
+
 // Returns a read-only channel with all the "started" events.
 func (server *Server) StartedEvent() <-chan ServerStartedEvent {
 	return server.startedEvent
@@ -121,32 +557,185 @@ func (server *Server) StoppedEvent() <-chan ServerStoppedEvent {
 }
 
 
+// Returns a read-only channel with all the "bandwidth exceeded" events.
+// They only occur when the server's factory is a BandwidthMarshaler.
+func (server *Server) BandwidthExceededEvent() <-chan BandwidthExceededEvent {
+	return server.bandwidthEvent
+}
+
+
+// Returns a read-only channel with all the "event overflow" events.
+// They only occur when the attendants drop events (see
+// WithAttendantEventDelivery).
+func (server *Server) EventOverflowEvent() <-chan EventOverflowEvent {
+	return server.overflowEvent
+}
+
+
+// Returns a read-only channel with all the "authenticated" events.
+// They only occur when the attendants have an authentication phase
+// (see WithAttendantAuth).
+func (server *Server) AuthenticatedEvent() <-chan AttendantAuthenticatedEvent {
+	return server.authenticatedEvent
+}
+
+
+// Returns a read-only channel with all the "slow consumer" events.
+// They only occur when the attendants have slow consumer detection
+// (see WithAttendantSlowConsumer).
+func (server *Server) SlowConsumerEvent() <-chan SlowConsumerEvent {
+	return server.slowConsumerEvent
+}
+
+
+// Returns a read-only channel with all the "send failed" events.
+// They only occur when the attendants have outgoing queues (see
+// WithAttendantSendQueue).
+func (server *Server) SendFailedEvent() <-chan SendFailedEvent {
+	return server.sendFailedEvent
+}
+
+
+// Returns a read-only channel with all the "message rejected"
+// events. They only occur when the marshaler rejects single
+// messages (see types.MessageRejectionError).
+func (server *Server) MessageRejectedEvent() <-chan MessageRejectedEvent {
+	return server.messageRejectedEvent
+}
+
+
+// Returns a read-only channel with all the "half closed" events.
+// They only occur when the server tells the half-closes apart
+// (see WithHalfClose).
+func (server *Server) HalfClosedEvent() <-chan AttendantHalfClosedEvent {
+	return server.halfClosedEvent
+}
+
+
+// Returns a read-only channel with all the "unresponsive" events.
+// They only occur when the attendants have a keepalive warning
+// time (see WithAttendantKeepalive).
+func (server *Server) UnresponsiveEvent() <-chan AttendantUnresponsiveEvent {
+	return server.unresponsiveEvent
+}
+
+
+// Returns a read-only channel with all the "connection
+// rejected" events. They only occur when the server has an
+// accept filter (see WithAcceptFilter).
+func (server *Server) ConnectionRejectedEvent() <-chan ConnectionRejectedEvent {
+	return server.rejectedEvent
+}
+
+
+// Returns a read-only channel with all the "PROXY header
+// rejected" events. They only occur when the server parses
+// PROXY protocol headers (see WithProxyProtocol).
+func (server *Server) ProxyHeaderRejectedEvent() <-chan ProxyHeaderRejectedEvent {
+	return server.proxyRejectedEvent
+}
+
+
+// Returns a read-only channel with all the "connection rate
+// limited" events. They only occur when the server limits the
+// accept rate (see WithAcceptRateLimit).
+func (server *Server) ConnectionRateLimitedEvent() <-chan ConnectionRateLimitedEvent {
+	return server.rateLimitedEvent
+}
+
+
 // Returns the current listen address of the server,
 // if running. Returns an error if it is not running.
+// Servers run by RunMulti tell their first address here
+// (see Addrs).
 func (server *Server) Addr() (net.Addr, error) {
 	return server.dispatcher.Addr()
 }
 
 
+// Returns the current listen address of the server as a TCP
+// address, or nil if it is not running (see Dispatcher.TCPAddr).
+// It is never nil once Run returned without error, until the
+// server stops.
+func (server *Server) TCPAddr() *net.TCPAddr {
+	return server.dispatcher.TCPAddr()
+}
+
+
+// Waits until the server is listening (e.g. while another
+// goroutine runs it by means of RunContext), for up to the
+// given time, and returns its listen address: the one actually
+// bound (e.g. telling the port chosen by the system, when
+// binding port 0). Returns an error if it is not listening by
+// then. It may be called from any goroutine.
+func (server *Server) WaitListening(timeout time.Duration) (net.Addr, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if addr, err := server.Addr(); err == nil || !time.Now().Before(deadline) {
+			return addr, err
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+
+// Returns the resources currently owned by this server,
+// including the ones of its dispatcher and its attendants
+// (even after they are removed). They should all be zero
+// shortly after the server and its attendants are fully
+// stopped (the goroutines finish right after the stopped
+// events are triggered).
+func (server *Server) ResourceCounts() ResourceCounts {
+	return server.resources.counts()
+}
+
+
 // Enumerates all the attendants using a callback. It will seldom
 // be used - perhaps for lobby features or debugging purposes.
+// It may be called from any goroutine: it iterates over the
+// attendants running when called, so the callback may Send to
+// them or Stop them safely (and may meet some stopped since).
 func (server *Server) Enumerate(callback func(*Attendant)) {
-	for attendant, _ := range server.attendants {
+	for _, attendant := range server.snapshotAttendants() {
 		callback(attendant)
 	}
 }
 
 
+// Returns the running attendants at this moment.
+func (server *Server) snapshotAttendants() []*Attendant {
+	server.attendantsMutex.RLock()
+	defer server.attendantsMutex.RUnlock()
+	attendants := make([]*Attendant, 0, len(server.attendants))
+	for attendant := range server.attendants {
+		attendants = append(attendants, attendant)
+	}
+	return attendants
+}
+
+
+// Returns the running attendant with the given ID, if any.
+// Attendants are found once their started event is triggered,
+// and not anymore once their stopped event is triggered.
+func (server *Server) AttendantByID(id uint64) (*Attendant, bool) {
+	server.attendantsMutex.RLock()
+	defer server.attendantsMutex.RUnlock()
+	attendant, ok := server.attendantsByID[id]
+	return attendant, ok
+}
+
+
 // Creates a new server by configuring a marshaler factory, the channel buffer size for the
-// message and throttled events, the default throttle time, and the buffer sizes.
-func NewServer(factory MessageMarshaler, activityBufferSize, lifecycleBufferSize uint, defaultThrottle time.Duration) *Server {
+// message and throttled events, the default throttle time, and the buffer sizes. Optional
+// features are configured by means of the trailing options.
+func NewServer(factory MarshalerFactory, activityBufferSize, lifecycleBufferSize uint, defaultThrottle time.Duration,
+	           options ...ServerOption) *Server {
 	if factory == nil {
 		panic(ArgumentError{"NewServer:factory"})
 	}
 
 	var onDispatcherAcceptError OnDispatcherAcceptError
 	var onDispatcherStart OnDispatcherStart
-	var onDispatcherStop OnDispatcherStop
 	var onDispatcherAcceptSuccess OnDispatcherAcceptSuccess
 	if activityBufferSize < 16 {
 		activityBufferSize = 16
@@ -154,8 +743,15 @@ func NewServer(factory MessageMarshaler, activityBufferSize, lifecycleBufferSize
 	if lifecycleBufferSize < 1 {
 		lifecycleBufferSize = 1
 	}
+	if defaultThrottle < 0 {
+		defaultThrottle = -defaultThrottle
+	}
 	server := &Server{
+		factory:               factory,
+		defaultThrottle:       defaultThrottle,
 		attendants:            Attendants{},
+		attendantsByID:        make(map[uint64]*Attendant),
+		logger:                nopLogger{},
 		startedEvent:          make(chan ServerStartedEvent, lifecycleBufferSize),
 		acceptFailedEvent:     make(chan ServerAcceptFailedEvent, lifecycleBufferSize),
 		attendantStartedEvent: make(chan AttendantStartedEvent, lifecycleBufferSize),
@@ -163,49 +759,173 @@ func NewServer(factory MessageMarshaler, activityBufferSize, lifecycleBufferSize
 		throttledEvent:        make(chan ThrottledEvent, activityBufferSize),
 		attendantStoppedEvent: make(chan AttendantStoppedEvent, lifecycleBufferSize),
 		stoppedEvent:          make(chan ServerStoppedEvent, lifecycleBufferSize),
+		bandwidthEvent:        make(chan BandwidthExceededEvent, activityBufferSize),
+		overflowEvent:         make(chan EventOverflowEvent, activityBufferSize),
+		authenticatedEvent:    make(chan AttendantAuthenticatedEvent, lifecycleBufferSize),
+		slowConsumerEvent:     make(chan SlowConsumerEvent, lifecycleBufferSize),
+		sendFailedEvent:       make(chan SendFailedEvent, lifecycleBufferSize),
+		halfClosedEvent:       make(chan AttendantHalfClosedEvent, lifecycleBufferSize),
+		unresponsiveEvent:     make(chan AttendantUnresponsiveEvent, lifecycleBufferSize),
+		messageRejectedEvent:  make(chan MessageRejectedEvent, activityBufferSize),
+		rejectedEvent:         make(chan ConnectionRejectedEvent, lifecycleBufferSize),
+		proxyRejectedEvent:    make(chan ProxyHeaderRejectedEvent, lifecycleBufferSize),
+		rateLimitedEvent:      make(chan ConnectionRateLimitedEvent, lifecycleBufferSize),
+		proxy:                 proxyState{pending: make(map[net.Conn]struct{})},
+		handshakes:            tlsHandshakeState{pending: make(map[net.Conn]struct{})},
+		jitter:                DefaultJitterFraction,
+		internalStartedEvent:  make(chan AttendantStartedEvent),
+		internalStoppedEvent:  make(chan AttendantStoppedEvent),
+	}
+	server.registerTeardown()
+	for _, option := range options {
+		option(server)
 	}
-	// Intermediate events from the attendants and the mapping
-	// lifecycle the basic server implements.
-	attendantStartedEvent := make(chan AttendantStartedEvent)
-	attendantStoppedEvent := make(chan AttendantStoppedEvent)
-	quit := make(chan uint8)
 
 	onDispatcherStart = func(_dispatcher *Dispatcher, addr *net.TCPAddr) {
-		go func(){
-			Loop: for {
-				select {
-				case event := <- attendantStartedEvent:
-					server.attendants[event.Attendant] = true
-					server.attendantStartedEvent <- event
-				case event := <- attendantStoppedEvent:
-					delete(server.attendants, event.Attendant)
-					server.attendantStoppedEvent <- event
-				case <-quit:
-					break Loop
-				}
-			}
-		}()
-		server.startedEvent <- ServerStartedEvent{
-			Addr: addr,
+		features, _ := server.checkFeatures()
+		server.logger.Infof("server started (%s)", addr)
+		// The accept loop runs this, and stopping waits for it.
+		select {
+		case server.startedEvent <- ServerStartedEvent{
+			Addr:     addr,
+			Network:  addressFamily(addr),
+			Features: features,
+		}:
+		case <-server.stopping:
+			server.logger.Warnf("server dropped its started event while stopping")
 		}
 	}
-	onDispatcherStop = func(_dispatcher *Dispatcher) {
-		close(quit)
-		server.stoppedEvent <- ServerStoppedEvent(1)
-	}
 	onDispatcherAcceptError = func(_dispatcher *Dispatcher, err error) {
-		server.acceptFailedEvent <- ServerAcceptFailedEvent(err)
+		server.logger.Warnf("server failed to accept a connection: %v", err)
+		select {
+		case server.acceptFailedEvent <- ServerAcceptFailedEvent(err):
+		case <-server.stopping:
+			server.logger.Warnf("server dropped an accept failed event while stopping")
+		}
 	}
-    onDispatcherAcceptSuccess = func(dispatcher *Dispatcher, conn *net.TCPConn) {
+	attend := func(conn net.Conn) {
+		if server.warmup != nil && !server.warmup.admit(time.Now()) {
+			server.logger.Debugf("server rejected a connection while warming up (%s)", conn.RemoteAddr())
+			server.reject(conn)
+			return
+		}
+		if !server.screen(conn) {
+			return
+		}
+		options := []AttendantOption{
+			WithBandwidthExceededEvent(server.bandwidthEvent),
+			WithSendQueue(server.sendQueueCapacity, server.sendQueuePolicy),
+			withResourceParent(&server.resources),
+			withTagIndex(&server.tags),
+			withContextSweeper(&server.sweeper),
+			WithLogger(server.logger),
+			WithReadBufferSize(server.readBufferSize),
+			WithJitter(server.jitter),
+			WithThrottleDelay(server.throttleDelay),
+			WithEventOverflowEvent(server.overflowEvent),
+			WithEventDelivery(server.eventDelivery),
+			WithStoppedContext(server.stoppedContext),
+			WithAuthenticatedEvent(server.authenticatedEvent),
+			WithAuth(server.authHandler, server.authNotify),
+			WithSlowConsumerEvent(server.slowConsumerEvent),
+			WithSendFailedEvent(server.sendFailedEvent),
+			WithUnresponsiveEvent(server.unresponsiveEvent),
+			WithMessageRejectedEvent(server.messageRejectedEvent),
+			WithSlowConsumer(server.slowConsumerThreshold, server.slowConsumerGrace),
+		}
+		if server.keepalive != nil {
+			options = append(options, WithKeepalive(*server.keepalive))
+		}
+		if server.tcpTuning != nil {
+			options = append(options, WithTCPTuning(*server.tcpTuning))
+		}
+		if server.halfClose {
+			options = append(options, WithHalfClosedEvent(server.halfClosedEvent))
+		}
+		// Once stopping, the mapping lifecycle may not be there
+		// to take the events of a new attendant.
+		if !server.admitAttendant() {
+			server.logger.Debugf("server rejected a connection while stopping (%s)", conn.RemoteAddr())
+			// noinspection GoUnhandledErrorResult
+			conn.Close()
+			return
+		}
 		attendant := NewAttendant(
-			conn, factory, defaultThrottle, attendantStartedEvent, attendantStoppedEvent,
-			server.messageEvent, server.throttledEvent,
+			conn, factory, defaultThrottle, server.internalStartedEvent, server.internalStoppedEvent,
+			server.messageEvent, server.throttledEvent, options...,
 		)
-		// noinspection GoUnhandledErrorResult
-		attendant.Start()
+		attendant.SetWriteTimeout(server.writeTimeout)
+		attendant.SetWriteStallTimeout(server.stallTimeout)
+		attendant.SetIdleTimeout(server.idleTimeout)
+		attendant.SetFirstMessageTimeout(server.firstMessageTimeout)
+		if server.maxLifetime > 0 {
+			attendant.SetExpiryReason(server.expiryCode, server.expiryText)
+			attendant.SetMaxLifetime(server.maxLifetime)
+		}
+		if server.throttlePolicy != nil {
+			attendant.SetThrottlePolicy(server.throttlePolicy())
+		}
+		if escalation := server.escalation; escalation != nil {
+			attendant.SetThrottleEscalation(escalation.maxViolations, escalation.window, escalation.action)
+		}
+		if certificates := attendant.PeerCertificates(); certificates != nil {
+			attendant.SetContext(PeerCertificatesKey, certificates)
+		}
+		if err := attendant.Start(); err != nil {
+			server.dismissAttendant()
+			server.logger.Errorf("server could not start attendant %d: %v", attendant.ID(), err)
+		}
+	}
+	onDispatcherAcceptSuccess = func(dispatcher *Dispatcher, conn net.Conn) {
+		if server.acceptRate != nil && !server.admitRate(conn) {
+			return
+		}
+		next := attend
+		if server.proxyHeaderTimeout > 0 {
+			next = func(conn net.Conn) {
+				server.acceptProxied(conn, attend)
+			}
+		}
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			server.acceptTLS(tlsConn, next)
+		} else {
+			next(conn)
+		}
+	}
+	if server.proxyHeaderTimeout > 0 {
+		server.registerProxyTeardown()
+	}
+	server.registerTLSTeardown()
+	dispatcherOptions := server.dispatcherOptions
+	if server.network != "" {
+		dispatcherOptions = append(dispatcherOptions, WithDispatcherNetwork(server.network))
+	}
+	if server.reusePort {
+		dispatcherOptions = append(dispatcherOptions, WithDispatcherReusePort(true))
+	}
+	onDispatcherReject := func(_dispatcher *Dispatcher, addr net.Addr, reason RejectReason) {
+		server.logger.Debugf("server rejected a connection by %s (%s)", reason, addr)
+		// Floods of rejected connections must not stall the
+		// accept loop.
+		select {
+		case server.rejectedEvent <- ConnectionRejectedEvent{addr, reason, nil}:
+		default:
+		}
+	}
+	if server.acceptFilter != nil {
+		dispatcherOptions = append(dispatcherOptions, WithDispatcherAcceptFilter(
+			server.acceptFilter, onDispatcherReject,
+		))
 	}
-	server.dispatcher = NewDispatcher(onDispatcherStart, onDispatcherAcceptSuccess,
-		                                   onDispatcherAcceptError, onDispatcherStop)
+	dispatcherOptions = append(dispatcherOptions, WithDispatcherAcceptVeto(server.veto, onDispatcherReject))
+	server.newDispatcher = func() *Dispatcher {
+		dispatcher := NewDispatcher(onDispatcherStart, onDispatcherAcceptSuccess,
+		                            onDispatcherAcceptError, server.recordDispatcherStop, dispatcherOptions...)
+		dispatcher.resources.parent = &server.resources
+		return dispatcher
+	}
+	server.dispatcher = server.newDispatcher()
+	server.sweeper.resources = &server.resources
 	return server
 }
 
@@ -224,6 +944,96 @@ type ServerFunnel interface {
 }
 
 
+// Optional interface for server funnels also processing the
+// "bandwidth exceeded" events. Funnels not implementing it
+// will silently discard those events.
+type ServerBandwidthFunnel interface {
+	BandwidthExceeded(*Server, *Attendant, Direction, uint64, uint64, time.Duration)
+}
+
+
+// Optional interface for server funnels also processing the
+// "event overflow" events. Funnels not implementing it will
+// silently discard those events.
+type ServerEventOverflowFunnel interface {
+	EventsOverflowed(*Server, *Attendant, uint64)
+}
+
+
+// Optional interface for server funnels also processing the
+// "authenticated" events. Funnels not implementing it will
+// silently discard those events.
+type ServerAuthFunnel interface {
+	AttendantAuthenticated(*Server, *Attendant)
+}
+
+
+// Optional interface for server funnels also processing the
+// "slow consumer" events. Funnels not implementing it will
+// silently discard those events.
+type ServerSlowConsumerFunnel interface {
+	SlowConsumer(*Server, *Attendant, bool, int, int)
+}
+
+
+// Optional interface for server funnels also processing the
+// "send failed" events. Funnels not implementing it will
+// silently discard those events. The failures of an attendant
+// are always processed before the stop they may have caused.
+type ServerSendFailedFunnel interface {
+	SendFailed(*Server, *Attendant, string, error)
+}
+
+
+// Optional interface for server funnels also processing the
+// "half closed" events. Funnels not implementing it will
+// silently discard those events. The pending messages are
+// always processed before a half-close.
+type ServerHalfClosedFunnel interface {
+	AttendantHalfClosed(*Server, *Attendant)
+}
+
+
+// Optional interface for server funnels also processing the
+// "message rejected" events. Funnels not implementing it will
+// silently discard those events.
+type ServerMessageRejectedFunnel interface {
+	MessageRejected(*Server, *Attendant, error)
+}
+
+
+// Optional interface for server funnels also processing the
+// "unresponsive" events. Funnels not implementing it will
+// silently discard those events.
+type ServerUnresponsiveFunnel interface {
+	Unresponsive(*Server, *Attendant, bool, time.Duration)
+}
+
+
+// Optional interface for server funnels also processing the
+// "connection rejected" events. Funnels not implementing it
+// will silently discard those events.
+type ServerConnectionRejectedFunnel interface {
+	ConnectionRejected(*Server, net.Addr, RejectReason)
+}
+
+
+// Optional interface for server funnels also processing the
+// "PROXY header rejected" events. Funnels not implementing it
+// will silently discard those events.
+type ServerProxyHeaderRejectedFunnel interface {
+	ProxyHeaderRejected(*Server, net.Addr, error)
+}
+
+
+// Optional interface for server funnels also processing the
+// "connection rate limited" events. Funnels not implementing
+// it will silently discard those events.
+type ServerConnectionRateLimitedFunnel interface {
+	ConnectionRateLimited(*Server, net.IP, uint64)
+}
+
+
 // Creates a funnel: runs a goroutine dispatching all the events from a server
 // to a given funnel object processing all the events. A funnel may be used by
 // several servers, but care should be taken, for race conditions will not be
@@ -238,7 +1048,7 @@ func FunnelServerWith(server *Server, funnel ServerFunnel) {
 		panic(ArgumentError{"Funnel:funnel"})
 	}
 
-	go func(server *Server) {
+	server.resources.spawn(func() {
 		Loop: for {
 			select {
 			case event := <-server.StartedEvent():
@@ -254,9 +1064,74 @@ func FunnelServerWith(server *Server, funnel ServerFunnel) {
 				funnel.MessageArrived(server, event.Attendant, event.Message)
 			case event := <-server.ThrottledEvent():
 				funnel.MessageThrottled(server, event.Attendant, event.Message, event.Instant, event.Lapse)
+			case event := <-server.SendFailedEvent():
+				if sendFailedFunnel, ok := funnel.(ServerSendFailedFunnel); ok {
+					sendFailedFunnel.SendFailed(server, event.Attendant, event.Command, event.Error)
+				}
+			case event := <-server.MessageRejectedEvent():
+				if rejectedFunnel, ok := funnel.(ServerMessageRejectedFunnel); ok {
+					rejectedFunnel.MessageRejected(server, event.Attendant, event.Error)
+				}
 			case event := <-server.AttendantStoppedEvent():
+				// The pending failures come first.
+				for pending := true; pending; {
+					select {
+					case failed := <-server.SendFailedEvent():
+						if sendFailedFunnel, ok := funnel.(ServerSendFailedFunnel); ok {
+							sendFailedFunnel.SendFailed(server, failed.Attendant, failed.Command, failed.Error)
+						}
+					default:
+						pending = false
+					}
+				}
 				funnel.AttendantStopped(server, event.Attendant, event.StopType, event.Error)
+			case event := <-server.BandwidthExceededEvent():
+				if bandwidthFunnel, ok := funnel.(ServerBandwidthFunnel); ok {
+					bandwidthFunnel.BandwidthExceeded(server, event.Attendant, event.Direction, event.Bytes, event.Limit, event.Window)
+				}
+			case event := <-server.EventOverflowEvent():
+				if overflowFunnel, ok := funnel.(ServerEventOverflowFunnel); ok {
+					overflowFunnel.EventsOverflowed(server, event.Attendant, event.Dropped)
+				}
+			case event := <-server.AuthenticatedEvent():
+				if authFunnel, ok := funnel.(ServerAuthFunnel); ok {
+					authFunnel.AttendantAuthenticated(server, event.Attendant)
+				}
+			case event := <-server.SlowConsumerEvent():
+				if slowFunnel, ok := funnel.(ServerSlowConsumerFunnel); ok {
+					slowFunnel.SlowConsumer(server, event.Attendant, event.Slow, event.PendingSends, event.PendingBytes)
+				}
+			case event := <-server.UnresponsiveEvent():
+				if unresponsiveFunnel, ok := funnel.(ServerUnresponsiveFunnel); ok {
+					unresponsiveFunnel.Unresponsive(server, event.Attendant, event.Unresponsive, event.SilentFor)
+				}
+			case event := <-server.ConnectionRejectedEvent():
+				if rejectedFunnel, ok := funnel.(ServerConnectionRejectedFunnel); ok {
+					rejectedFunnel.ConnectionRejected(server, event.Addr, event.Reason)
+				}
+			case event := <-server.ProxyHeaderRejectedEvent():
+				if proxyFunnel, ok := funnel.(ServerProxyHeaderRejectedFunnel); ok {
+					proxyFunnel.ProxyHeaderRejected(server, event.Addr, event.Error)
+				}
+			case event := <-server.ConnectionRateLimitedEvent():
+				if rateFunnel, ok := funnel.(ServerConnectionRateLimitedFunnel); ok {
+					rateFunnel.ConnectionRateLimited(server, event.IP, event.Count)
+				}
+			case event := <-server.HalfClosedEvent():
+				// The pending messages come first, so they may
+				// still be answered.
+				for pending := true; pending; {
+					select {
+					case arrived := <-server.MessageEvent():
+						funnel.MessageArrived(server, arrived.Attendant, arrived.Message)
+					default:
+						pending = false
+					}
+				}
+				if halfClosedFunnel, ok := funnel.(ServerHalfClosedFunnel); ok {
+					halfClosedFunnel.AttendantHalfClosed(server, event.Attendant)
+				}
 			}
 		}
-	}(server)
+	})
 }
\ No newline at end of file
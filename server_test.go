@@ -0,0 +1,400 @@
+package chasqui
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+func TestServerRunStopCyclesWithLiveClients(t *testing.T) {
+	server := newTestServer(16)
+	stopConsuming := consumeEvents(server)
+	defer stopConsuming()
+	var port int
+	for cycle := 0; cycle < 100; cycle++ {
+		if err := server.Run("127.0.0.1:" + strconv.Itoa(port)); err != nil {
+			t.Fatalf("cycle %d: run: %v", cycle, err)
+		}
+		// The same port is bound on every cycle, so a leaked
+		// listener fails the next run.
+		port = server.TCPAddr().Port
+		var conns []net.Conn
+		for index := 0; index < 3; index++ {
+			conn, _ := dialTest(t, server.TCPAddr())
+			conns = append(conns, conn)
+		}
+		within(t, 3*time.Second, "Stop", func() {
+			if err := server.Stop(); err != nil {
+				t.Errorf("cycle %d: stop: %v", cycle, err)
+			}
+		})
+		for _, conn := range conns {
+			// noinspection GoUnhandledErrorResult
+			conn.Close()
+		}
+	}
+	waitResourcesReleased(t, server)
+}
+
+
+func TestServerRunStopCyclesWithUnreadEvents(t *testing.T) {
+	// Nobody reads any event: once the channels are full,
+	// neither the accept loop nor the mapping lifecycle may
+	// block the next stop.
+	server := newTestServer(1)
+	for cycle := 0; cycle < 3; cycle++ {
+		if err := server.Run("127.0.0.1:0"); err != nil {
+			t.Fatalf("cycle %d: run: %v", cycle, err)
+		}
+		var conns []net.Conn
+		for index := 0; index < 3; index++ {
+			conn, _ := dialTest(t, server.TCPAddr())
+			conns = append(conns, conn)
+		}
+		within(t, 3*time.Second, "Stop", func() {
+			if err := server.Stop(); err != nil {
+				t.Errorf("cycle %d: stop: %v", cycle, err)
+			}
+		})
+		for _, conn := range conns {
+			// noinspection GoUnhandledErrorResult
+			conn.Close()
+		}
+	}
+	waitResourcesReleased(t, server)
+}
+
+
+func TestServerStopWhileClientsConnect(t *testing.T) {
+	for round := 0; round < 10; round++ {
+		server := newTestServer(1)
+		// The started events are taken slowly, so the attendants
+		// of the latest connections are still waiting to report
+		// their start when the server stops: they must be stopped
+		// anyway.
+		quit := make(chan struct{})
+		consumed := make(chan struct{})
+		go func() {
+			defer close(consumed)
+			for {
+				select {
+				case <-quit:
+					return
+				case <-server.AttendantStartedEvent():
+					time.Sleep(10 * time.Millisecond)
+				case <-server.AttendantStoppedEvent():
+				case <-server.StartedEvent():
+				case <-server.StoppedEvent():
+				}
+			}
+		}()
+		if err := server.Run("127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		var conns []net.Conn
+		for index := 0; index < 20; index++ {
+			conn, _ := dialTest(t, server.TCPAddr())
+			conns = append(conns, conn)
+		}
+		within(t, 3*time.Second, "Stop", func() {
+			// noinspection GoUnhandledErrorResult
+			server.Stop()
+		})
+		for _, conn := range conns {
+			// noinspection GoUnhandledErrorResult
+			conn.Close()
+		}
+		close(quit)
+		<-consumed
+		waitResourcesReleased(t, server)
+	}
+}
+
+
+// A funnel stopping the server when a message arrives.
+type stoppingFunnel struct {
+	stopped chan error
+}
+
+
+func (funnel stoppingFunnel) Started(*Server, *net.TCPAddr) {}
+
+
+func (funnel stoppingFunnel) AcceptFailed(*Server, error) {}
+
+
+func (funnel stoppingFunnel) Stopped(*Server) {}
+
+
+func (funnel stoppingFunnel) AttendantStarted(*Server, *Attendant) {}
+
+
+func (funnel stoppingFunnel) MessageArrived(server *Server, _ *Attendant, _ Message) {
+	funnel.stopped <- server.Stop()
+}
+
+
+func (funnel stoppingFunnel) MessageThrottled(*Server, *Attendant, Message, time.Time, time.Duration) {}
+
+
+func (funnel stoppingFunnel) AttendantStopped(*Server, *Attendant, AttendantStopType, error) {}
+
+
+func TestServerStopFromFunnel(t *testing.T) {
+	server := newTestServer(1)
+	funnel := stoppingFunnel{make(chan error, 1)}
+	FunnelServerWith(server, funnel)
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	for index := 0; index < 6; index++ {
+		conn, _ := dialTest(t, server.TCPAddr())
+		conns = append(conns, conn)
+	}
+	if _, err := server.WaitListening(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	conns[0].Write([]byte(`{"C":"STOP"}` + "\n"))
+	select {
+	case err := <-funnel.stopped:
+		if err != nil {
+			t.Fatalf("stop: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Stop called from the funnel did not return")
+	}
+	for _, conn := range conns {
+		// noinspection GoUnhandledErrorResult
+		conn.Close()
+	}
+}
+
+
+func TestServerEnumerateWhileConnectionsChurn(t *testing.T) {
+	server := newTestServer(16)
+	stopConsuming := consumeEvents(server)
+	defer stopConsuming()
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	addr := server.TCPAddr()
+	quit := make(chan struct{})
+	var group sync.WaitGroup
+	loop := func(step func()) {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for {
+				select {
+				case <-quit:
+					return
+				default:
+					step()
+				}
+			}
+		}()
+	}
+	for index := 0; index < 4; index++ {
+		loop(func() {
+			server.Enumerate(func(attendant *Attendant) {
+				// noinspection GoUnhandledErrorResult
+				attendant.Send("SHOUTED", Args{"churn"}, nil)
+			})
+		})
+	}
+	loop(func() {
+		server.Enumerate(func(attendant *Attendant) {
+			if attendant.ID() % 3 == 0 {
+				// noinspection GoUnhandledErrorResult
+				attendant.Stop()
+			}
+		})
+	})
+	for index := 0; index < 8; index++ {
+		loop(func() {
+			if conn, err := net.Dial("tcp", addr.String()); err == nil {
+				// noinspection GoUnhandledErrorResult
+				conn.SetReadDeadline(time.Now().Add(5 * time.Millisecond))
+				// noinspection GoUnhandledErrorResult
+				conn.Read(make([]byte, 64))
+				// noinspection GoUnhandledErrorResult
+				conn.Close()
+			}
+		})
+	}
+	time.Sleep(time.Second)
+	close(quit)
+	group.Wait()
+	within(t, 3*time.Second, "Stop", func() {
+		// noinspection GoUnhandledErrorResult
+		server.Stop()
+	})
+}
+
+
+func TestServerConcurrentStops(t *testing.T) {
+	server := newTestServer(4)
+	stopConsuming := consumeEvents(server)
+	defer stopConsuming()
+	for round := 0; round < 50; round++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		ran := make(chan error, 1)
+		go func() {
+			ran <- server.RunContext(ctx, "127.0.0.1:0")
+		}()
+		for server.runningCloser(false) == nil {
+			select {
+			case err := <-ran:
+				t.Fatalf("round %d: RunContext: %v", round, err)
+			default:
+				time.Sleep(time.Millisecond)
+			}
+		}
+		var stops int32
+		var group sync.WaitGroup
+		group.Add(4)
+		for index := 0; index < 4; index++ {
+			go func() {
+				defer group.Done()
+				if err := server.Stop(); err == nil {
+					atomic.AddInt32(&stops, 1)
+				} else if !errors.Is(err, ErrNotListening) {
+					t.Errorf("round %d: Stop: %v", round, err)
+				}
+			}()
+		}
+		cancel()
+		within(t, 3*time.Second, "stops", group.Wait)
+		var err error
+		within(t, 3*time.Second, "RunContext", func() {
+			err = <-ran
+		})
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Fatalf("round %d: RunContext returned %v", round, err)
+		}
+		// Exactly one stop succeeds: a user one (and RunContext
+		// returns nil), or the one of RunContext.
+		if stops > 1 || (stops == 1) != (err == nil) {
+			t.Fatalf("round %d: %d stops succeeded, RunContext returned %v", round, stops, err)
+		}
+	}
+}
+
+
+func TestAttendantByIDFollowsTheLifecycle(t *testing.T) {
+	// Only the first message passes the general throttle.
+	server := NewServer(&json.JSONMessageMarshaler{}, 16, 16, time.Hour)
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer server.Stop()
+	<-server.StartedEvent()
+	var previousID uint64
+	for round := 0; round < 2; round++ {
+		conn, _ := dialTest(t, server.TCPAddr())
+		var attendant *Attendant
+		select {
+		case event := <-server.AttendantStartedEvent():
+			attendant = event.Attendant
+			if event.AttendantID != attendant.ID() {
+				t.Fatalf("round %d: the started event tells ID %d, but the attendant has %d",
+					round, event.AttendantID, attendant.ID())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("round %d: no started event", round)
+		}
+		if attendant.ID() <= previousID {
+			t.Fatalf("round %d: ID %d is not above the previous one (%d)", round, attendant.ID(), previousID)
+		}
+		previousID = attendant.ID()
+		if found, ok := server.AttendantByID(attendant.ID()); !ok || found != attendant {
+			t.Fatalf("round %d: the started attendant must be found by ID, got: %v, %v", round, found, ok)
+		}
+
+		for index := 0; index < 2; index++ {
+			if _, err := conn.Write([]byte("{\"C\":\"MOVE\",\"A\":[],\"KWA\":{}}\n")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		select {
+		case event := <-server.MessageEvent():
+			if event.AttendantID != attendant.ID() {
+				t.Fatalf("round %d: the message event tells ID %d, expected %d", round, event.AttendantID, attendant.ID())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("round %d: no message event", round)
+		}
+		select {
+		case event := <-server.ThrottledEvent():
+			if event.AttendantID != attendant.ID() {
+				t.Fatalf("round %d: the throttled event tells ID %d, expected %d", round, event.AttendantID, attendant.ID())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("round %d: no throttled event", round)
+		}
+
+		// noinspection GoUnhandledErrorResult
+		conn.Close()
+		select {
+		case event := <-server.AttendantStoppedEvent():
+			if event.AttendantID != attendant.ID() {
+				t.Fatalf("round %d: the stopped event tells ID %d, expected %d", round, event.AttendantID, attendant.ID())
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("round %d: no stopped event", round)
+		}
+		if found, ok := server.AttendantByID(attendant.ID()); ok {
+			t.Fatalf("round %d: the stopped attendant must not be found by ID, got: %v", round, found)
+		}
+	}
+}
+
+
+func TestAttendantIDsAreUniqueUnderConcurrency(t *testing.T) {
+	const workers = 8
+	const perWorker = 250
+	ids := make(chan uint64, workers * perWorker)
+	var group sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for index := 0; index < perWorker; index++ {
+				local, remote := net.Pipe()
+				attendant := NewAttendant(
+					local, &json.JSONMessageMarshaler{}, 0, make(chan AttendantStartedEvent, 1),
+					make(chan AttendantStoppedEvent, 1), make(chan MessageEvent, 1), make(chan ThrottledEvent, 1),
+				)
+				ids <- attendant.ID()
+				// noinspection GoUnhandledErrorResult
+				local.Close()
+				// noinspection GoUnhandledErrorResult
+				remote.Close()
+			}
+		}()
+	}
+	group.Wait()
+	close(ids)
+	seen := make(map[uint64]bool, workers * perWorker)
+	for id := range ids {
+		if id == 0 || seen[id] {
+			t.Fatalf("ID %d is zero or was given twice", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != workers * perWorker {
+		t.Fatalf("expected %d IDs, got %d", workers * perWorker, len(seen))
+	}
+}
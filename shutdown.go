@@ -0,0 +1,98 @@
+package chasqui
+
+import (
+	"context"
+	"fmt"
+)
+
+
+// Error returned by Shutdown when some attendants did not stop
+// on their own before the context was done, and were stopped
+// forcefully. It unwraps to the error of the context.
+type ShutdownForcedError struct {
+	Forced int
+	Err    error
+}
+
+
+// The error message.
+func (err ShutdownForcedError) Error() string {
+	return fmt.Sprintf("server shutdown forced %d attendant(s) to stop: %v", err.Forced, err.Err)
+}
+
+
+// Returns the error of the context.
+func (err ShutdownForcedError) Unwrap() error {
+	return err.Err
+}
+
+
+// Hooks run for each running attendant when the server shuts
+// down (see WithShutdownNotice).
+type ShutdownNoticeFunc func(attendant *Attendant)
+
+
+// Gracefully stops the server: it stops accepting connections
+// (leaving the current ones alone), runs the shutdown notice
+// (if any, see WithShutdownNotice) for each running attendant,
+// and waits for all of them to stop on their own (e.g. once
+// their peers disconnect) until the context is done. The ones
+// still running by then are stopped forcefully, and a
+// ShutdownForcedError telling how many they were is returned.
+// Then, the server stops as Stop does.
+func (server *Server) Shutdown(ctx context.Context) error {
+	if ctx == nil {
+		panic(ArgumentError{"Shutdown:ctx"})
+	}
+	closer := server.runningCloser(true)
+	if closer == nil {
+		return DispatcherNotListeningError(true)
+	}
+	closer()
+	server.logger.Infof("server shutting down")
+	attendants := server.runningAttendants()
+	if server.shutdownNotice != nil {
+		for _, attendant := range attendants {
+			attendant := attendant
+			if err := runTeardownCallback(func() error {
+				server.shutdownNotice(attendant)
+				return nil
+			}); err != nil {
+				server.logger.Errorf("server shutdown notice failed for attendant %d: %v", attendant.id, err)
+			}
+		}
+	}
+	forced := 0
+	for _, attendant := range attendants {
+		select {
+		case <-attendant.done:
+			continue
+		case <-ctx.Done():
+		}
+		select {
+		case <-attendant.done:
+		default:
+			// noinspection GoUnhandledErrorResult
+			attendant.Stop()
+			forced++
+		}
+	}
+	err := server.Stop()
+	if forced > 0 {
+		server.logger.Warnf("server shutdown forced %d attendant(s) to stop", forced)
+		return ShutdownForcedError{forced, ctx.Err()}
+	}
+	return err
+}
+
+
+// Returns the attendants running right now.
+func (server *Server) runningAttendants() []*Attendant {
+	server.attendantsMutex.RLock()
+	defer server.attendantsMutex.RUnlock()
+	attendants := make([]*Attendant, 0, len(server.attendantsByID))
+	for _, attendant := range server.attendantsByID {
+		attendants = append(attendants, attendant)
+	}
+	return attendants
+}
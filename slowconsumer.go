@@ -0,0 +1,148 @@
+package chasqui
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+
+// Event reporting an attendant became a slow consumer (its
+// pending sends stayed above the threshold for longer than
+// the grace period), or stopped being one (Slow is false).
+// It tells the pending sends and bytes at that moment, and
+// how long the condition lasted.
+type SlowConsumerEvent struct {
+	Attendant    *Attendant
+	AttendantID  uint64
+	Slow         bool
+	PendingSends int
+	PendingBytes int
+	Duration     time.Duration
+}
+
+
+// The slow consumer detection of an attendant: the threshold
+// of pending sends, the grace period, the signals to stop the
+// monitor loop and to tell it finished, and whether it is
+// currently a slow consumer.
+type slowConsumerState struct {
+	threshold int
+	grace     time.Duration
+	slow      int32
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+
+// Returns the number of messages sent but not written yet:
+// the ones waiting in the outgoing queue (if any), and the
+// ones waiting for (or in the middle of) a direct write.
+func (attendant *Attendant) PendingSends() int {
+	return attendant.QueuedSends() + int(atomic.LoadInt64(&attendant.inflightSends))
+}
+
+
+// Returns the number of bytes handed to the connection but not
+// written yet (e.g. because the peer stopped reading). Queued
+// messages are not counted, since their size is only known once
+// they are encoded.
+func (attendant *Attendant) PendingBytes() int {
+	return int(atomic.LoadInt64(&attendant.stats.pendingBytes))
+}
+
+
+// Tells whether the attendant is currently a slow consumer.
+// Attendants without slow consumer detection never are.
+func (attendant *Attendant) SlowConsumer() bool {
+	return attendant.slowConsumer != nil && atomic.LoadInt32(&attendant.slowConsumer.slow) == 1
+}
+
+
+// Returns a read-only channel with all the "slow consumer"
+// events. It will be nil unless a channel was given on
+// construction.
+func (attendant *Attendant) SlowConsumerEvent() <-chan SlowConsumerEvent {
+	return attendant.slowConsumerEvent
+}
+
+
+// The monitor loop checks the pending sends periodically (once
+// past the jitter offset of the attendant), and triggers the
+// slow consumer events on each change.
+func (attendant *Attendant) slowConsumerLoop() {
+	state := attendant.slowConsumer
+	defer close(state.done)
+	period := state.grace / 4
+	if period < 10 * time.Millisecond {
+		period = 10 * time.Millisecond
+	}
+	attendant.resources.addTimers(1)
+	defer attendant.resources.addTimers(-1)
+	if !attendant.awaitJitter(period, state.quit) {
+		return
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	var above time.Time
+	for {
+		select {
+		case now := <-ticker.C:
+			pending := attendant.PendingSends()
+			slow := atomic.LoadInt32(&state.slow) == 1
+			if pending <= state.threshold {
+				if slow {
+					atomic.StoreInt32(&state.slow, 0)
+					if !attendant.emitSlowConsumer(false, now.Sub(above)) {
+						return
+					}
+				}
+				above = time.Time{}
+			} else if above.IsZero() {
+				above = now
+			} else if !slow && now.Sub(above) >= state.grace {
+				atomic.StoreInt32(&state.slow, 1)
+				if !attendant.emitSlowConsumer(true, now.Sub(above)) {
+					return
+				}
+			}
+		case <-state.quit:
+			return
+		}
+	}
+}
+
+
+// Triggers a slow consumer event, unless there is no channel
+// for them. Gives up (returning false) if the monitor loop is
+// told to finish meanwhile.
+func (attendant *Attendant) emitSlowConsumer(slow bool, duration time.Duration) bool {
+	if attendant.slowConsumerEvent == nil && !attendant.unified() {
+		return true
+	}
+	event := SlowConsumerEvent{
+		attendant, attendant.id, slow, attendant.PendingSends(), attendant.PendingBytes(), duration,
+	}
+	if attendant.unified() {
+		return attendant.emitUnified(event, attendant.slowConsumer.quit)
+	}
+	select {
+	case attendant.slowConsumerEvent <- event:
+		return true
+	case <-attendant.slowConsumer.quit:
+		return false
+	}
+}
+
+
+// Registers the teardown callback of the slow consumer
+// detection: the monitor loop is stopped once the connection
+// is released.
+func (attendant *Attendant) registerSlowConsumerTeardown() {
+	attendant.teardown.register(TeardownReleaseResources, func() error {
+		if state := attendant.slowConsumer; state != nil {
+			close(state.quit)
+			<-state.done
+		}
+		return nil
+	})
+}
@@ -0,0 +1,107 @@
+package chasqui
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+
+// The size of the chunks the connection is written in, so
+// the progress of large writes can be told apart from total
+// stalls (see Attendant.SetWriteStallTimeout).
+const stallChunkSize = 16 * 1024
+
+
+// Error used to abort an attendant whose write made no
+// progress at all for too long (see SetWriteStallTimeout).
+type WriteStalledError struct {
+	Stalled time.Duration
+}
+
+
+// The error message.
+func (err WriteStalledError) Error() string {
+	return fmt.Sprintf("write stalled for %s", err.Stalled)
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err WriteStalledError) Is(target error) bool {
+	return target == ErrWriteStalled
+}
+
+
+// The watchdog of a single write: it checks the write progress
+// once the stall timeout elapses, and either aborts the
+// attendant (no progress at all) or checks again later.
+type stallWatchdog struct {
+	mutex    sync.Mutex
+	timer    *time.Timer
+	finished bool
+}
+
+
+// Gets the write stall timeout for the current attendant.
+func (attendant *Attendant) WriteStallTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&attendant.stallTimeout))
+}
+
+
+// Sets the write stall timeout for the current attendant. When
+// a single write makes no progress at all (e.g. the peer window
+// is zero) for this time, the connection is closed from another
+// goroutine so the write fails right away, and the attendant is
+// stopped abnormally with a WriteStalledError. Writes that are
+// slow but keep progressing are not stopped (unlike with the
+// write timeout). Zero means no stall detection. Negative
+// timeouts will be negated, to positive.
+func (attendant *Attendant) SetWriteStallTimeout(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = -timeout
+	}
+	atomic.StoreInt64(&attendant.stallTimeout, int64(timeout))
+}
+
+
+// Starts watching the write about to happen, if the attendant
+// has a stall timeout. Returns the function to stop watching
+// it, once the write finished.
+func (attendant *Attendant) watchStall() func() {
+	timeout := attendant.WriteStallTimeout()
+	if timeout == 0 {
+		return func() {}
+	}
+	atomic.StoreInt64(&attendant.stats.progressAt, time.Now().UnixNano())
+	watchdog := &stallWatchdog{}
+	attendant.resources.addTimers(1)
+	check := func() {
+		watchdog.mutex.Lock()
+		defer watchdog.mutex.Unlock()
+		if watchdog.finished {
+			return
+		}
+		stalled := time.Since(time.Unix(0, atomic.LoadInt64(&attendant.stats.progressAt)))
+		if stalled >= timeout {
+			watchdog.finished = true
+			attendant.resources.addTimers(-1)
+			attendant.logger.Warnf("attendant %d write stalled for %s", attendant.id, stalled)
+			attendant.abort(WriteStalledError{stalled})
+		} else {
+			watchdog.timer.Reset(timeout - stalled)
+		}
+	}
+	watchdog.mutex.Lock()
+	watchdog.timer = time.AfterFunc(timeout, check)
+	watchdog.mutex.Unlock()
+	return func() {
+		watchdog.mutex.Lock()
+		defer watchdog.mutex.Unlock()
+		if !watchdog.finished {
+			watchdog.finished = true
+			watchdog.timer.Stop()
+			attendant.resources.addTimers(-1)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package chasqui
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+
+// A snapshot of the traffic of an attendant: the messages
+// and bytes received and sent, the throttled messages, the
+// instants it started and stopped (zero until then), and
+// the time it has been (or was) running. Bytes are counted
+// as read from and written to the connection.
+type AttendantStats struct {
+	MessagesIn  uint64
+	MessagesOut uint64
+	BytesIn     uint64
+	BytesOut    uint64
+	Throttled   uint64
+	StartedAt   time.Time
+	StoppedAt   time.Time
+	Uptime      time.Duration
+}
+
+
+// The traffic counters of an attendant. The instants are
+// kept in unix nanoseconds, and zero means not yet. The
+// bytes being written right now, and the instant of the
+// last write progress, are also tracked.
+type attendantStats struct {
+	messagesIn     uint64
+	messagesOut    uint64
+	bytesIn        uint64
+	bytesOut       uint64
+	throttled      uint64
+	startedAt      int64
+	stoppedAt      int64
+	lastReceivedAt int64
+	lastSentAt     int64
+	progressAt     int64
+	pendingBytes   int64
+}
+
+
+// Converts an instant kept in unix nanoseconds, where zero
+// means the zero time.
+func unixInstant(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+
+// Takes a snapshot of the counters.
+func (stats *attendantStats) snapshot(now time.Time) AttendantStats {
+	snapshot := AttendantStats{
+		MessagesIn:  atomic.LoadUint64(&stats.messagesIn),
+		MessagesOut: atomic.LoadUint64(&stats.messagesOut),
+		BytesIn:     atomic.LoadUint64(&stats.bytesIn),
+		BytesOut:    atomic.LoadUint64(&stats.bytesOut),
+		Throttled:   atomic.LoadUint64(&stats.throttled),
+	}
+	if startedAt := atomic.LoadInt64(&stats.startedAt); startedAt != 0 {
+		snapshot.StartedAt = time.Unix(0, startedAt)
+		if stoppedAt := atomic.LoadInt64(&stats.stoppedAt); stoppedAt != 0 {
+			snapshot.StoppedAt = time.Unix(0, stoppedAt)
+			snapshot.Uptime = snapshot.StoppedAt.Sub(snapshot.StartedAt)
+		} else {
+			snapshot.Uptime = now.Sub(snapshot.StartedAt)
+		}
+	}
+	return snapshot
+}
+
+
+// A connection counting the bytes read and written. It keeps
+// all the other methods of the connection.
+type countedConnection struct {
+	net.Conn
+	stats *attendantStats
+}
+
+
+// Reads from the connection, counting the bytes.
+func (connection countedConnection) Read(data []byte) (int, error) {
+	n, err := connection.Conn.Read(data)
+	atomic.AddUint64(&connection.stats.bytesIn, uint64(n))
+	return n, err
+}
+
+
+// Writes to the connection, counting the bytes (and the
+// ones pending meanwhile). Data is written in chunks, and
+// the progress is noted after each one.
+func (connection countedConnection) Write(data []byte) (int, error) {
+	atomic.AddInt64(&connection.stats.pendingBytes, int64(len(data)))
+	defer atomic.AddInt64(&connection.stats.pendingBytes, -int64(len(data)))
+	written := 0
+	for written < len(data) {
+		end := written + stallChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		n, err := connection.Conn.Write(data[written:end])
+		written += n
+		atomic.AddUint64(&connection.stats.bytesOut, uint64(n))
+		atomic.StoreInt64(&connection.stats.progressAt, time.Now().UnixNano())
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+
+// Returns a snapshot of the traffic of this attendant. It is
+// safe to call it from any goroutine.
+func (attendant *Attendant) Stats() AttendantStats {
+	return attendant.stats.snapshot(time.Now())
+}
+
+
+// Returns the instants this attendant last received and last
+// sent a message (keepalive messages included). They are zero
+// until the first message is received or sent, respectively.
+// It is safe to call it from any goroutine.
+func (attendant *Attendant) LastActivity() (received, sent time.Time) {
+	return unixInstant(atomic.LoadInt64(&attendant.stats.lastReceivedAt)),
+		unixInstant(atomic.LoadInt64(&attendant.stats.lastSentAt))
+}
+
+
+// Returns the instant of the last activity of this attendant
+// (received or sent message), or the instant it started if
+// there was no activity at all yet.
+func (attendant *Attendant) lastActiveAt() time.Time {
+	received, sent := attendant.LastActivity()
+	if sent.After(received) {
+		received = sent
+	}
+	if received.IsZero() {
+		return unixInstant(atomic.LoadInt64(&attendant.stats.startedAt))
+	}
+	return received
+}
+
+
+// Returns the running attendants with no activity (neither
+// received nor sent messages) for at least the given time.
+// Attendants with no activity at all count since they started.
+func (server *Server) IdleAttendants(olderThan time.Duration) []*Attendant {
+	limit := time.Now().Add(-olderThan)
+	var idle []*Attendant
+	server.attendantsMutex.RLock()
+	defer server.attendantsMutex.RUnlock()
+	for _, attendant := range server.attendantsByID {
+		if !attendant.lastActiveAt().After(limit) {
+			idle = append(idle, attendant)
+		}
+	}
+	return idle
+}
+
+
+// Returns the sum of the traffic of all the current attendants.
+// StartedAt and Uptime are the ones of the oldest attendant.
+func (server *Server) AggregateStats() AttendantStats {
+	aggregate := AttendantStats{}
+	now := time.Now()
+	server.Enumerate(func(attendant *Attendant) {
+		stats := attendant.stats.snapshot(now)
+		aggregate.MessagesIn += stats.MessagesIn
+		aggregate.MessagesOut += stats.MessagesOut
+		aggregate.BytesIn += stats.BytesIn
+		aggregate.BytesOut += stats.BytesOut
+		aggregate.Throttled += stats.Throttled
+		if stats.Uptime > aggregate.Uptime {
+			aggregate.StartedAt, aggregate.Uptime = stats.StartedAt, stats.Uptime
+		}
+	})
+	return aggregate
+}
@@ -0,0 +1,189 @@
+package chasqui
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// Encodes the messages as the JSON marshaler writes them in
+// a row, returning the whole stream.
+func encodeJSONStream(t *testing.T, commands ...string) string {
+	t.Helper()
+	buffer := &strings.Builder{}
+	marshaler := (&json.JSONMessageMarshaler{}).Create(nopReadWriter{buffer})
+	for _, command := range commands {
+		if err := marshaler.Send(command, Args{command}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buffer.String()
+}
+
+
+// A writer counting the bytes written to it.
+type byteCounter struct {
+	count int64
+}
+
+
+func (counter *byteCounter) Write(data []byte) (int, error) {
+	atomic.AddInt64(&counter.count, int64(len(data)))
+	return len(data), nil
+}
+
+
+// Waits until the condition holds, failing the test otherwise.
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s did not happen", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+
+func TestStatsAfterScriptedExchange(t *testing.T) {
+	local, remote := net.Pipe()
+	// noinspection GoUnhandledErrorResult
+	defer remote.Close()
+	received := &byteCounter{}
+	go func() {
+		// noinspection GoUnhandledErrorResult
+		io.Copy(received, remote)
+	}()
+	messages := make(chan MessageEvent, 4)
+	throttled := make(chan ThrottledEvent, 4)
+	stopped := make(chan AttendantStoppedEvent, 1)
+	// Only the first message passes the general throttle.
+	attendant := NewAttendant(
+		local, &json.JSONMessageMarshaler{}, time.Hour, make(chan AttendantStartedEvent, 1), stopped,
+		messages, throttled,
+	)
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := attendant.Stats(); stats.StartedAt.IsZero() || !stats.StoppedAt.IsZero() {
+		t.Fatalf("a running attendant must have only a start instant: %+v", stats)
+	}
+
+	inbound := encodeJSONStream(t, "MOVE", "MOVE", "MOVE")
+	if _, err := remote.Write([]byte(inbound)); err != nil {
+		t.Fatal(err)
+	}
+	within(t, 2 * time.Second, "the inbound messages", func() {
+		<-messages
+		<-throttled
+		<-throttled
+	})
+	for _, command := range []string{"PONG", "PONG"} {
+		if err := attendant.Send(command, Args{command}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outbound := encodeJSONStream(t, "PONG", "PONG")
+	eventually(t, "the outbound bytes arrival", func() bool {
+		return atomic.LoadInt64(&received.count) == int64(len(outbound))
+	})
+
+	stats := attendant.Stats()
+	expected := AttendantStats{
+		MessagesIn: 3, MessagesOut: 2, BytesIn: uint64(len(inbound)), BytesOut: uint64(len(outbound)), Throttled: 2,
+	}
+	if stats.MessagesIn != expected.MessagesIn || stats.MessagesOut != expected.MessagesOut ||
+		stats.BytesIn != expected.BytesIn || stats.BytesOut != expected.BytesOut ||
+		stats.Throttled != expected.Throttled {
+		t.Fatalf("unexpected counters: %+v, expected: %+v", stats, expected)
+	}
+	if stats.Uptime <= 0 {
+		t.Fatalf("a running attendant must have some uptime: %v", stats.Uptime)
+	}
+
+	// noinspection GoUnhandledErrorResult
+	remote.Close()
+	var event AttendantStoppedEvent
+	within(t, 2 * time.Second, "the stopped event", func() {
+		event = <-stopped
+	})
+	final := event.Stats
+	if final.MessagesIn != expected.MessagesIn || final.MessagesOut != expected.MessagesOut ||
+		final.BytesIn != expected.BytesIn || final.BytesOut != expected.BytesOut ||
+		final.Throttled != expected.Throttled {
+		t.Fatalf("unexpected final counters: %+v, expected: %+v", final, expected)
+	}
+	if !final.StartedAt.Equal(stats.StartedAt) || final.StoppedAt.IsZero() ||
+		final.Uptime != final.StoppedAt.Sub(final.StartedAt) {
+		t.Fatalf("the final snapshot must be complete: %+v", final)
+	}
+	// The snapshot is frozen after the stop.
+	time.Sleep(10 * time.Millisecond)
+	if later := attendant.Stats(); later != final {
+		t.Fatalf("the stats changed after the stop: %+v, then: %+v", final, later)
+	}
+}
+
+
+func TestAggregateStatsSumsCurrentAttendants(t *testing.T) {
+	server := newTestServer(16)
+	watch := watchServer(server, 4)
+	defer watch.stop()
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer server.Stop()
+	first, _ := dialTest(t, server.TCPAddr())
+	// noinspection GoUnhandledErrorResult
+	defer first.Close()
+	second, _ := dialTest(t, server.TCPAddr())
+	// noinspection GoUnhandledErrorResult
+	defer second.Close()
+	var attendants []*Attendant
+	for index := 0; index < 2; index++ {
+		attendants = append(attendants, <-watch.started)
+	}
+
+	firstStream := encodeJSONStream(t, "MOVE", "MOVE")
+	secondStream := encodeJSONStream(t, "MOVE", "MOVE", "MOVE")
+	for _, write := range []struct {
+		conn   net.Conn
+		stream string
+	}{{first, firstStream}, {second, secondStream}} {
+		if _, err := write.conn.Write([]byte(write.stream)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, "the aggregate of both attendants", func() bool {
+		return server.AggregateStats().MessagesIn == 5
+	})
+	aggregate := server.AggregateStats()
+	if aggregate.BytesIn != uint64(len(firstStream) + len(secondStream)) || aggregate.MessagesOut != 0 {
+		t.Fatalf("unexpected aggregate: %+v", aggregate)
+	}
+	for _, attendant := range attendants {
+		if stats := attendant.Stats(); stats.StartedAt.Before(aggregate.StartedAt) {
+			t.Fatalf("the aggregate must start with the oldest attendant: %v, but %v is older",
+				aggregate.StartedAt, stats.StartedAt)
+		}
+	}
+
+	// Stopped attendants are no longer part of the aggregate.
+	// noinspection GoUnhandledErrorResult
+	first.Close()
+	within(t, 2 * time.Second, "the stopped event", func() {
+		<-watch.stopped
+	})
+	eventually(t, "the aggregate of the remaining attendant", func() bool {
+		return server.AggregateStats().MessagesIn == 3
+	})
+}
@@ -0,0 +1,79 @@
+package chasqui
+
+import (
+	"fmt"
+	"sync"
+)
+
+
+// Hooks run when an attendant stops, with the stop type and
+// error (see OnStop).
+type StopHookFunc func(attendant *Attendant, stopType AttendantStopType, err error)
+
+
+// The stop hooks of an attendant, in registration order, and
+// whether they ran already.
+type stopHooks struct {
+	mutex sync.Mutex
+	hooks []StopHookFunc
+	ran   bool
+}
+
+
+// Registers a hook to run when the attendant stops, for any
+// cause (e.g. to release the application state attached to
+// it). Hooks run synchronously, once the attendant is marked
+// as stopped and before the stopped event is triggered (in the
+// PersistHooks teardown phase), in reverse registration order.
+// A panicking hook does not prevent the others from running
+// (the panic is logged, and reported among the teardown
+// errors). Hooks registered once the attendant stopped run
+// right away, in the calling goroutine. Attendants stopped
+// before starting run their hooks with a local stop.
+func (attendant *Attendant) OnStop(hook StopHookFunc) {
+	if hook == nil {
+		panic(ArgumentError{"OnStop:hook"})
+	}
+	attendant.stopHooks.mutex.Lock()
+	if !attendant.stopHooks.ran {
+		attendant.stopHooks.hooks = append(attendant.stopHooks.hooks, hook)
+		attendant.stopHooks.mutex.Unlock()
+		return
+	}
+	attendant.stopHooks.mutex.Unlock()
+	// noinspection GoUnhandledErrorResult
+	attendant.runStopHook(hook, attendant.stopType, attendant.stopError)
+}
+
+
+// Runs the registered hooks, in reverse registration order.
+// Returns the first failure, if any.
+func (attendant *Attendant) runStopHooks(stopType AttendantStopType, stopError error) error {
+	attendant.stopHooks.mutex.Lock()
+	hooks := attendant.stopHooks.hooks
+	attendant.stopHooks.hooks = nil
+	attendant.stopHooks.ran = true
+	attendant.stopHooks.mutex.Unlock()
+	var first error
+	for index := len(hooks) - 1; index >= 0; index-- {
+		if err := attendant.runStopHook(hooks[index], stopType, stopError); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+
+// Runs a single hook, converting panics into errors (which
+// are logged).
+func (attendant *Attendant) runStopHook(hook StopHookFunc, stopType AttendantStopType, stopError error) error {
+	err := runTeardownCallback(func() error {
+		hook(attendant, stopType, stopError)
+		return nil
+	})
+	if err != nil {
+		attendant.logger.Errorf("attendant %d stop hook failed: %v", attendant.id, err)
+		return fmt.Errorf("stop hook failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package chasqui
+
+import (
+	. "github.com/universe-10th/chasqui/types"
+	"sort"
+	"sync"
+)
+
+
+// The tags of an attendant, and the index (of its server, if
+// any) they are kept in. Once the attendant is detached from
+// the index (i.e. it stopped), tags are not indexed anymore.
+type tagState struct {
+	mutex    sync.Mutex
+	tags     map[string]bool
+	index    *tagIndex
+	detached bool
+}
+
+
+// The tag index of a server: the attendants by tag.
+type tagIndex struct {
+	mutex sync.RWMutex
+	byTag map[string]map[*Attendant]bool
+}
+
+
+// Adds an attendant to a tag in the index.
+func (index *tagIndex) add(tag string, attendant *Attendant) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if index.byTag == nil {
+		index.byTag = make(map[string]map[*Attendant]bool)
+	}
+	attendants, ok := index.byTag[tag]
+	if !ok {
+		attendants = make(map[*Attendant]bool)
+		index.byTag[tag] = attendants
+	}
+	attendants[attendant] = true
+}
+
+
+// Removes an attendant from a tag in the index, forgetting
+// the tag once it has no attendants.
+func (index *tagIndex) remove(tag string, attendant *Attendant) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+	if attendants, ok := index.byTag[tag]; ok {
+		delete(attendants, attendant)
+		if len(attendants) == 0 {
+			delete(index.byTag, tag)
+		}
+	}
+}
+
+
+// Returns a snapshot of the attendants having a tag.
+func (index *tagIndex) snapshot(tag string) []*Attendant {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+	attendants := make([]*Attendant, 0, len(index.byTag[tag]))
+	for attendant := range index.byTag[tag] {
+		attendants = append(attendants, attendant)
+	}
+	return attendants
+}
+
+
+// Adds a tag to the attendant (e.g. "room:lobby" or "admin"),
+// so its server can target it by that tag. Adding a tag the
+// attendant already has does nothing.
+func (attendant *Attendant) AddTag(tag string) {
+	attendant.tags.mutex.Lock()
+	defer attendant.tags.mutex.Unlock()
+	if attendant.tags.tags == nil {
+		attendant.tags.tags = make(map[string]bool)
+	}
+	if !attendant.tags.tags[tag] {
+		attendant.tags.tags[tag] = true
+		if attendant.tags.index != nil && !attendant.tags.detached {
+			attendant.tags.index.add(tag, attendant)
+		}
+	}
+}
+
+
+// Removes a tag from the attendant. Removing a tag the
+// attendant does not have does nothing.
+func (attendant *Attendant) RemoveTag(tag string) {
+	attendant.tags.mutex.Lock()
+	defer attendant.tags.mutex.Unlock()
+	if attendant.tags.tags[tag] {
+		delete(attendant.tags.tags, tag)
+		if attendant.tags.index != nil && !attendant.tags.detached {
+			attendant.tags.index.remove(tag, attendant)
+		}
+	}
+}
+
+
+// Tells whether the attendant has a tag.
+func (attendant *Attendant) HasTag(tag string) bool {
+	attendant.tags.mutex.Lock()
+	defer attendant.tags.mutex.Unlock()
+	return attendant.tags.tags[tag]
+}
+
+
+// Returns the tags of the attendant, sorted.
+func (attendant *Attendant) Tags() []string {
+	attendant.tags.mutex.Lock()
+	defer attendant.tags.mutex.Unlock()
+	tags := make([]string, 0, len(attendant.tags.tags))
+	for tag := range attendant.tags.tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+
+// Removes the attendant from the index of its server, for
+// good. Its tags are kept, but not indexed anymore.
+func (attendant *Attendant) detachTags() {
+	attendant.tags.mutex.Lock()
+	defer attendant.tags.mutex.Unlock()
+	if attendant.tags.index != nil && !attendant.tags.detached {
+		for tag := range attendant.tags.tags {
+			attendant.tags.index.remove(tag, attendant)
+		}
+	}
+	attendant.tags.detached = true
+}
+
+
+// Enumerates the running attendants having a tag, using a
+// callback. The callback runs over a snapshot, so it may add
+// or remove tags freely.
+func (server *Server) EnumerateTagged(tag string, callback func(*Attendant)) {
+	for _, attendant := range server.tags.snapshot(tag) {
+		callback(attendant)
+	}
+}
+
+
+// Sends a message to all the running attendants having a tag
+// (a snapshot of them, taken when called), as Broadcast does.
+// Attendants which stop meanwhile are skipped, instead of being
+// told as failures.
+func (server *Server) BroadcastTagged(tag string, command string, args Args, kwargs KWArgs) BroadcastResult {
+	return broadcastTo(server.tags.snapshot(tag), command, args, kwargs)
+}
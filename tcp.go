@@ -0,0 +1,123 @@
+package chasqui
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+
+// The TCP tuning of a connection. It is applied as a whole:
+// NoDelay (disabling Nagle's algorithm) and KeepAlive are
+// always set, while the keepalive period and the buffer
+// sizes are only set when positive (keeping the OS defaults
+// otherwise).
+type TCPTuning struct {
+	NoDelay         bool
+	KeepAlive       bool
+	KeepAlivePeriod time.Duration
+	ReadBuffer      int
+	WriteBuffer     int
+}
+
+
+// Connections that can be tuned, like *net.TCPConn.
+type tcpTunable interface {
+	SetNoDelay(bool) error
+	SetKeepAlive(bool) error
+	SetKeepAlivePeriod(time.Duration) error
+	SetReadBuffer(int) error
+	SetWriteBuffer(int) error
+}
+
+
+// Connections wrapping another one, like *tls.Conn.
+type netConnWrapper interface {
+	NetConn() net.Conn
+}
+
+
+// The TCP tuning state of an attendant: the tuning to apply
+// on start (nil means none), and whether it was applied.
+type tcpTuningState struct {
+	mutex   sync.Mutex
+	tuning  *TCPTuning
+	applied bool
+}
+
+
+// Gets the tunable connection under the given one, if any.
+func tunableConnection(connection net.Conn) (tcpTunable, bool) {
+	for {
+		if tunable, ok := connection.(tcpTunable); ok {
+			return tunable, true
+		} else if wrapper, ok := connection.(netConnWrapper); ok {
+			connection = wrapper.NetConn()
+		} else {
+			return nil, false
+		}
+	}
+}
+
+
+// Applies a tuning to a connection. Returns the first error,
+// if any, after trying all the settings.
+func (tuning TCPTuning) apply(tunable tcpTunable) error {
+	var errs []error
+	errs = append(errs, tunable.SetNoDelay(tuning.NoDelay), tunable.SetKeepAlive(tuning.KeepAlive))
+	if tuning.KeepAlive && tuning.KeepAlivePeriod > 0 {
+		errs = append(errs, tunable.SetKeepAlivePeriod(tuning.KeepAlivePeriod))
+	}
+	if tuning.ReadBuffer > 0 {
+		errs = append(errs, tunable.SetReadBuffer(tuning.ReadBuffer))
+	}
+	if tuning.WriteBuffer > 0 {
+		errs = append(errs, tunable.SetWriteBuffer(tuning.WriteBuffer))
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+
+// Sets the TCP tuning to apply to the connection when the
+// attendant starts. Connections that are not TCP (nor wrap
+// a TCP one, like TLS connections do) are not tuned at all.
+// Fails if the attendant was already started.
+func (attendant *Attendant) SetTCPTuning(tuning TCPTuning) error {
+	if attendant.Status() != AttendantNew {
+		return AttendantIsNotNew(true)
+	}
+	attendant.tcpTuning.mutex.Lock()
+	defer attendant.tcpTuning.mutex.Unlock()
+	attendant.tcpTuning.tuning = &tuning
+	return nil
+}
+
+
+// Returns the TCP tuning of the attendant, and whether it
+// was effectively applied to its connection.
+func (attendant *Attendant) TCPTuning() (TCPTuning, bool) {
+	attendant.tcpTuning.mutex.Lock()
+	defer attendant.tcpTuning.mutex.Unlock()
+	if attendant.tcpTuning.tuning == nil {
+		return TCPTuning{}, false
+	}
+	return *attendant.tcpTuning.tuning, attendant.tcpTuning.applied
+}
+
+
+// Applies the TCP tuning, if any and possible, on start.
+func (attendant *Attendant) applyTCPTuning() {
+	attendant.tcpTuning.mutex.Lock()
+	defer attendant.tcpTuning.mutex.Unlock()
+	if attendant.tcpTuning.tuning == nil {
+		return
+	}
+	if tunable, ok := tunableConnection(attendant.connection); ok {
+		attendant.tcpTuning.applied = attendant.tcpTuning.tuning.apply(tunable) == nil
+	}
+}
@@ -0,0 +1,180 @@
+package chasqui
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+
+// The phases of a teardown, in execution order. Both the
+// attendants and the servers stop by running the callbacks
+// registered in each phase, in order, so features tearing
+// down have a well-defined ordering among them:
+// - StopAccepting: No new connections are accepted.
+// - QuiesceReads: No more messages are read or delivered.
+// - DrainWrites: Pending outgoing messages are flushed.
+// - ResolveWaiters: Anyone blocked waiting for a result
+//   is released.
+// - PersistHooks: State is persisted (e.g. sessions).
+// - ReleaseResources: Sockets, timers and goroutines are
+//   released.
+// - EmitStopped: The stopped event is emitted. It will be
+//   triggered after all the callbacks in this phase.
+type TeardownPhase int
+const (
+	TeardownStopAccepting TeardownPhase = iota
+	TeardownQuiesceReads
+	TeardownDrainWrites
+	TeardownResolveWaiters
+	TeardownPersistHooks
+	TeardownReleaseResources
+	TeardownEmitStopped
+	teardownPhases
+)
+
+
+// The names of the teardown phases.
+var teardownPhaseNames = [teardownPhases]string{
+	"StopAccepting", "QuiesceReads", "DrainWrites", "ResolveWaiters", "PersistHooks", "ReleaseResources",
+	"EmitStopped",
+}
+
+
+// A readable representation of the phase.
+func (phase TeardownPhase) String() string {
+	if phase >= 0 && phase < teardownPhases {
+		return teardownPhaseNames[phase]
+	}
+	return fmt.Sprintf("TeardownPhase(%d)", int(phase))
+}
+
+
+// A callback to run in a teardown phase.
+type TeardownFunc func() error
+
+
+// Error raised by a teardown callback (or a panic in it).
+// A failure never skips the remaining callbacks or phases.
+type TeardownError struct {
+	Phase TeardownPhase
+	Err   error
+}
+
+
+// The error message.
+func (err TeardownError) Error() string {
+	return "teardown failed in phase " + err.Phase.String() + ": " + err.Err.Error()
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err TeardownError) Is(target error) bool {
+	return target == ErrTeardownFailed
+}
+
+
+// Returns the error of the failed callback.
+func (err TeardownError) Unwrap() error {
+	return err.Err
+}
+
+
+// Error raised when stopping a server whose teardown had
+// failures. The server is stopped anyway.
+type TeardownErrors []error
+
+
+// The error message.
+func (errs TeardownErrors) Error() string {
+	return fmt.Sprintf("%d teardown callback(s) failed, first: %s", len(errs), errs[0])
+}
+
+
+// Tells whether the error matches the given sentinel, or
+// any of the errors of the failed callbacks matches the
+// target (e.g. the error returned by a callback).
+func (errs TeardownErrors) Is(target error) bool {
+	if target == ErrTeardownFailed {
+		return true
+	}
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+
+// Finds the first error of the failed callbacks matching
+// the target type (e.g. a TeardownError, to tell the phase),
+// and sets the target to it.
+func (errs TeardownErrors) As(target interface{}) bool {
+	for _, err := range errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+
+// The callbacks registered for each phase, in registration
+// order.
+type teardownPipeline struct {
+	mutex     sync.Mutex
+	callbacks [teardownPhases][]TeardownFunc
+}
+
+
+// Registers a callback in a phase.
+func (pipeline *teardownPipeline) register(phase TeardownPhase, callback TeardownFunc) {
+	if phase < 0 || phase >= teardownPhases {
+		panic(ArgumentError{"OnTeardown:phase"})
+	}
+	if callback == nil {
+		panic(ArgumentError{"OnTeardown:callback"})
+	}
+	pipeline.mutex.Lock()
+	defer pipeline.mutex.Unlock()
+	pipeline.callbacks[phase] = append(pipeline.callbacks[phase], callback)
+}
+
+
+// Runs all the phases in order, and all the callbacks of
+// each phase in registration order. Errors and panics are
+// collected, but never stop the teardown.
+func (pipeline *teardownPipeline) run() []error {
+	pipeline.mutex.Lock()
+	var callbacks [teardownPhases][]TeardownFunc
+	for phase := range pipeline.callbacks {
+		callbacks[phase] = append([]TeardownFunc(nil), pipeline.callbacks[phase]...)
+	}
+	pipeline.mutex.Unlock()
+
+	var errs []error
+	for phase := TeardownPhase(0); phase < teardownPhases; phase++ {
+		for _, callback := range callbacks[phase] {
+			if err := runTeardownCallback(callback); err != nil {
+				errs = append(errs, TeardownError{phase, err})
+			}
+		}
+	}
+	return errs
+}
+
+
+// Runs a single callback, converting panics into errors.
+func runTeardownCallback(callback TeardownFunc) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if panicError, ok := recovered.(error); ok {
+				err = fmt.Errorf("panic: %w", panicError)
+			} else {
+				err = fmt.Errorf("panic: %v", recovered)
+			}
+		}
+	}()
+	return callback()
+}
@@ -0,0 +1,118 @@
+package chasqui
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+
+func TestTeardownPhaseOrdering(t *testing.T) {
+	pipeline := &teardownPipeline{}
+	var order []string
+	record := func(name string) TeardownFunc {
+		return func() error {
+			order = append(order, name)
+			return nil
+		}
+	}
+	// Registered out of order on purpose.
+	pipeline.register(TeardownEmitStopped, record("EmitStopped"))
+	pipeline.register(TeardownReleaseResources, record("ReleaseResources/1"))
+	pipeline.register(TeardownStopAccepting, record("StopAccepting"))
+	pipeline.register(TeardownPersistHooks, record("PersistHooks"))
+	pipeline.register(TeardownReleaseResources, record("ReleaseResources/2"))
+	pipeline.register(TeardownQuiesceReads, record("QuiesceReads"))
+	pipeline.register(TeardownResolveWaiters, record("ResolveWaiters"))
+	pipeline.register(TeardownDrainWrites, record("DrainWrites"))
+	if errs := pipeline.run(); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	expected := []string{
+		"StopAccepting", "QuiesceReads", "DrainWrites", "ResolveWaiters", "PersistHooks",
+		"ReleaseResources/1", "ReleaseResources/2", "EmitStopped",
+	}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("ran %v, expected %v", order, expected)
+	}
+}
+
+
+func TestTeardownMiddleFailureDoesNotSkip(t *testing.T) {
+	pipeline := &teardownPipeline{}
+	var ran []TeardownPhase
+	for phase := TeardownPhase(0); phase < teardownPhases; phase++ {
+		phase := phase
+		pipeline.register(phase, func() error {
+			ran = append(ran, phase)
+			return nil
+		})
+	}
+	pipeline.register(TeardownDrainWrites, func() error {
+		return io.ErrClosedPipe
+	})
+	pipeline.register(TeardownResolveWaiters, func() error {
+		panic("waiter exploded")
+	})
+	errs := pipeline.run()
+	if len(ran) != int(teardownPhases) {
+		t.Fatalf("only phases %v ran", ran)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("%d errors: %v", len(errs), errs)
+	}
+	for index, phase := range []TeardownPhase{TeardownDrainWrites, TeardownResolveWaiters} {
+		var teardownErr TeardownError
+		if !errors.As(errs[index], &teardownErr) || teardownErr.Phase != phase {
+			t.Fatalf("error %d is %v, expected one in phase %s", index, errs[index], phase)
+		}
+	}
+}
+
+
+func TestTeardownErrorsMatching(t *testing.T) {
+	var err error = TeardownErrors{
+		TeardownError{TeardownDrainWrites, io.ErrClosedPipe},
+		TeardownError{TeardownReleaseResources, io.ErrUnexpectedEOF},
+	}
+	if !errors.Is(err, ErrTeardownFailed) {
+		t.Fatal("does not match ErrTeardownFailed")
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatal("does not match the callback errors")
+	}
+	if errors.Is(err, io.EOF) {
+		t.Fatal("matches an unrelated error")
+	}
+	var teardownErr TeardownError
+	if !errors.As(err, &teardownErr) || teardownErr.Phase != TeardownDrainWrites {
+		t.Fatalf("As retrieved %v", teardownErr)
+	}
+}
+
+
+func TestServerStopReportsTeardownErrors(t *testing.T) {
+	server := newTestServer(1)
+	stop := consumeEvents(server)
+	defer stop()
+	var ran []TeardownPhase
+	server.OnTeardown(TeardownPersistHooks, func() error {
+		ran = append(ran, TeardownPersistHooks)
+		return io.ErrShortWrite
+	})
+	server.OnTeardown(TeardownEmitStopped, func() error {
+		ran = append(ran, TeardownEmitStopped)
+		return nil
+	})
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	err := server.Stop()
+	if !errors.Is(err, ErrTeardownFailed) || !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("Stop returned %v", err)
+	}
+	if !reflect.DeepEqual(ran, []TeardownPhase{TeardownPersistHooks, TeardownEmitStopped}) {
+		t.Fatalf("ran %v", ran)
+	}
+}
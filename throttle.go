@@ -0,0 +1,577 @@
+package chasqui
+
+import (
+	"fmt"
+	. "github.com/universe-10th/chasqui/types"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+
+// A throttle for a particular command: the minimum lapse
+// between messages of that command, and the instant of the
+// last one being accepted.
+type commandThrottle struct {
+	lapse time.Duration
+	from  time.Time
+}
+
+
+// Gets the throttle time for a command, and whether the
+// command has its own throttle.
+func (attendant *Attendant) CommandThrottle(command string) (time.Duration, bool) {
+	attendant.throttleMutex.Lock()
+	defer attendant.throttleMutex.Unlock()
+	if throttle, ok := attendant.commandThrottles[command]; ok {
+		return throttle.lapse, true
+	}
+	return 0, false
+}
+
+
+// Sets the throttle time for a command, overriding the general
+// throttle for the messages of that command (a throttle of 0
+// means those messages are never throttled). Negative throttle
+// times will be negated, to positive.
+func (attendant *Attendant) SetCommandThrottle(command string, throttle time.Duration) {
+	if throttle < 0 {
+		throttle = -throttle
+	}
+	attendant.throttleMutex.Lock()
+	defer attendant.throttleMutex.Unlock()
+	if existing, ok := attendant.commandThrottles[command]; ok {
+		existing.lapse = throttle
+	} else {
+		attendant.commandThrottles[command] = &commandThrottle{lapse: throttle}
+	}
+}
+
+
+// Removes the throttle of a command, so the general throttle
+// applies again to its messages.
+func (attendant *Attendant) RemoveCommandThrottle(command string) {
+	attendant.throttleMutex.Lock()
+	defer attendant.throttleMutex.Unlock()
+	delete(attendant.commandThrottles, command)
+}
+
+
+// The outcome of a throttle check. An escalation error
+// means the attendant must be stopped.
+type throttleCheck struct {
+	rule       string
+	instant    time.Time
+	lapse      time.Duration
+	tokens     float64
+	retryAfter time.Duration
+	bytes      int
+	throttled  bool
+	escalate   error
+}
+
+
+// Checks whether a message (of the given size in bytes, if
+// known) must be throttled, according to the byte throttle
+// (if any), and then the throttle of its command (if any)
+// or the general one (the throttle policy, if any, or the
+// general throttle). The bytes are only taken from the byte
+// throttle once the message is accepted. Rechecks of delayed
+// messages do not count as byte rate violations again.
+func (attendant *Attendant) throttled(message Message, bytes int, recheck bool) throttleCheck {
+	attendant.throttleMutex.Lock()
+	defer attendant.throttleMutex.Unlock()
+	now := time.Now()
+	var check throttleCheck
+	byteThrottle := attendant.byteThrottle
+	if bytes <= 0 {
+		byteThrottle = nil
+	}
+	if byteThrottle != nil {
+		if check = byteThrottle.check(now, bytes); check.throttled {
+			if !recheck {
+				check.escalate = byteThrottle.violate()
+			}
+			check.bytes = bytes
+			return check
+		}
+	}
+	if command, ok := attendant.commandThrottles[message.Command()]; ok {
+		check = checkLapse(now, attendant.escalation.scale(now, command.lapse), &command.from)
+		check.rule = message.Command()
+	} else if attendant.throttlePolicy != nil {
+		accepted, tokens, retryAfter := attendant.throttlePolicy.Check(now)
+		check = throttleCheck{instant: now, tokens: tokens, retryAfter: retryAfter, throttled: !accepted}
+	} else {
+		check = checkLapse(now, attendant.escalation.scale(now, attendant.Throttle()), &attendant.throttleFrom)
+	}
+	if byteThrottle != nil && !check.throttled {
+		byteThrottle.take(bytes)
+	}
+	check.bytes = bytes
+	return check
+}
+
+
+// Checks a lapse-based throttle: messages are accepted only
+// if a minimum lapse passed since the last accepted one.
+func checkLapse(now time.Time, throttle time.Duration, from *time.Time) throttleCheck {
+	if throttle == 0 {
+		// No throttle is being used right now. It counts as "ok".
+		return throttleCheck{instant: now}
+	} else if *from == (time.Time{}) {
+		// Throttle is being used, but this is the first message
+		// being received (no throttle can occur for it). It counts
+		// as "ok" but the current time will be stored for the next
+		// throttle.
+		*from = now
+		return throttleCheck{instant: now}
+	} else {
+		// Now a throttle check starts. This means that if the lapse
+		// between the current time and the previous message time is
+		// greater than or equal to the throttle time, it counts as
+		// "ok" but the current time will be stored for the next
+		// throttle check. Otherwise, the message is throttled and
+		// not processed.
+		lapse := now.Sub(*from)
+		if lapse >= throttle {
+			*from = now
+			return throttleCheck{instant: now, lapse: lapse}
+		} else {
+			return throttleCheck{instant: now, lapse: lapse, retryAfter: throttle - lapse, throttled: true}
+		}
+	}
+}
+
+
+// Throttle policies replace the lapse-based general throttle
+// of an attendant (see Attendant.SetThrottlePolicy). Each
+// policy instance keeps its own state, so it must not be
+// shared among attendants (unless the sharing is intended,
+// as with a shared rate limiter). Check tells whether a message
+// arriving at the given instant is accepted, and also the
+// remaining allowance (e.g. tokens) and the time to wait
+// before another message would be accepted.
+type ThrottlePolicy interface {
+	Check(now time.Time) (bool, float64, time.Duration)
+}
+
+
+// A token bucket throttle policy: the bucket holds up to
+// Burst tokens, and refills at Rate tokens per second. Each
+// message takes a token, and messages arriving while the
+// bucket is empty are throttled. Short bursts are allowed,
+// while the sustained rate is limited.
+type TokenBucketThrottle struct {
+	mutex    sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	refilled time.Time
+}
+
+
+// Takes a token, if available.
+func (throttle *TokenBucketThrottle) Check(now time.Time) (bool, float64, time.Duration) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	if throttle.refilled == (time.Time{}) {
+		throttle.tokens = throttle.burst
+	} else if elapsed := now.Sub(throttle.refilled); elapsed > 0 {
+		throttle.tokens += elapsed.Seconds() * throttle.rate
+		if throttle.tokens > throttle.burst {
+			throttle.tokens = throttle.burst
+		}
+	}
+	throttle.refilled = now
+	if throttle.tokens >= 1 {
+		throttle.tokens--
+		return true, throttle.tokens, 0
+	} else if throttle.rate > 0 {
+		return false, throttle.tokens, time.Duration((1 - throttle.tokens) / throttle.rate * float64(time.Second))
+	} else {
+		return false, throttle.tokens, 0
+	}
+}
+
+
+// Gets the rate (tokens per second) and the burst size.
+func (throttle *TokenBucketThrottle) Params() (float64, uint) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	return throttle.rate, uint(throttle.burst)
+}
+
+
+// Creates a new token bucket throttle policy, with the given
+// rate (in tokens per second) and burst size. The bucket
+// starts full.
+func NewTokenBucketThrottle(rate float64, burst uint) *TokenBucketThrottle {
+	if rate < 0 {
+		rate = -rate
+	}
+	if burst == 0 {
+		burst = 1
+	}
+	return &TokenBucketThrottle{rate: rate, burst: float64(burst)}
+}
+
+
+// A lapse-based throttle policy: messages are accepted only
+// if a minimum lapse passed since the last accepted one. It
+// behaves like the general throttle of an attendant.
+type LapseThrottle struct {
+	mutex sync.Mutex
+	lapse time.Duration
+	from  time.Time
+}
+
+
+// Accepts the message if the lapse passed.
+func (throttle *LapseThrottle) Check(now time.Time) (bool, float64, time.Duration) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	check := checkLapse(now, throttle.lapse, &throttle.from)
+	return !check.throttled, 0, check.retryAfter
+}
+
+
+// Creates a new lapse-based throttle policy, with the given
+// minimum lapse between accepted messages.
+func NewLapseThrottle(lapse time.Duration) *LapseThrottle {
+	if lapse < 0 {
+		lapse = -lapse
+	}
+	return &LapseThrottle{lapse: lapse}
+}
+
+
+// Rate limiters tell whether n events may happen at the given
+// instant, consuming them if so. The *rate.Limiter type (from
+// golang.org/x/time/rate) is a rate limiter.
+type RateLimiter interface {
+	AllowN(now time.Time, n int) bool
+}
+
+
+// Rate limiters also telling their available tokens.
+type tokenReporter interface {
+	TokensAt(now time.Time) float64
+}
+
+
+// A throttle policy backed by a rate limiter: each message
+// takes one event from it. The limiter keeps the state, so
+// sharing a limiter among several attendants (e.g. all the
+// ones from the same address) makes them share the limit,
+// provided it is safe for concurrent use (as *rate.Limiter
+// is). The remaining tokens are only reported if the limiter
+// tells them, and the time to wait is never reported.
+type LimiterThrottle struct {
+	limiter RateLimiter
+}
+
+
+// Takes an event from the limiter, if allowed.
+func (throttle *LimiterThrottle) Check(now time.Time) (bool, float64, time.Duration) {
+	allowed := throttle.limiter.AllowN(now, 1)
+	tokens := 0.0
+	if reporter, ok := throttle.limiter.(tokenReporter); ok {
+		tokens = reporter.TokensAt(now)
+	}
+	return allowed, tokens, 0
+}
+
+
+// Gets the underlying rate limiter.
+func (throttle *LimiterThrottle) Limiter() RateLimiter {
+	return throttle.limiter
+}
+
+
+// Creates a new throttle policy backed by the given rate
+// limiter (which may be shared).
+func NewLimiterThrottle(limiter RateLimiter) *LimiterThrottle {
+	if limiter == nil {
+		panic(ArgumentError{"NewLimiterThrottle:limiter"})
+	}
+	return &LimiterThrottle{limiter}
+}
+
+
+// Gets the throttle policy for the current attendant (nil
+// means the lapse-based general throttle is used).
+func (attendant *Attendant) ThrottlePolicy() ThrottlePolicy {
+	attendant.throttleMutex.Lock()
+	defer attendant.throttleMutex.Unlock()
+	return attendant.throttlePolicy
+}
+
+
+// Sets the throttle policy for the current attendant. It
+// replaces the lapse-based general throttle (nil brings it
+// back), while the command throttles still override it.
+func (attendant *Attendant) SetThrottlePolicy(policy ThrottlePolicy) {
+	attendant.throttleMutex.Lock()
+	defer attendant.throttleMutex.Unlock()
+	attendant.throttlePolicy = policy
+}
+
+
+// The rule of the throttled events fired by the byte throttle.
+const ByteThrottleRule = "<bytes>"
+
+
+// Error used to abort an attendant exceeding its byte rate
+// too many times (see Attendant.SetByteThrottle).
+type ByteRateExceededError struct {
+	Violations uint
+}
+
+
+// The error message.
+func (err ByteRateExceededError) Error() string {
+	return fmt.Sprintf("byte rate exceeded %d times", err.Violations)
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err ByteRateExceededError) Is(target error) bool {
+	return target == ErrByteRateExceeded
+}
+
+
+// A token bucket of bytes, and the count of violations.
+type byteThrottle struct {
+	rate          float64
+	burst         float64
+	maxViolations uint
+	tokens        float64
+	refilled      time.Time
+	violations    uint
+}
+
+
+// Refills the bucket, and tells whether the bytes of a
+// message fit in it (without taking them).
+func (throttle *byteThrottle) check(now time.Time, bytes int) throttleCheck {
+	if throttle.refilled == (time.Time{}) {
+		throttle.tokens = throttle.burst
+	} else if elapsed := now.Sub(throttle.refilled); elapsed > 0 {
+		throttle.tokens += elapsed.Seconds() * throttle.rate
+		if throttle.tokens > throttle.burst {
+			throttle.tokens = throttle.burst
+		}
+	}
+	throttle.refilled = now
+	if float64(bytes) <= throttle.tokens {
+		return throttleCheck{instant: now}
+	}
+	check := throttleCheck{rule: ByteThrottleRule, instant: now, tokens: throttle.tokens, throttled: true}
+	if throttle.rate > 0 && float64(bytes) <= throttle.burst {
+		check.retryAfter = time.Duration((float64(bytes) - throttle.tokens) / throttle.rate * float64(time.Second))
+	}
+	return check
+}
+
+
+// Takes the bytes of an accepted message from the bucket.
+func (throttle *byteThrottle) take(bytes int) {
+	throttle.tokens -= float64(bytes)
+}
+
+
+// Counts a violation. Violations escalate once they reach
+// the maximum (if any).
+func (throttle *byteThrottle) violate() error {
+	throttle.violations++
+	if throttle.maxViolations > 0 && throttle.violations >= throttle.maxViolations {
+		return ByteRateExceededError{throttle.violations}
+	}
+	return nil
+}
+
+
+// Gets the byte throttle for the current attendant: the rate
+// (bytes per second), the burst (bytes), the max violations,
+// and whether there is a byte throttle at all.
+func (attendant *Attendant) ByteThrottle() (float64, uint64, uint, bool) {
+	attendant.throttleMutex.Lock()
+	defer attendant.throttleMutex.Unlock()
+	if throttle := attendant.byteThrottle; throttle != nil {
+		return throttle.rate, uint64(throttle.burst), throttle.maxViolations, true
+	}
+	return 0, 0, 0, false
+}
+
+
+// Sets a byte throttle for the current attendant: received
+// messages take their size (as told by the marshaler, which
+// must be a FrameSizer) from a bucket of up to burst bytes,
+// refilled at the given rate (bytes per second). Messages not
+// fitting in the bucket are throttled, and the attendant is
+// stopped abnormally (with a ByteRateExceededError) once this
+// happens maxViolations times (zero means never). A rate of
+// zero removes the byte throttle.
+func (attendant *Attendant) SetByteThrottle(rate float64, burst uint64, maxViolations uint) {
+	attendant.throttleMutex.Lock()
+	defer attendant.throttleMutex.Unlock()
+	if rate <= 0 {
+		attendant.byteThrottle = nil
+	} else {
+		attendant.byteThrottle = &byteThrottle{rate: rate, burst: float64(burst), maxViolations: maxViolations}
+	}
+}
+
+
+// A delayed message, and its size in bytes (if known).
+type delayedMessage struct {
+	message Message
+	bytes   int
+}
+
+
+// A bounded queue of delayed messages, released in order
+// once the throttle allows them.
+type delayQueue struct {
+	mutex    sync.Mutex
+	pending  []delayedMessage
+	capacity int
+	wake     chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+
+// Returns the number of received messages being delayed by
+// the throttle (always 0 unless the attendant delays them).
+func (attendant *Attendant) DelayedMessages() int {
+	if attendant.delayQueue == nil {
+		return 0
+	}
+	attendant.delayQueue.mutex.Lock()
+	defer attendant.delayQueue.mutex.Unlock()
+	return len(attendant.delayQueue.pending)
+}
+
+
+// Conveys a received message, unless throttled. Throttled
+// messages trigger a throttled event or, if the attendant
+// delays them, are queued until the throttle allows them.
+// Queued messages keep their order: while there are pending
+// messages, new ones are queued behind them. Messages not
+// fitting in the queue trigger a throttled event.
+func (attendant *Attendant) convey(message Message) {
+	bytes := 0
+	if sizer, ok := attendant.receiver.(FrameSizer); ok {
+		bytes = sizer.LastFrameSize()
+	}
+	queue := attendant.delayQueue
+	if queue != nil {
+		queue.mutex.Lock()
+		defer queue.mutex.Unlock()
+		if len(queue.pending) > 0 {
+			if len(queue.pending) < queue.capacity {
+				queue.pending = append(queue.pending, delayedMessage{message, bytes})
+			} else {
+				now := time.Now()
+				atomic.AddUint64(&attendant.stats.throttled, 1)
+				attendant.violate(now)
+				attendant.deliverThrottled(ThrottledEvent{
+					Attendant: attendant, AttendantID: attendant.id, Message: message, Instant: now, Bytes: bytes,
+				})
+			}
+			return
+		}
+	}
+	if check := attendant.throttled(message, bytes, false); !check.throttled {
+		attendant.deliverMessage(MessageEvent{attendant, attendant.id, message}, nil)
+	} else {
+		if check.escalate != nil {
+			attendant.logger.Warnf("attendant %d throttle escalated: %v", attendant.id, check.escalate)
+			attendant.abort(check.escalate)
+		}
+		attendant.violate(check.instant)
+		// Messages larger than the byte burst would never be
+		// allowed, so they are not delayed.
+		if queue != nil && queue.capacity > 0 && (check.rule != ByteThrottleRule || check.retryAfter > 0) {
+			queue.pending = append(queue.pending, delayedMessage{message, bytes})
+			select {
+			case queue.wake <- struct{}{}:
+			default:
+			}
+			return
+		}
+		atomic.AddUint64(&attendant.stats.throttled, 1)
+		attendant.deliverThrottled(ThrottledEvent{
+			attendant, attendant.id, message, check.instant, check.lapse, check.rule, check.tokens, check.retryAfter,
+			check.bytes,
+		})
+	}
+}
+
+
+// The release loop conveys the delayed messages, in order,
+// once the throttle allows each of them.
+func (attendant *Attendant) releaseLoop() {
+	queue := attendant.delayQueue
+	defer close(queue.done)
+	for {
+		queue.mutex.Lock()
+		if len(queue.pending) == 0 {
+			queue.mutex.Unlock()
+			select {
+			case <-queue.wake:
+				continue
+			case <-queue.quit:
+				return
+			}
+		}
+		head := queue.pending[0]
+		check := attendant.throttled(head.message, head.bytes, true)
+		if !check.throttled {
+			queue.pending[0] = delayedMessage{}
+			queue.pending = queue.pending[1:]
+			delivered := attendant.deliverMessage(MessageEvent{attendant, attendant.id, head.message}, queue.quit)
+			queue.mutex.Unlock()
+			if !delivered {
+				return
+			}
+			continue
+		}
+		queue.mutex.Unlock()
+		if check.escalate != nil {
+			attendant.logger.Warnf("attendant %d throttle escalated: %v", attendant.id, check.escalate)
+			attendant.abort(check.escalate)
+		}
+		// Policies not telling when to retry are polled.
+		wait := check.retryAfter
+		if wait <= 0 {
+			wait = 10 * time.Millisecond
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-queue.quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+
+// Registers the teardown callback of the delay queue: the
+// pending messages are discarded, and the release loop is
+// waited for, once reads stop.
+func (attendant *Attendant) registerDelayTeardown() {
+	attendant.teardown.register(TeardownQuiesceReads, func() error {
+		if queue := attendant.delayQueue; queue != nil {
+			close(queue.quit)
+			<-queue.done
+			queue.mutex.Lock()
+			queue.pending = nil
+			queue.mutex.Unlock()
+		}
+		return nil
+	})
+}
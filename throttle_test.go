@@ -0,0 +1,422 @@
+package chasqui
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// An attendant over an in-memory pipe, and a JSON marshaler
+// writing to it from the other end.
+type throttleHarness struct {
+	attendant *Attendant
+	remote    net.Conn
+	peer      MessageMarshaler
+	messages  chan MessageEvent
+	throttled chan ThrottledEvent
+	stopped   chan AttendantStoppedEvent
+}
+
+
+// Creates an attendant with the given general throttle and
+// options, configures it, and starts it.
+func newThrottleHarness(t *testing.T, throttle time.Duration, configure func(*Attendant),
+	                    options ...AttendantOption) *throttleHarness {
+	local, remote := net.Pipe()
+	harness := &throttleHarness{
+		remote:    remote,
+		peer:      (&json.JSONMessageMarshaler{}).Create(remote),
+		messages:  make(chan MessageEvent, 64),
+		throttled: make(chan ThrottledEvent, 64),
+		stopped:   make(chan AttendantStoppedEvent, 1),
+	}
+	harness.attendant = NewAttendant(
+		local, &json.JSONMessageMarshaler{}, throttle, make(chan AttendantStartedEvent, 1), harness.stopped,
+		harness.messages, harness.throttled, options...,
+	)
+	if configure != nil {
+		configure(harness.attendant)
+	}
+	if err := harness.attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// noinspection GoUnhandledErrorResult
+		harness.attendant.Stop()
+		// noinspection GoUnhandledErrorResult
+		remote.Close()
+		harness.attendant.Wait()
+	})
+	return harness
+}
+
+
+// Sends a message of the given command, with a payload of the
+// given size, from the remote end.
+func (harness *throttleHarness) send(t *testing.T, command string, size int) {
+	t.Helper()
+	if err := harness.peer.Send(command, Args{strings.Repeat("x", size)}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+
+// Sizes a message the same way the attendant does: the JSON
+// marshaler counts the separator before a message as part
+// of it, so all the messages but the first one are 1 byte
+// longer.
+func jsonFrameSize(t *testing.T, command string, size int) int {
+	buffer := &strings.Builder{}
+	marshaler := (&json.JSONMessageMarshaler{}).Create(nopReadWriter{buffer})
+	if err := marshaler.Send(command, Args{strings.Repeat("x", size)}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Len()
+}
+
+
+// A write-only read-writer.
+type nopReadWriter struct {
+	*strings.Builder
+}
+
+
+func (nopReadWriter) Read([]byte) (int, error) {
+	return 0, errors.New("write only")
+}
+
+
+// Waits for the next message event.
+func (harness *throttleHarness) nextMessage(t *testing.T) MessageEvent {
+	t.Helper()
+	select {
+	case event := <-harness.messages:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message event")
+		return MessageEvent{}
+	}
+}
+
+
+// Waits for the next throttled event.
+func (harness *throttleHarness) nextThrottled(t *testing.T) ThrottledEvent {
+	t.Helper()
+	select {
+	case event := <-harness.throttled:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no throttled event")
+		return ThrottledEvent{}
+	}
+}
+
+
+func TestByteThrottleAccounting(t *testing.T) {
+	size := jsonFrameSize(t, "BIG", 1000)
+	// Room for 3 frames, with a negligible refill.
+	harness := newThrottleHarness(t, 0, func(attendant *Attendant) {
+		attendant.SetByteThrottle(1, uint64(3*size), 0)
+	})
+	for index := 0; index < 5; index++ {
+		harness.send(t, "BIG", 1000)
+	}
+	for index := 0; index < 3; index++ {
+		harness.nextMessage(t)
+	}
+	for index := 0; index < 2; index++ {
+		event := harness.nextThrottled(t)
+		if event.Rule != ByteThrottleRule || event.Bytes != size || event.Tokens >= float64(size) {
+			t.Fatalf("unexpected throttled event: rule %q, %d bytes, %f tokens", event.Rule, event.Bytes, event.Tokens)
+		}
+	}
+	if stats := harness.attendant.Stats(); stats.MessagesIn != 5 {
+		t.Fatalf("%d messages in", stats.MessagesIn)
+	}
+}
+
+
+func TestByteThrottleChargesOnlyAccepted(t *testing.T) {
+	first := jsonFrameSize(t, "BIG", 1000) - 1
+	size := first + 1
+	// Room for the first frame and another one.
+	harness := newThrottleHarness(t, 0, func(attendant *Attendant) {
+		attendant.SetByteThrottle(1, uint64(first+size), 0)
+		attendant.SetCommandThrottle("BIG", time.Hour)
+	})
+	harness.send(t, "BIG", 1000)
+	harness.nextMessage(t)
+	// Throttled by its command: its bytes are not taken.
+	harness.send(t, "BIG", 1000)
+	if event := harness.nextThrottled(t); event.Rule != "BIG" {
+		t.Fatalf("throttled by %q", event.Rule)
+	}
+	harness.send(t, "OTH", 1000)
+	if event := harness.nextMessage(t); event.Message.Command() != "OTH" {
+		t.Fatalf("received %q", event.Message.Command())
+	}
+}
+
+
+func TestByteThrottleEscalation(t *testing.T) {
+	size := jsonFrameSize(t, "BIG", 1000)
+	harness := newThrottleHarness(t, 0, func(attendant *Attendant) {
+		attendant.SetByteThrottle(1, uint64(size), 2)
+	})
+	go func() {
+		for index := 0; index < 3; index++ {
+			if err := harness.peer.Send("BIG", Args{strings.Repeat("x", 1000)}, nil); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case event := <-harness.stopped:
+		if event.StopType != AttendantAbnormalStop || !errors.Is(event.Error, ErrByteRateExceeded) {
+			t.Fatalf("stopped as %s: %v", event.StopType, event.Error)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("not stopped")
+	}
+}
+
+
+// A throttle policy rejecting everything until an instant,
+// without telling when to retry (so the delayed messages
+// are polled).
+type gatePolicy struct {
+	opensAt time.Time
+}
+
+
+func (policy gatePolicy) Check(now time.Time) (bool, float64, time.Duration) {
+	return !now.Before(policy.opensAt), 0, 0
+}
+
+
+func TestDelayedRechecksAreNotCharged(t *testing.T) {
+	size := jsonFrameSize(t, "MSG", 100)
+	harness := newThrottleHarness(t, 0, func(attendant *Attendant) {
+		// The message is polled ~20 times: charging it each
+		// time would exhaust the bucket, and escalate.
+		attendant.SetThrottlePolicy(gatePolicy{time.Now().Add(200 * time.Millisecond)})
+		attendant.SetByteThrottle(1, uint64(5*size), 1)
+	}, WithThrottleDelay(4))
+	harness.send(t, "MSG", 100)
+	harness.nextMessage(t)
+	if status := harness.attendant.Status(); status == AttendantStopped {
+		t.Fatal("the attendant was stopped")
+	}
+	if len(harness.throttled) != 0 {
+		t.Fatalf("%d throttled events", len(harness.throttled))
+	}
+}
+
+
+func TestThrottleDelayOrderAndPacing(t *testing.T) {
+	const lapse = 40 * time.Millisecond
+	harness := newThrottleHarness(t, lapse, nil, WithThrottleDelay(8))
+	for index := 0; index < 5; index++ {
+		harness.send(t, "MSG"+string(rune('0'+index)), 1)
+	}
+	var previous time.Time
+	for index := 0; index < 5; index++ {
+		event := harness.nextMessage(t)
+		now := time.Now()
+		if command := event.Message.Command(); command != "MSG"+string(rune('0'+index)) {
+			t.Fatalf("message %d is %q", index, command)
+		}
+		// Timers never fire early, but the receiving side may
+		// lag a bit behind.
+		if index > 0 && now.Sub(previous) < lapse-10*time.Millisecond {
+			t.Fatalf("message %d came %s after the previous one", index, now.Sub(previous))
+		}
+		previous = now
+	}
+	if len(harness.throttled) != 0 || harness.attendant.DelayedMessages() != 0 {
+		t.Fatalf("%d throttled, %d delayed", len(harness.throttled), harness.attendant.DelayedMessages())
+	}
+}
+
+
+func TestThrottleDelayOverflow(t *testing.T) {
+	harness := newThrottleHarness(t, time.Hour, nil, WithThrottleDelay(2))
+	for index := 0; index < 5; index++ {
+		harness.send(t, "MSG"+string(rune('0'+index)), 1)
+	}
+	harness.nextMessage(t)
+	// Two messages wait in the queue, and the other two fall
+	// back to throttled events.
+	for _, command := range []string{"MSG3", "MSG4"} {
+		if event := harness.nextThrottled(t); event.Message.Command() != command {
+			t.Fatalf("throttled %q, expected %q", event.Message.Command(), command)
+		}
+	}
+	if delayed := harness.attendant.DelayedMessages(); delayed != 2 {
+		t.Fatalf("%d delayed messages", delayed)
+	}
+	// noinspection GoUnhandledErrorResult
+	harness.attendant.Stop()
+	within(t, time.Second, "Wait", harness.attendant.Wait)
+	if delayed := harness.attendant.DelayedMessages(); delayed != 0 || len(harness.messages) != 0 {
+		t.Fatalf("%d delayed and %d delivered after stopping", delayed, len(harness.messages))
+	}
+}
+
+
+// Sends a message and tells the rule throttling it, or
+// whether it was accepted.
+func (harness *throttleHarness) outcome(t *testing.T, command string) (string, bool) {
+	t.Helper()
+	harness.send(t, command, 1)
+	select {
+	case event := <-harness.messages:
+		if event.Message.Command() != command {
+			t.Fatalf("expected %s, got %s", command, event.Message.Command())
+		}
+		return "", true
+	case event := <-harness.throttled:
+		if event.Message.Command() != command {
+			t.Fatalf("expected %s to be throttled, got %s", command, event.Message.Command())
+		}
+		return event.Rule, false
+	case <-time.After(2 * time.Second):
+		t.Fatalf("%s was neither conveyed nor throttled", command)
+		return "", false
+	}
+}
+
+
+func TestCommandThrottles(t *testing.T) {
+	harness := newThrottleHarness(t, 100 * time.Millisecond, func(attendant *Attendant) {
+		attendant.SetCommandThrottle("MOVE", 0)
+		attendant.SetCommandThrottle("CRAFT", -time.Hour)
+	})
+	expect := func(command string, accepted bool, rule string) {
+		t.Helper()
+		if gotRule, gotAccepted := harness.outcome(t, command); gotAccepted != accepted || gotRule != rule {
+			t.Fatalf("%s: expected accepted=%v (rule %q), got accepted=%v (rule %q)",
+				command, accepted, rule, gotAccepted, gotRule)
+		}
+	}
+	// MOVE is never throttled, CRAFT has its own lapse, and
+	// the other commands share the general one.
+	for index := 0; index < 5; index++ {
+		expect("MOVE", true, "")
+	}
+	expect("CRAFT", true, "")
+	expect("CRAFT", false, "CRAFT")
+	expect("CHAT", true, "")
+	expect("CHAT", false, "")
+	expect("EMOTE", false, "")
+	expect("MOVE", true, "")
+	expect("CRAFT", false, "CRAFT")
+	if lapse, ok := harness.attendant.CommandThrottle("CRAFT"); !ok || lapse != time.Hour {
+		t.Fatalf("unexpected CRAFT throttle: %v, %v", lapse, ok)
+	}
+
+	// Without its own throttle, CRAFT follows the general one.
+	harness.attendant.RemoveCommandThrottle("CRAFT")
+	if _, ok := harness.attendant.CommandThrottle("CRAFT"); ok {
+		t.Fatal("the CRAFT throttle was not removed")
+	}
+	time.Sleep(150 * time.Millisecond)
+	expect("CRAFT", true, "")
+	expect("CHAT", false, "")
+}
+
+
+// Runs a burst of messages at an instant, and then a sustained
+// stream of them (one each period, for the given duration),
+// through a policy. Returns the accepted messages of each
+// phase.
+func burstThenSustain(policy ThrottlePolicy, start time.Time, burst int, period, duration time.Duration) (int, int) {
+	burstAccepted, sustainAccepted := 0, 0
+	for index := 0; index < burst; index++ {
+		if accepted, _, _ := policy.Check(start); accepted {
+			burstAccepted++
+		}
+	}
+	for elapsed := period; elapsed <= duration; elapsed += period {
+		if accepted, _, _ := policy.Check(start.Add(elapsed)); accepted {
+			sustainAccepted++
+		}
+	}
+	return burstAccepted, sustainAccepted
+}
+
+
+func TestThrottlePoliciesBurstThenSustain(t *testing.T) {
+	start := time.Unix(1000000, 0)
+	// A token bucket takes the whole burst (up to its size),
+	// and then the sustained rate.
+	burst, sustained := burstThenSustain(NewTokenBucketThrottle(10, 5), start, 8, 100 * time.Millisecond, 2 * time.Second)
+	if burst != 5 || sustained != 20 {
+		t.Fatalf("token bucket at its rate: %d burst and %d sustained accepted, expected 5 and 20", burst, sustained)
+	}
+	burst, sustained = burstThenSustain(NewTokenBucketThrottle(10, 5), start, 8, 50 * time.Millisecond, 2 * time.Second)
+	if burst != 5 || sustained < 19 || sustained > 21 {
+		t.Fatalf("token bucket at twice its rate: %d burst and %d sustained accepted, expected 5 and about 20",
+			burst, sustained)
+	}
+	// The lapse punishes the burst, but takes the same rate.
+	burst, sustained = burstThenSustain(NewLapseThrottle(100 * time.Millisecond), start, 8, 100 * time.Millisecond, 2 * time.Second)
+	if burst != 1 || sustained != 20 {
+		t.Fatalf("lapse at its rate: %d burst and %d sustained accepted, expected 1 and 20", burst, sustained)
+	}
+	burst, sustained = burstThenSustain(NewLapseThrottle(100 * time.Millisecond), start, 8, 50 * time.Millisecond, 2 * time.Second)
+	if burst != 1 || sustained != 20 {
+		t.Fatalf("lapse at twice its rate: %d burst and %d sustained accepted, expected 1 and 20", burst, sustained)
+	}
+}
+
+
+func TestTokenBucketReportsRetryAfter(t *testing.T) {
+	policy := NewTokenBucketThrottle(4, 2)
+	start := time.Unix(1000000, 0)
+	for index := 0; index < 2; index++ {
+		if accepted, tokens, _ := policy.Check(start); !accepted || tokens != float64(1 - index) {
+			t.Fatalf("message %d: accepted=%v with %v tokens left", index, accepted, tokens)
+		}
+	}
+	if accepted, tokens, retryAfter := policy.Check(start.Add(125 * time.Millisecond)); accepted ||
+		tokens != 0.5 || retryAfter != 125 * time.Millisecond {
+		t.Fatalf("unexpected check: accepted=%v, %v tokens, retry after %v", accepted, tokens, retryAfter)
+	}
+	if accepted, _, _ := policy.Check(start.Add(250 * time.Millisecond)); !accepted {
+		t.Fatal("the message must be accepted once the retry lapse passed")
+	}
+}
+
+
+func TestThrottlePolicyOnAttendant(t *testing.T) {
+	harness := newThrottleHarness(t, time.Hour, func(attendant *Attendant) {
+		attendant.SetThrottlePolicy(NewTokenBucketThrottle(1, 3))
+	})
+	// The burst fits the bucket, despite the general throttle.
+	for index := 0; index < 3; index++ {
+		if rule, accepted := harness.outcome(t, "BURST"); !accepted {
+			t.Fatalf("message %d of the burst was throttled by %q", index, rule)
+		}
+	}
+	harness.send(t, "BURST", 1)
+	event := harness.nextThrottled(t)
+	if event.Tokens >= 1 || event.RetryAfter <= 0 || event.RetryAfter > time.Second {
+		t.Fatalf("unexpected throttled event: %v tokens, retry after %v", event.Tokens, event.RetryAfter)
+	}
+	// Back to the general throttle.
+	harness.attendant.SetThrottlePolicy(nil)
+	if harness.attendant.ThrottlePolicy() != nil {
+		t.Fatal("the policy was not removed")
+	}
+	harness.outcome(t, "LAPSE")
+	if _, accepted := harness.outcome(t, "LAPSE"); accepted {
+		t.Fatal("the general throttle must apply again")
+	}
+}
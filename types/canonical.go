@@ -0,0 +1,158 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+
+// Error raised when a normalized value has no canonical
+// form (it should not happen for values coming out of the
+// JSON normalization).
+type CanonicalValueError struct {
+	Value interface{}
+}
+
+
+// The error message.
+func (err CanonicalValueError) Error() string {
+	return fmt.Sprintf("value of type %T has no canonical form", err.Value)
+}
+
+
+// Encodes a message in a canonical, deterministic form:
+// the same command and semantically equal arguments will
+// always produce the same bytes, regardless of the map
+// iteration order or the numeric types being used. This
+// is suitable to compute signatures or digests that will
+// be verified on other processes.
+//
+// The output is a compact JSON array: [command, args,
+// kwargs], where:
+// - Map keys are sorted (kwargs, and any nested map).
+// - Integral numbers print their exact digits, with no
+//   precision loss (so integers beyond 2^53 never collide,
+//   and 3 and 3.0 encode the same).
+// - Non-integral numbers are normalized to float64 values,
+//   and printed in their shortest form.
+// - nil and empty args (or kwargs) encode the same.
+// - Any other value is first normalized through its JSON
+//   representation (e.g. structs become maps).
+func CanonicalEncode(command string, args Args, kwargs KWArgs) ([]byte, error) {
+	if args == nil {
+		args = Args{}
+	}
+	if kwargs == nil {
+		kwargs = KWArgs{}
+	}
+	var normalized interface{}
+	if raw, err := json.Marshal([]interface{}{command, args, kwargs}); err != nil {
+		return nil, err
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&normalized); err != nil {
+			return nil, err
+		}
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := writeCanonical(buffer, normalized); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+
+// Writes a normalized value in canonical form.
+func writeCanonical(buffer *bytes.Buffer, value interface{}) error {
+	switch typed := value.(type) {
+	case nil:
+		buffer.WriteString("null")
+	case bool:
+		if typed {
+			buffer.WriteString("true")
+		} else {
+			buffer.WriteString("false")
+		}
+	case json.Number:
+		if isIntegralLiteral(string(typed)) {
+			if typed == "-0" {
+				buffer.WriteString("0")
+			} else {
+				buffer.WriteString(string(typed))
+			}
+		} else if number, err := typed.Float64(); err != nil {
+			return err
+		} else {
+			buffer.WriteString(canonicalNumber(number))
+		}
+	case string:
+		if raw, err := json.Marshal(typed); err != nil {
+			return err
+		} else {
+			buffer.Write(raw)
+		}
+	case []interface{}:
+		buffer.WriteByte('[')
+		for index, item := range typed {
+			if index > 0 {
+				buffer.WriteByte(',')
+			}
+			if err := writeCanonical(buffer, item); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buffer.WriteByte('{')
+		for index, key := range keys {
+			if index > 0 {
+				buffer.WriteByte(',')
+			}
+			if err := writeCanonical(buffer, key); err != nil {
+				return err
+			}
+			buffer.WriteByte(':')
+			if err := writeCanonical(buffer, typed[key]); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte('}')
+	default:
+		return CanonicalValueError{value}
+	}
+	return nil
+}
+
+
+// Tells whether a JSON number literal is an integer (i.e.
+// it has neither a fraction nor an exponent). Such literals
+// are already canonical, since json.Marshal prints them
+// without leading zeros nor a plus sign.
+func isIntegralLiteral(literal string) bool {
+	return !strings.ContainsAny(literal, ".eE")
+}
+
+
+// Prints a number in its shortest canonical form.
+func canonicalNumber(number float64) string {
+	if number == 0 {
+		// Also normalizes the negative zero.
+		return "0"
+	} else if number == math.Trunc(number) && math.Abs(number) < 1e21 {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	} else {
+		return strconv.FormatFloat(number, 'g', -1, 64)
+	}
+}
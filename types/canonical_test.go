@@ -0,0 +1,89 @@
+package types
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+	"testing"
+)
+
+
+// Encodes a message, failing the test on errors.
+func mustCanonical(t *testing.T, command string, args Args, kwargs KWArgs) string {
+	encoded, err := CanonicalEncode(command, args, kwargs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+
+func TestCanonicalMapOrder(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"}
+	build := func(reversed bool) KWArgs {
+		kwargs := KWArgs{}
+		for index := range keys {
+			if reversed {
+				index = len(keys) - 1 - index
+			}
+			key := keys[index]
+			kwargs[key] = map[string]interface{}{key + "1": index, key + "2": []interface{}{index, key}}
+		}
+		return kwargs
+	}
+	expected := mustCanonical(t, "MAP", Args{build(false)}, build(false))
+	for round := 0; round < 50; round++ {
+		if encoded := mustCanonical(t, "MAP", Args{build(true)}, build(round%2 == 0)); encoded != expected {
+			t.Fatalf("round %d: %s differs from %s", round, encoded, expected)
+		}
+	}
+}
+
+
+func TestCanonicalLargeIntegers(t *testing.T) {
+	base := int64(1) << 53
+	if mustCanonical(t, "N", Args{base}, nil) == mustCanonical(t, "N", Args{base + 1}, nil) {
+		t.Fatal("2^53 and 2^53+1 collide")
+	}
+	cases := []struct {
+		value    interface{}
+		expected string
+	}{
+		{int64(math.MaxInt64), strconv.FormatInt(math.MaxInt64, 10)},
+		{int64(math.MinInt64), strconv.FormatInt(math.MinInt64, 10)},
+		{uint64(math.MaxUint64), strconv.FormatUint(math.MaxUint64, 10)},
+		{base + 1, strconv.FormatInt(base+1, 10)},
+	}
+	for _, test := range cases {
+		if encoded := mustCanonical(t, "N", Args{test.value}, nil); encoded != `["N",[`+test.expected+`],{}]` {
+			t.Fatalf("%v encoded as %s", test.value, encoded)
+		}
+	}
+}
+
+
+func TestCanonicalNumberTypes(t *testing.T) {
+	expected := `["N",[3,0,0.5,1e+21],{}]`
+	for _, args := range []Args{
+		{3, 0, 0.5, 1e21},
+		{uint8(3), int64(0), float32(0.5), 1e21},
+		{3.0, math.Copysign(0, -1), 0.5, float32(1e21)},
+	} {
+		if encoded := mustCanonical(t, "N", args, nil); encoded != expected {
+			t.Fatalf("%#v encoded as %s, expected %s", args, encoded, expected)
+		}
+	}
+	if encoded := mustCanonical(t, "EMPTY", nil, nil); encoded != mustCanonical(t, "EMPTY", Args{}, KWArgs{}) {
+		t.Fatalf("nil and empty differ: %s", encoded)
+	}
+}
+
+
+func TestCanonicalUnknownValue(t *testing.T) {
+	err := writeCanonical(&bytes.Buffer{}, struct{}{})
+	var canonicalErr CanonicalValueError
+	if !errors.As(err, &canonicalErr) {
+		t.Fatalf("unknown value gave %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+package types
+
+
+// The direction of the traffic in a connection, as seen
+// by the local side: inbound traffic is received, and
+// outbound traffic is sent.
+type Direction int
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+
+// A readable representation of the direction.
+func (direction Direction) String() string {
+	if direction == Inbound {
+		return "inbound"
+	} else {
+		return "outbound"
+	}
+}
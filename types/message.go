@@ -1,6 +1,9 @@
 package types
 
-import "io"
+import (
+	"bufio"
+	"io"
+)
 
 
 type Args []interface{}
@@ -24,17 +27,95 @@ type Message interface {
 }
 
 
+// Message Receivers are the reading half of a marshaler.
+// They will read from the underlying buffer until a new
+// message is available. Aside of the receive error, they
+// get a flag telling whether the error involves a graceful
+// close.
+type MessageReceiver interface {
+	Receive() (Message, error, bool)
+}
+
+
+// Message Senders are the writing half of a marshaler.
+// They will serialize the command and arguments, and
+// write them to the underlying buffer.
+type MessageSender interface {
+	Send(command string, args Args, kwargs KWArgs) error
+}
+
+
+// Marshaler Factories create new marshalers around a
+// read-writer object (e.g. a socket). Implementations
+// are typically prototype instances of the marshaler
+// they create.
+type MarshalerFactory interface {
+	// Constructor - Creates a new marshaler by its buffer.
+	Create(io.ReadWriter) MessageMarshaler
+}
+
+
+// Receiver Factories create just the reading half of a
+// marshaler around a read-writer object. They are meant
+// for receive-only tools (see NewAttendantFromHalves).
+type ReceiverFactory interface {
+	// Constructor - Creates a new receiver by its buffer.
+	CreateReceiver(io.ReadWriter) MessageReceiver
+}
+
+
+// Sender Factories create just the writing half of a
+// marshaler around a read-writer object. They are meant
+// for send-only tools (see NewAttendantFromHalves).
+type SenderFactory interface {
+	// Constructor - Creates a new sender by its buffer.
+	CreateSender(io.ReadWriter) MessageSender
+}
+
+
 // Message Marshalers are wrappers around a read-write
 // object, and will do their magic to receive / send
 // Message objects (implementations will vary, but the
-// interface will be respected). This interface has a
-// constructor taking a read-writer and creating the
-// wrapper for it. Aside of the receive error, it gets
-// a flag telling whether the error involves a graceful
-// close.
+// interface will be respected). This interface is the
+// composition of the receiver, the sender, and the
+// factory interfaces: read-only or write-only tools
+// may just implement the halves they need.
 type MessageMarshaler interface {
-	Receive()                                      (Message, error, bool)
-	Send(command string, args Args, kwargs KWArgs) error
-	// Constructor - Creates a new marshaler by its buffer.
-	Create(io.ReadWriter)                          MessageMarshaler
+	MessageReceiver
+	MessageSender
+	MarshalerFactory
+}
+
+
+// Frame Sizers are an optional interface for receivers
+// able to tell the size (in bytes, as read from the
+// underlying buffer) of the last message they received.
+// Wrapping marshalers should tell the size of the frames
+// of the marshaler they wrap, if it is a frame sizer.
+type FrameSizer interface {
+	LastFrameSize() int
+}
+
+
+// Message Rejection errors are an optional interface for
+// the errors returned by MessageReceiver.Receive, telling
+// only the received message was rejected (e.g. it holds
+// invalid data): it was consumed entirely, so the stream
+// is still consistent and the next messages may be read.
+// Other receive errors end the reading.
+type MessageRejectionError interface {
+	error
+	MessageRejected() bool
+}
+
+
+// Buffered Read-Writers are an optional interface for the
+// read-writers handed to MarshalerFactory.Create, telling
+// they already read through a buffered reader (which is
+// reused across messages). Marshalers needing a buffered
+// reader should take that one instead of wrapping the
+// read-writer again.
+type BufferedReadWriter interface {
+	io.ReadWriter
+	BufferedReader() *bufio.Reader
 }
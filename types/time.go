@@ -0,0 +1,111 @@
+package types
+
+import "time"
+
+
+// The key marking a time value in text marshalers. A
+// time.Time placed in the args or kwargs is conveyed as a
+// single-key map: {TimeMarker: <RFC3339Nano string>}, which
+// keeps both the nanosecond precision and the zone offset.
+// Binary marshalers use their own native representation.
+const TimeMarker = "$time"
+
+
+// Replaces, recursively, all the time.Time values inside
+// lists and maps (Args, KWArgs, []interface{} and
+// map[string]interface{}) with their marked form. The
+// given value is not modified: containers are copied.
+func MarkTimes(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case time.Time:
+		return map[string]interface{}{TimeMarker: typed.Format(time.RFC3339Nano)}
+	case Args:
+		return Args(markList(typed))
+	case []interface{}:
+		return markList(typed)
+	case KWArgs:
+		return KWArgs(markMap(typed))
+	case map[string]interface{}:
+		return markMap(typed)
+	default:
+		return value
+	}
+}
+
+
+// Marks the times in a list.
+func markList(list []interface{}) []interface{} {
+	if list == nil {
+		return nil
+	}
+	result := make([]interface{}, len(list))
+	for index, item := range list {
+		result[index] = MarkTimes(item)
+	}
+	return result
+}
+
+
+// Marks the times in a map.
+func markMap(entries map[string]interface{}) map[string]interface{} {
+	if entries == nil {
+		return nil
+	}
+	result := make(map[string]interface{}, len(entries))
+	for key, item := range entries {
+		result[key] = MarkTimes(item)
+	}
+	return result
+}
+
+
+// Tells whether a value is a marked time, and parses it.
+func UnmarkTime(value interface{}) (time.Time, bool) {
+	if entries, ok := value.(map[string]interface{}); !ok || len(entries) != 1 {
+		return time.Time{}, false
+	} else if text, ok := entries[TimeMarker].(string); !ok {
+		return time.Time{}, false
+	} else if instant, err := time.Parse(time.RFC3339Nano, text); err != nil {
+		return time.Time{}, false
+	} else {
+		return instant, true
+	}
+}
+
+
+// Replaces, recursively and in place, all the marked times
+// inside lists and maps (Args, KWArgs, []interface{} and
+// map[string]interface{}) with time.Time values. Returns
+// the resulting value.
+func UnmarkTimes(value interface{}) interface{} {
+	if instant, ok := UnmarkTime(value); ok {
+		return instant
+	}
+	switch typed := value.(type) {
+	case Args:
+		unmarkList(typed)
+	case []interface{}:
+		unmarkList(typed)
+	case KWArgs:
+		unmarkMap(typed)
+	case map[string]interface{}:
+		unmarkMap(typed)
+	}
+	return value
+}
+
+
+// Unmarks the times in a list.
+func unmarkList(list []interface{}) {
+	for index, item := range list {
+		list[index] = UnmarkTimes(item)
+	}
+}
+
+
+// Unmarks the times in a map.
+func unmarkMap(entries map[string]interface{}) {
+	for key, item := range entries {
+		entries[key] = UnmarkTimes(item)
+	}
+}
@@ -0,0 +1,71 @@
+package types
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+
+// Instants with nanoseconds and several zone offsets.
+var markedInstants = []time.Time{
+	time.Date(2024, 2, 29, 23, 59, 59, 999999999, time.UTC),
+	time.Date(1999, 12, 31, 1, 2, 3, 1, time.FixedZone("", -(3*3600 + 30*60))),
+	time.Date(2030, 6, 15, 12, 0, 0, 123456789, time.FixedZone("", 14*3600)),
+	time.Date(1970, 1, 1, 0, 0, 0, 0, time.FixedZone("", 5*3600 + 45*60)),
+}
+
+
+// Tells whether two instants are the same, with the same
+// zone offset.
+func sameInstant(left, right time.Time) bool {
+	_, leftOffset := left.Zone()
+	_, rightOffset := right.Zone()
+	return left.Equal(right) && leftOffset == rightOffset && left.Nanosecond() == right.Nanosecond()
+}
+
+
+func TestMarkTimesRoundTrip(t *testing.T) {
+	for _, instant := range markedInstants {
+		args := Args{instant, []interface{}{1, instant}, map[string]interface{}{"at": instant}}
+		kwargs := KWArgs{"at": instant, "nested": KWArgs{"list": []interface{}{instant}}}
+		markedArgs := MarkTimes(args).(Args)
+		markedKWArgs := MarkTimes(kwargs).(KWArgs)
+		// The originals are not modified.
+		if !sameInstant(args[0].(time.Time), instant) || !sameInstant(kwargs["at"].(time.Time), instant) {
+			t.Fatalf("the original values were modified")
+		}
+		if _, isMarked := markedArgs[0].(map[string]interface{})[TimeMarker].(string); !isMarked {
+			t.Fatalf("the time was not marked: %#v", markedArgs[0])
+		}
+
+		unmarkedArgs := UnmarkTimes(markedArgs).(Args)
+		unmarkedKWArgs := UnmarkTimes(markedKWArgs).(KWArgs)
+		for _, restored := range []interface{}{
+			unmarkedArgs[0], unmarkedArgs[1].([]interface{})[1], unmarkedArgs[2].(map[string]interface{})["at"],
+			unmarkedKWArgs["at"], unmarkedKWArgs["nested"].(KWArgs)["list"].([]interface{})[0],
+		} {
+			if restoredTime, ok := restored.(time.Time); !ok || !sameInstant(restoredTime, instant) {
+				t.Fatalf("expected %v, got %#v", instant, restored)
+			}
+		}
+	}
+}
+
+
+func TestUnmarkTimesLeavesOtherMaps(t *testing.T) {
+	for _, value := range []map[string]interface{}{
+		{TimeMarker: "yesterday"},
+		{TimeMarker: 12345},
+		{TimeMarker: "2024-01-01T00:00:00Z", "other": 1},
+		{"time": "2024-01-01T00:00:00Z"},
+	} {
+		copied := map[string]interface{}{}
+		for key, item := range value {
+			copied[key] = item
+		}
+		if restored := UnmarkTimes(value); !reflect.DeepEqual(restored, copied) {
+			t.Fatalf("%#v must stay as it is, got %#v", copied, restored)
+		}
+	}
+}
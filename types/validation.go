@@ -0,0 +1,183 @@
+package types
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+
+// Error raised when a value in the args or kwargs of a
+// message cannot be serialized. It tells the path to the
+// offending value, e.g. `kwargs["player"].Inventory[3]`.
+type UnserializableValueError struct {
+	Path   string
+	Reason string
+}
+
+
+// The error message.
+func (err UnserializableValueError) Error() string {
+	return "unserializable value at " + err.Path + ": " + err.Reason
+}
+
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+
+// Validates that all the values in the args and kwargs can
+// be serialized by the bundled marshalers, before anything
+// is written. Rejected values are: channels, functions,
+// complex numbers, unsafe pointers, NaN or infinite floats,
+// maps with non-string (or non-integer) keys, and cyclic
+// structures. Only the struct fields the JSON encoding sees
+// are walked: exported ones (and the embedded structs whose
+// fields are promoted), except those tagged as `json:"-"`.
+// Values implementing json.Marshaler or TextMarshaler are
+// taken as they are.
+func ValidateArgs(args Args, kwargs KWArgs) error {
+	for index, arg := range args {
+		if err := validateValue(reflect.ValueOf(arg), "args[" + strconv.Itoa(index) + "]", map[uintptr]bool{}); err != nil {
+			return err
+		}
+	}
+	for key, value := range kwargs {
+		if err := validateValue(reflect.ValueOf(value), "kwargs[" + strconv.Quote(key) + "]", map[uintptr]bool{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+
+// Validates a single value, recursively. The visiting set
+// holds the references in the current path, so cycles can
+// be told apart from mere shared references.
+func validateValue(value reflect.Value, path string, visiting map[uintptr]bool) error {
+	if !value.IsValid() {
+		return nil
+	}
+	valueType := value.Type()
+	if valueType.Implements(jsonMarshalerType) || valueType.Implements(textMarshalerType) {
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return nil
+	case reflect.Float32, reflect.Float64:
+		if number := value.Float(); math.IsNaN(number) || math.IsInf(number, 0) {
+			return UnserializableValueError{path, fmt.Sprintf("unsupported float value: %v", number)}
+		}
+		return nil
+	case reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return UnserializableValueError{path, "unsupported kind: " + value.Kind().String()}
+	case reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		return validateValue(value.Elem(), path, visiting)
+	case reflect.Ptr:
+		if value.IsNil() {
+			return nil
+		}
+		return validateReference(value, path, visiting, func() error {
+			return validateValue(value.Elem(), path, visiting)
+		})
+	case reflect.Slice:
+		if value.IsNil() || valueType.Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+		return validateReference(value, path, visiting, func() error {
+			return validateItems(value, path, visiting)
+		})
+	case reflect.Array:
+		return validateItems(value, path, visiting)
+	case reflect.Map:
+		if value.IsNil() {
+			return nil
+		}
+		switch valueType.Key().Kind() {
+		case reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		default:
+			if !valueType.Key().Implements(textMarshalerType) {
+				return UnserializableValueError{path, "unsupported map key type: " + valueType.Key().String()}
+			}
+		}
+		return validateReference(value, path, visiting, func() error {
+			iterator := value.MapRange()
+			for iterator.Next() {
+				keyPath := path + "[" + fmt.Sprintf("%#v", iterator.Key()) + "]"
+				if err := validateValue(iterator.Value(), keyPath, visiting); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case reflect.Struct:
+		for index := 0; index < valueType.NumField(); index++ {
+			field := valueType.Field(index)
+			if !jsonVisible(field) {
+				continue
+			}
+			if err := validateValue(value.Field(index), path + "." + field.Name, visiting); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return UnserializableValueError{path, "unsupported kind: " + value.Kind().String()}
+	}
+}
+
+
+// Tells whether the JSON encoding sees a struct field: it
+// must not be tagged as `json:"-"`, and it must be exported
+// or embed a struct (or a pointer to one), whose exported
+// fields are promoted.
+func jsonVisible(field reflect.StructField) bool {
+	if field.Tag.Get("json") == "-" {
+		return false
+	} else if field.PkgPath == "" {
+		return true
+	} else if !field.Anonymous {
+		return false
+	}
+	fieldType := field.Type
+	if fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	return fieldType.Kind() == reflect.Struct
+}
+
+
+// Validates the items of a slice or array.
+func validateItems(value reflect.Value, path string, visiting map[uintptr]bool) error {
+	for index := 0; index < value.Len(); index++ {
+		if err := validateValue(value.Index(index), path + "[" + strconv.Itoa(index) + "]", visiting); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+
+// Validates a reference value (pointer, slice, map) while
+// keeping track of it in the current path, to detect cycles.
+func validateReference(value reflect.Value, path string, visiting map[uintptr]bool, validate func() error) error {
+	pointer := value.Pointer()
+	if visiting[pointer] {
+		return UnserializableValueError{path, "cyclic structure"}
+	}
+	visiting[pointer] = true
+	defer delete(visiting, pointer)
+	return validate()
+}
@@ -0,0 +1,89 @@
+package types
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+
+type inventory struct {
+	Items []interface{}
+}
+
+
+type player struct {
+	Name      string
+	Inventory inventory
+}
+
+
+type hiddenState struct {
+	Name    string
+	updates chan int
+	notify  func()
+	Ignored chan int `json:"-"`
+}
+
+
+type embeddedState struct {
+	inventory
+	Level int
+}
+
+
+// Expects the args and kwargs to be rejected at the given
+// path.
+func expectRejected(t *testing.T, args Args, kwargs KWArgs, path string) {
+	t.Helper()
+	err := ValidateArgs(args, kwargs)
+	var unserializable UnserializableValueError
+	if !errors.As(err, &unserializable) {
+		t.Fatalf("expected an unserializable value error, got: %v", err)
+	} else if unserializable.Path != path {
+		t.Fatalf("expected the path %s, got: %s (%v)", path, unserializable.Path, err)
+	}
+}
+
+
+func TestValidateArgsRejects(t *testing.T) {
+	expectRejected(t, Args{1, make(chan int)}, nil, "args[1]")
+	expectRejected(t, nil, KWArgs{"callback": func() {}}, `kwargs["callback"]`)
+	expectRejected(t, Args{math.NaN()}, nil, "args[0]")
+	expectRejected(t, Args{[]float64{1, math.Inf(1)}}, nil, "args[0][1]")
+	expectRejected(t, Args{float32(math.Inf(-1))}, nil, "args[0]")
+	expectRejected(t, Args{complex(1, 2)}, nil, "args[0]")
+	expectRejected(t, Args{map[float64]int{1.5: 1}}, nil, "args[0]")
+	expectRejected(t, nil, KWArgs{"player": &player{"alice", inventory{[]interface{}{1, 2, 3, make(chan int)}}}},
+		`kwargs["player"].Inventory.Items[3]`)
+	expectRejected(t, Args{embeddedState{inventory{[]interface{}{func() {}}}, 1}}, nil, "args[0].inventory.Items[0]")
+}
+
+
+func TestValidateArgsRejectsCycles(t *testing.T) {
+	cyclic := map[string]interface{}{"name": "root"}
+	cyclic["self"] = cyclic
+	expectRejected(t, Args{cyclic}, nil, `args[0]["self"]`)
+
+	list := []interface{}{1, nil}
+	list[1] = list
+	expectRejected(t, nil, KWArgs{"list": list}, `kwargs["list"][1]`)
+}
+
+
+func TestValidateArgsAccepts(t *testing.T) {
+	// Shared (but acyclic) references are fine.
+	shared := map[string]interface{}{"value": 1}
+	args := Args{
+		nil, true, "text", 1, uint8(2), 3.5, []byte("raw"), time.Now(),
+		[]interface{}{shared, shared}, map[int]string{1: "one"},
+		&player{"bob", inventory{[]interface{}{"sword"}}},
+		// Unexported and json:"-" fields are not serialized.
+		hiddenState{Name: "state", updates: make(chan int), notify: func() {}, Ignored: make(chan int)},
+		embeddedState{inventory{[]interface{}{"shield"}}, 2},
+	}
+	if err := ValidateArgs(args, KWArgs{"shared": shared, "nothing": nil}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package chasqui
+
+import (
+	. "github.com/universe-10th/chasqui/types"
+	"net"
+	"time"
+)
+
+
+// Any of the events an attendant triggers. Attendants given a
+// unified channel (see WithUnifiedEvents) trigger all of their
+// events through it, as values of the concrete event types
+// (e.g. AttendantStartedEvent, MessageEvent, ThrottledEvent or
+// AttendantStoppedEvent), in the order they occur.
+type AttendantEvent interface {
+	isAttendantEvent()
+}
+
+
+func (AttendantStartedEvent) isAttendantEvent()       {}
+func (MessageEvent) isAttendantEvent()                {}
+func (ThrottledEvent) isAttendantEvent()              {}
+func (AttendantStoppedEvent) isAttendantEvent()       {}
+func (BandwidthExceededEvent) isAttendantEvent()      {}
+func (EventOverflowEvent) isAttendantEvent()          {}
+func (AttendantAuthenticatedEvent) isAttendantEvent() {}
+func (SlowConsumerEvent) isAttendantEvent()           {}
+func (SendFailedEvent) isAttendantEvent()             {}
+func (AttendantHalfClosedEvent) isAttendantEvent()    {}
+func (AttendantUnresponsiveEvent) isAttendantEvent()  {}
+func (MessageRejectedEvent) isAttendantEvent()        {}
+
+
+// Returns a read-only channel with all the events of the
+// attendant, in the order they occur. It will be nil unless a
+// unified channel was given on construction.
+func (attendant *Attendant) Events() <-chan AttendantEvent {
+	return attendant.events
+}
+
+
+// Tells whether the attendant triggers its events through a
+// unified channel.
+func (attendant *Attendant) unified() bool {
+	return attendant.events != nil
+}
+
+
+// Triggers an event through the unified channel, waiting until
+// there is room or the quit channel is closed (nil means never).
+// Returns whether the event was taken.
+func (attendant *Attendant) emitUnified(event AttendantEvent, quit <-chan struct{}) bool {
+	select {
+	case attendant.events <- event:
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+
+// Delivers a message (or throttled) event through the unified
+// channel, according to the event delivery policy. Since the
+// channel also holds the lifecycle events, nothing is evicted
+// from it: EventDeliveryDropOldest drops the new event, as
+// EventDeliveryDrop does. Blocking deliveries give up when the
+// quit channel is closed (nil means never), returning false.
+func (attendant *Attendant) deliverUnified(event AttendantEvent, quit <-chan struct{}) bool {
+	if attendant.eventDelivery == EventDeliveryBlock {
+		return attendant.emitUnified(event, quit)
+	}
+	select {
+	case attendant.events <- event:
+	default:
+		attendant.dropEvent()
+	}
+	return true
+}
+
+
+// Creates an autonomous client (in a context where only one is
+// needed) triggering all of its events, in order, through a
+// single unified channel with the given buffer size (see
+// Attendant.Events).
+func NewUnifiedClient(connection net.Conn, factory MarshalerFactory, throttle time.Duration, bufferSize uint) *Attendant {
+	return NewAttendant(
+		connection, factory, throttle, nil, nil, nil, nil,
+		WithUnifiedEvents(make(chan AttendantEvent, bufferSize)),
+	)
+}
@@ -0,0 +1,123 @@
+package chasqui
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// Collects the events of a unified attendant until the stopped
+// one, failing the test if it does not come in time.
+func collectUnified(t *testing.T, attendant *Attendant) []AttendantEvent {
+	t.Helper()
+	var events []AttendantEvent
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case event := <-attendant.Events():
+			events = append(events, event)
+			if _, ok := event.(AttendantStoppedEvent); ok {
+				return events
+			}
+		case <-timeout:
+			t.Fatalf("no stopped event after %d events", len(events))
+			return nil
+		}
+	}
+}
+
+
+func TestUnifiedEventsOrder(t *testing.T) {
+	const messages = 20
+	for round := 0; round < 50; round++ {
+		local, remote := net.Pipe()
+		// Only the first message passes the general throttle.
+		attendant := NewUnifiedClient(local, &json.JSONMessageMarshaler{}, time.Hour, 4)
+		// The peer writes right away, racing the start.
+		go func() {
+			peer := (&json.JSONMessageMarshaler{}).Create(remote)
+			for sequence := 0; sequence < messages; sequence++ {
+				if peer.Send("MOVE", Args{sequence}, nil) != nil {
+					break
+				}
+			}
+			// noinspection GoUnhandledErrorResult
+			remote.Close()
+		}()
+		if err := attendant.Start(); err != nil {
+			t.Fatal(err)
+		}
+		events := collectUnified(t, attendant)
+
+		if _, ok := events[0].(AttendantStartedEvent); !ok {
+			t.Fatalf("round %d: the first event must be the started one, got: %T", round, events[0])
+		}
+		stopped := events[len(events) - 1].(AttendantStoppedEvent)
+		if stopped.StopType != AttendantRemoteStop {
+			t.Fatalf("round %d: unexpected stop: %v (%v)", round, stopped.StopType, stopped.Error)
+		}
+		sequence := 0
+		for index, event := range events[1:len(events) - 1] {
+			var message Message
+			switch value := event.(type) {
+			case MessageEvent:
+				if sequence != 0 {
+					t.Fatalf("round %d: message %d was not throttled", round, sequence)
+				}
+				message = value.Message
+			case ThrottledEvent:
+				if sequence == 0 {
+					t.Fatalf("round %d: the first message was throttled", round)
+				}
+				message = value.Message
+			default:
+				t.Fatalf("round %d: unexpected event %d: %T", round, index + 1, event)
+			}
+			if got := int(message.Args()[0].(float64)); got != sequence {
+				t.Fatalf("round %d: message %d arrived as %d", round, sequence, got)
+			}
+			sequence++
+		}
+		if sequence != messages {
+			t.Fatalf("round %d: %d of %d messages arrived", round, sequence, messages)
+		}
+		select {
+		case event := <-attendant.Events():
+			t.Fatalf("round %d: an event came after the stopped one: %T", round, event)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+
+func TestUnifiedEventsSkipTheLegacyChannels(t *testing.T) {
+	local, remote := net.Pipe()
+	started, stopped := make(chan AttendantStartedEvent, 1), make(chan AttendantStoppedEvent, 1)
+	messages, throttled := make(chan MessageEvent, 4), make(chan ThrottledEvent, 4)
+	attendant := NewAttendant(
+		local, &json.JSONMessageMarshaler{}, time.Hour, started, stopped, messages, throttled,
+		WithUnifiedEvents(make(chan AttendantEvent, 8)),
+	)
+	if err := attendant.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		peer := (&json.JSONMessageMarshaler{}).Create(remote)
+		for sequence := 0; sequence < 2; sequence++ {
+			// noinspection GoUnhandledErrorResult
+			peer.Send("MOVE", Args{sequence}, nil)
+		}
+		// noinspection GoUnhandledErrorResult
+		remote.Close()
+	}()
+	if events := collectUnified(t, attendant); len(events) != 4 {
+		t.Fatalf("expected the started, message, throttled and stopped events, got %d events", len(events))
+	}
+	if len(started) + len(stopped) + len(messages) + len(throttled) != 0 {
+		t.Fatal("events were delivered twice, through the legacy channels as well")
+	}
+}
@@ -0,0 +1,123 @@
+package chasqui
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+
+// Error used to abort an attendant whose peer stayed silent
+// for too long (see Keepalive.KillAfter). It also matches
+// ErrKeepaliveTimeout.
+type UnresponsiveError struct {
+	SilentFor time.Duration
+}
+
+
+// The error message.
+func (err UnresponsiveError) Error() string {
+	return fmt.Sprintf("keepalive timeout: nothing received for %s", err.SilentFor)
+}
+
+
+// Tells whether the error matches the given sentinel.
+func (err UnresponsiveError) Is(target error) bool {
+	return target == ErrKeepaliveTimeout
+}
+
+
+// Event reporting the peer of an attendant stayed silent (not
+// even replying pings) for longer than the warning time (see
+// Keepalive.WarnAfter), or that it is heard again (Unresponsive
+// is false). It tells how long the peer has been (or was)
+// silent.
+type AttendantUnresponsiveEvent struct {
+	Attendant    *Attendant
+	AttendantID  uint64
+	Unresponsive bool
+	SilentFor    time.Duration
+}
+
+
+// What the assessment of the silence of a peer tells to do.
+type responsiveness int
+
+
+const (
+	responsivenessSteady responsiveness = iota
+	responsivenessWarn
+	responsivenessRecover
+	responsivenessKill
+)
+
+
+// Returns a read-only channel with all the "unresponsive"
+// events. It will be nil unless a channel was given on
+// construction.
+func (attendant *Attendant) UnresponsiveEvent() <-chan AttendantUnresponsiveEvent {
+	return attendant.unresponsiveEvent
+}
+
+
+// Tells whether the peer is currently considered unresponsive.
+// Attendants without a keepalive warning time never are.
+func (attendant *Attendant) Unresponsive() bool {
+	return attendant.keepalive != nil && atomic.LoadInt32(&attendant.keepalive.unresponsive) == 1
+}
+
+
+// Tells the instant the peer was last heard of (or the instant
+// the attendant started, if never).
+func (attendant *Attendant) lastHeardAt() time.Time {
+	if received := atomic.LoadInt64(&attendant.stats.lastReceivedAt); received != 0 {
+		return time.Unix(0, received)
+	}
+	return unixInstant(atomic.LoadInt64(&attendant.stats.startedAt))
+}
+
+
+// Assesses the silence of the peer at the given instant, given
+// the instant it was last heard of. Tells what to do, and how
+// long the peer has been (or, when recovering, was) silent.
+// Only the ping loop calls it.
+func (keepalive *keepaliveState) assess(now, lastHeard time.Time) (responsiveness, time.Duration) {
+	config := keepalive.config
+	silentFor := now.Sub(lastHeard)
+	if config.KillAfter > 0 && silentFor >= config.KillAfter {
+		return responsivenessKill, silentFor
+	}
+	if config.WarnAfter <= 0 {
+		return responsivenessSteady, silentFor
+	}
+	unresponsive := atomic.LoadInt32(&keepalive.unresponsive) == 1
+	if !unresponsive && silentFor >= config.WarnAfter {
+		atomic.StoreInt32(&keepalive.unresponsive, 1)
+		keepalive.silentSince = lastHeard
+		return responsivenessWarn, silentFor
+	} else if unresponsive && lastHeard.After(keepalive.silentSince) {
+		atomic.StoreInt32(&keepalive.unresponsive, 0)
+		return responsivenessRecover, lastHeard.Sub(keepalive.silentSince)
+	}
+	return responsivenessSteady, silentFor
+}
+
+
+// Triggers an unresponsive event, unless there is no channel
+// for them. Gives up (returning false) if the ping loop is
+// told to finish meanwhile.
+func (attendant *Attendant) emitUnresponsive(unresponsive bool, silentFor time.Duration) bool {
+	if attendant.unresponsiveEvent == nil && !attendant.unified() {
+		return true
+	}
+	event := AttendantUnresponsiveEvent{attendant, attendant.id, unresponsive, silentFor}
+	if attendant.unified() {
+		return attendant.emitUnified(event, attendant.keepalive.quit)
+	}
+	select {
+	case attendant.unresponsiveEvent <- event:
+		return true
+	case <-attendant.keepalive.quit:
+		return false
+	}
+}
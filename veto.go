@@ -0,0 +1,104 @@
+package chasqui
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+
+// The reason a dispatcher rejected (and closed) a connection
+// right when it was accepted.
+type RejectReason int
+
+
+const (
+	// The connection is not rejected (only meaningful as the
+	// result of an accept veto).
+	NotRejected RejectReason = iota
+	// The accept filter rejected the remote address.
+	RejectedByFilter
+	// The accept veto rejected the connection.
+	RejectedByVeto
+	// The server is in maintenance mode.
+	RejectedByMaintenance
+	// The TLS handshake failed (e.g. a missing or invalid
+	// client certificate).
+	RejectedByTLSHandshake
+	// The TLS verification callback refused the handshake.
+	RejectedByTLSVerify
+)
+
+
+// The name of the reason.
+func (reason RejectReason) String() string {
+	switch reason {
+	case NotRejected:
+		return "not rejected"
+	case RejectedByFilter:
+		return "filter"
+	case RejectedByVeto:
+		return "veto"
+	case RejectedByMaintenance:
+		return "maintenance"
+	case RejectedByTLSHandshake:
+		return "TLS handshake"
+	case RejectedByTLSVerify:
+		return "TLS verification"
+	default:
+		return "unknown"
+	}
+}
+
+
+// Vetoes the incoming connections right when they are accepted
+// (after the accept filter), considering any state (e.g. the
+// current connection count, or the connections per address).
+// Returns NotRejected to let a connection through, or else the
+// reason to reject it: it is closed right away, so it never
+// gets an attendant. It runs in the accept loop, so it should
+// be fast.
+type AcceptVeto func(conn net.Conn) RejectReason
+
+
+// Makes the dispatcher veto the accepted connections (after
+// the accept filter, if any): the rejected ones are closed
+// right away, and reported to the given callback (if any)
+// instead of the accept success one.
+func WithDispatcherAcceptVeto(veto AcceptVeto, onRejected OnDispatcherReject) DispatcherOption {
+	return func(dispatcher *Dispatcher) {
+		dispatcher.acceptVeto = veto
+		dispatcher.onReject = onRejected
+	}
+}
+
+
+// Turns the maintenance mode on or off. While on, the new
+// connections are rejected right when they are accepted (a
+// ConnectionRejectedEvent tells RejectedByMaintenance), while
+// the running attendants keep running. It may be called from
+// any goroutine.
+func (server *Server) MaintenanceMode(on bool) {
+	if on {
+		atomic.StoreInt32(&server.maintenance, 1)
+	} else {
+		atomic.StoreInt32(&server.maintenance, 0)
+	}
+}
+
+
+// Tells whether the maintenance mode is on.
+func (server *Server) InMaintenance() bool {
+	return atomic.LoadInt32(&server.maintenance) == 1
+}
+
+
+// The veto the server gives its dispatchers: the maintenance
+// mode, and then the accept veto (if any).
+func (server *Server) veto(conn net.Conn) RejectReason {
+	if server.InMaintenance() {
+		return RejectedByMaintenance
+	} else if server.acceptVeto != nil {
+		return server.acceptVeto(conn)
+	}
+	return NotRejected
+}
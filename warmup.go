@@ -0,0 +1,154 @@
+package chasqui
+
+import (
+	. "github.com/universe-10th/chasqui/types"
+	"net"
+	"sync"
+	"time"
+)
+
+
+// The command of the notice sent to the connections being
+// rejected while the server warms up. Its "after" kwarg
+// tells the seconds to wait before retrying.
+const RetryAfterCommand = "__RETRY_AFTER"
+
+
+// The progress of the warmup of a server. While warming up,
+// the accepted connections are admitted at a limited rate,
+// which ramps from an initial rate to a final one (both in
+// connections per second) over the warmup duration.
+type WarmupStatus struct {
+	Warming  bool
+	Elapsed  time.Duration
+	Progress float64
+	Rate     float64
+	Admitted uint64
+	Rejected uint64
+}
+
+
+// The warmup state of a server: the ramp configuration, and
+// a token bucket admitting connections at the current rate.
+type warmup struct {
+	mutex       sync.Mutex
+	duration    time.Duration
+	initialRate float64
+	finalRate   float64
+	retryAfter  time.Duration
+	started     time.Time
+	ready       bool
+	tokens      float64
+	refilled    time.Time
+	admitted    uint64
+	rejected    uint64
+}
+
+
+// Starts (or restarts) the warmup.
+func (warmup *warmup) start(now time.Time) {
+	warmup.mutex.Lock()
+	defer warmup.mutex.Unlock()
+	warmup.started = now
+	warmup.refilled = now
+	warmup.ready = false
+	warmup.tokens = 0
+	warmup.admitted = 0
+	warmup.rejected = 0
+}
+
+
+// Ends the warmup right now.
+func (warmup *warmup) end() {
+	warmup.mutex.Lock()
+	defer warmup.mutex.Unlock()
+	warmup.ready = true
+}
+
+
+// Computes the progress and the current rate. Must be
+// called with the mutex locked.
+func (warmup *warmup) ramp(now time.Time) (bool, time.Duration, float64, float64) {
+	elapsed := now.Sub(warmup.started)
+	if warmup.ready || elapsed >= warmup.duration {
+		return false, elapsed, 1, warmup.finalRate
+	}
+	progress := float64(elapsed) / float64(warmup.duration)
+	return true, elapsed, progress, warmup.initialRate + (warmup.finalRate - warmup.initialRate) * progress
+}
+
+
+// Tells whether a new connection is admitted. Connections
+// are always admitted once the warmup is over.
+func (warmup *warmup) admit(now time.Time) bool {
+	warmup.mutex.Lock()
+	defer warmup.mutex.Unlock()
+	warming, _, _, rate := warmup.ramp(now)
+	if !warming {
+		warmup.admitted++
+		return true
+	}
+	// The bucket holds up to one second of connections
+	// (but at least one connection).
+	warmup.tokens += now.Sub(warmup.refilled).Seconds() * rate
+	warmup.refilled = now
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	if warmup.tokens > burst {
+		warmup.tokens = burst
+	}
+	if warmup.tokens >= 1 {
+		warmup.tokens--
+		warmup.admitted++
+		return true
+	}
+	warmup.rejected++
+	return false
+}
+
+
+// Takes a snapshot of the warmup progress.
+func (warmup *warmup) status(now time.Time) WarmupStatus {
+	warmup.mutex.Lock()
+	defer warmup.mutex.Unlock()
+	warming, elapsed, progress, rate := warmup.ramp(now)
+	return WarmupStatus{
+		Warming:  warming,
+		Elapsed:  elapsed,
+		Progress: progress,
+		Rate:     rate,
+		Admitted: warmup.admitted,
+		Rejected: warmup.rejected,
+	}
+}
+
+
+// Rejects a connection while warming up: sends the retry
+// after notice (bounded by a short write deadline) and
+// closes the connection.
+func (server *Server) reject(conn net.Conn) {
+	server.sendAndClose(conn, RetryAfterCommand, Args{}, KWArgs{
+		"after": server.warmup.retryAfter.Seconds(),
+	})
+}
+
+
+// Tells the server the application is ready to handle the
+// full load, ending the warmup (if any) right now.
+func (server *Server) Ready() {
+	if server.warmup != nil {
+		server.warmup.end()
+	}
+}
+
+
+// Reports the progress of the warmup. Servers without
+// warmup are never warming.
+func (server *Server) Warmup() WarmupStatus {
+	if server.warmup == nil {
+		return WarmupStatus{Progress: 1}
+	}
+	return server.warmup.status(time.Now())
+}
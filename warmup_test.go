@@ -0,0 +1,120 @@
+package chasqui
+
+import (
+	json2 "encoding/json"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+
+func TestWarmupAdmissionCurve(t *testing.T) {
+	// The rate ramps from 0 to 100 connections per second
+	// over 10 seconds, while a storm of 1000 connections per
+	// second tries to get in: the admitted ones follow the
+	// integral of the rate (100 * t² / 20).
+	state := &warmup{duration: 10 * time.Second, initialRate: 0, finalRate: 100}
+	start := time.Unix(1000000, 0)
+	state.start(start)
+	attempts := 0
+	for step := 1; step <= 10000; step++ {
+		now := start.Add(time.Duration(step) * time.Millisecond)
+		state.admit(now)
+		attempts++
+		if step % 1000 == 0 {
+			elapsed := float64(step) / 1000
+			expected := 100 * elapsed * elapsed / 20
+			status := state.status(now)
+			if math.Abs(float64(status.Admitted) - expected) > 2 {
+				t.Fatalf("at %vs: %d admitted, expected about %v", elapsed, status.Admitted, expected)
+			}
+			if status.Admitted + status.Rejected != uint64(attempts) {
+				t.Fatalf("at %vs: the counts do not add up", elapsed)
+			}
+			if expectedProgress := elapsed / 10; status.Warming != (step < 10000) ||
+				math.Abs(status.Progress - expectedProgress) > 1e-9 {
+				t.Fatalf("at %vs: unexpected progress: %+v", elapsed, status)
+			}
+		}
+	}
+	// Once over, everything is admitted.
+	before := state.status(start.Add(10 * time.Second)).Admitted
+	for step := 0; step < 100; step++ {
+		if !state.admit(start.Add(10 * time.Second)) {
+			t.Fatal("connections must be admitted once warm")
+		}
+	}
+	if after := state.status(start.Add(10 * time.Second)).Admitted; after != before + 100 {
+		t.Fatalf("expected %d admitted, got %d", before + 100, after)
+	}
+}
+
+
+func TestWarmupReadyEndsIt(t *testing.T) {
+	state := &warmup{duration: time.Hour, initialRate: 0, finalRate: 10}
+	start := time.Unix(1000000, 0)
+	state.start(start)
+	if state.admit(start) {
+		t.Fatal("nothing must be admitted at a zero rate")
+	}
+	state.end()
+	if status := state.status(start); status.Warming || status.Progress != 1 || status.Rate != 10 {
+		t.Fatalf("unexpected status once ready: %+v", status)
+	}
+	if !state.admit(start) {
+		t.Fatal("connections must be admitted once ready")
+	}
+}
+
+
+func TestWarmupReconnectStorm(t *testing.T) {
+	server := newTestServer(64, WithWarmup(time.Hour, 0, 0, 3 * time.Second))
+	stopConsuming := consumeEvents(server)
+	defer stopConsuming()
+	if err := server.Run("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer server.Stop()
+	const clients = 20
+	var group sync.WaitGroup
+	for index := 0; index < clients; index++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			conn, reader := dialTest(t, server.TCPAddr())
+			// noinspection GoUnhandledErrorResult
+			defer conn.Close()
+			// noinspection GoUnhandledErrorResult
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				t.Errorf("no retry after notice: %v", err)
+				return
+			}
+			frame := wireFrame{}
+			if err := json2.Unmarshal(line, &frame); err != nil || frame.C != RetryAfterCommand ||
+				frame.KWA["after"] != float64(3) {
+				t.Errorf("unexpected notice: %s (%v)", line, err)
+			}
+		}()
+	}
+	group.Wait()
+	if status := server.Warmup(); !status.Warming || status.Rejected != clients || status.Admitted != 0 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+
+	// Once ready, the clients get in.
+	server.Ready()
+	conn, _ := dialTest(t, server.TCPAddr())
+	// noinspection GoUnhandledErrorResult
+	defer conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for server.Warmup().Admitted != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the client was not admitted once ready: %+v", server.Warmup())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,342 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+
+// The kind of data frames a connection sends.
+type FrameMode int
+
+
+const (
+	// Each message (a newline-terminated line, as the JSON
+	// marshaler writes them) goes in its own text frame,
+	// which browsers take as a single message.
+	TextFrames FrameMode = iota
+	// Each write goes in its own binary frame (e.g. for the
+	// binary marshalers).
+	BinaryFrames
+)
+
+
+// The frame opcodes.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+
+// The close status codes sent by this package.
+const (
+	closeNormal        = 1000
+	closeProtocolError = 1002
+	closeTooBig        = 1009
+)
+
+
+// The largest payload accepted for a single frame.
+const maxFramePayload = 1 << 24
+
+
+// The time given to the close frame to be written, when
+// closing the connection.
+const closeWriteTimeout = time.Second
+
+
+// Error raised when the peer breaks the WebSocket protocol
+// (e.g. an unmasked frame from a client, or a fragmented
+// control frame). The connection is closed afterwards.
+type ProtocolError struct {
+	Reason string
+}
+
+
+// The error message.
+func (err ProtocolError) Error() string {
+	return "websocket protocol error: " + err.Reason
+}
+
+
+// A connection exchanging its bytes through WebSocket frames:
+// the payloads of the data frames received make the stream
+// read from it, and what is written to it is sent as data
+// frames (see FrameMode). Pings are answered, and a close
+// frame from the peer ends the stream (io.EOF) gracefully.
+// The other methods are the ones of the underlying connection.
+type Conn struct {
+	net.Conn
+	reader     *bufio.Reader
+	mode       FrameMode
+	client     bool
+	// The state of the frame being read: the payload bytes
+	// remaining, its masking key and the position in it.
+	remaining  uint64
+	masked     bool
+	mask       [4]byte
+	maskPos    int
+	readClosed bool
+	// Writes (of data and control frames) go one at a time.
+	writeMutex sync.Mutex
+	closeSent  bool
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+
+// Wraps an upgraded connection (with the reader holding any
+// byte already buffered from it). Client connections mask
+// what they send, and expect unmasked frames.
+func newConn(conn net.Conn, reader *bufio.Reader, mode FrameMode, client bool) *Conn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &Conn{Conn: conn, reader: reader, mode: mode, client: client}
+}
+
+
+// Reads the payload of the data frames, in order. Control
+// frames are handled meanwhile. Returns io.EOF once the peer
+// sent a close frame.
+func (conn *Conn) Read(data []byte) (int, error) {
+	for {
+		if conn.readClosed {
+			return 0, io.EOF
+		}
+		if conn.remaining > 0 {
+			if len(data) == 0 {
+				return 0, nil
+			}
+			if uint64(len(data)) > conn.remaining {
+				data = data[:conn.remaining]
+			}
+			read, err := conn.reader.Read(data)
+			conn.unmask(data[:read])
+			conn.remaining -= uint64(read)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return read, err
+		}
+		if err := conn.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+
+// Unmasks the received bytes, if the frame is masked.
+func (conn *Conn) unmask(data []byte) {
+	if !conn.masked {
+		return
+	}
+	for index := range data {
+		data[index] ^= conn.mask[conn.maskPos & 3]
+		conn.maskPos++
+	}
+}
+
+
+// Reads the header of the next frame. Data frames become the
+// current frame, while control frames are read and handled
+// right away.
+func (conn *Conn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(conn.reader, header[:]); err != nil {
+		return err
+	}
+	final, opcode := header[0] & 0x80 != 0, header[0] & 0x0f
+	masked, length := header[1] & 0x80 != 0, uint64(header[1] & 0x7f)
+	if header[0] & 0x70 != 0 {
+		return conn.fail(closeProtocolError, "reserved bits set")
+	}
+	if masked == conn.client {
+		if conn.client {
+			return conn.fail(closeProtocolError, "masked frame from the server")
+		}
+		return conn.fail(closeProtocolError, "unmasked frame from the client")
+	}
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(conn.reader, extended[:]); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(conn.reader, extended[:]); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > maxFramePayload {
+		return conn.fail(closeTooBig, "frame too big")
+	}
+	conn.masked, conn.maskPos = masked, 0
+	if masked {
+		if _, err := io.ReadFull(conn.reader, conn.mask[:]); err != nil {
+			return err
+		}
+	}
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		conn.remaining = length
+		return nil
+	case opClose, opPing, opPong:
+		if !final || length > 125 {
+			return conn.fail(closeProtocolError, "invalid control frame")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn.reader, payload); err != nil {
+			return err
+		}
+		conn.unmask(payload)
+		return conn.control(opcode, payload)
+	default:
+		return conn.fail(closeProtocolError, "unknown opcode")
+	}
+}
+
+
+// Handles a control frame: pings are answered with pongs, and
+// a close frame is answered (if not closing already) and ends
+// the stream.
+func (conn *Conn) control(opcode byte, payload []byte) error {
+	switch opcode {
+	case opPing:
+		return conn.writeFrame(opPong, payload)
+	case opClose:
+		conn.readClosed = true
+		// noinspection GoUnhandledErrorResult
+		conn.sendClose(closeNormal)
+		return io.EOF
+	default:
+		return nil
+	}
+}
+
+
+// Sends a close frame with the given code, and fails with a
+// protocol error.
+func (conn *Conn) fail(code uint16, reason string) error {
+	// noinspection GoUnhandledErrorResult
+	conn.sendClose(code)
+	return ProtocolError{reason}
+}
+
+
+// Sends a close frame with the given code, unless one was
+// already sent.
+func (conn *Conn) sendClose(code uint16) error {
+	conn.writeMutex.Lock()
+	if conn.closeSent {
+		conn.writeMutex.Unlock()
+		return nil
+	}
+	conn.closeSent = true
+	conn.writeMutex.Unlock()
+	var payload [2]byte
+	binary.BigEndian.PutUint16(payload[:], code)
+	return conn.writeFrameForced(opClose, payload[:])
+}
+
+
+// Writes the data as data frames: one text frame per line in
+// the TextFrames mode, or a single binary frame otherwise.
+func (conn *Conn) Write(data []byte) (int, error) {
+	if conn.mode == BinaryFrames {
+		if err := conn.writeFrame(opBinary, data); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	written := 0
+	for written < len(data) {
+		line := data[written:]
+		if end := bytes.IndexByte(line, '\n'); end >= 0 {
+			line = line[:end + 1]
+		}
+		if err := conn.writeFrame(opText, line); err != nil {
+			return written, err
+		}
+		written += len(line)
+	}
+	return written, nil
+}
+
+
+// Writes a single (final) frame, unless a close frame was
+// already sent.
+func (conn *Conn) writeFrame(opcode byte, payload []byte) error {
+	conn.writeMutex.Lock()
+	closed := conn.closeSent
+	conn.writeMutex.Unlock()
+	if closed {
+		return net.ErrClosed
+	}
+	return conn.writeFrameForced(opcode, payload)
+}
+
+
+// Writes a single (final) frame, masking it for clients.
+func (conn *Conn) writeFrameForced(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload) + 14)
+	frame = append(frame, 0x80 | opcode)
+	maskBit := byte(0)
+	if conn.client {
+		maskBit = 0x80
+	}
+	switch length := len(payload); {
+	case length <= 125:
+		frame = append(frame, maskBit | byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit | 126, byte(length >> 8), byte(length))
+	default:
+		var extended [8]byte
+		binary.BigEndian.PutUint64(extended[:], uint64(length))
+		frame = append(append(frame, maskBit | 127), extended[:]...)
+	}
+	if conn.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for index, value := range payload {
+			frame = append(frame, value ^ mask[index & 3])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+	_, err := conn.Conn.Write(frame)
+	return err
+}
+
+
+// Closes the connection, after sending a normal close frame
+// (bounded by a short write deadline) if none was sent.
+func (conn *Conn) Close() error {
+	conn.closeOnce.Do(func() {
+		// noinspection GoUnhandledErrorResult
+		conn.Conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+		// noinspection GoUnhandledErrorResult
+		conn.sendClose(closeNormal)
+		conn.closeErr = conn.Conn.Close()
+	})
+	return conn.closeErr
+}
+
@@ -0,0 +1,119 @@
+package ws
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+
+// Error raised when the server does not accept the WebSocket
+// handshake.
+type HandshakeError struct {
+	Status int
+	Reason string
+}
+
+
+// The error message.
+func (err HandshakeError) Error() string {
+	return "websocket handshake failed: " + err.Reason
+}
+
+
+// Connects to the given ws:// (or wss://) URL and performs
+// the handshake, with the given timeout (zero means none).
+// The returned connection can be given to NewAttendant, as
+// any other connection.
+func Dial(rawURL string, mode FrameMode, timeout time.Duration) (*Conn, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := target.Host
+	if target.Port() == "" {
+		if target.Scheme == "wss" {
+			host = net.JoinHostPort(target.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(target.Hostname(), "80")
+		}
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var raw net.Conn
+	switch target.Scheme {
+	case "ws":
+		raw, err = dialer.Dial("tcp", host)
+	case "wss":
+		raw, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: target.Hostname()})
+	default:
+		return nil, errors.New("websocket dial: unsupported scheme " + target.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		// noinspection GoUnhandledErrorResult
+		raw.SetDeadline(time.Now().Add(timeout))
+	}
+	conn, err := handshake(raw, target)
+	if err != nil {
+		// noinspection GoUnhandledErrorResult
+		raw.Close()
+		return nil, err
+	}
+	// noinspection GoUnhandledErrorResult
+	raw.SetDeadline(time.Time{})
+	conn.mode = mode
+	return conn, nil
+}
+
+
+// Sends the upgrade request through the connection and checks
+// the response.
+func handshake(raw net.Conn, target *url.URL) (*Conn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	request := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: target.Path, RawQuery: target.RawQuery},
+		Host:       target.Host,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-Websocket-Key":     {key},
+			"Sec-Websocket-Version": {"13"},
+		},
+	}
+	if request.URL.Path == "" {
+		request.URL.Path = "/"
+	}
+	if err := request.Write(raw); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(raw)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	// noinspection GoUnhandledErrorResult
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, HandshakeError{response.StatusCode, response.Status}
+	}
+	if response.Header.Get("Sec-Websocket-Accept") != acceptKey(key) {
+		return nil, HandshakeError{response.StatusCode, "invalid accept key"}
+	}
+	return newConn(raw, reader, TextFrames, true), nil
+}
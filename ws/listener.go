@@ -0,0 +1,206 @@
+package ws
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+
+// The GUID appended to the client key to compute the accept
+// value of the handshake (RFC 6455).
+const handshakeGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+
+// A listener whose connections come from WebSocket upgrades.
+// It is also the http.Handler performing them: mount it in
+// any HTTP server (e.g. under "/ws"), and give it to a server
+// (e.g. by Server.RunWithListeners, along with plain TCP
+// listeners) to have regular attendants over WebSocket. Each
+// accepted connection is a *Conn.
+type Listener struct {
+	// Tells whether a request from the given origin is
+	// allowed (by default, all of them are).
+	CheckOrigin     func(*http.Request) bool
+	addr            net.Addr
+	mode            FrameMode
+	conns           chan net.Conn
+	closed          chan struct{}
+	closeOnce       sync.Once
+	mutex           sync.Mutex
+	deadline        time.Time
+	deadlineChanged chan struct{}
+}
+
+
+// Creates a listener reporting the given address (typically,
+// the one of the HTTP server it is mounted on) and sending
+// the data in the given frame mode.
+func NewListener(addr net.Addr, mode FrameMode) *Listener {
+	if addr == nil {
+		panic("ws.NewListener: addr must not be nil")
+	}
+	return &Listener{
+		addr:            addr,
+		mode:            mode,
+		conns:           make(chan net.Conn),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}),
+	}
+}
+
+
+// Returns the address given on creation.
+func (listener *Listener) Addr() net.Addr {
+	return listener.addr
+}
+
+
+// Waits for the next upgraded connection. Returns net.ErrClosed
+// once the listener is closed, and os.ErrDeadlineExceeded once
+// the accept deadline (if any) expires.
+func (listener *Listener) Accept() (net.Conn, error) {
+	for {
+		listener.mutex.Lock()
+		deadline, changed := listener.deadline, listener.deadlineChanged
+		listener.mutex.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		var conn net.Conn
+		var err error
+		select {
+		case <-listener.closed:
+			err = net.ErrClosed
+		case conn = <-listener.conns:
+		case <-expired:
+			err = os.ErrDeadlineExceeded
+		case <-changed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if conn != nil || err != nil {
+			return conn, err
+		}
+	}
+}
+
+
+// Sets the deadline of the pending and future Accept calls.
+// A zero value means no deadline.
+func (listener *Listener) SetDeadline(deadline time.Time) error {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	listener.deadline = deadline
+	close(listener.deadlineChanged)
+	listener.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+
+// Closes the listener: pending Accept calls return, and the
+// further upgrade requests are answered as unavailable. The
+// HTTP server it is mounted on is not affected.
+func (listener *Listener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.closed)
+	})
+	return nil
+}
+
+
+// Tells whether the header has the given token, among its
+// comma-separated values (case-insensitive).
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+
+// Returns the accept value for the given client key.
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + handshakeGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+
+// Performs the WebSocket handshake and hands the upgraded
+// connection to Accept. Invalid handshakes are answered with
+// 400 (426 for unsupported versions), rejected origins with
+// 403, and requests arriving after close with 503.
+func (listener *Listener) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	select {
+	case <-listener.closed:
+		http.Error(writer, "websocket listener closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	key := request.Header.Get("Sec-Websocket-Key")
+	switch {
+	case request.Method != http.MethodGet:
+		http.Error(writer, "websocket upgrade requires GET", http.StatusMethodNotAllowed)
+		return
+	case !headerHasToken(request.Header, "Connection", "upgrade"),
+		!headerHasToken(request.Header, "Upgrade", "websocket"), key == "":
+		http.Error(writer, "not a websocket handshake", http.StatusBadRequest)
+		return
+	case request.Header.Get("Sec-Websocket-Version") != "13":
+		writer.Header().Set("Sec-Websocket-Version", "13")
+		http.Error(writer, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	case listener.CheckOrigin != nil && !listener.CheckOrigin(request):
+		http.Error(writer, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		http.Error(writer, "websocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	raw, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	// The HTTP server deadlines must not apply to the upgraded
+	// connection.
+	// noinspection GoUnhandledErrorResult
+	raw.SetDeadline(time.Time{})
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := raw.Write([]byte(response)); err != nil {
+		// noinspection GoUnhandledErrorResult
+		raw.Close()
+		return
+	}
+	conn := newConn(raw, buffered.Reader, listener.mode, false)
+	select {
+	case listener.conns <- conn:
+	case <-listener.closed:
+		// noinspection GoUnhandledErrorResult
+		conn.Close()
+	case <-request.Context().Done():
+		// noinspection GoUnhandledErrorResult
+		conn.Close()
+	}
+}
@@ -0,0 +1,193 @@
+package ws
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/universe-10th/chasqui"
+	"github.com/universe-10th/chasqui/marshalers/json"
+	. "github.com/universe-10th/chasqui/types"
+)
+
+
+// The server side of the NAME/SHOUT sample flow. The stops of
+// the attendants are reported through a channel.
+type shoutFunnel struct {
+	stopped chan chasqui.AttendantStopType
+}
+
+
+func (funnel shoutFunnel) Started(*chasqui.Server, *net.TCPAddr) {}
+
+
+func (funnel shoutFunnel) AcceptFailed(*chasqui.Server, error) {}
+
+
+func (funnel shoutFunnel) Stopped(*chasqui.Server) {}
+
+
+func (funnel shoutFunnel) AttendantStarted(server *chasqui.Server, attendant *chasqui.Attendant) {
+	// noinspection GoUnhandledErrorResult
+	attendant.Send("HELLO", nil, nil)
+}
+
+
+func (funnel shoutFunnel) MessageArrived(server *chasqui.Server, attendant *chasqui.Attendant, message Message) {
+	switch message.Command() {
+	case "NAME":
+		attendant.SetContext("name", message.Args()[0])
+		// noinspection GoUnhandledErrorResult
+		attendant.Send("NAME_OK", message.Args(), nil)
+	case "SHOUT":
+		name, _ := attendant.Context("name")
+		server.Broadcast("SHOUTED", Args{name, message.Args()[0]}, nil)
+	case "QUIT":
+		// noinspection GoUnhandledErrorResult
+		attendant.StopWith("GOODBYE", nil, nil)
+	}
+}
+
+
+func (funnel shoutFunnel) MessageThrottled(*chasqui.Server, *chasqui.Attendant, Message, time.Time, time.Duration) {}
+
+
+func (funnel shoutFunnel) AttendantStopped(_ *chasqui.Server, _ *chasqui.Attendant, stopType chasqui.AttendantStopType, _ error) {
+	funnel.stopped <- stopType
+}
+
+
+// A client of the flow: a marshaler over its connection.
+type shoutClient struct {
+	conn      net.Conn
+	marshaler MessageMarshaler
+}
+
+
+// Sends a message, failing the test otherwise.
+func (client shoutClient) send(t *testing.T, command string, args ...interface{}) {
+	t.Helper()
+	if err := client.marshaler.Send(command, args, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+
+// Expects the next message to be the given one.
+func (client shoutClient) expect(t *testing.T, command string, args ...interface{}) {
+	t.Helper()
+	// noinspection GoUnhandledErrorResult
+	client.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	message, err, _ := client.marshaler.Receive()
+	if err != nil {
+		t.Fatalf("expected %s, got: %v", command, err)
+	}
+	if message.Command() != command || len(message.Args()) != len(args) {
+		t.Fatalf("expected %s %v, got: %s %v", command, args, message.Command(), message.Args())
+	}
+	for index, arg := range args {
+		if message.Args()[index] != arg {
+			t.Fatalf("expected %s %v, got: %s %v", command, args, message.Command(), message.Args())
+		}
+	}
+}
+
+
+// Expects the stop of an attendant of the given type.
+func expectStop(t *testing.T, stopped chan chasqui.AttendantStopType, expected chasqui.AttendantStopType) {
+	t.Helper()
+	select {
+	case stopType := <-stopped:
+		if stopType != expected {
+			t.Fatalf("expected the stop type %v, got: %v", expected, stopType)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no attendant stopped")
+	}
+}
+
+
+func TestShoutFlowOverWebSocketAndTCP(t *testing.T) {
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsListener := NewListener(httpListener.Addr(), TextFrames)
+	mux := http.NewServeMux()
+	mux.Handle("/ws", wsListener)
+	httpServer := &http.Server{Handler: mux}
+	go func() {
+		// noinspection GoUnhandledErrorResult
+		httpServer.Serve(httpListener)
+	}()
+	// noinspection GoUnhandledErrorResult
+	defer httpServer.Close()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := chasqui.NewServer(&json.JSONMessageMarshaler{}, 64, 16, 0)
+	funnel := shoutFunnel{make(chan chasqui.AttendantStopType, 4)}
+	chasqui.FunnelServerWith(server, funnel)
+	if err := server.RunWithListeners(tcpListener, wsListener); err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer server.Stop()
+
+	wsConn, err := Dial("ws://" + httpListener.Addr().String() + "/ws", TextFrames, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer wsConn.Close()
+	browser := shoutClient{wsConn, (&json.JSONMessageMarshaler{}).Create(wsConn)}
+	browser.expect(t, "HELLO")
+	tcpConn, err := net.DialTimeout("tcp", tcpListener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// noinspection GoUnhandledErrorResult
+	defer tcpConn.Close()
+	native := shoutClient{tcpConn, (&json.JSONMessageMarshaler{}).Create(tcpConn)}
+	native.expect(t, "HELLO")
+
+	browser.send(t, "NAME", "alice")
+	browser.expect(t, "NAME_OK", "alice")
+	native.send(t, "NAME", "bob")
+	native.expect(t, "NAME_OK", "bob")
+	browser.send(t, "SHOUT", "hi")
+	browser.expect(t, "SHOUTED", "alice", "hi")
+	native.expect(t, "SHOUTED", "alice", "hi")
+	native.send(t, "SHOUT", "yo")
+	browser.expect(t, "SHOUTED", "bob", "yo")
+	native.expect(t, "SHOUTED", "bob", "yo")
+
+	// Quitting ends with a goodbye and a local stop, as over TCP.
+	browser.send(t, "QUIT")
+	browser.expect(t, "GOODBYE")
+	// noinspection GoUnhandledErrorResult
+	wsConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := wsConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("the WebSocket connection must end gracefully after the goodbye, got: %v", err)
+	}
+	expectStop(t, funnel.stopped, chasqui.AttendantLocalStop)
+
+	// A close frame from the browser is a graceful remote stop.
+	closing, err := Dial("ws://" + httpListener.Addr().String() + "/ws", TextFrames, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closingClient := shoutClient{closing, (&json.JSONMessageMarshaler{}).Create(closing)}
+	closingClient.expect(t, "HELLO")
+	// noinspection GoUnhandledErrorResult
+	closing.Close()
+	expectStop(t, funnel.stopped, chasqui.AttendantRemoteStop)
+
+	// The TCP client is not affected.
+	native.send(t, "SHOUT", "still here")
+	native.expect(t, "SHOUTED", "bob", "still here")
+}